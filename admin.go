@@ -0,0 +1,97 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// adminTimeToken returns the time-based admin token for the period t falls
+// in: like a TOTP code, an HMAC of the period's number under the shared
+// secret, but long enough that it can't be guessed within a period.
+func adminTimeToken(secret string, period time.Duration, t time.Time) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("staticomment-admin:" + strconv.FormatInt(t.Unix()/int64(period.Seconds()), 10)))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// validAdminTimeToken reports whether token is the admin token for the
+// current period or the one before, so a token printed just before the
+// period ends still works, and clocks may be a little apart.
+func validAdminTimeToken(secret string, period time.Duration, token string, now time.Time) bool {
+	for _, t := range []time.Time{now, now.Add(-period)} {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminTimeToken(secret, period, t))) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// writeJSON writes v as an indented JSON response.
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// registerAdmin mounts the admin API under /admin/, each endpoint
+// requiring a role. Without an admin token, time-based token secret or
+// admin users, nothing is mounted, so the endpoints don't exist at all.
+func registerAdmin(mux *http.ServeMux, cfg *Config, repo Repo, dispatcher *Dispatcher, maintenance *Maintenance, publisher *Publisher, bayes *Bayes, comments *CommentHandler) {
+	auth := NewAdminAuth(cfg)
+	if auth == nil {
+		return
+	}
+	admin := http.NewServeMux()
+	handle := func(pattern string, role Role, h http.Handler) {
+		admin.Handle(pattern, requireRole(role, h))
+	}
+	handle("GET /admin/whoami", RoleViewer, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, adminIdentity(r))
+	}))
+	if dispatcher != nil {
+		handle("GET /admin/notifications/dead-letters", RoleViewer, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			writeJSON(w, dispatcher.DeadLetters())
+		}))
+	}
+	clusters := NewClusterReport(publisher)
+	handle("GET /admin/reports/clusters", RoleViewer, http.HandlerFunc(clusters.ServeReport))
+	handle("POST /admin/reports/clusters/{id}/reject", RoleModerator, http.HandlerFunc(clusters.ServeReject))
+	bulk := NewBulkModeration(cfg, publisher)
+	handle("POST /admin/quarantine/{slug}/approve", RoleModerator, http.HandlerFunc(bulk.ServeApprove))
+	handle("POST /admin/quarantine/{slug}/reject", RoleModerator, http.HandlerFunc(bulk.ServeReject))
+	handle("POST /admin/comments/delete", RoleModerator, http.HandlerFunc(bulk.ServeDelete))
+	handle("POST /admin/reply", RoleModerator, NewAdminReply(cfg, comments))
+	if r, ok := repo.(Recloner); ok {
+		handle("POST /admin/repo/reclone", RoleAdmin, serveReclone(r))
+	}
+	if publisher.outbox != nil {
+		outbox := NewOutboxAdmin(publisher.outbox, publisher)
+		handle("GET /admin/outbox", RoleViewer, http.HandlerFunc(outbox.ServeList))
+		handle("POST /admin/outbox/retry", RoleAdmin, http.HandlerFunc(outbox.ServeRetryAll))
+		handle("POST /admin/outbox/{id}/retry", RoleAdmin, http.HandlerFunc(outbox.ServeRetry))
+		handle("DELETE /admin/outbox/{id}", RoleAdmin, http.HandlerFunc(outbox.ServeDiscard))
+	}
+	if bayes != nil {
+		classifier := NewBayesAdmin(cfg, bayes, repo)
+		handle("GET /admin/bayes", RoleViewer, http.HandlerFunc(classifier.ServeStats))
+		handle("POST /admin/bayes/score", RoleViewer, http.HandlerFunc(classifier.ServeScore))
+		handle("POST /admin/bayes/train", RoleModerator, http.HandlerFunc(classifier.ServeTrain))
+	}
+	handle("GET /admin/maintenance", RoleViewer, maintenance)
+	handle("PUT /admin/maintenance", RoleAdmin, maintenance)
+	if cfg.AdminOIDCRedirectURL != "" {
+		// Login itself needs no authentication
+		mux.HandleFunc("GET /admin/login", auth.ServeLogin)
+		mux.HandleFunc("GET /admin/callback", auth.ServeCallback)
+		mux.HandleFunc("POST /admin/logout", auth.ServeLogout)
+	}
+	mux.Handle("/admin/", auth.Wrap(admin))
+}
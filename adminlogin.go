@@ -0,0 +1,290 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// adminSessionCookie holds the signed session set after an OIDC login.
+	adminSessionCookie = "staticomment_admin"
+	// adminLoginCookie holds the state, nonce and PKCE verifier of a login
+	// in progress.
+	adminLoginCookie = "staticomment_admin_login"
+	// adminLoginTimeout is how long a login may take at the provider.
+	adminLoginTimeout = 10 * time.Minute
+)
+
+// adminSession is the content of the session cookie. Only the user's name
+// is kept: their role is looked up on each request, so a change to the
+// users file applies to sessions already open.
+type adminSession struct {
+	Name string `json:"name"`
+}
+
+// adminLogin is the content of the login cookie.
+type adminLogin struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	Return   string `json:"return"`
+}
+
+// sealedCookie wraps a cookie's content with its expiry before signing.
+type sealedCookie struct {
+	Expiry int64           `json:"exp"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// seal encodes v, valid for ttl, and signs it with the session key.
+func (a *AdminAuth) seal(v any, ttl time.Duration) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(sealedCookie{Expiry: time.Now().Add(ttl).Unix(), Data: data})
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, a.sessionKey)
+	mac.Write(payload)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+// open checks the signature and expiry of a value made by seal and decodes
+// it into v.
+func (a *AdminAuth) open(value string, v any) error {
+	p, s, ok := strings.Cut(value, ".")
+	payload, err1 := base64.RawURLEncoding.DecodeString(p)
+	sig, err2 := base64.RawURLEncoding.DecodeString(s)
+	if !ok || err1 != nil || err2 != nil {
+		return errors.New("malformed cookie")
+	}
+	mac := hmac.New(sha256.New, a.sessionKey)
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return errors.New("bad cookie signature")
+	}
+	var sealed sealedCookie
+	if err := json.Unmarshal(payload, &sealed); err != nil {
+		return err
+	}
+	if time.Now().Unix() > sealed.Expiry {
+		return errors.New("cookie expired")
+	}
+	return json.Unmarshal(sealed.Data, v)
+}
+
+// sessionIdentity returns the identity of r's session cookie, if it has a
+// valid one for a user who's still listed.
+func (a *AdminAuth) sessionIdentity(r *http.Request) (AdminIdentity, bool) {
+	if a.sessionKey == nil {
+		return AdminIdentity{}, false
+	}
+	c, err := r.Cookie(adminSessionCookie)
+	if err != nil {
+		return AdminIdentity{}, false
+	}
+	var session adminSession
+	if err := a.open(c.Value, &session); err != nil {
+		return AdminIdentity{}, false
+	}
+	for _, u := range a.users {
+		if u.Name == session.Name {
+			return AdminIdentity{Name: u.Name, Role: u.role}, true
+		}
+	}
+	return AdminIdentity{}, false
+}
+
+// setCookie sets a cookie scoped to the admin paths. SameSite=Strict keeps
+// other sites from making requests with the session.
+func (a *AdminAuth) setCookie(w http.ResponseWriter, name, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/admin/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(a.cfg.AdminOIDCRedirectURL, "https://"),
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// ServeLogin handles GET /admin/login, sending the browser to the provider
+// to sign in. The return parameter is the admin path to come back to.
+func (a *AdminAuth) ServeLogin(w http.ResponseWriter, r *http.Request) {
+	discovery, err := a.oidc.Discovery()
+	if err != nil || discovery.AuthorizationEndpoint == "" {
+		log.Printf("admin: OIDC discovery failed: %v", err)
+		http.Error(w, "Identity provider unavailable", http.StatusBadGateway)
+		return
+	}
+	login := adminLogin{Return: r.URL.Query().Get("return")}
+	for _, s := range []*string{&login.State, &login.Nonce, &login.Verifier} {
+		if *s, err = randomHex(32); err != nil {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	// Only come back to an admin path, so the login can't be used as an
+	// open redirect
+	if !strings.HasPrefix(login.Return, "/admin/") || strings.HasPrefix(login.Return, "/admin/login") {
+		login.Return = "/admin/whoami"
+	}
+	value, err := a.seal(login, adminLoginTimeout)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	// The login cookie is sent back on the provider's redirect, which is a
+	// cross-site navigation, so it can't be SameSite=Strict
+	http.SetCookie(w, &http.Cookie{
+		Name:     adminLoginCookie,
+		Value:    value,
+		Path:     "/admin/",
+		MaxAge:   int(adminLoginTimeout.Seconds()),
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(a.cfg.AdminOIDCRedirectURL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+	challenge := sha256.Sum256([]byte(login.Verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {a.cfg.AdminOIDCAudience},
+		"redirect_uri":          {a.cfg.AdminOIDCRedirectURL},
+		"scope":                 {"openid email"},
+		"state":                 {login.State},
+		"nonce":                 {login.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(w, r, discovery.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+// ServeCallback handles the provider's redirect back after sign-in: it
+// exchanges the code for an ID token, matches that to an admin user like a
+// bearer ID token, and starts a session for them.
+func (a *AdminAuth) ServeCallback(w http.ResponseWriter, r *http.Request) {
+	var login adminLogin
+	c, err := r.Cookie(adminLoginCookie)
+	if err == nil {
+		err = a.open(c.Value, &login)
+	}
+	if err != nil {
+		http.Error(w, "Login expired, please try again", http.StatusBadRequest)
+		return
+	}
+	a.setCookie(w, adminLoginCookie, "", -1)
+	q := r.URL.Query()
+	if e := q.Get("error"); e != "" {
+		log.Printf("admin: OIDC login failed at the provider: %s %s", e, q.Get("error_description"))
+		http.Error(w, "Login failed", http.StatusForbidden)
+		return
+	}
+	if q.Get("state") == "" || !hmac.Equal([]byte(q.Get("state")), []byte(login.State)) {
+		http.Error(w, "Login state mismatch, please try again", http.StatusBadRequest)
+		return
+	}
+	idToken, err := a.exchangeCode(q.Get("code"), login.Verifier)
+	if err != nil {
+		log.Printf("admin: OIDC code exchange failed: %v", err)
+		http.Error(w, "Login failed", http.StatusBadGateway)
+		return
+	}
+	claims, err := a.oidc.Verify(idToken)
+	if err == nil && !hmac.Equal([]byte(claims.Nonce), []byte(login.Nonce)) {
+		err = errors.New("nonce mismatch")
+	}
+	if err != nil {
+		log.Printf("admin: rejected ID token from login: %v", err)
+		http.Error(w, "Login failed", http.StatusForbidden)
+		return
+	}
+	id, ok := a.userForClaims(claims)
+	if !ok {
+		http.Error(w, "Forbidden: not an admin user", http.StatusForbidden)
+		return
+	}
+	value, err := a.seal(adminSession{Name: id.Name}, time.Duration(a.cfg.AdminSessionTTL)*time.Second)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	a.setCookie(w, adminSessionCookie, value, a.cfg.AdminSessionTTL)
+	log.Printf("admin: %s (%s) logged in", id.Name, id.Role)
+	http.Redirect(w, r, login.Return, http.StatusFound)
+}
+
+// ServeLogout handles POST /admin/logout.
+func (a *AdminAuth) ServeLogout(w http.ResponseWriter, r *http.Request) {
+	a.setCookie(w, adminSessionCookie, "", -1)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// exchangeCode redeems an authorization code at the provider's token
+// endpoint and returns the ID token. The client secret, if any, is sent
+// with HTTP basic auth, which every provider accepts.
+func (a *AdminAuth) exchangeCode(code, verifier string) (string, error) {
+	if code == "" {
+		return "", errors.New("no code in callback")
+	}
+	discovery, err := a.oidc.Discovery()
+	if err != nil {
+		return "", err
+	}
+	if discovery.TokenEndpoint == "" {
+		return "", errors.New("no token_endpoint in discovery document")
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {a.cfg.AdminOIDCRedirectURL},
+		"code_verifier": {verifier},
+	}
+	if a.cfg.AdminOIDCClientSecret == "" {
+		form.Set("client_id", a.cfg.AdminOIDCAudience)
+	}
+	req, err := http.NewRequest(http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if a.cfg.AdminOIDCClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(a.cfg.AdminOIDCAudience), url.QueryEscape(a.cfg.AdminOIDCClientSecret))
+	}
+	resp, err := a.oidc.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var tokens struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1024*1024)).Decode(&tokens); err != nil && resp.StatusCode == http.StatusOK {
+		return "", fmt.Errorf("decoding token response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("POST %s: %s %s", discovery.TokenEndpoint, resp.Status, tokens.Error)
+	}
+	if tokens.IDToken == "" {
+		return "", errors.New("no id_token in token response")
+	}
+	return tokens.IDToken, nil
+}
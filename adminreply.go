@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// AdminReply serves POST /admin/reply: the site owner replying to a
+// comment, or commenting on a post, through the admin API. The comment is
+// flagged author: true, skips the spam checks and moderation, and is
+// committed and pushed like any other.
+type AdminReply struct {
+	cfg      *Config
+	comments *CommentHandler
+}
+
+func NewAdminReply(cfg *Config, comments *CommentHandler) *AdminReply {
+	return &AdminReply{cfg: cfg, comments: comments}
+}
+
+// adminReplyRequest is the body of POST /admin/reply. Name defaults to
+// STATICOMMENT_OWNER_NAME, and without ReplyTo the comment is top-level.
+type adminReplyRequest struct {
+	Slug    string `json:"slug"`
+	ReplyTo string `json:"reply_to"`
+	Body    string `json:"body"`
+	Name    string `json:"name"`
+	Lang    string `json:"lang"`
+}
+
+func (a *AdminReply) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req adminReplyRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	body := strings.TrimSpace(req.Body)
+	name := strings.TrimSpace(req.Name)
+	if name == "" {
+		name = a.cfg.OwnerName
+	}
+	switch {
+	case !isValidSlug(req.Slug):
+		http.Error(w, "Invalid slug", http.StatusBadRequest)
+		return
+	case req.ReplyTo != "" && !isValidSlug(req.ReplyTo):
+		http.Error(w, "Invalid reply_to", http.StatusBadRequest)
+		return
+	case req.Lang != "" && !isValidLang(req.Lang):
+		http.Error(w, "Invalid lang", http.StatusBadRequest)
+		return
+	case body == "":
+		http.Error(w, "No body given", http.StatusBadRequest)
+		return
+	case len(body) > defaultMaxBodyLen:
+		http.Error(w, fmt.Sprintf("Body must be %d characters or fewer", defaultMaxBodyLen), http.StatusBadRequest)
+		return
+	}
+
+	h := a.comments
+	if err := h.repo.Pull(); err != nil {
+		log.Printf("warning: git pull before admin reply failed: %v", err)
+	}
+	if a.cfg.PostsPath != "" {
+		if err := h.posts.Pull(); err != nil {
+			log.Printf("warning: git pull before post validation failed: %v", err)
+		}
+		found, err := h.postExists(req.Slug)
+		if err != nil {
+			log.Printf("error checking post existence for %s: %v", req.Slug, err)
+			http.Error(w, "Failed to validate post", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, "Post not found", http.StatusNotFound)
+			return
+		}
+	}
+	replyTo := req.ReplyTo
+	if replyTo != "" {
+		parent := h.repo.FullPath(filepath.Join(a.cfg.CommentsPath, req.Slug, replyTo+".yml"))
+		if _, err := os.Stat(parent); err != nil {
+			http.Error(w, "Comment not found", http.StatusNotFound)
+			return
+		}
+		resolved, err := h.resolveReplyTo(req.Slug, replyTo)
+		if errors.Is(err, errReplyTooDeep) {
+			http.Error(w, "Reply nesting too deep", http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			log.Printf("error resolving reply thread for %s: %v", req.Slug, err)
+			http.Error(w, "Failed to validate reply", http.StatusInternalServerError)
+			return
+		}
+		replyTo = resolved
+	}
+
+	acceptedAt := h.clock.Now()
+	comment := Comment{
+		Name:    name,
+		Body:    body,
+		Date:    acceptedAt.UTC().Format(time.RFC3339),
+		Slug:    req.Slug,
+		ReplyTo: replyTo,
+		Lang:    req.Lang,
+		Dir:     textDirection(body, req.Lang),
+		Author:  true,
+
+		QuotedExcerpt: h.quotedExcerpt(req.Slug, replyTo),
+	}
+	if a.cfg.BodyHTML {
+		comment.BodyHTML = renderBodyHTML(body, a.cfg)
+	}
+	ip := extractIP(r.RemoteAddr)
+	h.events.Publish(Event{Type: EventAccepted, Time: acceptedAt, IP: ip, Slug: req.Slug, Comment: &comment})
+
+	job, err := h.publisher.NewJob(comment, ip, false, acceptedAt)
+	if err != nil {
+		log.Printf("error preparing admin reply: %v", err)
+		http.Error(w, "Failed to save reply", http.StatusInternalServerError)
+		return
+	}
+	// The owner's own replies don't need moderating
+	job.Moderated = false
+	queued, err := h.publisher.Submit(job)
+	if err != nil && !queued {
+		log.Printf("error publishing admin reply: %v", err)
+		http.Error(w, "Failed to publish reply", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("admin: %s posted a reply on %s", adminIdentity(r).Name, req.Slug)
+	writeJSON(w, map[string]any{"id": commentID(job.Path), "path": job.Path, "queued": queued})
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Akismet actions: what happens to a submission Akismet calls spam
+// (STATICOMMENT_AKISMET_ACTION).
+const (
+	AkismetQuarantine = "quarantine"
+	AkismetReject     = "reject"
+)
+
+// akismetRetention is how long what was sent to Akismet about a comment is
+// kept for reporting a moderator's correction.
+const akismetRetention = 30 * 24 * time.Hour
+
+// akismetPruneInterval is how often expired submissions are removed.
+const akismetPruneInterval = time.Hour
+
+// akismetSubmission is what Akismet was told about a comment and what it
+// said, kept in case a moderator disagrees.
+type akismetSubmission struct {
+	Time   time.Time  `json:"time"`
+	Spam   bool       `json:"spam"`
+	Params url.Values `json:"params"`
+}
+
+// akismetReport is a moderator's verdict on a comment, to be passed on.
+type akismetReport struct {
+	id   string
+	spam bool
+}
+
+// Akismet checks submissions with the Akismet API. What was sent about each
+// comment is kept in a directory for akismetRetention, including the
+// commenter's IP and email, so that approving a comment Akismet called spam
+// or rejecting one it let through can be reported back to it, which is how
+// it learns from its mistakes. Reports are sent in the background and, like
+// analytics, dropped if they pile up.
+type Akismet struct {
+	cfg    *Config
+	dir    string
+	client *http.Client
+	queue  chan akismetReport
+}
+
+// NewAkismet creates the directory for submissions in the data directory.
+func NewAkismet(cfg *Config) (*Akismet, error) {
+	dir := filepath.Join(cfg.DataDir, "akismet")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating akismet dir: %w", err)
+	}
+	return &Akismet{
+		cfg:    cfg,
+		dir:    dir,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan akismetReport, 100),
+	}, nil
+}
+
+// AkismetCheck is Akismet's verdict on a submission.
+type AkismetCheck struct {
+	Spam bool
+	// Discard is set for spam so blatant Akismet suggests not keeping it
+	// even for review
+	Discard bool
+	params  url.Values
+}
+
+// Check asks Akismet whether c, submitted by r from the page at permalink,
+// is spam.
+func (a *Akismet) Check(r *http.Request, c Comment, permalink string) (*AkismetCheck, error) {
+	params := url.Values{
+		"user_ip":              {extractIP(r.RemoteAddr)},
+		"user_agent":           {r.UserAgent()},
+		"referrer":             {r.Referer()},
+		"permalink":            {permalink},
+		"comment_type":         {"comment"},
+		"comment_author":       {c.Name},
+		"comment_author_email": {c.Email},
+		"comment_content":      {c.Body},
+		"comment_date_gmt":     {time.Now().UTC().Format(time.RFC3339)},
+	}
+	if c.ReplyTo != "" {
+		params.Set("comment_type", "reply")
+	}
+	if c.Lang != "" {
+		params.Set("blog_lang", c.Lang)
+	}
+	resp, body, err := a.call("comment-check", params)
+	if err != nil {
+		return nil, err
+	}
+	switch body {
+	case "true":
+		return &AkismetCheck{Spam: true, Discard: resp.Header.Get("X-akismet-pro-tip") == "discard", params: params}, nil
+	case "false":
+		return &AkismetCheck{params: params}, nil
+	}
+	return nil, akismetError(resp, body)
+}
+
+// Remember keeps what was sent about the comment at relPath and Akismet's
+// verdict, for Report.
+func (a *Akismet) Remember(relPath string, check *AkismetCheck) error {
+	data, err := json.Marshal(akismetSubmission{Time: time.Now().UTC(), Spam: check.Spam, Params: check.params})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(a.path(commentID(relPath)), data, 0600)
+}
+
+// Report queues a moderator's verdict on the comment at relPath. If Akismet
+// checked it and got it wrong, it's told so.
+func (a *Akismet) Report(relPath string, spam bool) {
+	select {
+	case a.queue <- akismetReport{id: commentID(relPath), spam: spam}:
+	default:
+		log.Printf("warning: akismet report queue full, dropping report for %s", relPath)
+	}
+}
+
+// Run sends queued reports and prunes old submissions periodically.
+func (a *Akismet) Run() {
+	a.prune()
+	ticker := time.NewTicker(akismetPruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case report := <-a.queue:
+			if err := a.report(report); err != nil {
+				log.Printf("warning: akismet: reporting %s: %v", report.id, err)
+			}
+		case <-ticker.C:
+			a.prune()
+		}
+	}
+}
+
+// report sends a correction for a comment Akismet got wrong. Either way
+// the submission is done with once a moderator has judged the comment.
+func (a *Akismet) report(report akismetReport) error {
+	data, err := os.ReadFile(a.path(report.id))
+	if errors.Is(err, fs.ErrNotExist) {
+		// Not checked, or too long ago
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var sub akismetSubmission
+	if err := json.Unmarshal(data, &sub); err != nil {
+		return err
+	}
+	if sub.Spam != report.spam {
+		method := "submit-ham"
+		if report.spam {
+			method = "submit-spam"
+		}
+		resp, body, err := a.call(method, sub.Params)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return akismetError(resp, body)
+		}
+		log.Printf("akismet: reported %s as %s", report.id, strings.TrimPrefix(method, "submit-"))
+	}
+	return os.Remove(a.path(report.id))
+}
+
+// call makes an Akismet API call, returning the response and its body.
+func (a *Akismet) call(method string, params url.Values) (*http.Response, string, error) {
+	form := url.Values{"api_key": {a.cfg.AkismetKey}, "blog": {a.cfg.AkismetBlog}}
+	for k, v := range params {
+		form[k] = v
+	}
+	resp, err := a.client.PostForm(a.cfg.AkismetAPI+"/1.1/"+method, form)
+	if err != nil {
+		return nil, "", fmt.Errorf("akismet %s: %w", method, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return resp, strings.TrimSpace(string(body)), nil
+}
+
+// akismetError describes an unexpected response, which for a bad key or
+// missing parameter comes with an explanation in a header.
+func akismetError(resp *http.Response, body string) error {
+	if help := resp.Header.Get("X-akismet-debug-help"); help != "" {
+		return fmt.Errorf("akismet: %s: %s (%s)", resp.Status, body, help)
+	}
+	return fmt.Errorf("akismet: %s: %s", resp.Status, body)
+}
+
+func (a *Akismet) path(id string) string {
+	return filepath.Join(a.dir, id+".json")
+}
+
+// prune removes submissions older than akismetRetention.
+func (a *Akismet) prune() {
+	entries, err := os.ReadDir(a.dir)
+	if err != nil {
+		log.Printf("warning: pruning akismet submissions: %v", err)
+		return
+	}
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < akismetRetention {
+			continue
+		}
+		if err := os.Remove(filepath.Join(a.dir, e.Name())); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("warning: pruning akismet submissions: %v", err)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// analyticsSaltLifetime is how long visitor hashes stay comparable. Like
+// Plausible's daily salt, it lets a day's events be counted by unique
+// commenter without anything that identifies one beyond that.
+const analyticsSaltLifetime = 24 * time.Hour
+
+// AnalyticsEvent is the anonymized form of an Event sent to
+// STATICOMMENT_ANALYTICS_URL and written to STATICOMMENT_ANALYTICS_FILE.
+// Nothing the commenter wrote or sent is included, only its shape.
+type AnalyticsEvent struct {
+	Event      string    `json:"event"`
+	Time       time.Time `json:"time"`
+	Slug       string    `json:"slug,omitempty"`
+	Category   string    `json:"category,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+	Lang       string    `json:"lang,omitempty"`
+	Reply      bool      `json:"reply,omitempty"`
+	Length     int       `json:"length,omitempty"`
+	Visitor    string    `json:"visitor,omitempty"`
+	DurationMS int64     `json:"duration_ms,omitempty"`
+}
+
+// Analytics is the event bus subscriber feeding analytics pipelines. Each
+// submission event is queued for a writer goroutine, which POSTs it as JSON
+// and appends it to an NDJSON file, whichever are configured. Like the spam
+// corpus it drops events rather than slow down request handling, and failed
+// POSTs aren't retried: the figures are for charts, not accounting.
+type Analytics struct {
+	url    string
+	file   string
+	client *http.Client
+	queue  chan AnalyticsEvent
+
+	mu     sync.Mutex
+	salt   []byte
+	salted time.Time
+}
+
+func NewAnalytics(url, file string) *Analytics {
+	return &Analytics{
+		url:    url,
+		file:   file,
+		client: &http.Client{Timeout: 10 * time.Second},
+		queue:  make(chan AnalyticsEvent, 100),
+	}
+}
+
+// HandleEvent is the event bus subscriber.
+func (a *Analytics) HandleEvent(e Event) {
+	if e.Type == EventClockSkew || e.Type == EventCanary || e.Type == EventNotificationFailed || e.Type == EventNotificationDeadLetter || e.Canary {
+		return
+	}
+	ae := AnalyticsEvent{
+		Event:    string(e.Type),
+		Time:     e.Time.UTC(),
+		Slug:     e.Slug,
+		Category: e.Category,
+		Reason:   e.Reason,
+		Visitor:  a.visitor(e.IP),
+	}
+	if e.Type == EventPublished {
+		ae.DurationMS = e.Duration.Milliseconds()
+	}
+	if c := e.Comment; c != nil {
+		ae.Lang = c.Lang
+		ae.Reply = c.ReplyTo != ""
+		ae.Length = utf8.RuneCountInString(c.Body)
+	}
+	select {
+	case a.queue <- ae:
+	default:
+		log.Printf("warning: analytics queue full, dropping %s event", e.Type)
+	}
+}
+
+// visitor returns a hash of ip under the current salt, which is random,
+// kept only in memory and replaced every analyticsSaltLifetime.
+func (a *Analytics) visitor(ip string) string {
+	if ip == "" {
+		return ""
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.salt == nil || time.Since(a.salted) > analyticsSaltLifetime {
+		salt := make([]byte, 32)
+		if _, err := rand.Read(salt); err != nil {
+			return ""
+		}
+		a.salt, a.salted = salt, time.Now()
+	}
+	mac := hmac.New(sha256.New, a.salt)
+	mac.Write([]byte(ip))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+// Run sends queued events.
+func (a *Analytics) Run() {
+	for ae := range a.queue {
+		data, err := json.Marshal(ae)
+		if err != nil {
+			continue
+		}
+		if a.file != "" {
+			if err := a.append(data); err != nil {
+				log.Printf("warning: writing analytics event: %v", err)
+			}
+		}
+		if a.url != "" {
+			if err := a.post(data); err != nil {
+				log.Printf("warning: sending analytics event: %v", err)
+			}
+		}
+	}
+}
+
+// append writes one line to the file. It's opened for each event, so the
+// file can be rotated or truncated by whatever ingests it.
+func (a *Analytics) append(data []byte) error {
+	f, err := os.OpenFile(a.file, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (a *Analytics) post(data []byte) error {
+	resp, err := a.client.Post(a.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("posting to %s: %s", a.url, resp.Status)
+	}
+	return nil
+}
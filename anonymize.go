@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const anonymizeUsage = `usage: staticomment anonymize -email ADDRESS|HASH [-name NAME] [-dry-run]
+
+Anonymize the comments, published and quarantined, of the commenter with
+the given email address or its hash (hex SHA-256 of the trimmed, lowercased
+address): the email is removed, the name replaced with -name (default
+"Anonymous"), and the moderation block's client hashes dropped. The change
+is committed and pushed as one commit, from a fresh clone in a temporary
+directory, so it's safe while the server runs. Run it with the server's
+STATICOMMENT_* settings.
+
+Only the tip of the branch is changed: the commenter's details are still in
+the repo's history, and in every clone, fork and cache of it. See the
+README for removing them from the history.
+`
+
+func anonymizeCommand(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("anonymize", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { fmt.Fprint(stderr, anonymizeUsage) }
+	email := fs.String("email", "", "commenter's email address or its hash")
+	name := fs.String("name", "Anonymous", "name to replace theirs with")
+	dryRun := fs.Bool("dry-run", false, "only list the comments that would change")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 || *email == "" {
+		fs.Usage()
+		return 2
+	}
+	req := deleteRequest{Email: *email}
+	if !strings.Contains(*email, "@") {
+		if b, err := hex.DecodeString(*email); err != nil || len(b) != 32 {
+			fmt.Fprintln(stderr, "-email must be an address or a hex SHA-256 hash")
+			return 2
+		}
+		req = deleteRequest{EmailHash: *email}
+	}
+	f, err := req.filter()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		fmt.Fprintf(stderr, "config error: %v\n", err)
+		return 2
+	}
+	if cfg.SSHKey != nil && cfg.Backend == BackendGit {
+		if err := writeSSHKey(cfg); err != nil {
+			fmt.Fprintf(stderr, "ssh key error: %v\n", err)
+			return 1
+		}
+	}
+	// The server's clone is left alone; it pulls the change like any other
+	dir, err := os.MkdirTemp("", "staticomment-anonymize-")
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	defer os.RemoveAll(dir)
+	cfg.RepoDir = dir
+	repo := openRepo(cfg)
+	if err := repo.Clone(); err != nil {
+		fmt.Fprintf(stderr, "git clone failed: %v\n", err)
+		return 1
+	}
+	publisher := NewPublisher(cfg, repo, repo, NewEventBus(), nil, nil, nil)
+
+	comments, err := publisher.StoredComments(time.Time{})
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	var paths, slugs []string
+	seen := make(map[string]bool)
+	for _, c := range comments {
+		if !f.match(c) {
+			continue
+		}
+		fmt.Fprintf(stdout, "%s  %s  %s\n", c.Path, c.Date, c.Name)
+		paths = append(paths, c.Path)
+		if !seen[c.Slug] {
+			seen[c.Slug] = true
+			slugs = append(slugs, c.Slug)
+		}
+	}
+	if len(paths) == 0 {
+		fmt.Fprintln(stderr, "no comments match")
+		return 0
+	}
+	if *dryRun {
+		return 0
+	}
+	sort.Strings(slugs)
+	// Only ever the hash, so the address doesn't end up in the history
+	msg := fmt.Sprintf("Anonymize %s\n\nCriteria: email hash %s\nPosts: %s",
+		countComments(len(paths)), f.emailHash[:16], strings.Join(slugs, ", "))
+	changed, err := publisher.Rewrite(paths, func(c *Comment) { anonymize(c, *name) }, msg)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	fmt.Fprintf(stderr, "anonymized %s\n", countComments(changed))
+	return 0
+}
+
+// anonymize removes what identifies the commenter from c. The body is left
+// as it is, since it's the comment.
+func anonymize(c *Comment, name string) {
+	c.Name = name
+	c.Email = ""
+	if c.Moderation != nil {
+		c.Moderation.IPHash = ""
+		c.Moderation.UserAgentHash = ""
+	}
+}
@@ -0,0 +1,654 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// bareIndex is the scratch index trees are built in, inside the bare repo.
+const bareIndex = "staticomment-index"
+
+// BareRepo is the git backend with STATICOMMENT_GIT_BARE=1: a bare clone in
+// <repo dir>/.git, committed to with the git CLI's plumbing commands
+// (hash-object, update-index, write-tree, commit-tree) instead of through a
+// working tree. Like ContentsRepo, the repo dir otherwise holds a mirror of
+// just the directories the server reads, with empty placeholders for the
+// posts, so a site's media are never written to disk.
+//
+// Local commits live on the branch in the bare repo until they're pushed.
+// When upstream has moved on they're rebuilt on top of it file by file, the
+// way GoGitRepo replays them, so there's never a half-finished rebase to
+// clean up.
+type BareRepo struct {
+	cfg *Config
+	// cli runs git with the clone's SSH and credential settings, in dir
+	cli     *GitRepo
+	dir     string
+	mirrors *Mirrors
+
+	mu sync.Mutex
+	// shas maps mirrored paths to their blob SHA on the branch as of the
+	// last sync or commit; a file with a different SHA has local changes
+	shas  map[string]string
+	posts map[string]bool
+}
+
+func NewBareRepo(cfg *Config) *BareRepo {
+	dir := filepath.Join(cfg.RepoDir, ".git")
+	cliCfg := *cfg
+	cliCfg.RepoDir = dir
+	b := &BareRepo{
+		cfg:   cfg,
+		cli:   &GitRepo{cfg: &cliCfg},
+		dir:   dir,
+		shas:  make(map[string]string),
+		posts: make(map[string]bool),
+	}
+	if len(cfg.GitMirrors) > 0 {
+		b.mirrors = NewMirrors(cfg.GitMirrors, b.pushMirror)
+		go b.mirrors.Run()
+	}
+	return b
+}
+
+// git runs a local git command in the bare repo, with env added to its
+// environment and stdin as its input, and returns what it prints.
+func (b *BareRepo) git(env []string, stdin string, args ...string) (string, error) {
+	ctx, cancel := gitContext(b.cfg)
+	defer cancel()
+	cmd := b.cli.command(ctx, b.dir, "git", args...)
+	cmd.Env = append(cmd.Env, env...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	var stdout bytes.Buffer
+	stderr := &tailBuffer{max: gitOutputLimit}
+	cmd.Stdout = &stdout
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return "", timedOut(ctx, b.cfg, "git "+args[0], err)
+		}
+		return "", &GitError{Command: "git " + args[0], Output: b.cli.redactOutput(string(stderr.buf)), Err: err}
+	}
+	return stdout.String(), nil
+}
+
+// rev returns the commit ref points to, or "" if there's no such ref.
+func (b *BareRepo) rev(ref string) string {
+	out, err := b.git(nil, "", "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(out)
+}
+
+func (b *BareRepo) branchRef() string { return "refs/heads/" + b.cfg.Branch }
+func (b *BareRepo) originRef() string { return "refs/remotes/origin/" + b.cfg.Branch }
+
+func (b *BareRepo) Clone() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.cloneLocked()
+}
+
+func (b *BareRepo) cloneLocked() error {
+	if err := ensureHostKeys(b.cfg); err != nil {
+		log.Printf("warning: could not ensure host keys: %v", err)
+	}
+
+	if out, err := b.git(nil, "", "rev-parse", "--is-bare-repository"); err == nil && strings.TrimSpace(out) == "true" {
+		log.Println("git: bare repo already cloned, fetching instead")
+		if err := b.cli.configure(); err != nil {
+			return err
+		}
+		if err := b.pullLocked(); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	// Whatever is there, a working tree clone or an old mirror, is replaced
+	if err := emptyDir(b.cfg, b.cfg.RepoDir); err != nil {
+		return fmt.Errorf("clearing repo dir: %w", err)
+	}
+	cloneArgs := []string{"clone", "--bare", "--branch", b.cfg.Branch, "--single-branch"}
+	if b.cfg.CloneDepth > 0 {
+		cloneArgs = append(cloneArgs, "--depth", strconv.Itoa(b.cfg.CloneDepth))
+	}
+	if b.cfg.CloneFilter != "" {
+		// Blobs outside the mirror are never needed, so never fetched
+		cloneArgs = append(cloneArgs, "--filter="+b.cfg.CloneFilter)
+	}
+	cloneArgs = append(cloneArgs, b.cfg.GitRepo, b.dir)
+	err := b.cli.run(b.cfg.RepoDir, "git", cloneArgs...)
+	if err != nil && !b.cfg.SSHInsecure && isSSHRemote(b.cfg.GitRepo) {
+		log.Printf("git clone failed, refreshing SSH host keys and retrying")
+		if scanErr := refreshHostKeys(b.cfg); scanErr != nil {
+			log.Printf("host key scan failed: %v", scanErr)
+			return fmt.Errorf("git clone: %w", err)
+		}
+		if rmErr := emptyDir(b.cfg, b.cfg.RepoDir); rmErr != nil {
+			return fmt.Errorf("clearing repo dir before retry: %w", rmErr)
+		}
+		err = b.cli.run(b.cfg.RepoDir, "git", cloneArgs...)
+	}
+	if err != nil {
+		return fmt.Errorf("git clone: %w", err)
+	}
+	// A bare clone has the branch but no remote-tracking ref to tell which
+	// of its commits have been pushed
+	if _, err := b.git(nil, "", "update-ref", b.originRef(), b.branchRef()); err != nil {
+		return fmt.Errorf("git update-ref: %w", err)
+	}
+	if err := b.cli.configure(); err != nil {
+		return err
+	}
+	b.shas = make(map[string]string)
+	b.posts = make(map[string]bool)
+	return b.syncLocked()
+}
+
+// Reclone discards the bare repo and the mirror, including any unpushed
+// commits, and clones the repo afresh.
+func (b *BareRepo) Reclone() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	log.Printf("git: removing the bare repo in %s", b.dir)
+	if err := emptyDir(b.cfg, b.cfg.RepoDir); err != nil {
+		return fmt.Errorf("removing clone: %w", err)
+	}
+	return b.cloneLocked()
+}
+
+func (b *BareRepo) Pull() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.pullLocked()
+}
+
+// pullLocked fetches the branch, rebuilds any unpushed commits on top of
+// it, and brings the mirror up to date.
+func (b *BareRepo) pullLocked() error {
+	spec := "+" + b.branchRef() + ":" + b.originRef()
+	if err := b.cli.run(b.dir, "git", "fetch", "origin", spec); err != nil {
+		return fmt.Errorf("git fetch: %w", err)
+	}
+	if err := b.replayLocked(); err != nil {
+		return err
+	}
+	return b.syncLocked()
+}
+
+// replayLocked moves the branch onto origin's, rebuilding the commits only
+// it has on top. Where a commit changes a file that also changed upstream,
+// STATICOMMENT_CONFLICT_STRATEGY picks the version kept, as with GoGitRepo.
+func (b *BareRepo) replayLocked() error {
+	local, upstream := b.rev(b.branchRef()), b.rev(b.originRef())
+	if local == upstream || upstream == "" {
+		return nil
+	}
+	if local == "" {
+		_, err := b.git(nil, "", "update-ref", b.branchRef(), upstream)
+		return err
+	}
+	if _, err := b.git(nil, "", "merge-base", "--is-ancestor", upstream, local); err == nil {
+		// Only ahead of upstream; nothing to pull
+		return nil
+	}
+	out, err := b.git(nil, "", "rev-list", "--reverse", upstream+".."+local)
+	if err != nil {
+		return fmt.Errorf("git rev-list: %w", err)
+	}
+	tip := upstream
+	commits := strings.Fields(out)
+	for _, c := range commits {
+		if tip, err = b.replayCommit(c, tip); err != nil {
+			return fmt.Errorf("replaying %s onto origin/%s: %w", c, b.cfg.Branch, err)
+		}
+	}
+	if _, err := b.git(nil, "", "update-ref", b.branchRef(), tip, local); err != nil {
+		return fmt.Errorf("git update-ref: %w", err)
+	}
+	if len(commits) > 0 {
+		log.Printf("git: replayed %d local commit(s) onto origin/%s", len(commits), b.cfg.Branch)
+	}
+	return nil
+}
+
+// indexEntry is a line for update-index --index-info: a file's mode and
+// blob, or mode 0 to remove it.
+type indexEntry struct {
+	mode string
+	sha  string
+	path string
+}
+
+// replayCommit applies c's changes on top of tip and returns the new
+// commit, or tip if they're all there already.
+func (b *BareRepo) replayCommit(c, tip string) (string, error) {
+	out, err := b.git(nil, "", "diff-tree", "-r", "-z", "--no-renames", "--no-commit-id", c+"^", c)
+	if err != nil {
+		return "", err
+	}
+	// -z output alternates ":<old mode> <new mode> <old sha> <new sha> <status>"
+	// and the path
+	fields := strings.Split(strings.TrimSuffix(out, "\x00"), "\x00")
+	var entries []indexEntry
+	for i := 0; i+1 < len(fields); i += 2 {
+		meta := strings.Fields(strings.TrimPrefix(fields[i], ":"))
+		if len(meta) != 5 {
+			return "", fmt.Errorf("unexpected diff-tree output %q", fields[i])
+		}
+		path := fields[i+1]
+		base, ours := meta[2], meta[3]
+		current, err := b.blobAt(tip, path)
+		if err != nil {
+			return "", err
+		}
+		if current == "" {
+			// diff-tree's SHA for a side without the file
+			current = strings.Repeat("0", len(base))
+		}
+		if current != base && current != ours {
+			switch b.cfg.Conflicts {
+			case ConflictFail:
+				return "", fmt.Errorf("%s was changed upstream too", path)
+			case ConflictRemote:
+				log.Printf("git: %s was changed upstream too, keeping the upstream version", path)
+				continue
+			}
+			log.Printf("git: %s was changed upstream too, keeping the local version", path)
+		}
+		if isZeroSHA(ours) {
+			entries = append(entries, indexEntry{mode: "0", sha: ours, path: path})
+		} else {
+			entries = append(entries, indexEntry{mode: meta[1], sha: ours, path: path})
+		}
+	}
+	info, err := b.git(nil, "", "log", "-1", "--format=%an%x00%ae%x00%ad%x00%B", c)
+	if err != nil {
+		return "", err
+	}
+	parts := strings.SplitN(info, "\x00", 4)
+	if len(parts) != 4 {
+		return "", fmt.Errorf("unexpected log output for %s", c)
+	}
+	env := []string{"GIT_AUTHOR_NAME=" + parts[0], "GIT_AUTHOR_EMAIL=" + parts[1], "GIT_AUTHOR_DATE=" + parts[2]}
+	return b.commitLocked(tip, entries, env, strings.TrimSpace(parts[3]))
+}
+
+func isZeroSHA(sha string) bool {
+	return strings.Trim(sha, "0") == ""
+}
+
+// blobAt returns the blob SHA of path in commit, or "" if it has none.
+func (b *BareRepo) blobAt(commit, path string) (string, error) {
+	out, err := b.git(nil, "", "ls-tree", "-z", commit, "--", path)
+	if err != nil {
+		return "", err
+	}
+	// "<mode> blob <sha>\t<path>"
+	if meta, _, ok := strings.Cut(out, "\t"); ok {
+		if f := strings.Fields(meta); len(f) == 3 {
+			return f[2], nil
+		}
+	}
+	return "", nil
+}
+
+// commitLocked builds the tree of parent with entries applied and commits
+// it on top of parent with msg, returning the new commit. If that changes
+// nothing, parent is returned and no commit is made.
+func (b *BareRepo) commitLocked(parent string, entries []indexEntry, env []string, msg string) (string, error) {
+	index := []string{"GIT_INDEX_FILE=" + filepath.Join(b.dir, bareIndex)}
+	if _, err := b.git(index, "", "read-tree", parent); err != nil {
+		return "", fmt.Errorf("git read-tree: %w", err)
+	}
+	var info strings.Builder
+	for _, e := range entries {
+		fmt.Fprintf(&info, "%s %s\t%s\x00", e.mode, e.sha, e.path)
+	}
+	if info.Len() > 0 {
+		if _, err := b.git(index, info.String(), "update-index", "-z", "--index-info"); err != nil {
+			return "", fmt.Errorf("git update-index: %w", err)
+		}
+	}
+	out, err := b.git(index, "", "write-tree")
+	if err != nil {
+		return "", fmt.Errorf("git write-tree: %w", err)
+	}
+	tree := strings.TrimSpace(out)
+	if old, err := b.git(nil, "", "rev-parse", parent+"^{tree}"); err == nil && strings.TrimSpace(old) == tree {
+		return parent, nil
+	}
+	args := []string{"commit-tree", tree, "-p", parent, "-F", "-"}
+	if b.cfg.SigningKey != "" {
+		// commit-tree doesn't read commit.gpgsign
+		args = append(args, "-S")
+	}
+	out, err = b.git(env, msg+"\n", args...)
+	if err != nil {
+		return "", fmt.Errorf("git commit-tree: %w", err)
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// stage hashes the mirror's copies of paths into the bare repo, returning
+// the entries to commit them with. A path missing from the mirror is
+// removed.
+func (b *BareRepo) stage(paths []string) ([]indexEntry, error) {
+	var entries []indexEntry
+	for _, p := range paths {
+		rel := filepath.ToSlash(p)
+		if _, err := os.Stat(b.FullPath(p)); errors.Is(err, fs.ErrNotExist) {
+			entries = append(entries, indexEntry{mode: "0", sha: strings.Repeat("0", 40), path: rel})
+			continue
+		}
+		out, err := b.git(nil, "", "hash-object", "-w", "--no-filters", "--", b.FullPath(p))
+		if err != nil {
+			return nil, fmt.Errorf("git hash-object %s: %w", p, err)
+		}
+		entries = append(entries, indexEntry{mode: "100644", sha: strings.TrimSpace(out), path: rel})
+	}
+	return entries, nil
+}
+
+// authorEnv attributes a commit to author, or to the server's identity for
+// the zero Author.
+func authorEnv(author Author) []string {
+	if author == (Author{}) {
+		return nil
+	}
+	return []string{"GIT_AUTHOR_NAME=" + author.Name, "GIT_AUTHOR_EMAIL=" + author.Email}
+}
+
+// CommitAndPush commits the given repo-relative paths, as they are in the
+// mirror, on top of the branch and pushes it, rebuilding the commit on top
+// of upstream and retrying if the push is rejected.
+func (b *BareRepo) CommitAndPush(author Author, msg string, paths ...string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.pullLocked(); err != nil {
+		return fmt.Errorf("git pull before commit: %w", err)
+	}
+	entries, err := b.stage(paths)
+	if err != nil {
+		return err
+	}
+	parent := b.rev(b.branchRef())
+	commit, err := b.commitLocked(parent, entries, authorEnv(author), msg)
+	if err != nil {
+		return err
+	}
+	// Nothing new means a retried publish whose commit already exists
+	// locally or upstream; skip straight to pushing
+	if commit != parent {
+		if _, err := b.git(nil, "", "update-ref", b.branchRef(), commit, parent); err != nil {
+			return fmt.Errorf("git update-ref: %w", err)
+		}
+	}
+	for _, e := range entries {
+		if e.mode == "0" {
+			delete(b.shas, e.path)
+		} else {
+			b.shas[e.path] = e.sha
+		}
+	}
+
+	for attempt := 1; attempt <= b.cfg.PushRetries; attempt++ {
+		if err = b.pushLocked(); err == nil {
+			if b.mirrors != nil {
+				b.mirrors.Notify()
+			}
+			return nil
+		}
+		if attempt == b.cfg.PushRetries {
+			break
+		}
+		backoff := pushBackoff(b.cfg, attempt)
+		log.Printf("git push attempt %d failed: %v, retrying in %s after fetching", attempt, err, backoff.Round(time.Millisecond))
+		time.Sleep(backoff)
+		if pullErr := b.pullLocked(); pullErr != nil {
+			log.Printf("git pull during push retry failed: %v", pullErr)
+		}
+	}
+	return fmt.Errorf("git push failed after %d attempts: %w", b.cfg.PushRetries, err)
+}
+
+// pushLocked pushes the branch, if it's ahead of origin's, and records
+// that origin has it.
+func (b *BareRepo) pushLocked() error {
+	local := b.rev(b.branchRef())
+	if local == b.rev(b.originRef()) {
+		return nil
+	}
+	if err := b.cli.run(b.dir, "git", "push", "origin", b.branchRef()+":"+b.branchRef()); err != nil {
+		return err
+	}
+	_, err := b.git(nil, "", "update-ref", b.originRef(), local)
+	return err
+}
+
+// pushMirror pushes the branch, as last pushed to the repo, to a
+// STATICOMMENT_GIT_MIRRORS remote.
+func (b *BareRepo) pushMirror(remote string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.cli.run(b.dir, "git", "push", remote, b.originRef()+":"+b.branchRef())
+}
+
+// CommitToBranch calls write to produce the paths to commit and commits
+// them to branch, started from the branch if it doesn't exist yet, then
+// pushes it. The written files are then put back in the mirror as they are
+// on the branch.
+func (b *BareRepo) CommitToBranch(branch string, author Author, msg string, write func() ([]string, error)) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.pullLocked(); err != nil {
+		return fmt.Errorf("git pull before commit: %w", err)
+	}
+	ref := "refs/heads/" + branch
+	parent := b.rev(ref)
+	if parent == "" {
+		parent = b.rev(b.branchRef())
+	}
+
+	paths, err := write()
+	defer func() {
+		if restoreErr := b.restore(paths); restoreErr != nil {
+			log.Printf("warning: restoring the mirror after committing to %s: %v", branch, restoreErr)
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	entries, err := b.stage(paths)
+	if err != nil {
+		return err
+	}
+	commit, err := b.commitLocked(parent, entries, authorEnv(author), msg)
+	if err != nil {
+		return err
+	}
+	if _, err := b.git(nil, "", "update-ref", ref, commit); err != nil {
+		return fmt.Errorf("git update-ref: %w", err)
+	}
+	if err := b.cli.run(b.dir, "git", "push", "origin", ref+":"+ref); err != nil {
+		return fmt.Errorf("git push %s: %w", branch, err)
+	}
+	return nil
+}
+
+// restore puts paths in the mirror back as they are on the branch.
+func (b *BareRepo) restore(paths []string) error {
+	for _, p := range paths {
+		rel := filepath.ToSlash(p)
+		delete(b.shas, rel)
+		sha, err := b.blobAt(b.branchRef(), rel)
+		if err != nil {
+			return err
+		}
+		if sha == "" {
+			if err := os.Remove(b.FullPath(p)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			continue
+		}
+		if err := b.download(map[string]string{rel: sha}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncLocked brings the mirror up to date with the branch. Only blobs whose
+// SHA changed are written, and like ContentsRepo, files changed locally
+// since the last sync are left alone.
+func (b *BareRepo) syncLocked() error {
+	dirs := []string{}
+	for _, d := range []string{b.cfg.CommentsPath, b.cfg.QuarantinePath, b.cfg.IndexPath, b.cfg.StatePath, b.cfg.TemplatesPath, b.cfg.PostsPath} {
+		if d != "" {
+			dirs = append(dirs, filepath.ToSlash(d)+"/")
+		}
+	}
+	out, err := b.git(nil, "", append([]string{"ls-tree", "-r", "-z", b.branchRef(), "--"}, dirs...)...)
+	if err != nil {
+		return fmt.Errorf("git ls-tree: %w", err)
+	}
+
+	seen := make(map[string]bool)
+	want := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSuffix(out, "\x00"), "\x00") {
+		meta, path, ok := strings.Cut(line, "\t")
+		f := strings.Fields(meta)
+		if !ok || len(f) != 3 || f[1] != "blob" {
+			continue
+		}
+		sha := f[2]
+		switch {
+		case mirrored(b.cfg, path):
+			seen[path] = true
+			if b.shas[path] == sha {
+				continue
+			}
+			local, err := b.localSHA(path)
+			if err != nil {
+				return err
+			}
+			if local != "" && local != b.shas[path] && local != sha {
+				log.Printf("git: keeping unpushed local changes to %s", path)
+				continue
+			}
+			want[path] = sha
+		case underDir(path, b.cfg.PostsPath):
+			seen[path] = true
+			if !b.posts[path] {
+				if err := writeMirrorFile(b.cfg, b.FullPath(path), nil); err != nil {
+					return err
+				}
+				b.posts[path] = true
+			}
+		}
+	}
+	if err := b.download(want); err != nil {
+		return err
+	}
+
+	// Drop files deleted upstream, unless they've changed locally since
+	for path, sha := range b.shas {
+		if !mirrored(b.cfg, path) || seen[path] {
+			continue
+		}
+		if local, err := b.localSHA(path); err == nil && (local == sha || local == "") {
+			os.Remove(b.FullPath(path))
+			delete(b.shas, path)
+		}
+	}
+	for path := range b.posts {
+		if !seen[path] {
+			os.Remove(b.FullPath(path))
+			delete(b.posts, path)
+		}
+	}
+	return nil
+}
+
+// download writes the blobs in files, by path, to the mirror, reading them
+// all with one cat-file.
+func (b *BareRepo) download(files map[string]string) error {
+	if len(files) == 0 {
+		return nil
+	}
+	var in strings.Builder
+	var order []string
+	for path, sha := range files {
+		in.WriteString(sha + "\n")
+		order = append(order, path)
+	}
+	out, err := b.git(nil, in.String(), "cat-file", "--batch")
+	if err != nil {
+		return fmt.Errorf("git cat-file: %w", err)
+	}
+	r := bufio.NewReader(strings.NewReader(out))
+	for _, path := range order {
+		header, err := r.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("git cat-file: reading %s: %w", path, err)
+		}
+		f := strings.Fields(header)
+		if len(f) != 3 || f[1] != "blob" {
+			return fmt.Errorf("git cat-file: unexpected output %q for %s", strings.TrimSpace(header), path)
+		}
+		size, err := strconv.Atoi(f[2])
+		if err != nil {
+			return fmt.Errorf("git cat-file: unexpected output %q for %s", strings.TrimSpace(header), path)
+		}
+		data := make([]byte, size+1)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return fmt.Errorf("git cat-file: reading %s: %w", path, err)
+		}
+		if err := writeMirrorFile(b.cfg, b.FullPath(path), data[:size]); err != nil {
+			return err
+		}
+		b.shas[path] = files[path]
+	}
+	return nil
+}
+
+// localSHA returns the blob SHA of the mirrored file, or "" if it doesn't
+// exist.
+func (b *BareRepo) localSHA(relPath string) (string, error) {
+	data, err := os.ReadFile(b.FullPath(relPath))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return blobSHA(data), nil
+}
+
+// CheckRemote verifies the remote is reachable and has the configured
+// branch.
+func (b *BareRepo) CheckRemote() error {
+	return b.cli.CheckRemote()
+}
+
+// FullPath returns the absolute path for a file relative to the repo root.
+func (b *BareRepo) FullPath(relPath string) string {
+	return filepath.Join(b.cfg.RepoDir, relPath)
+}
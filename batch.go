@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CommitQueue batches the commits of comments accepted close together.
+// The first comment to arrive opens a batch; comments arriving within
+// STATICOMMENT_BATCH_INTERVAL of it join, and the batch is committed and
+// pushed once, as a single commit, when the interval is up or it reaches
+// STATICOMMENT_BATCH_MAX comments. Callers wait for their batch, so each
+// learns whether its comment was pushed just as with an unbatched commit.
+//
+// With a threshold, comments are only batched while they arrive quickly:
+// once STATICOMMENT_BATCH_THRESHOLD comments have arrived within
+// STATICOMMENT_BATCH_THRESHOLD_WINDOW, until fewer than half that many
+// have. The rest of the time each is committed and pushed as it arrives.
+type CommitQueue struct {
+	repo      Repo
+	interval  time.Duration
+	max       int
+	threshold int // comments per window; 0 always batches
+	window    time.Duration
+
+	mu       sync.Mutex
+	pending  *commitBatch
+	arrivals []time.Time // in the last window, with a threshold
+	batching bool
+}
+
+// commitBatch is the set of commits being gathered into one.
+type commitBatch struct {
+	authors  []Author
+	messages []string
+	paths    []string
+	seen     map[string]bool
+	timer    *time.Timer
+	done     chan struct{}
+	err      error
+}
+
+func NewCommitQueue(repo Repo, interval time.Duration, max, threshold int, window time.Duration) *CommitQueue {
+	return &CommitQueue{repo: repo, interval: interval, max: max, threshold: threshold, window: window}
+}
+
+// CommitAndPush adds a commit to the open batch and waits until the batch
+// has been pushed, returning its error. Below the threshold, it commits
+// and pushes straight away instead.
+func (q *CommitQueue) CommitAndPush(author Author, msg string, paths ...string) error {
+	q.mu.Lock()
+	if q.threshold > 0 && !q.busy(time.Now()) && q.pending == nil {
+		q.mu.Unlock()
+		return q.repo.CommitAndPush(author, msg, paths...)
+	}
+	b := q.pending
+	if b == nil {
+		b = &commitBatch{seen: make(map[string]bool), done: make(chan struct{})}
+		b.timer = time.AfterFunc(q.interval, func() { q.flush(b) })
+		q.pending = b
+	}
+	b.authors = append(b.authors, author)
+	b.messages = append(b.messages, msg)
+	for _, p := range paths {
+		// Comments on the same post share an index file
+		if !b.seen[p] {
+			b.seen[p] = true
+			b.paths = append(b.paths, p)
+		}
+	}
+	full := len(b.messages) >= q.max
+	q.mu.Unlock()
+
+	if full && b.timer.Stop() {
+		go q.flush(b)
+	}
+	<-b.done
+	return b.err
+}
+
+// busy records a comment arriving at now and reports whether comments are
+// arriving quickly enough to batch. q.mu must be held.
+func (q *CommitQueue) busy(now time.Time) bool {
+	cutoff := now.Add(-q.window)
+	i := 0
+	for i < len(q.arrivals) && !q.arrivals[i].After(cutoff) {
+		i++
+	}
+	q.arrivals = append(q.arrivals[i:], now)
+	rate := len(q.arrivals)
+	switch {
+	case !q.batching && rate >= q.threshold:
+		q.batching = true
+		log.Printf("git: %d comments in the last %s, batching commits", rate, q.window)
+	case q.batching && rate*2 < q.threshold:
+		q.batching = false
+		log.Printf("git: comments have slowed down, committing each as it arrives")
+	}
+	return q.batching
+}
+
+// flush closes batch b to new commits and commits it.
+func (q *CommitQueue) flush(b *commitBatch) {
+	q.mu.Lock()
+	if q.pending == b {
+		q.pending = nil
+	}
+	q.mu.Unlock()
+
+	author, msg := batchCommit(b.authors, b.messages)
+	if len(b.messages) > 1 {
+		log.Printf("git: committing a batch of %d comments", len(b.messages))
+	}
+	b.err = q.repo.CommitAndPush(author, msg, b.paths...)
+	close(b.done)
+}
+
+// batchCommit combines the authors and messages of a batch's commits. A
+// batch of one is committed as is. Otherwise the message summarizes the
+// commits, and the author is theirs if they all share one, or else the
+// server.
+func batchCommit(authors []Author, messages []string) (Author, string) {
+	if len(messages) == 1 {
+		return authors[0], messages[0]
+	}
+	author := authors[0]
+	for _, a := range authors[1:] {
+		if a != author {
+			author = Author{}
+			break
+		}
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "Add %d comments\n\n", len(messages))
+	for _, m := range messages {
+		sb.WriteString("- " + m + "\n")
+	}
+	return author, sb.String()
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Bayes actions: what happens to a comment the classifier calls spam
+// (STATICOMMENT_BAYES_ACTION).
+const (
+	BayesQuarantine = "quarantine"
+	BayesReject     = "reject"
+)
+
+// bayesFile is the model's default file name, in the data directory or,
+// with STATICOMMENT_BAYES_IN_REPO=1, the state path.
+const bayesFile = "bayes.json"
+
+const (
+	// bayesInteresting is how many of a text's tokens, those furthest from
+	// neutral, decide its score.
+	bayesInteresting = 15
+	// bayesStrength weighs a token's probability towards neutral until it
+	// has been seen in a few examples.
+	bayesStrength = 1.0
+)
+
+// bayesModel is what the classifier has learned, as stored: how many spam
+// and ham examples it was trained on, how many of each contained each
+// token, and which examples it was trained on with which label, so
+// training on one again is a no-op and relabeling one moves it over.
+type bayesModel struct {
+	Spam    int               `json:"spam"`
+	Ham     int               `json:"ham"`
+	Tokens  map[string][2]int `json:"tokens"` // spam, ham
+	Trained map[string]string `json:"trained"`
+}
+
+// BayesExample is a text to train on. Key identifies it among everything
+// trained, like "comment:<slug>/<id>".
+type BayesExample struct {
+	Key  string
+	Text string
+}
+
+// BayesStats summarizes the model.
+type BayesStats struct {
+	Spam        int  `json:"spam"`
+	Ham         int  `json:"ham"`
+	Tokens      int  `json:"tokens"`
+	MinTraining int  `json:"min_training"`
+	Active      bool `json:"active"`
+}
+
+// Bayes is a naive Bayes classifier scoring comment bodies by the words
+// they share with comments marked as spam and as ham. It only scores once
+// it has been trained on STATICOMMENT_BAYES_MIN_TRAINING examples of each.
+// The model is a JSON file, reloaded whenever it changes on disk, so
+// training by the CLI or, with the model in the repo, by another instance
+// is picked up without a restart.
+type Bayes struct {
+	cfg     *Config
+	path    string
+	mu      sync.Mutex
+	model   *bayesModel
+	modTime time.Time
+}
+
+// NewBayes opens the model at path, which needn't exist yet.
+func NewBayes(cfg *Config, path string) *Bayes {
+	return &Bayes{cfg: cfg, path: path}
+}
+
+// bayesPath returns where the model is on disk: STATICOMMENT_BAYES_PATH, in
+// repo's clone with STATICOMMENT_BAYES_IN_REPO=1.
+func bayesPath(cfg *Config, repo Repo) string {
+	if cfg.BayesInRepo {
+		return repo.FullPath(cfg.BayesPath)
+	}
+	return cfg.BayesPath
+}
+
+// load rereads the model if the file changed since it was last read.
+// Callers hold b.mu.
+func (b *Bayes) load() error {
+	info, err := os.Stat(b.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		if b.model == nil || !b.modTime.IsZero() {
+			b.model, b.modTime = &bayesModel{}, time.Time{}
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading bayes model: %w", err)
+	}
+	if b.model != nil && info.ModTime().Equal(b.modTime) {
+		return nil
+	}
+	data, err := os.ReadFile(b.path)
+	if err != nil {
+		return fmt.Errorf("reading bayes model: %w", err)
+	}
+	var m bayesModel
+	if err := json.Unmarshal(data, &m); err != nil {
+		return fmt.Errorf("parsing bayes model %s: %w", b.path, err)
+	}
+	b.model, b.modTime = &m, info.ModTime()
+	return nil
+}
+
+func (b *Bayes) save() error {
+	data, err := json.Marshal(b.model)
+	if err != nil {
+		return fmt.Errorf("marshaling bayes model: %w", err)
+	}
+	if err := makeDirs(b.cfg, filepath.Dir(b.path)); err != nil {
+		return fmt.Errorf("creating bayes model dir: %w", err)
+	}
+	if err := writeFileAtomic(b.cfg, b.path, data); err != nil {
+		return fmt.Errorf("writing bayes model: %w", err)
+	}
+	if info, err := os.Stat(b.path); err == nil {
+		b.modTime = info.ModTime()
+	}
+	return nil
+}
+
+// Score returns the probability that text is spam. ok is false while the
+// model has too few examples to go by.
+func (b *Bayes) Score(text string) (p float64, ok bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.load(); err != nil {
+		return 0, false, err
+	}
+	m := b.model
+	if m.Spam < b.cfg.BayesMinTraining || m.Ham < b.cfg.BayesMinTraining {
+		return 0, false, nil
+	}
+
+	var probs []float64
+	for _, token := range bayesTokens(text) {
+		counts, found := m.Tokens[token]
+		if !found {
+			continue
+		}
+		spamFreq := float64(counts[0]) / float64(m.Spam)
+		hamFreq := float64(counts[1]) / float64(m.Ham)
+		n := float64(counts[0] + counts[1])
+		p := (bayesStrength*0.5 + n*spamFreq/(spamFreq+hamFreq)) / (bayesStrength + n)
+		probs = append(probs, min(max(p, 0.01), 0.99))
+	}
+	sort.Slice(probs, func(i, j int) bool { return math.Abs(probs[i]-0.5) > math.Abs(probs[j]-0.5) })
+	var logOdds float64
+	for _, p := range probs[:min(len(probs), bayesInteresting)] {
+		logOdds += math.Log(p / (1 - p))
+	}
+	return 1 / (1 + math.Exp(-logOdds)), true, nil
+}
+
+// Train labels examples LabelSpam or LabelHam, or with "" forgets them,
+// and saves the model. It returns how many examples changed.
+func (b *Bayes) Train(examples []BayesExample, label string) (int, error) {
+	if label != LabelSpam && label != LabelHam && label != "" {
+		return 0, fmt.Errorf("label must be %q or %q", LabelSpam, LabelHam)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.load(); err != nil {
+		return 0, err
+	}
+	m := b.model
+	if m.Tokens == nil {
+		m.Tokens = make(map[string][2]int)
+	}
+	if m.Trained == nil {
+		m.Trained = make(map[string]string)
+	}
+
+	changed := 0
+	for _, ex := range examples {
+		prev := m.Trained[ex.Key]
+		if prev == label {
+			continue
+		}
+		tokens := bayesTokens(ex.Text)
+		if prev != "" {
+			m.add(tokens, prev, -1)
+			delete(m.Trained, ex.Key)
+		}
+		if label != "" {
+			m.add(tokens, label, 1)
+			m.Trained[ex.Key] = label
+		}
+		changed++
+	}
+	if changed == 0 {
+		return 0, nil
+	}
+	return changed, b.save()
+}
+
+// add counts tokens, from an example labeled label, delta times.
+func (m *bayesModel) add(tokens []string, label string, delta int) {
+	i := 0
+	if label == LabelSpam {
+		m.Spam = max(m.Spam+delta, 0)
+	} else {
+		m.Ham = max(m.Ham+delta, 0)
+		i = 1
+	}
+	for _, token := range tokens {
+		counts := m.Tokens[token]
+		counts[i] = max(counts[i]+delta, 0)
+		if counts == [2]int{} {
+			delete(m.Tokens, token)
+		} else {
+			m.Tokens[token] = counts
+		}
+	}
+}
+
+// Stats summarizes the model as it is now.
+func (b *Bayes) Stats() (BayesStats, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.load(); err != nil {
+		return BayesStats{}, err
+	}
+	m := b.model
+	return BayesStats{
+		Spam:        m.Spam,
+		Ham:         m.Ham,
+		Tokens:      len(m.Tokens),
+		MinTraining: b.cfg.BayesMinTraining,
+		Active:      m.Spam >= b.cfg.BayesMinTraining && m.Ham >= b.cfg.BayesMinTraining,
+	}, nil
+}
+
+// bayesTokens splits text into the distinct lowercased words, and numbers,
+// the classifier goes by.
+func bayesTokens(text string) []string {
+	seen := make(map[string]bool)
+	var tokens []string
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	for _, w := range words {
+		if n := utf8.RuneCountInString(w); n < 2 || n > 40 || seen[w] {
+			continue
+		}
+		seen[w] = true
+		tokens = append(tokens, w)
+	}
+	return tokens
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// BayesAdmin serves the admin API's view of the spam classifier, and
+// trains it on comments in the repo, published or quarantined, marked as
+// spam or ham by a moderator.
+type BayesAdmin struct {
+	cfg   *Config
+	bayes *Bayes
+	repo  Repo
+}
+
+func NewBayesAdmin(cfg *Config, bayes *Bayes, repo Repo) *BayesAdmin {
+	return &BayesAdmin{cfg: cfg, bayes: bayes, repo: repo}
+}
+
+// bayesTrainRequest is the body of POST /admin/bayes/train: comments as
+// "<slug>/<id>", and the label to give them, "spam", "ham" or "none" to
+// forget them.
+type bayesTrainRequest struct {
+	Label    string   `json:"label"`
+	Comments []string `json:"comments"`
+}
+
+// ServeStats handles GET /admin/bayes, showing how much the classifier has
+// been trained and whether it's scoring yet.
+func (a *BayesAdmin) ServeStats(w http.ResponseWriter, r *http.Request) {
+	stats, err := a.bayes.Stats()
+	if err != nil {
+		log.Printf("bayes: %v", err)
+		http.Error(w, "Failed to read the model", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, stats)
+}
+
+// ServeScore handles POST /admin/bayes/score, scoring {"body": "..."} the
+// way a submitted comment's body is.
+func (a *BayesAdmin) ServeScore(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Body string `json:"body"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	p, ok, err := a.bayes.Score(req.Body)
+	if err != nil {
+		log.Printf("bayes: %v", err)
+		http.Error(w, "Failed to read the model", http.StatusInternalServerError)
+		return
+	}
+	resp := struct {
+		Active          bool     `json:"active"`
+		SpamProbability *float64 `json:"spam_probability,omitempty"`
+	}{Active: ok}
+	if ok {
+		resp.SpamProbability = &p
+	}
+	writeJSON(w, resp)
+}
+
+// ServeTrain handles POST /admin/bayes/train. With the model in the repo,
+// the change is committed and pushed.
+func (a *BayesAdmin) ServeTrain(w http.ResponseWriter, r *http.Request) {
+	var req bayesTrainRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	label := req.Label
+	if label == "none" {
+		label = ""
+	} else if label != LabelSpam && label != LabelHam {
+		http.Error(w, `label must be "spam", "ham" or "none"`, http.StatusBadRequest)
+		return
+	}
+	if len(req.Comments) == 0 {
+		http.Error(w, "No comments given", http.StatusBadRequest)
+		return
+	}
+	for _, ref := range req.Comments {
+		slug, id, _ := strings.Cut(ref, "/")
+		if !isValidSlug(slug) || !isValidSlug(id) {
+			http.Error(w, fmt.Sprintf("Invalid comment %q: want <slug>/<id>", ref), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if err := a.repo.Pull(); err != nil {
+		log.Printf("warning: git pull before training: %v", err)
+	}
+	var examples []BayesExample
+	notFound := []string{}
+	for _, ref := range req.Comments {
+		c, err := a.readComment(ref)
+		if errors.Is(err, fs.ErrNotExist) {
+			notFound = append(notFound, ref)
+			continue
+		}
+		if err != nil {
+			log.Printf("bayes: %v", err)
+			http.Error(w, "Failed to read comments", http.StatusInternalServerError)
+			return
+		}
+		examples = append(examples, BayesExample{Key: "comment:" + ref, Text: c.Body})
+	}
+	trained, err := a.bayes.Train(examples, label)
+	if err != nil {
+		log.Printf("bayes: %v", err)
+		http.Error(w, "Failed to train", http.StatusInternalServerError)
+		return
+	}
+	if trained > 0 && a.cfg.BayesInRepo {
+		msg := fmt.Sprintf("Train spam filter\n\n%s %s", countComments(trained), bayesVerb(label))
+		if err := a.repo.CommitAndPush(Author{}, msg, a.cfg.BayesPath); err != nil {
+			log.Printf("committing bayes model: %v", err)
+			http.Error(w, "Trained, but the commit failed: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+	log.Printf("bayes: %s %s", countComments(trained), bayesVerb(label))
+	writeJSON(w, map[string]any{"trained": trained, "not_found": notFound})
+}
+
+// readComment reads the comment ref, "<slug>/<id>", published or else
+// quarantined.
+func (a *BayesAdmin) readComment(ref string) (Comment, error) {
+	var c Comment
+	var data []byte
+	var err error
+	for _, base := range []string{a.cfg.CommentsPath, a.cfg.QuarantinePath} {
+		data, err = os.ReadFile(a.repo.FullPath(filepath.Join(base, ref+".yml")))
+		if !errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+	}
+	if err != nil {
+		return c, err
+	}
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return c, fmt.Errorf("parsing %s: %w", ref, err)
+	}
+	return c, nil
+}
+
+// bayesVerb says what training with label did, for log and commit
+// messages.
+func bayesVerb(label string) string {
+	if label == "" {
+		return "forgotten"
+	}
+	return "marked as " + label
+}
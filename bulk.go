@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// BulkModeration serves the admin API's bulk actions. Each changes any
+// number of comments in a single commit whose message says what was done
+// and why, so a bulk action shows up in the history as one reviewable,
+// revertable change.
+type BulkModeration struct {
+	cfg       *Config
+	publisher *Publisher
+}
+
+func NewBulkModeration(cfg *Config, publisher *Publisher) *BulkModeration {
+	return &BulkModeration{cfg: cfg, publisher: publisher}
+}
+
+// ServeApprove handles POST /admin/quarantine/{slug}/approve, publishing
+// every quarantined comment on the post.
+func (b *BulkModeration) ServeApprove(w http.ResponseWriter, r *http.Request) {
+	slug := r.PathValue("slug")
+	if !isValidSlug(slug) {
+		http.Error(w, "Invalid slug", http.StatusBadRequest)
+		return
+	}
+	approved, err := b.publisher.ApproveAll(slug)
+	if err != nil {
+		log.Printf("approving quarantined comments on %s: %v", slug, err)
+		http.Error(w, "Failed to approve comments", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]int{"approved": approved})
+}
+
+// ServeReject handles POST /admin/quarantine/{slug}/reject, deleting every
+// quarantined comment on the post.
+func (b *BulkModeration) ServeReject(w http.ResponseWriter, r *http.Request) {
+	slug := r.PathValue("slug")
+	if !isValidSlug(slug) {
+		http.Error(w, "Invalid slug", http.StatusBadRequest)
+		return
+	}
+	matches, err := filepath.Glob(filepath.Join(b.publisher.repo.FullPath(filepath.Join(b.cfg.QuarantinePath, slug)), "*.yml"))
+	if err != nil {
+		http.Error(w, "Failed to list comments", http.StatusInternalServerError)
+		return
+	}
+	paths := make([]string, len(matches))
+	for i, m := range matches {
+		paths[i] = filepath.Join(b.cfg.QuarantinePath, slug, filepath.Base(m))
+	}
+	msg := fmt.Sprintf("Reject quarantined comments on %s\n\n%s rejected in bulk", slug, countComments(len(paths)))
+	rejected, err := b.publisher.Remove(paths, msg)
+	if err != nil {
+		log.Printf("rejecting quarantined comments on %s: %v", slug, err)
+		http.Error(w, "Failed to reject comments", http.StatusInternalServerError)
+		return
+	}
+	b.publisher.ReportSpam(true, paths...)
+	writeJSON(w, map[string]int{"rejected": rejected})
+}
+
+// deleteRequest is the body of POST /admin/comments/delete. Every condition
+// given must match; at least one is required.
+type deleteRequest struct {
+	Slug      string `json:"slug"`
+	Pattern   string `json:"pattern"`
+	Email     string `json:"email"`
+	EmailHash string `json:"email_hash"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	DryRun    bool   `json:"dry_run"`
+}
+
+// commentFilter is a parsed deleteRequest.
+type commentFilter struct {
+	slug      string
+	pattern   *regexp.Regexp
+	emailHash string
+	from, to  time.Time
+}
+
+// parseDate accepts an RFC 3339 time or a date. A date stands for the start
+// of that day (UTC), or with end set, the start of the next, so a range of
+// dates includes both ends.
+func parseDate(s string, end bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.DateOnly, s)
+	if err != nil {
+		return t, fmt.Errorf("invalid date %q", s)
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// emailHash is the hex SHA-256 of an address, trimmed and lowercased, as
+// used for Gravatar.
+func emailHash(email string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(email))))
+	return hex.EncodeToString(sum[:])
+}
+
+func (req deleteRequest) filter() (commentFilter, error) {
+	f := commentFilter{slug: req.Slug, emailHash: strings.ToLower(req.EmailHash)}
+	var err error
+	if req.Slug != "" && !isValidSlug(req.Slug) {
+		return f, fmt.Errorf("invalid slug")
+	}
+	if req.Pattern != "" {
+		if f.pattern, err = regexp.Compile(req.Pattern); err != nil {
+			return f, fmt.Errorf("invalid pattern: %w", err)
+		}
+	}
+	if req.Email != "" {
+		if f.emailHash != "" {
+			return f, fmt.Errorf("give email or email_hash, not both")
+		}
+		f.emailHash = emailHash(req.Email)
+	}
+	if req.From != "" {
+		if f.from, err = parseDate(req.From, false); err != nil {
+			return f, err
+		}
+	}
+	if req.To != "" {
+		if f.to, err = parseDate(req.To, true); err != nil {
+			return f, err
+		}
+	}
+	if f.slug == "" && f.pattern == nil && f.emailHash == "" && f.from.IsZero() && f.to.IsZero() {
+		return f, fmt.Errorf("at least one of slug, pattern, email, email_hash, from and to is required")
+	}
+	return f, nil
+}
+
+func (f commentFilter) match(c StoredComment) bool {
+	if f.slug != "" && c.Slug != f.slug {
+		return false
+	}
+	if f.pattern != nil && !f.pattern.MatchString(c.Body) {
+		return false
+	}
+	if f.emailHash != "" && (c.Email == "" || emailHash(c.Email) != f.emailHash) {
+		return false
+	}
+	if !f.to.IsZero() {
+		// StoredComments has already checked that the date parses
+		if date, _ := time.Parse(time.RFC3339, c.Date); !date.Before(f.to) {
+			return false
+		}
+	}
+	return true
+}
+
+// describe is the commit message body for a deletion by req: the
+// conditions and the posts affected.
+func (req deleteRequest) describe(f commentFilter, slugs []string) string {
+	var conds []string
+	if req.Slug != "" {
+		conds = append(conds, "post "+req.Slug)
+	}
+	if req.Pattern != "" {
+		conds = append(conds, "body matching /"+req.Pattern+"/")
+	}
+	if f.emailHash != "" {
+		// Only ever the hash, so the address doesn't end up in the history
+		conds = append(conds, "email hash "+f.emailHash[:min(16, len(f.emailHash))])
+	}
+	switch {
+	case req.From != "" && req.To != "":
+		conds = append(conds, "dated "+req.From+" to "+req.To)
+	case req.From != "":
+		conds = append(conds, "dated from "+req.From)
+	case req.To != "":
+		conds = append(conds, "dated up to "+req.To)
+	}
+	return "Criteria: " + strings.Join(conds, ", ") + "\nPosts: " + strings.Join(slugs, ", ")
+}
+
+// countComments is "1 comment" or "<n> comments".
+func countComments(n int) string {
+	if n == 1 {
+		return "1 comment"
+	}
+	return fmt.Sprintf("%d comments", n)
+}
+
+// ServeDelete handles POST /admin/comments/delete, deleting the comments,
+// published and quarantined, that match the request: by post, body pattern,
+// author email and date range. With dry_run the matches are only listed.
+func (b *BulkModeration) ServeDelete(w http.ResponseWriter, r *http.Request) {
+	var req deleteRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	f, err := req.filter()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	comments, err := b.publisher.StoredComments(f.from)
+	if err != nil {
+		log.Printf("listing comments: %v", err)
+		http.Error(w, "Failed to list comments", http.StatusInternalServerError)
+		return
+	}
+	matched := []CommentSummary{}
+	var paths, slugs []string
+	seen := make(map[string]bool)
+	for _, c := range comments {
+		if !f.match(c) {
+			continue
+		}
+		matched = append(matched, CommentSummary{Path: c.Path, Slug: c.Slug, Name: c.Name, Date: c.Date, Quarantined: c.Quarantined})
+		paths = append(paths, c.Path)
+		if !seen[c.Slug] {
+			seen[c.Slug] = true
+			slugs = append(slugs, c.Slug)
+		}
+	}
+	if req.DryRun {
+		writeJSON(w, map[string]any{"matched": matched})
+		return
+	}
+	sort.Strings(slugs)
+	msg := fmt.Sprintf("Delete %s\n\n%s", countComments(len(paths)), req.describe(f, slugs))
+	deleted, err := b.publisher.Remove(paths, msg)
+	if err != nil {
+		log.Printf("deleting comments: %v", err)
+		http.Error(w, "Failed to delete comments", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]any{"deleted": deleted, "matched": matched})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"time"
+)
+
+// Canary is the self-test run every STATICOMMENT_CANARY_INTERVAL: it
+// publishes a synthetic comment on STATICOMMENT_CANARY_SLUG the way a
+// visitor's is published, files, index, commit and push, then deletes it
+// again. Every run is reported as an EventCanary with how long the comment
+// took to reach the remote, so a broken deploy key, a full disk or a new
+// branch protection rule shows up before a visitor runs into it.
+//
+// The comment skips the outbox, so a failed run is never retried: the next
+// run simply tries again, and removes anything an earlier one left behind.
+type Canary struct {
+	cfg       *Config
+	publisher *Publisher
+	events    *EventBus
+}
+
+func NewCanary(cfg *Config, publisher *Publisher, events *EventBus) *Canary {
+	return &Canary{cfg: cfg, publisher: publisher, events: events}
+}
+
+// Run checks at startup and then every interval.
+func (c *Canary) Run() {
+	ticker := time.NewTicker(time.Duration(c.cfg.CanaryInterval) * time.Second)
+	defer ticker.Stop()
+	for {
+		c.Check()
+		<-ticker.C
+	}
+}
+
+// Check runs the self-test once.
+func (c *Canary) Check() {
+	e := Event{Type: EventCanary, Slug: c.cfg.CanarySlug}
+	stage, err := c.check(&e)
+	if err != nil {
+		e.Reason, e.Err = stage, err
+		log.Printf("canary: failed at %s: %v", stage, err)
+	} else {
+		log.Printf("canary: %s published in %s", e.Path, e.Duration.Round(time.Millisecond))
+	}
+	c.events.Publish(e)
+}
+
+// check publishes and deletes the comment, filling in e, and returns the
+// stage that failed.
+func (c *Canary) check(e *Event) (stage string, err error) {
+	now := time.Now()
+	comment := Comment{
+		Name: "staticomment canary",
+		Body: "Self-test comment. It's deleted again as soon as it has been pushed.",
+		Date: now.UTC().Format(time.RFC3339),
+		Slug: c.cfg.CanarySlug,
+	}
+	job, err := c.publisher.NewJob(comment, "", false, now)
+	if err != nil {
+		return "write", err
+	}
+	job.Message = "Add canary comment"
+	job.Moderated = false // it's never worth a review
+	job.Canary = true
+	e.Path = job.Path
+	if err := c.publisher.publish(job); err != nil {
+		var pe *publishError
+		if errors.As(err, &pe) {
+			return pe.stage, pe.err
+		}
+		return "publish", err
+	}
+	e.Duration = time.Since(now)
+
+	// Earlier runs' comments go too, if they couldn't be deleted then
+	paths, err := filepath.Glob(filepath.Join(c.publisher.repo.FullPath(filepath.Join(c.cfg.CommentsPath, c.cfg.CanarySlug)), "*.yml"))
+	if err != nil {
+		return "revert", err
+	}
+	for i, p := range paths {
+		paths[i] = filepath.Join(c.cfg.CommentsPath, c.cfg.CanarySlug, filepath.Base(p))
+	}
+	removed, err := c.publisher.Remove(paths, "Remove canary comment")
+	if err != nil {
+		return "revert", err
+	}
+	if removed == 0 {
+		return "verify", fmt.Errorf("%s was gone after the push", job.Path)
+	}
+	return "", nil
+}
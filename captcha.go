@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Form fields the CAPTCHA scripts fill in with the visitor's token.
+const (
+	recaptchaField = "g-recaptcha-response"
+	hcaptchaField  = "h-captcha-response"
+)
+
+// errCaptchaFailed is returned for a visitor who failed a CAPTCHA: with a
+// token that's missing, forged, expired, already used or for another
+// action or site, or too low a score.
+var errCaptchaFailed = errors.New("CAPTCHA check failed")
+
+// siteverifyResult is the answer of a siteverify API, which reCAPTCHA and
+// hCaptcha share.
+type siteverifyResult struct {
+	Success    bool     `json:"success"`
+	Score      float64  `json:"score"`
+	Action     string   `json:"action"`
+	ErrorCodes []string `json:"error-codes"`
+}
+
+// siteverify checks token, sent by the visitor at ip, with the siteverify
+// API at api. It returns errCaptchaFailed if the token is rejected, and any
+// other error if the API couldn't be asked or rejected our secret.
+func siteverify(client *http.Client, api string, params url.Values, token, ip string) (*siteverifyResult, error) {
+	if token == "" {
+		return nil, fmt.Errorf("%w: no token", errCaptchaFailed)
+	}
+	params.Set("response", token)
+	params.Set("remoteip", ip)
+	resp, err := client.PostForm(api, params)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	var result siteverifyResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+	if !result.Success {
+		for _, code := range result.ErrorCodes {
+			// Our fault, not the visitor's
+			if code == "missing-input-secret" || code == "invalid-input-secret" || code == "sitekey-secret-mismatch" {
+				return nil, errors.New(code)
+			}
+		}
+		return nil, fmt.Errorf("%w: %s", errCaptchaFailed, strings.Join(result.ErrorCodes, ", "))
+	}
+	return &result, nil
+}
+
+// Recaptcha verifies reCAPTCHA v3 tokens with Google. v3 never shows the
+// visitor a challenge; it scores how likely they are to be human, from 0.0
+// (a bot) to 1.0, and the score is what's checked.
+type Recaptcha struct {
+	cfg    *Config
+	client *http.Client
+}
+
+func NewRecaptcha(cfg *Config) *Recaptcha {
+	return &Recaptcha{cfg: cfg, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Verify returns the score of token, sent by the visitor at ip. It returns
+// errCaptchaFailed if Google rejects the token or it was issued for
+// another action than STATICOMMENT_RECAPTCHA_ACTION, and any other error if
+// Google couldn't be asked.
+func (rc *Recaptcha) Verify(token, ip string) (float64, error) {
+	result, err := siteverify(rc.client, rc.cfg.RecaptchaAPI, url.Values{"secret": {rc.cfg.RecaptchaSecret}}, token, ip)
+	if err != nil {
+		return 0, fmt.Errorf("recaptcha: %w", err)
+	}
+	if rc.cfg.RecaptchaAction != "" && result.Action != rc.cfg.RecaptchaAction {
+		return 0, fmt.Errorf("recaptcha: %w: action %q", errCaptchaFailed, result.Action)
+	}
+	return result.Score, nil
+}
+
+// HCaptcha verifies hCaptcha tokens. Unlike reCAPTCHA v3, hCaptcha decides
+// itself whether the visitor passed, challenging them if it's unsure, so
+// there's no score to check.
+type HCaptcha struct {
+	cfg    *Config
+	client *http.Client
+}
+
+func NewHCaptcha(cfg *Config) *HCaptcha {
+	return &HCaptcha{cfg: cfg, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Verify checks token, sent by the visitor at ip. It returns
+// errCaptchaFailed if hCaptcha rejects the token, including one issued for
+// another site key than STATICOMMENT_HCAPTCHA_SITEKEY, and any other error
+// if hCaptcha couldn't be asked.
+func (hc *HCaptcha) Verify(token, ip string) error {
+	params := url.Values{"secret": {hc.cfg.HCaptchaSecret}}
+	if hc.cfg.HCaptchaSiteKey != "" {
+		params.Set("sitekey", hc.cfg.HCaptchaSiteKey)
+	}
+	if _, err := siteverify(hc.client, hc.cfg.HCaptchaAPI, params, token, ip); err != nil {
+		return fmt.Errorf("hcaptcha: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// runCommand runs the CLI subcommand named by args, if any, and exits.
+// With no subcommand it returns so main can start the server.
+func runCommand(args []string) {
+	if len(args) == 0 {
+		return
+	}
+	switch args[0] {
+	case "corpus":
+		os.Exit(corpusCommand(args[1:], os.Stdout, os.Stderr))
+	case "init":
+		os.Exit(initCommand(args[1:], os.Stdin, os.Stdout, os.Stderr))
+	case "deploy-key":
+		os.Exit(deployKeyCommand(args[1:], os.Stdout, os.Stderr))
+	case "anonymize":
+		os.Exit(anonymizeCommand(args[1:], os.Stdout, os.Stderr))
+	case "bayes":
+		os.Exit(bayesCommand(args[1:], os.Stdin, os.Stdout, os.Stderr))
+	case "admin-token":
+		os.Exit(adminTokenCommand(args[1:], os.Stdout, os.Stderr))
+	case "demo":
+		// Sets up a throwaway site, then the server starts as usual
+		if code := demoCommand(args[1:], os.Stderr); code != 0 {
+			os.Exit(code)
+		}
+	case "help", "-h", "--help":
+		fmt.Println("usage: staticomment [init | deploy-key [-repo URL] ... | corpus <list|show|label|export> ... | bayes <stats|score|train> ... | anonymize -email ADDRESS|HASH | admin-token | demo [-port N]]")
+		fmt.Println("With no arguments, starts the server (configured by STATICOMMENT_* env vars).")
+		os.Exit(0)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q (try \"staticomment help\")\n", args[0])
+		os.Exit(2)
+	}
+}
+
+const adminTokenUsage = `usage: staticomment admin-token
+
+Print a short-lived token for the admin API, derived from
+STATICOMMENT_ADMIN_TOTP_SECRET. It's accepted until the end of the next
+STATICOMMENT_ADMIN_TOTP_PERIOD (default 300 seconds), so it lasts at least
+one period. Both must match the server's, and the clocks roughly agree.
+`
+
+func adminTokenCommand(args []string, stdout, stderr io.Writer) int {
+	if len(args) > 0 {
+		fmt.Fprint(stderr, adminTokenUsage)
+		return 2
+	}
+	secret, period, err := adminTOTPConfig()
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	if secret == "" {
+		fmt.Fprintln(stderr, "STATICOMMENT_ADMIN_TOTP_SECRET not set")
+		return 2
+	}
+	fmt.Fprintln(stdout, adminTimeToken(secret, time.Duration(period)*time.Second, time.Now()))
+	return 0
+}
+
+const corpusUsage = `usage: staticomment corpus <command> [flags]
+
+Review the spam corpus in STATICOMMENT_CORPUS_DIR (or -dir):
+
+  list [-reason R] [-unlabeled] [-n N]   summarize entries, newest last
+  show ID                                print one entry as JSON
+  label ID spam|ham|none                 label an entry for training
+  export [-labeled]                      write entries as JSON lines
+`
+
+func corpusCommand(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, corpusUsage)
+		return 2
+	}
+	fs := flag.NewFlagSet("corpus "+args[0], flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	dir := fs.String("dir", os.Getenv("STATICOMMENT_CORPUS_DIR"), "corpus directory")
+	reason := fs.String("reason", "", "only entries rejected for this reason")
+	unlabeled := fs.Bool("unlabeled", false, "only entries without a label")
+	labeled := fs.Bool("labeled", false, "only entries with a label")
+	limit := fs.Int("n", 50, "show at most the newest N entries (0 for all)")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	if *dir == "" {
+		fmt.Fprintln(stderr, "corpus directory not set (STATICOMMENT_CORPUS_DIR or -dir)")
+		return 2
+	}
+	// The CLI never prunes, so the limits don't matter here
+	corpus, err := OpenCorpus(*dir, 0, 0)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	switch args[0] {
+	case "list", "export":
+		entries, err := corpus.List()
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		var selected []CorpusEntry
+		for _, e := range entries {
+			if (*reason != "" && e.Reason != *reason) || (*unlabeled && e.Label != "") || (*labeled && e.Label == "") {
+				continue
+			}
+			selected = append(selected, e)
+		}
+		if args[0] == "export" {
+			enc := json.NewEncoder(stdout)
+			for _, e := range selected {
+				enc.Encode(e)
+			}
+			return 0
+		}
+		if *limit > 0 && len(selected) > *limit {
+			selected = selected[len(selected)-*limit:]
+		}
+		for _, e := range selected {
+			label := e.Label
+			if label == "" {
+				label = "-"
+			}
+			body := strings.Join(strings.Fields(e.Body), " ")
+			if len(body) > 60 {
+				body = body[:57] + "..."
+			}
+			fmt.Fprintf(stdout, "%s  %s  %-16s %-4s  %s\n", e.ID, e.Time.Format(time.DateTime), e.Reason, label, body)
+		}
+		return 0
+
+	case "show":
+		if fs.NArg() != 1 {
+			fmt.Fprint(stderr, corpusUsage)
+			return 2
+		}
+		entry, err := corpus.Get(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(entry)
+		return 0
+
+	case "label":
+		if fs.NArg() != 2 {
+			fmt.Fprint(stderr, corpusUsage)
+			return 2
+		}
+		label := fs.Arg(1)
+		if label == "none" {
+			label = ""
+		}
+		if err := corpus.Label(fs.Arg(0), label); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		return 0
+
+	default:
+		fmt.Fprint(stderr, corpusUsage)
+		return 2
+	}
+}
+
+const bayesUsage = `usage: staticomment bayes <command> [args]
+
+Inspect and train the spam classifier, run with the server's STATICOMMENT_*
+settings:
+
+  stats                        show how much it has been trained
+  score [FILE]                 print the spam probability of FILE's text
+                               (or standard input's)
+  train spam|ham|none FILE...  mark each file's text as spam or ham, or
+                               forget it
+  train -corpus                train on the spam corpus's labeled entries,
+                               and forget entries whose label was cleared
+
+With STATICOMMENT_BAYES_IN_REPO=1, training is committed and pushed from a
+fresh clone in a temporary directory; otherwise the model file is written in
+place. The server picks up the change either way.
+`
+
+func bayesCommand(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, bayesUsage)
+		return 2
+	}
+	fs := flag.NewFlagSet("bayes "+args[0], flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { fmt.Fprint(stderr, bayesUsage) }
+	fromCorpus := fs.Bool("corpus", false, "train on the spam corpus")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+	cfg, err := LoadConfig()
+	if err != nil {
+		fmt.Fprintf(stderr, "config error: %v\n", err)
+		return 2
+	}
+	// Reading goes by the server's clone, if that's where the model is
+	path := cfg.BayesPath
+	if cfg.BayesInRepo {
+		path = filepath.Join(cfg.RepoDir, cfg.BayesPath)
+	}
+
+	switch args[0] {
+	case "stats":
+		stats, err := NewBayes(cfg, path).Stats()
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(stats)
+		return 0
+
+	case "score":
+		var data []byte
+		switch fs.NArg() {
+		case 0:
+			data, err = io.ReadAll(stdin)
+		case 1:
+			data, err = os.ReadFile(fs.Arg(0))
+		default:
+			fs.Usage()
+			return 2
+		}
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		p, ok, err := NewBayes(cfg, path).Score(string(data))
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		if !ok {
+			fmt.Fprintf(stderr, "not scoring yet: needs %d examples each of spam and ham\n", cfg.BayesMinTraining)
+			return 1
+		}
+		fmt.Fprintf(stdout, "%.4f\n", p)
+		return 0
+
+	case "train":
+		examples := map[string][]BayesExample{}
+		if *fromCorpus {
+			if fs.NArg() > 0 || cfg.CorpusDir == "" {
+				fmt.Fprintln(stderr, "train -corpus takes no arguments and needs STATICOMMENT_CORPUS_DIR")
+				return 2
+			}
+			corpus, err := OpenCorpus(cfg.CorpusDir, 0, 0)
+			if err != nil {
+				fmt.Fprintln(stderr, err)
+				return 1
+			}
+			entries, err := corpus.List()
+			if err != nil {
+				fmt.Fprintln(stderr, err)
+				return 1
+			}
+			for _, e := range entries {
+				// Unlabeled entries are forgotten, in case they were labeled before
+				examples[e.Label] = append(examples[e.Label], BayesExample{Key: "corpus:" + e.ID, Text: e.Body})
+			}
+		} else {
+			if fs.NArg() < 2 {
+				fs.Usage()
+				return 2
+			}
+			label := fs.Arg(0)
+			if label == "none" {
+				label = ""
+			} else if label != LabelSpam && label != LabelHam {
+				fs.Usage()
+				return 2
+			}
+			for _, name := range fs.Args()[1:] {
+				data, err := os.ReadFile(name)
+				if err != nil {
+					fmt.Fprintln(stderr, err)
+					return 1
+				}
+				sum := sha256.Sum256(data)
+				examples[label] = append(examples[label], BayesExample{Key: "file:" + hex.EncodeToString(sum[:8]), Text: string(data)})
+			}
+		}
+		return bayesTrain(cfg, examples, stderr)
+
+	default:
+		fs.Usage()
+		return 2
+	}
+}
+
+// bayesTrain trains the model on examples by label, in a fresh clone of the
+// repo if that's where the model is.
+func bayesTrain(cfg *Config, examples map[string][]BayesExample, stderr io.Writer) int {
+	var repo Repo
+	if cfg.BayesInRepo {
+		if cfg.SSHKey != nil && cfg.Backend == BackendGit {
+			if err := writeSSHKey(cfg); err != nil {
+				fmt.Fprintf(stderr, "ssh key error: %v\n", err)
+				return 1
+			}
+		}
+		dir, err := os.MkdirTemp("", "staticomment-bayes-")
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		defer os.RemoveAll(dir)
+		cfg.RepoDir = dir
+		repo = openRepo(cfg)
+		if err := repo.Clone(); err != nil {
+			fmt.Fprintf(stderr, "git clone failed: %v\n", err)
+			return 1
+		}
+	}
+	bayes := NewBayes(cfg, bayesPath(cfg, repo))
+	var summary []string
+	for _, label := range []string{LabelSpam, LabelHam, ""} {
+		if len(examples[label]) == 0 {
+			continue
+		}
+		n, err := bayes.Train(examples[label], label)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		if n > 0 {
+			summary = append(summary, fmt.Sprintf("%d %s", n, bayesVerb(label)))
+		}
+	}
+	if len(summary) == 0 {
+		fmt.Fprintln(stderr, "nothing to change")
+		return 0
+	}
+	if repo != nil {
+		msg := "Train spam filter\n\n" + strings.Join(summary, ", ")
+		if err := repo.CommitAndPush(Author{}, msg, cfg.BayesPath); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+	}
+	fmt.Fprintf(stderr, "trained: %s\n", strings.Join(summary, ", "))
+	return 0
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Near-duplicate detection compares bodies as sets of word shingles.
+// Candidate pairs are found with MinHash and locality-sensitive hashing, so
+// the report doesn't compare every pair of comments, and then confirmed by
+// their exact Jaccard similarity.
+const (
+	shingleWords  = 3
+	minhashHashes = 64
+	lshBands      = 16
+	lshRows       = minhashHashes / lshBands
+)
+
+// minhashSeeds perturb the shingle hashes into minhashHashes independent
+// hash functions.
+var minhashSeeds = func() [minhashHashes]uint64 {
+	var seeds [minhashHashes]uint64
+	for i := range seeds {
+		seeds[i] = mix64(uint64(i) + 1)
+	}
+	return seeds
+}()
+
+// mix64 is the SplitMix64 finalizer.
+func mix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// shingles returns the hashes of body's runs of shingleWords consecutive
+// words, ignoring case and punctuation. A body shorter than that is a
+// single shingle.
+func shingles(body string) map[uint64]bool {
+	words := strings.FieldsFunc(strings.ToLower(body), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	set := make(map[uint64]bool)
+	hash := func(ws []string) {
+		h := fnv.New64a()
+		h.Write([]byte(strings.Join(ws, " ")))
+		set[h.Sum64()] = true
+	}
+	if len(words) > 0 && len(words) < shingleWords {
+		hash(words)
+	}
+	for i := 0; i+shingleWords <= len(words); i++ {
+		hash(words[i : i+shingleWords])
+	}
+	return set
+}
+
+func minhash(set map[uint64]bool) [minhashHashes]uint64 {
+	var sig [minhashHashes]uint64
+	for i := range sig {
+		sig[i] = ^uint64(0)
+	}
+	for s := range set {
+		for i, seed := range minhashSeeds {
+			if h := mix64(s ^ seed); h < sig[i] {
+				sig[i] = h
+			}
+		}
+	}
+	return sig
+}
+
+func jaccard(a, b map[uint64]bool) float64 {
+	shared := 0
+	for s := range a {
+		if b[s] {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(a)+len(b)-shared)
+}
+
+// CommentCluster is a group of comments with near-identical bodies. Its ID
+// is derived from its members, so it changes if they do.
+type CommentCluster struct {
+	ID       string           `json:"id"`
+	Size     int              `json:"size"`
+	Slugs    []string         `json:"slugs"`
+	Sample   string           `json:"sample"`
+	Comments []CommentSummary `json:"comments"`
+}
+
+// CommentSummary identifies a stored comment in admin API responses.
+type CommentSummary struct {
+	Path        string `json:"path"`
+	Slug        string `json:"slug"`
+	Name        string `json:"name"`
+	Date        string `json:"date"`
+	Quarantined bool   `json:"quarantined,omitempty"`
+}
+
+// clusterComments groups comments whose bodies have a Jaccard similarity of
+// at least threshold, directly or through other members, and returns the
+// groups of minSize or more, largest and most widespread first.
+func clusterComments(comments []StoredComment, threshold float64, minSize int) []CommentCluster {
+	sets := make([]map[uint64]bool, len(comments))
+	parent := make([]int, len(comments))
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	buckets := make(map[[lshRows + 1]uint64][]int)
+	for i, c := range comments {
+		parent[i] = i
+		sets[i] = shingles(c.Body)
+		if len(sets[i]) == 0 {
+			continue
+		}
+		sig := minhash(sets[i])
+		for b := 0; b < lshBands; b++ {
+			var key [lshRows + 1]uint64
+			key[0] = uint64(b)
+			copy(key[1:], sig[b*lshRows:(b+1)*lshRows])
+			for _, j := range buckets[key] {
+				if find(i) != find(j) && jaccard(sets[i], sets[j]) >= threshold {
+					parent[find(i)] = find(j)
+				}
+			}
+			buckets[key] = append(buckets[key], i)
+		}
+	}
+
+	groups := make(map[int][]int)
+	for i := range comments {
+		groups[find(i)] = append(groups[find(i)], i)
+	}
+	var clusters []CommentCluster
+	for _, members := range groups {
+		if len(members) < minSize {
+			continue
+		}
+		cluster := CommentCluster{Size: len(members), Sample: truncateRunes(comments[members[0]].Body, 200)}
+		slugs := make(map[string]bool)
+		id := sha256.New()
+		for _, i := range members {
+			c := comments[i]
+			cluster.Comments = append(cluster.Comments, CommentSummary{Path: c.Path, Slug: c.Slug, Name: c.Name, Date: c.Date, Quarantined: c.Quarantined})
+			if !slugs[c.Slug] {
+				slugs[c.Slug] = true
+				cluster.Slugs = append(cluster.Slugs, c.Slug)
+			}
+			id.Write([]byte(c.Path + "\n"))
+		}
+		sort.Strings(cluster.Slugs)
+		cluster.ID = hex.EncodeToString(id.Sum(nil))[:16]
+		clusters = append(clusters, cluster)
+	}
+	sort.Slice(clusters, func(i, j int) bool {
+		if clusters[i].Size != clusters[j].Size {
+			return clusters[i].Size > clusters[j].Size
+		}
+		if len(clusters[i].Slugs) != len(clusters[j].Slugs) {
+			return len(clusters[i].Slugs) > len(clusters[j].Slugs)
+		}
+		return clusters[i].ID < clusters[j].ID
+	})
+	return clusters
+}
+
+func truncateRunes(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n]) + "…"
+	}
+	return s
+}
+
+// ClusterReport serves the admin API's similarity report, which surfaces
+// campaigns posting the same text across many posts, and the rejection of
+// a whole cluster at once.
+type ClusterReport struct {
+	publisher *Publisher
+}
+
+func NewClusterReport(publisher *Publisher) *ClusterReport {
+	return &ClusterReport{publisher: publisher}
+}
+
+// clusters builds the report for the request's days, threshold and
+// min_size parameters.
+func (cr *ClusterReport) clusters(r *http.Request) ([]CommentCluster, error) {
+	q := r.URL.Query()
+	days, err := strconv.Atoi(cmp.Or(q.Get("days"), "7"))
+	if err != nil || days <= 0 {
+		return nil, fmt.Errorf("days must be a positive integer")
+	}
+	threshold, err := strconv.ParseFloat(cmp.Or(q.Get("threshold"), "0.6"), 64)
+	if err != nil || threshold <= 0 || threshold > 1 {
+		return nil, fmt.Errorf("threshold must be between 0 and 1")
+	}
+	minSize, err := strconv.Atoi(cmp.Or(q.Get("min_size"), "3"))
+	if err != nil || minSize < 2 {
+		return nil, fmt.Errorf("min_size must be at least 2")
+	}
+	comments, err := cr.publisher.StoredComments(time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		return nil, err
+	}
+	return clusterComments(comments, threshold, minSize), nil
+}
+
+// ServeReport handles GET /admin/reports/clusters.
+func (cr *ClusterReport) ServeReport(w http.ResponseWriter, r *http.Request) {
+	clusters, err := cr.clusters(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if clusters == nil {
+		clusters = []CommentCluster{}
+	}
+	writeJSON(w, clusters)
+}
+
+// ServeReject handles POST /admin/reports/clusters/{id}/reject, deleting
+// every comment in the cluster in one commit. It takes the report's
+// parameters and rebuilds it, so a cluster that has changed since the
+// report was fetched isn't rejected.
+func (cr *ClusterReport) ServeReject(w http.ResponseWriter, r *http.Request) {
+	clusters, err := cr.clusters(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, cluster := range clusters {
+		if cluster.ID != r.PathValue("id") {
+			continue
+		}
+		paths := make([]string, len(cluster.Comments))
+		for i, c := range cluster.Comments {
+			paths[i] = c.Path
+		}
+		msg := fmt.Sprintf("Reject %d similar comments\n\nSpam cluster %s on: %s", cluster.Size, cluster.ID, strings.Join(cluster.Slugs, ", "))
+		removed, err := cr.publisher.Remove(paths, msg)
+		if err != nil {
+			log.Printf("rejecting cluster %s: %v", cluster.ID, err)
+			http.Error(w, "Failed to reject cluster", http.StatusInternalServerError)
+			return
+		}
+		cr.publisher.ReportSpam(true, paths...)
+		writeJSON(w, map[string]int{"rejected": removed})
+		return
+	}
+	http.Error(w, "Cluster not found; it may have changed since the report was fetched", http.StatusConflict)
+}
@@ -1,43 +1,409 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"net"
 	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
 )
 
 type Config struct {
+	Backend        string
 	GitRepo        string
 	Branch         string
 	CommentsPath   string
+	QuarantinePath string
 	PostsPath      string
+	PostsRepo      string // set when posts are read from a separate clone
+	PostsBranch    string
+	SlugMapping    *SlugMapping // nil when slugs only come from the form
+	IndexPath      string
+	OutboxDir      string
+	OutboxLease    int
+	AsyncPublish   bool
+	OutboxRetry    int
+	PushRetries    int
+	PushBackoff    int // seconds
+	PushMaxBackoff int // seconds
+	StatePath      string
+	StateKey       []byte
+	SQLitePath     string
+	RedisURL       string
+	RedisPrefix    string
+
+	CloneRetry        bool
+	CloneRetryTimeout int // seconds; 0 retries forever
+
+	BatchInterval int // seconds; 0 commits each comment on its own
+	BatchMax      int
+	// Comments per BatchThresholdWindow from which they're batched; 0
+	// always batches
+	BatchThreshold       int
+	BatchThresholdWindow int // seconds
+
+	// Further origins verified by a TXT record naming DNSOriginToken
+	DNSOriginToken    string
+	DNSOriginCacheTTL int // seconds
+
+	FormSecret     string
+	ClientHashKey  []byte
+	FormTokenTTL   int
+	NonceCacheSize int
 	Port           string
 	AllowedOrigins []string
-	SSHKeyPath     string
+	SSHKeyPaths    []string
+	SSHKey         []byte
+	Local          bool
+	DataDir        string
+	SSHDir         string
+	KnownHostsPath string
+	RepoDir        string
+	FileMode       os.FileMode
+	DirMode        os.FileMode
+	FileUID        int // -1 leaves the owner as is
+	FileGID        int
 	SSHInsecure    bool
+	HostKeyPins    []string
+	GitCLI         bool
+	GitBare        bool
+	GitTimeout     int // seconds; 0 waits forever
+	Conflicts      string
+	CloneDepth     int
+	CloneFilter    string
+	SparseCheckout bool
+	GitName        string
+	GitEmail       string
+	GitToken       string
+	GitUsername    string
+	GitMirrors     []string
+
+	PowEnabled   bool
+	PowKey       []byte
+	PowMaxNumber int
+	PowTTL       int // seconds
+
+	IdempotencyWindow int // seconds; 0 ignores idempotency keys
+
+	IPAllowlist IPList // if set, only these may submit
+	IPDenylist  IPList
+
+	// Peers whose forwarding headers are believed about the client's address
+	TrustedProxies IPList
+
+	CanaryInterval int // seconds; 0 disables the self-test
+	CanarySlug     string
+
+	CommentIDFormat string
+	CommentIDNode   int       // snowflake node; -1 derives it from the hostname
+	FixedTime       time.Time // zero for the real time
+
+	SigningKey        string
+	SigningFormat     string
+	SigningPassphrase string
+
+	PreviewMode   bool
+	PreviewBranch string
+
+	// Set by a tenant host for the instances it runs (see TenantHost)
+	Tenant       string
+	TenantSecret string
+
+	Moderation       bool
+	ModerationPrefix string
+	PRAPI            string
+	PRRepo           string
+	PRToken          string
+	PRProvider       string
+	PRLabels         []string
+
+	CommitAsCommenter bool
+
+	IssueModeration bool
+	WebhookSecret   string
+
+	// Settings for the github and gitea backends
+	ContentsAPI   string
+	ContentsRepo  string
+	ContentsToken string
+
+	// A GitHub App whose installation tokens stand in for the tokens above
+	GitHubApp *GitHubApp
+
+	HoneypotField      string
+	HoneypotAction     string
+	TarpitReasons      []string
+	TarpitDuration     int
+	TarpitMax          int
+	RateLimitWindow    int
+	RateLimitMax       int
+	RateLimitAlgorithm string
+	RateLimitBurst     int
+	RateLimitPostIPMax int
+	RateLimitPostMax   int
+	RateLimitGlobalMax int
+	MaxInFlight        int
+	MaxLinks           int
+	BlockedPatterns    []*regexp.Regexp
+	Content            *ContentPolicy
+	MinSubmitTime      int
+	ClockSkew          int
+
+	Rules           *Ruleset
+	ScoreQuarantine int
+	ScoreReject     int
 
-	HoneypotField   string
-	RateLimitWindow int
-	RateLimitMax    int
-	MaxLinks        int
-	BlockedPatterns []*regexp.Regexp
-	MinSubmitTime   int
+	Reputation          bool
+	ReputationWeight    int
+	ReputationASNWeight int
+	ReputationHalfLife  int
+	ASNDB               string
+
+	AkismetKey    string
+	AkismetBlog   string
+	AkismetAction string
+	AkismetAPI    string
+
+	RecaptchaSecret   string
+	RecaptchaMinScore float64
+	RecaptchaAction   string
+	RecaptchaAPI      string
+
+	HCaptchaSecret  string
+	HCaptchaSiteKey string
+	HCaptchaAPI     string
+
+	StopForumSpam          bool
+	StopForumSpamThreshold float64
+	StopForumSpamAction    string
+	StopForumSpamCacheTTL  int // seconds
+	StopForumSpamAPI       string
+
+	Bayes            bool
+	BayesInRepo      bool
+	BayesPath        string // repo-relative with BayesInRepo
+	BayesThreshold   float64
+	BayesAction      string
+	BayesMinTraining int
+
+	Languages      []string // primary subtags; empty allows any
+	LanguageAction string
+
+	DNSBLZones    []DNSBLZone
+	DNSBLAction   string
+	DNSBLTimeout  int // seconds
+	DNSBLResolver string
+
+	MaxReplyDepth  int
+	FlattenReplies bool
+	ReplyExcerpt   int // characters of the parent quoted in replies; 0 for none
+
+	BodyHTML     bool
+	Autolink     bool
+	ImagePolicy  string
+	ImageProxy   string
+	ImageDomains []string
+	EmbedDomains []string
+
+	Widget        bool
+	TemplatesPath string
+	FieldIDPrefix string
+
+	MetricsEnabled bool
+	AuditLog       bool
+
+	CorpusDir       string
+	CorpusMax       int
+	CorpusRetention int
+
+	AnalyticsURL  string
+	AnalyticsFile string
+
+	PostPushCmd     string
+	PostPushTimeout int // seconds
+
+	NotifyEmails  []string
+	SMTPHost      string
+	SMTPPort      int
+	SMTPUser      string
+	SMTPPassword  string
+	SMTPFrom      string
+	NotifyWebhook string
+	NotifyRetries int
+
+	AdminToken            string
+	AdminTOTPSecret       string
+	AdminTOTPPeriod       int
+	AdminUsers            []*AdminUser
+	AdminOIDCIssuer       string
+	AdminOIDCAudience     string
+	AdminOIDCRedirectURL  string
+	AdminOIDCClientSecret string
+	AdminSessionSecret    string
+	AdminSessionTTL       int
+	SyncToken             string
+	PullInterval          int
+	Maintenance           bool
+	MaintenanceMessage    string
+
+	SecurityContacts []string
+	SecurityPolicy   string
+	SecurityTxt      []byte
+	RobotsTxt        []byte
+
+	ReplySecret       string
+	InboundSigningKey string
+	OwnerEmails       []string
+	OwnerName         string
 }
 
 func LoadConfig() (*Config, error) {
 	cfg := &Config{
-		Branch:       envOrDefault("STATICOMMENT_BRANCH", "main"),
-		CommentsPath: envOrDefault("STATICOMMENT_COMMENTS_PATH", "_data/comments"),
-		PostsPath:    os.Getenv("STATICOMMENT_POSTS_PATH"),
-		Port:         envOrDefault("STATICOMMENT_PORT", "8080"),
-		SSHKeyPath:   envOrDefault("STATICOMMENT_SSH_KEY_PATH", "/app/.ssh/id_ed25519"),
+		Branch:         envOrDefault("STATICOMMENT_BRANCH", "main"),
+		CommentsPath:   envOrDefault("STATICOMMENT_COMMENTS_PATH", "_data/comments"),
+		QuarantinePath: envOrDefault("STATICOMMENT_QUARANTINE_PATH", "_data/quarantine"),
+		PostsPath:      os.Getenv("STATICOMMENT_POSTS_PATH"),
+		Port:           envOrDefault("STATICOMMENT_PORT", "8080"),
+		Local:          os.Getenv("STATICOMMENT_LOCAL") == "1",
+	}
+	// The clone and SSH files go under one directory unless placed
+	// separately; local mode uses the user's own SSH setup, as git would
+	dataDir, err := filepath.Abs(envOrDefault("STATICOMMENT_DATA_DIR", defaultDataDir(cfg.Local)))
+	if err != nil {
+		return nil, fmt.Errorf("STATICOMMENT_DATA_DIR: %w", err)
+	}
+	cfg.DataDir = dataDir
+	defaultSSHDir, defaultKeys := filepath.Join(cfg.DataDir, ".ssh"), []string{"id_ed25519"}
+	if home, err := os.UserHomeDir(); err == nil && cfg.Local {
+		defaultSSHDir, defaultKeys = filepath.Join(home, ".ssh"), []string{"id_ed25519", "id_ecdsa", "id_rsa"}
+	}
+	cfg.SSHDir = envOrDefault("STATICOMMENT_SSH_DIR", defaultSSHDir)
+	cfg.RepoDir = envOrDefault("STATICOMMENT_REPO_DIR", filepath.Join(cfg.DataDir, "repo"))
+	for i, k := range defaultKeys {
+		defaultKeys[i] = filepath.Join(cfg.SSHDir, k)
+	}
+	// Several keys are tried in turn, so a deploy key can be rotated by
+	// listing the new one before the old one is removed
+	for _, p := range strings.Split(envOrDefault("STATICOMMENT_SSH_KEY_PATH", strings.Join(defaultKeys, ",")), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			cfg.SSHKeyPaths = append(cfg.SSHKeyPaths, p)
+		}
+	}
+	cfg.KnownHostsPath = filepath.Join(cfg.SSHDir, "known_hosts")
+
+	// Platforms without secret files can pass the deploy key itself; it's
+	// written to a private file at startup by writeSSHKey
+	sshKey := os.Getenv("STATICOMMENT_SSH_KEY")
+	if encoded := os.Getenv("STATICOMMENT_SSH_KEY_BASE64"); encoded != "" {
+		if sshKey != "" {
+			return nil, fmt.Errorf("set STATICOMMENT_SSH_KEY or STATICOMMENT_SSH_KEY_BASE64, not both")
+		}
+		data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(encoded), ""))
+		if err != nil {
+			return nil, fmt.Errorf("STATICOMMENT_SSH_KEY_BASE64 must be base64")
+		}
+		sshKey = string(data)
+	}
+	if sshKey != "" {
+		if os.Getenv("STATICOMMENT_SSH_KEY_PATH") != "" {
+			return nil, fmt.Errorf("STATICOMMENT_SSH_KEY can't be combined with STATICOMMENT_SSH_KEY_PATH")
+		}
+		// Some dashboards only take one line, so the line breaks may come
+		// escaped; and ssh refuses a key without the final one
+		if !strings.Contains(sshKey, "\n") {
+			sshKey = strings.ReplaceAll(sshKey, `\n`, "\n")
+		}
+		if !strings.HasSuffix(sshKey, "\n") {
+			sshKey += "\n"
+		}
+		if _, err := ssh.ParseRawPrivateKey([]byte(sshKey)); err != nil {
+			return nil, fmt.Errorf("STATICOMMENT_SSH_KEY: %w", err)
+		}
+		cfg.SSHKey = []byte(sshKey)
+	}
+
+	// The clone is worked on from other directories, so it needs an absolute
+	// path. It's wiped and refilled by the API backends, so it mustn't be /
+	repoDir, err := filepath.Abs(cfg.RepoDir)
+	if err != nil || repoDir == filepath.Dir(repoDir) {
+		return nil, fmt.Errorf("STATICOMMENT_REPO_DIR must be a directory below the root")
+	}
+	cfg.RepoDir = repoDir
+
+	// Modes and owner for the files and directories written to the clone,
+	// for volumes the server doesn't share a user with
+	if cfg.FileMode, err = envFileMode("STATICOMMENT_FILE_MODE", 0644, 0600); err != nil {
+		return nil, err
+	}
+	if cfg.DirMode, err = envFileMode("STATICOMMENT_DIR_MODE", 0755, 0700); err != nil {
+		return nil, err
+	}
+	cfg.FileUID, cfg.FileGID = -1, -1
+	if owner := os.Getenv("STATICOMMENT_FILE_OWNER"); owner != "" {
+		uid, gid, hasGID := strings.Cut(owner, ":")
+		if cfg.FileUID, err = strconv.Atoi(uid); err != nil || cfg.FileUID < 0 {
+			return nil, fmt.Errorf("STATICOMMENT_FILE_OWNER must be a numeric uid or uid:gid")
+		}
+		if hasGID {
+			if cfg.FileGID, err = strconv.Atoi(gid); err != nil || cfg.FileGID < 0 {
+				return nil, fmt.Errorf("STATICOMMENT_FILE_OWNER must be a numeric uid or uid:gid")
+			}
+		}
+		if os.Geteuid() != 0 {
+			return nil, fmt.Errorf("STATICOMMENT_FILE_OWNER requires running as root")
+		}
 	}
 
 	cfg.SSHInsecure = os.Getenv("STATICOMMENT_SSH_INSECURE") == "1"
+	if v := os.Getenv("STATICOMMENT_SSH_HOST_FINGERPRINTS"); v != "" {
+		for _, fp := range strings.Split(v, ",") {
+			fp = strings.TrimRight(strings.TrimSpace(fp), "=")
+			if fp == "" {
+				continue
+			}
+			// Accept fingerprints with or without ssh-keygen's prefix
+			if !strings.HasPrefix(fp, "SHA256:") {
+				fp = "SHA256:" + fp
+			}
+			cfg.HostKeyPins = append(cfg.HostKeyPins, fp)
+		}
+	}
+
+	// Preview mode commits to a local-only branch and never pushes
+	cfg.PreviewMode = os.Getenv("STATICOMMENT_PREVIEW") == "1"
+	cfg.PreviewBranch = envOrDefault("STATICOMMENT_PREVIEW_BRANCH", "staticomment-preview")
+	if cfg.PreviewMode && cfg.PreviewBranch == cfg.Branch {
+		return nil, fmt.Errorf("STATICOMMENT_PREVIEW_BRANCH must differ from STATICOMMENT_BRANCH")
+	}
+
+	// A tenant host runs this instance for one of its tenants
+	cfg.Tenant = os.Getenv("STATICOMMENT_TENANT")
+	cfg.TenantSecret = os.Getenv("STATICOMMENT_TENANT_SECRET")
+	if cfg.Tenant != "" && cfg.TenantSecret == "" {
+		return nil, fmt.Errorf("STATICOMMENT_TENANT requires STATICOMMENT_TENANT_SECRET")
+	}
+
+	// Moderation pushes each comment to its own branch for review
+	cfg.Moderation = os.Getenv("STATICOMMENT_MODERATION") == "1"
+	cfg.ModerationPrefix = envOrDefault("STATICOMMENT_MODERATION_PREFIX", "staticomment/")
+	cfg.PRAPI = envOrDefault("STATICOMMENT_PR_API", "https://api.github.com")
+	cfg.PRRepo = os.Getenv("STATICOMMENT_PR_REPO")
+	cfg.PRToken = os.Getenv("STATICOMMENT_PR_TOKEN")
+	cfg.PRProvider = envOrDefault("STATICOMMENT_PR_PROVIDER", ProviderGitHub)
+	for _, l := range strings.Split(os.Getenv("STATICOMMENT_PR_LABELS"), ",") {
+		if l = strings.TrimSpace(l); l != "" {
+			cfg.PRLabels = append(cfg.PRLabels, l)
+		}
+	}
 
 	// Validate CommentsPath is relative and clean
 	if filepath.IsAbs(cfg.CommentsPath) {
@@ -48,6 +414,32 @@ func LoadConfig() (*Config, error) {
 		return nil, fmt.Errorf("STATICOMMENT_COMMENTS_PATH must not escape the repo directory")
 	}
 
+	// Validate QuarantinePath is relative, clean, and separate from CommentsPath
+	if filepath.IsAbs(cfg.QuarantinePath) {
+		return nil, fmt.Errorf("STATICOMMENT_QUARANTINE_PATH must be a relative path")
+	}
+	cfg.QuarantinePath = filepath.Clean(cfg.QuarantinePath)
+	if strings.HasPrefix(cfg.QuarantinePath, "..") {
+		return nil, fmt.Errorf("STATICOMMENT_QUARANTINE_PATH must not escape the repo directory")
+	}
+	if cfg.QuarantinePath == cfg.CommentsPath {
+		return nil, fmt.Errorf("STATICOMMENT_QUARANTINE_PATH must differ from STATICOMMENT_COMMENTS_PATH")
+	}
+
+	// Validate IndexPath if set (empty disables the per-slug index)
+	if cfg.IndexPath = os.Getenv("STATICOMMENT_INDEX_PATH"); cfg.IndexPath != "" {
+		if filepath.IsAbs(cfg.IndexPath) {
+			return nil, fmt.Errorf("STATICOMMENT_INDEX_PATH must be a relative path")
+		}
+		cfg.IndexPath = filepath.Clean(cfg.IndexPath)
+		if strings.HasPrefix(cfg.IndexPath, "..") {
+			return nil, fmt.Errorf("STATICOMMENT_INDEX_PATH must not escape the repo directory")
+		}
+		if cfg.IndexPath == cfg.CommentsPath {
+			return nil, fmt.Errorf("STATICOMMENT_INDEX_PATH must differ from STATICOMMENT_COMMENTS_PATH")
+		}
+	}
+
 	// Validate PostsPath if set (empty disables post validation)
 	if cfg.PostsPath != "" {
 		if filepath.IsAbs(cfg.PostsPath) {
@@ -59,9 +451,340 @@ func LoadConfig() (*Config, error) {
 		}
 	}
 
+	// Sites whose forms don't carry a slug have it taken from the page URL
+	if os.Getenv("STATICOMMENT_SLUG_FROM_URL") == "1" {
+		if cfg.SlugMapping, err = LoadSlugMapping(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Optional embedded database for rate limits and subscriptions
+	cfg.SQLitePath = os.Getenv("STATICOMMENT_SQLITE_PATH")
+
+	// Redis for rate limits and nonces shared by replicas
+	cfg.RedisURL = os.Getenv("STATICOMMENT_REDIS_URL")
+	cfg.RedisPrefix = envOrDefault("STATICOMMENT_REDIS_PREFIX", "staticomment:")
+	if cfg.RedisURL != "" {
+		if _, err := NewRedisClient(cfg.RedisURL); err != nil {
+			return nil, fmt.Errorf("STATICOMMENT_REDIS_URL %w", err)
+		}
+	}
+
+	// Outbox for durable publishing; may live on storage shared by instances
+	cfg.OutboxDir = os.Getenv("STATICOMMENT_OUTBOX_DIR")
+	outboxLease, err := strconv.Atoi(envOrDefault("STATICOMMENT_OUTBOX_LEASE", "600"))
+	if err != nil || outboxLease <= 0 {
+		return nil, fmt.Errorf("STATICOMMENT_OUTBOX_LEASE must be a positive integer")
+	}
+	cfg.OutboxLease = outboxLease
+
+	// Asynchronous publishing answers once a comment is in the outbox and
+	// leaves the git work to a background worker
+	cfg.AsyncPublish = os.Getenv("STATICOMMENT_ASYNC_PUBLISH") == "1"
+	if cfg.AsyncPublish && cfg.OutboxDir == "" {
+		return nil, fmt.Errorf("STATICOMMENT_ASYNC_PUBLISH requires STATICOMMENT_OUTBOX_DIR")
+	}
+	outboxRetry, err := strconv.Atoi(envOrDefault("STATICOMMENT_OUTBOX_RETRY", "60"))
+	if err != nil || outboxRetry <= 0 {
+		return nil, fmt.Errorf("STATICOMMENT_OUTBOX_RETRY must be a positive integer")
+	}
+	cfg.OutboxRetry = outboxRetry
+
+	// Pushes are retried with exponential backoff, first while the request
+	// waits and then in the background
+	pushRetries, err := strconv.Atoi(envOrDefault("STATICOMMENT_PUSH_RETRIES", "3"))
+	if err != nil || pushRetries <= 0 {
+		return nil, fmt.Errorf("STATICOMMENT_PUSH_RETRIES must be a positive integer")
+	}
+	cfg.PushRetries = pushRetries
+	pushBackoff, err := strconv.Atoi(envOrDefault("STATICOMMENT_PUSH_BACKOFF", "1"))
+	if err != nil || pushBackoff <= 0 {
+		return nil, fmt.Errorf("STATICOMMENT_PUSH_BACKOFF must be a positive integer")
+	}
+	cfg.PushBackoff = pushBackoff
+	pushMaxBackoff, err := strconv.Atoi(envOrDefault("STATICOMMENT_PUSH_MAX_BACKOFF", "300"))
+	if err != nil || pushMaxBackoff < pushBackoff {
+		return nil, fmt.Errorf("STATICOMMENT_PUSH_MAX_BACKOFF must be an integer no less than STATICOMMENT_PUSH_BACKOFF")
+	}
+	cfg.PushMaxBackoff = pushMaxBackoff
+
+	// Retrying the initial clone keeps a git host outage during a deploy
+	// from crash-looping the container
+	cfg.CloneRetry = os.Getenv("STATICOMMENT_CLONE_RETRY") == "1"
+	cloneRetryTimeout, err := strconv.Atoi(envOrDefault("STATICOMMENT_CLONE_RETRY_TIMEOUT", "600"))
+	if err != nil || cloneRetryTimeout < 0 {
+		return nil, fmt.Errorf("STATICOMMENT_CLONE_RETRY_TIMEOUT must be a non-negative integer")
+	}
+	cfg.CloneRetryTimeout = cloneRetryTimeout
+
+	// Comments accepted within the batch interval share a commit and push
+	batchInterval, err := strconv.Atoi(envOrDefault("STATICOMMENT_BATCH_INTERVAL", "0"))
+	if err != nil || batchInterval < 0 {
+		return nil, fmt.Errorf("STATICOMMENT_BATCH_INTERVAL must be a non-negative integer")
+	}
+	cfg.BatchInterval = batchInterval
+	batchMax, err := strconv.Atoi(envOrDefault("STATICOMMENT_BATCH_MAX", "50"))
+	if err != nil || batchMax <= 0 {
+		return nil, fmt.Errorf("STATICOMMENT_BATCH_MAX must be a positive integer")
+	}
+	cfg.BatchMax = batchMax
+	batchThreshold, err := strconv.Atoi(envOrDefault("STATICOMMENT_BATCH_THRESHOLD", "0"))
+	if err != nil || batchThreshold < 0 {
+		return nil, fmt.Errorf("STATICOMMENT_BATCH_THRESHOLD must be a non-negative integer")
+	}
+	if batchThreshold > 0 && batchInterval == 0 {
+		return nil, fmt.Errorf("STATICOMMENT_BATCH_THRESHOLD requires STATICOMMENT_BATCH_INTERVAL")
+	}
+	cfg.BatchThreshold = batchThreshold
+	batchThresholdWindow, err := strconv.Atoi(envOrDefault("STATICOMMENT_BATCH_THRESHOLD_WINDOW", "60"))
+	if err != nil || batchThresholdWindow <= 0 {
+		return nil, fmt.Errorf("STATICOMMENT_BATCH_THRESHOLD_WINDOW must be a positive integer")
+	}
+	cfg.BatchThresholdWindow = batchThresholdWindow
+
+	// Subscriptions and bans live in the repo; the dot directory keeps them
+	// out of the built site
+	cfg.StatePath = envOrDefault("STATICOMMENT_STATE_PATH", ".staticomment")
+	if filepath.IsAbs(cfg.StatePath) {
+		return nil, fmt.Errorf("STATICOMMENT_STATE_PATH must be a relative path")
+	}
+	cfg.StatePath = filepath.Clean(cfg.StatePath)
+	if strings.HasPrefix(cfg.StatePath, "..") {
+		return nil, fmt.Errorf("STATICOMMENT_STATE_PATH must not escape the repo directory")
+	}
+	if cfg.StatePath == cfg.CommentsPath || cfg.StatePath == cfg.QuarantinePath {
+		return nil, fmt.Errorf("STATICOMMENT_STATE_PATH must differ from the comments and quarantine paths")
+	}
+	if key := os.Getenv("STATICOMMENT_STATE_KEY"); key != "" {
+		cfg.StateKey, err = hex.DecodeString(key)
+		if err != nil || len(cfg.StateKey) != 32 {
+			return nil, fmt.Errorf("STATICOMMENT_STATE_KEY must be 64 hex characters (32 bytes)")
+		}
+	}
+
 	cfg.GitRepo = os.Getenv("STATICOMMENT_GIT_REPO")
-	if cfg.GitRepo == "" {
-		return nil, fmt.Errorf("STATICOMMENT_GIT_REPO is required")
+	cfg.Backend = envOrDefault("STATICOMMENT_BACKEND", BackendGit)
+
+	// Posts can be read from another repo, or another branch of this one,
+	// cloned alongside it
+	cfg.PostsRepo = os.Getenv("STATICOMMENT_POSTS_REPO")
+	cfg.PostsBranch = os.Getenv("STATICOMMENT_POSTS_BRANCH")
+	if cfg.PostsRepo != "" || cfg.PostsBranch != "" {
+		if cfg.PostsPath == "" {
+			return nil, fmt.Errorf("STATICOMMENT_POSTS_REPO and STATICOMMENT_POSTS_BRANCH require STATICOMMENT_POSTS_PATH")
+		}
+		if cfg.Backend != BackendGit {
+			return nil, fmt.Errorf("STATICOMMENT_POSTS_REPO and STATICOMMENT_POSTS_BRANCH require the %q backend", BackendGit)
+		}
+		if cfg.PostsBranch == "" {
+			cfg.PostsBranch = cfg.Branch
+		}
+		if cfg.PostsRepo == "" {
+			cfg.PostsRepo = cfg.GitRepo
+		}
+		if cfg.PostsRepo == cfg.GitRepo && cfg.PostsBranch == cfg.Branch {
+			// The same branch of the same repo: nothing separate to clone
+			cfg.PostsRepo, cfg.PostsBranch = "", ""
+		}
+	}
+	switch cfg.Backend {
+	case BackendGit:
+		if cfg.GitRepo == "" {
+			return nil, fmt.Errorf("STATICOMMENT_GIT_REPO is required")
+		}
+		// The clone is managed with go-git unless the git CLI is asked for
+		cfg.GitCLI = os.Getenv("STATICOMMENT_GIT_CLI") == "1"
+		gitTimeout, err := strconv.Atoi(envOrDefault("STATICOMMENT_GIT_TIMEOUT", "300"))
+		if err != nil || gitTimeout < 0 {
+			return nil, fmt.Errorf("STATICOMMENT_GIT_TIMEOUT must be a non-negative integer")
+		}
+		cfg.GitTimeout = gitTimeout
+
+		// Which side wins when a pull finds a file changed both here and
+		// upstream
+		cfg.Conflicts = envOrDefault("STATICOMMENT_CONFLICT_STRATEGY", ConflictLocal)
+		if cfg.Conflicts != ConflictLocal && cfg.Conflicts != ConflictRemote && cfg.Conflicts != ConflictFail {
+			return nil, fmt.Errorf("STATICOMMENT_CONFLICT_STRATEGY must be %q, %q or %q", ConflictLocal, ConflictRemote, ConflictFail)
+		}
+
+		// Shallow and partial clones skip history and old blobs that
+		// commenting never needs
+		cloneDepth, err := strconv.Atoi(envOrDefault("STATICOMMENT_CLONE_DEPTH", "0"))
+		if err != nil || cloneDepth < 0 {
+			return nil, fmt.Errorf("STATICOMMENT_CLONE_DEPTH must be a non-negative integer")
+		}
+		cfg.CloneDepth = cloneDepth
+		cfg.CloneFilter = os.Getenv("STATICOMMENT_CLONE_FILTER")
+		if cfg.CloneFilter != "" && cfg.CloneFilter != "blob:none" {
+			return nil, fmt.Errorf("STATICOMMENT_CLONE_FILTER must be empty or \"blob:none\"")
+		}
+		if cfg.CloneFilter != "" && !cfg.GitCLI {
+			// go-git can't do partial clones
+			return nil, fmt.Errorf("STATICOMMENT_CLONE_FILTER requires STATICOMMENT_GIT_CLI=1")
+		}
+		cfg.SparseCheckout = os.Getenv("STATICOMMENT_SPARSE_CHECKOUT") == "1"
+		if cfg.SparseCheckout && !cfg.GitCLI {
+			return nil, fmt.Errorf("STATICOMMENT_SPARSE_CHECKOUT requires STATICOMMENT_GIT_CLI=1")
+		}
+
+		// A bare clone committed to with plumbing commands, with no working
+		// tree at all
+		cfg.GitBare = os.Getenv("STATICOMMENT_GIT_BARE") == "1"
+		if cfg.GitBare && !cfg.GitCLI {
+			return nil, fmt.Errorf("STATICOMMENT_GIT_BARE requires STATICOMMENT_GIT_CLI=1")
+		}
+		if cfg.GitBare && cfg.SparseCheckout {
+			return nil, fmt.Errorf("STATICOMMENT_GIT_BARE and STATICOMMENT_SPARSE_CHECKOUT can't be combined")
+		}
+		if cfg.GitBare && cfg.PreviewMode {
+			return nil, fmt.Errorf("STATICOMMENT_PREVIEW is not supported with STATICOMMENT_GIT_BARE=1")
+		}
+
+		// HTTPS remotes authenticate with a token, handed to git by a
+		// credential helper rather than put in the URL, where it'd be logged
+		// and written to .git/config
+		cfg.GitToken = os.Getenv("STATICOMMENT_GIT_TOKEN")
+		cfg.GitUsername = envOrDefault("STATICOMMENT_GIT_USERNAME", "x-access-token")
+		if cfg.GitToken != "" && !isHTTPRemote(cfg.GitRepo) {
+			return nil, fmt.Errorf("STATICOMMENT_GIT_TOKEN requires an https:// STATICOMMENT_GIT_REPO")
+		}
+
+		// The committer identity, which signed commits must be verifiable
+		// against, and the key to sign with
+		cfg.GitName = envOrDefault("STATICOMMENT_GIT_NAME", "staticomment")
+		cfg.GitEmail = envOrDefault("STATICOMMENT_GIT_EMAIL", "staticomment@quietlife.net")
+		cfg.SigningKey = os.Getenv("STATICOMMENT_SIGNING_KEY")
+		cfg.SigningFormat = envOrDefault("STATICOMMENT_SIGNING_FORMAT", SigningSSH)
+		cfg.SigningPassphrase = os.Getenv("STATICOMMENT_SIGNING_PASSPHRASE")
+		if cfg.SigningFormat != SigningSSH && cfg.SigningFormat != SigningOpenPGP {
+			return nil, fmt.Errorf("STATICOMMENT_SIGNING_FORMAT must be %q or %q", SigningSSH, SigningOpenPGP)
+		}
+		if cfg.SigningKey != "" && cfg.GitCLI && (cfg.SigningFormat != SigningSSH || cfg.SigningPassphrase != "") {
+			// The CLI signs through ssh-keygen, which can't be given a
+			// passphrase; the image has no gpg
+			return nil, fmt.Errorf("with STATICOMMENT_GIT_CLI=1, only SSH signing keys without a passphrase are supported")
+		}
+
+		// Mirrors are pushed the branch after every push to the repo
+		for _, m := range strings.Split(os.Getenv("STATICOMMENT_GIT_MIRRORS"), ",") {
+			if m = strings.TrimSpace(m); m != "" {
+				cfg.GitMirrors = append(cfg.GitMirrors, m)
+			}
+		}
+	case BackendGitHub, BackendGitea:
+		// The API backends talk to the host's REST API only, so they need
+		// no clone, SSH key or git binary
+		prefix := "STATICOMMENT_GITHUB_"
+		defaultAPI := "https://api.github.com"
+		if cfg.Backend == BackendGitea {
+			prefix = "STATICOMMENT_GITEA_"
+			defaultAPI = ""
+			if cfg.GitRepo != "" {
+				defaultAPI = "https://" + extractHost(cfg.GitRepo) + "/api/v1"
+			}
+		}
+		cfg.ContentsAPI = strings.TrimSuffix(envOrDefault(prefix+"API", defaultAPI), "/")
+		if cfg.ContentsAPI == "" {
+			return nil, fmt.Errorf("%sAPI is required with STATICOMMENT_BACKEND=%s unless STATICOMMENT_GIT_REPO is set", prefix, cfg.Backend)
+		}
+		cfg.ContentsRepo = os.Getenv(prefix + "REPO")
+		if cfg.ContentsRepo == "" && cfg.GitRepo != "" {
+			cfg.ContentsRepo = repoPath(cfg.GitRepo)
+		}
+		if strings.Count(cfg.ContentsRepo, "/") != 1 {
+			return nil, fmt.Errorf("%sREPO must be set as owner/name", prefix)
+		}
+		cfg.ContentsToken = os.Getenv(prefix + "TOKEN")
+		if cfg.ContentsToken == "" && (cfg.Backend == BackendGitea || os.Getenv("STATICOMMENT_GITHUB_APP_ID") == "") {
+			return nil, fmt.Errorf("%sTOKEN is required with STATICOMMENT_BACKEND=%s", prefix, cfg.Backend)
+		}
+		if cfg.PreviewMode {
+			return nil, fmt.Errorf("STATICOMMENT_PREVIEW is not supported with STATICOMMENT_BACKEND=%s", cfg.Backend)
+		}
+		if os.Getenv("STATICOMMENT_GIT_MIRRORS") != "" {
+			return nil, fmt.Errorf("STATICOMMENT_GIT_MIRRORS is not supported with STATICOMMENT_BACKEND=%s", cfg.Backend)
+		}
+		// Pull requests for moderation go to the same repo by default;
+		// Gitea's pulls API accepts the same request as GitHub's
+		if os.Getenv("STATICOMMENT_PR_API") == "" {
+			cfg.PRAPI = cfg.ContentsAPI
+		}
+		if cfg.PRRepo == "" {
+			cfg.PRRepo = cfg.ContentsRepo
+		}
+		if cfg.PRToken == "" {
+			cfg.PRToken = cfg.ContentsToken
+		}
+	default:
+		return nil, fmt.Errorf("STATICOMMENT_BACKEND must be %q, %q or %q", BackendGit, BackendGitHub, BackendGitea)
+	}
+	if cfg.PRRepo == "" {
+		cfg.PRRepo = repoPath(cfg.GitRepo)
+	}
+	switch cfg.PRProvider {
+	case ProviderGitHub:
+	case ProviderGitLab:
+		// GitLab has its own merge requests API, on the git host
+		if cfg.Backend != BackendGit {
+			return nil, fmt.Errorf("STATICOMMENT_PR_PROVIDER=%s requires STATICOMMENT_BACKEND=%s", ProviderGitLab, BackendGit)
+		}
+		if os.Getenv("STATICOMMENT_PR_API") == "" {
+			cfg.PRAPI = "https://" + extractHost(cfg.GitRepo) + "/api/v4"
+		}
+	default:
+		return nil, fmt.Errorf("STATICOMMENT_PR_PROVIDER must be %q or %q", ProviderGitHub, ProviderGitLab)
+	}
+
+	// A GitHub App pushes and calls the API as its installation on the
+	// repo, with short-lived tokens minted as they're needed
+	if appID := os.Getenv("STATICOMMENT_GITHUB_APP_ID"); appID != "" {
+		keyPath := os.Getenv("STATICOMMENT_GITHUB_APP_KEY_PATH")
+		if keyPath == "" {
+			return nil, fmt.Errorf("STATICOMMENT_GITHUB_APP_ID requires STATICOMMENT_GITHUB_APP_KEY_PATH")
+		}
+		api, repo := cfg.ContentsAPI, cfg.ContentsRepo
+		switch cfg.Backend {
+		case BackendGit:
+			if !isHTTPRemote(cfg.GitRepo) {
+				return nil, fmt.Errorf("STATICOMMENT_GITHUB_APP_ID requires an https:// STATICOMMENT_GIT_REPO")
+			}
+			if cfg.GitToken != "" {
+				return nil, fmt.Errorf("set STATICOMMENT_GIT_TOKEN or STATICOMMENT_GITHUB_APP_ID, not both")
+			}
+			// GitHub Enterprise Server has its API under /api/v3
+			defaultAPI := "https://api.github.com"
+			if host := extractHost(cfg.GitRepo); host != "github.com" {
+				defaultAPI = "https://" + host + "/api/v3"
+			}
+			api = envOrDefault("STATICOMMENT_GITHUB_API", defaultAPI)
+			repo = repoPath(cfg.GitRepo)
+		case BackendGitHub:
+			if cfg.ContentsToken != "" {
+				return nil, fmt.Errorf("set STATICOMMENT_GITHUB_TOKEN or STATICOMMENT_GITHUB_APP_ID, not both")
+			}
+		default:
+			return nil, fmt.Errorf("STATICOMMENT_GITHUB_APP_ID is not supported with STATICOMMENT_BACKEND=%s", cfg.Backend)
+		}
+		app, err := LoadGitHubApp(api, appID, os.Getenv("STATICOMMENT_GITHUB_APP_INSTALLATION_ID"), keyPath, repo)
+		if err != nil {
+			return nil, fmt.Errorf("STATICOMMENT_GITHUB_APP_ID: %w", err)
+		}
+		cfg.GitHubApp = app
+	}
+
+	// Comment commits can be attributed to the commenter instead of the bot
+	cfg.CommitAsCommenter = os.Getenv("STATICOMMENT_COMMIT_AS_COMMENTER") == "1"
+
+	// Issue moderation opens an issue per quarantined comment and takes
+	// commands on it through the GitHub webhook, which also reports merged
+	// moderation pull requests
+	cfg.IssueModeration = os.Getenv("STATICOMMENT_ISSUE_MODERATION") == "1"
+	cfg.WebhookSecret = os.Getenv("STATICOMMENT_WEBHOOK_SECRET")
+	if cfg.IssueModeration && (!cfg.hasPRToken() || cfg.WebhookSecret == "") {
+		return nil, fmt.Errorf("STATICOMMENT_ISSUE_MODERATION requires STATICOMMENT_PR_TOKEN and STATICOMMENT_WEBHOOK_SECRET")
+	}
+	if cfg.IssueModeration && cfg.PRProvider == ProviderGitLab {
+		return nil, fmt.Errorf("STATICOMMENT_ISSUE_MODERATION is not supported with STATICOMMENT_PR_PROVIDER=%s", ProviderGitLab)
 	}
 
 	origins := os.Getenv("STATICOMMENT_ALLOWED_ORIGINS")
@@ -82,9 +805,47 @@ func LoadConfig() (*Config, error) {
 	if len(cfg.AllowedOrigins) == 0 {
 		return nil, fmt.Errorf("STATICOMMENT_ALLOWED_ORIGINS must contain at least one origin")
 	}
+	cfg.DNSOriginToken = os.Getenv("STATICOMMENT_DNS_ORIGIN_TOKEN")
+	if strings.ContainsAny(cfg.DNSOriginToken, " \t\"") {
+		return nil, fmt.Errorf("STATICOMMENT_DNS_ORIGIN_TOKEN must not contain spaces or quotes")
+	}
+	dnsOriginCacheTTL, err := strconv.Atoi(envOrDefault("STATICOMMENT_DNS_ORIGIN_CACHE_TTL", "300"))
+	if err != nil || dnsOriginCacheTTL < 0 {
+		return nil, fmt.Errorf("STATICOMMENT_DNS_ORIGIN_CACHE_TTL must be a non-negative integer")
+	}
+	cfg.DNSOriginCacheTTL = dnsOriginCacheTTL
 
 	// Spam mitigation config
 	cfg.HoneypotField = envOrDefault("STATICOMMENT_HONEYPOT_FIELD", "website")
+	cfg.HoneypotAction = envOrDefault("STATICOMMENT_HONEYPOT_ACTION", HoneypotAccept)
+	if cfg.HoneypotAction != HoneypotAccept && cfg.HoneypotAction != HoneypotTarpit && cfg.HoneypotAction != HoneypotReject {
+		return nil, fmt.Errorf("STATICOMMENT_HONEYPOT_ACTION must be %q, %q or %q", HoneypotAccept, HoneypotTarpit, HoneypotReject)
+	}
+
+	// The tarpit slows responses to bots; the honeypot opts in through
+	// STATICOMMENT_HONEYPOT_ACTION, other spam checks through this list
+	if os.Getenv("STATICOMMENT_TARPIT") == "1" {
+		for _, reason := range strings.Split(envOrDefault("STATICOMMENT_TARPIT_REASONS", "too_fast,token_replay"), ",") {
+			reason = strings.TrimSpace(reason)
+			if reason == "" {
+				continue
+			}
+			if !tarpitReasons[reason] {
+				return nil, fmt.Errorf("STATICOMMENT_TARPIT_REASONS: unknown reason %q", reason)
+			}
+			cfg.TarpitReasons = append(cfg.TarpitReasons, reason)
+		}
+	}
+	tarpitDuration, err := strconv.Atoi(envOrDefault("STATICOMMENT_TARPIT_DURATION", "30"))
+	if err != nil || tarpitDuration < 1 || tarpitDuration > maxTarpitDuration {
+		return nil, fmt.Errorf("STATICOMMENT_TARPIT_DURATION must be between 1 and %d seconds", maxTarpitDuration)
+	}
+	cfg.TarpitDuration = tarpitDuration
+	tarpitMax, err := strconv.Atoi(envOrDefault("STATICOMMENT_TARPIT_MAX", "20"))
+	if err != nil || tarpitMax <= 0 {
+		return nil, fmt.Errorf("STATICOMMENT_TARPIT_MAX must be a positive integer")
+	}
+	cfg.TarpitMax = tarpitMax
 
 	rateLimitWindow, err := strconv.Atoi(envOrDefault("STATICOMMENT_RATE_LIMIT_WINDOW", "60"))
 	if err != nil || rateLimitWindow < 0 {
@@ -98,6 +859,41 @@ func LoadConfig() (*Config, error) {
 	}
 	cfg.RateLimitMax = rateLimitMax
 
+	cfg.RateLimitAlgorithm = envOrDefault("STATICOMMENT_RATE_LIMIT_ALGORITHM", "sliding-window")
+	if cfg.RateLimitAlgorithm != "sliding-window" && cfg.RateLimitAlgorithm != "token-bucket" {
+		return nil, fmt.Errorf("STATICOMMENT_RATE_LIMIT_ALGORITHM must be \"sliding-window\" or \"token-bucket\"")
+	}
+
+	rateLimitBurst, err := strconv.Atoi(envOrDefault("STATICOMMENT_RATE_LIMIT_BURST", "0"))
+	if err != nil || rateLimitBurst < 0 {
+		return nil, fmt.Errorf("STATICOMMENT_RATE_LIMIT_BURST must be a non-negative integer")
+	}
+	cfg.RateLimitBurst = rateLimitBurst
+
+	rateLimitPostIPMax, err := strconv.Atoi(envOrDefault("STATICOMMENT_RATE_LIMIT_POST_IP_MAX", "0"))
+	if err != nil || rateLimitPostIPMax < 0 {
+		return nil, fmt.Errorf("STATICOMMENT_RATE_LIMIT_POST_IP_MAX must be a non-negative integer")
+	}
+	cfg.RateLimitPostIPMax = rateLimitPostIPMax
+
+	rateLimitPostMax, err := strconv.Atoi(envOrDefault("STATICOMMENT_RATE_LIMIT_POST_MAX", "0"))
+	if err != nil || rateLimitPostMax < 0 {
+		return nil, fmt.Errorf("STATICOMMENT_RATE_LIMIT_POST_MAX must be a non-negative integer")
+	}
+	cfg.RateLimitPostMax = rateLimitPostMax
+
+	rateLimitGlobalMax, err := strconv.Atoi(envOrDefault("STATICOMMENT_RATE_LIMIT_GLOBAL_MAX", "0"))
+	if err != nil || rateLimitGlobalMax < 0 {
+		return nil, fmt.Errorf("STATICOMMENT_RATE_LIMIT_GLOBAL_MAX must be a non-negative integer")
+	}
+	cfg.RateLimitGlobalMax = rateLimitGlobalMax
+
+	maxInFlight, err := strconv.Atoi(envOrDefault("STATICOMMENT_MAX_IN_FLIGHT", "0"))
+	if err != nil || maxInFlight < 0 {
+		return nil, fmt.Errorf("STATICOMMENT_MAX_IN_FLIGHT must be a non-negative integer")
+	}
+	cfg.MaxInFlight = maxInFlight
+
 	maxLinks, err := strconv.Atoi(envOrDefault("STATICOMMENT_MAX_LINKS", "3"))
 	if err != nil || maxLinks < 0 {
 		return nil, fmt.Errorf("STATICOMMENT_MAX_LINKS must be a non-negative integer")
@@ -119,18 +915,521 @@ func LoadConfig() (*Config, error) {
 		}
 	}
 
+	// Communities differ in how they write, so the limits can vary by
+	// language and country
+	cfg.Content, err = LoadContentPolicy(ContentLimits{MaxLinks: cfg.MaxLinks, BlockedPatterns: cfg.BlockedPatterns},
+		os.Getenv("STATICOMMENT_CONTENT_OVERRIDES_FILE"), os.Getenv("STATICOMMENT_GEOIP_DB"))
+	if err != nil {
+		return nil, fmt.Errorf("STATICOMMENT_CONTENT_OVERRIDES_FILE: %w", err)
+	}
+
 	minSubmitTime, err := strconv.Atoi(envOrDefault("STATICOMMENT_MIN_SUBMIT_TIME", "5"))
 	if err != nil || minSubmitTime < 0 {
 		return nil, fmt.Errorf("STATICOMMENT_MIN_SUBMIT_TIME must be a non-negative integer")
 	}
 	cfg.MinSubmitTime = minSubmitTime
+	clockSkew, err := strconv.Atoi(envOrDefault("STATICOMMENT_CLOCK_SKEW", "0"))
+	if err != nil || clockSkew < 0 {
+		return nil, fmt.Errorf("STATICOMMENT_CLOCK_SKEW must be a non-negative integer")
+	}
+	cfg.ClockSkew = clockSkew
+
+	// Signed single-use form tokens; the secret enables them
+	cfg.FormSecret = os.Getenv("STATICOMMENT_FORM_SECRET")
+
+	// Key for the client hashes in quarantined comments; without one they
+	// only match between comments held since the last restart
+	if key := os.Getenv("STATICOMMENT_CLIENT_HASH_KEY"); key != "" {
+		if len(key) < 32 {
+			return nil, fmt.Errorf("STATICOMMENT_CLIENT_HASH_KEY must be at least 32 characters")
+		}
+		cfg.ClientHashKey = []byte(key)
+	} else {
+		cfg.ClientHashKey = make([]byte, 32)
+		if _, err := rand.Read(cfg.ClientHashKey); err != nil {
+			return nil, fmt.Errorf("generating client hash key: %w", err)
+		}
+	}
+	formTokenTTL, err := strconv.Atoi(envOrDefault("STATICOMMENT_FORM_TOKEN_TTL", "3600"))
+	if err != nil || formTokenTTL <= 0 {
+		return nil, fmt.Errorf("STATICOMMENT_FORM_TOKEN_TTL must be a positive integer")
+	}
+	cfg.FormTokenTTL = formTokenTTL
+	nonceCacheSize, err := strconv.Atoi(envOrDefault("STATICOMMENT_NONCE_CACHE_SIZE", "100000"))
+	if err != nil || nonceCacheSize <= 0 {
+		return nil, fmt.Errorf("STATICOMMENT_NONCE_CACHE_SIZE must be a positive integer")
+	}
+	cfg.NonceCacheSize = nonceCacheSize
+
+	// Proof-of-work challenges, signed with their own key; without one,
+	// challenges issued before a restart can't be used after it
+	cfg.PowEnabled = os.Getenv("STATICOMMENT_POW") == "1"
+	if key := os.Getenv("STATICOMMENT_POW_SECRET"); key != "" {
+		if len(key) < 32 {
+			return nil, fmt.Errorf("STATICOMMENT_POW_SECRET must be at least 32 characters")
+		}
+		cfg.PowKey = []byte(key)
+	} else {
+		cfg.PowKey = make([]byte, 32)
+		if _, err := rand.Read(cfg.PowKey); err != nil {
+			return nil, fmt.Errorf("generating proof-of-work key: %w", err)
+		}
+	}
+	powMaxNumber, err := strconv.Atoi(envOrDefault("STATICOMMENT_POW_MAX_NUMBER", "100000"))
+	if err != nil || powMaxNumber <= 0 {
+		return nil, fmt.Errorf("STATICOMMENT_POW_MAX_NUMBER must be a positive integer")
+	}
+	cfg.PowMaxNumber = powMaxNumber
+	powTTL, err := strconv.Atoi(envOrDefault("STATICOMMENT_POW_TTL", "3600"))
+	if err != nil || powTTL <= 0 {
+		return nil, fmt.Errorf("STATICOMMENT_POW_TTL must be a positive integer")
+	}
+	cfg.PowTTL = powTTL
+
+	idempotencyWindow, err := strconv.Atoi(envOrDefault("STATICOMMENT_IDEMPOTENCY_WINDOW", "86400"))
+	if err != nil || idempotencyWindow < 0 {
+		return nil, fmt.Errorf("STATICOMMENT_IDEMPOTENCY_WINDOW must be a non-negative integer")
+	}
+	cfg.IdempotencyWindow = idempotencyWindow
+
+	if cfg.IPAllowlist, err = LoadIPList("STATICOMMENT_IP_ALLOWLIST"); err != nil {
+		return nil, err
+	}
+	if cfg.IPDenylist, err = LoadIPList("STATICOMMENT_IP_DENYLIST"); err != nil {
+		return nil, err
+	}
+	if cfg.TrustedProxies, err = LoadIPList("STATICOMMENT_TRUSTED_PROXIES"); err != nil {
+		return nil, err
+	}
+
+	canaryInterval, err := strconv.Atoi(envOrDefault("STATICOMMENT_CANARY_INTERVAL", "0"))
+	if err != nil || canaryInterval < 0 {
+		return nil, fmt.Errorf("STATICOMMENT_CANARY_INTERVAL must be a non-negative integer")
+	}
+	cfg.CanaryInterval = canaryInterval
+	cfg.CanarySlug = envOrDefault("STATICOMMENT_CANARY_SLUG", "staticomment-canary")
+	if !isValidSlug(cfg.CanarySlug) {
+		return nil, fmt.Errorf("STATICOMMENT_CANARY_SLUG must be a valid slug")
+	}
+
+	cfg.CommentIDFormat = envOrDefault("STATICOMMENT_COMMENT_ID", CommentIDTimestamp)
+	switch cfg.CommentIDFormat {
+	case CommentIDTimestamp, CommentIDULID, CommentIDSnowflake, CommentIDSequential:
+	default:
+		return nil, fmt.Errorf("STATICOMMENT_COMMENT_ID must be %q, %q, %q or %q", CommentIDTimestamp, CommentIDULID, CommentIDSnowflake, CommentIDSequential)
+	}
+	cfg.CommentIDNode = -1
+	if v := os.Getenv("STATICOMMENT_COMMENT_ID_NODE"); v != "" {
+		node, err := strconv.Atoi(v)
+		if err != nil || node < 0 || node > snowflakeMaxNode {
+			return nil, fmt.Errorf("STATICOMMENT_COMMENT_ID_NODE must be an integer from 0 to %d", snowflakeMaxNode)
+		}
+		cfg.CommentIDNode = node
+	}
+	if v := os.Getenv("STATICOMMENT_FIXED_TIME"); v != "" {
+		if cfg.FixedTime, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, fmt.Errorf("STATICOMMENT_FIXED_TIME must be an RFC 3339 time, like 2024-01-15T10:30:00Z")
+		}
+	}
+
+	if rulesFile := os.Getenv("STATICOMMENT_RULES_FILE"); rulesFile != "" {
+		rules, err := LoadRules(rulesFile)
+		if err != nil {
+			return nil, fmt.Errorf("STATICOMMENT_RULES_FILE: %w", err)
+		}
+		cfg.Rules = rules
+	}
+
+	scoreQuarantine, err := strconv.Atoi(envOrDefault("STATICOMMENT_SCORE_QUARANTINE", "5"))
+	if err != nil || scoreQuarantine < 0 {
+		return nil, fmt.Errorf("STATICOMMENT_SCORE_QUARANTINE must be a non-negative integer")
+	}
+	cfg.ScoreQuarantine = scoreQuarantine
+
+	scoreReject, err := strconv.Atoi(envOrDefault("STATICOMMENT_SCORE_REJECT", "10"))
+	if err != nil || scoreReject < 0 {
+		return nil, fmt.Errorf("STATICOMMENT_SCORE_REJECT must be a non-negative integer")
+	}
+	cfg.ScoreReject = scoreReject
+
+	// Reputation adds a submitter's recent spam rejections to the rule score
+	cfg.Reputation = os.Getenv("STATICOMMENT_REPUTATION") == "1"
+	reputationWeight, err := strconv.Atoi(envOrDefault("STATICOMMENT_REPUTATION_WEIGHT", "2"))
+	if err != nil || reputationWeight < 0 {
+		return nil, fmt.Errorf("STATICOMMENT_REPUTATION_WEIGHT must be a non-negative integer")
+	}
+	cfg.ReputationWeight = reputationWeight
+	reputationASNWeight, err := strconv.Atoi(envOrDefault("STATICOMMENT_REPUTATION_ASN_WEIGHT", "1"))
+	if err != nil || reputationASNWeight < 0 {
+		return nil, fmt.Errorf("STATICOMMENT_REPUTATION_ASN_WEIGHT must be a non-negative integer")
+	}
+	cfg.ReputationASNWeight = reputationASNWeight
+	reputationHalfLife, err := strconv.Atoi(envOrDefault("STATICOMMENT_REPUTATION_HALF_LIFE", "24"))
+	if err != nil || reputationHalfLife <= 0 {
+		return nil, fmt.Errorf("STATICOMMENT_REPUTATION_HALF_LIFE must be a positive integer")
+	}
+	cfg.ReputationHalfLife = reputationHalfLife
+	cfg.ASNDB = os.Getenv("STATICOMMENT_ASN_DB")
+
+	// Akismet classifies submissions that got through the local checks
+	cfg.AkismetKey = os.Getenv("STATICOMMENT_AKISMET_KEY")
+	cfg.AkismetBlog = envOrDefault("STATICOMMENT_AKISMET_BLOG", cfg.AllowedOrigins[0])
+	cfg.AkismetAction = envOrDefault("STATICOMMENT_AKISMET_ACTION", AkismetQuarantine)
+	if cfg.AkismetAction != AkismetQuarantine && cfg.AkismetAction != AkismetReject {
+		return nil, fmt.Errorf("STATICOMMENT_AKISMET_ACTION must be %q or %q", AkismetQuarantine, AkismetReject)
+	}
+	cfg.AkismetAPI = strings.TrimSuffix(envOrDefault("STATICOMMENT_AKISMET_API", "https://rest.akismet.com"), "/")
+
+	// reCAPTCHA v3 scores visitors on top of the honeypot and timing checks
+	cfg.RecaptchaSecret = os.Getenv("STATICOMMENT_RECAPTCHA_SECRET")
+	recaptchaMinScore, err := strconv.ParseFloat(envOrDefault("STATICOMMENT_RECAPTCHA_MIN_SCORE", "0.5"), 64)
+	if err != nil || recaptchaMinScore < 0 || recaptchaMinScore > 1 {
+		return nil, fmt.Errorf("STATICOMMENT_RECAPTCHA_MIN_SCORE must be a number between 0 and 1")
+	}
+	cfg.RecaptchaMinScore = recaptchaMinScore
+	cfg.RecaptchaAction = os.Getenv("STATICOMMENT_RECAPTCHA_ACTION")
+	cfg.RecaptchaAPI = envOrDefault("STATICOMMENT_RECAPTCHA_API", "https://www.google.com/recaptcha/api/siteverify")
+
+	// hCaptcha, for those who'd rather not use Google's
+	cfg.HCaptchaSecret = os.Getenv("STATICOMMENT_HCAPTCHA_SECRET")
+	cfg.HCaptchaSiteKey = os.Getenv("STATICOMMENT_HCAPTCHA_SITEKEY")
+	cfg.HCaptchaAPI = envOrDefault("STATICOMMENT_HCAPTCHA_API", "https://api.hcaptcha.com/siteverify")
+
+	// StopForumSpam knows submitters seen spamming other sites
+	cfg.StopForumSpam = os.Getenv("STATICOMMENT_STOPFORUMSPAM") == "1"
+	sfsThreshold, err := strconv.ParseFloat(envOrDefault("STATICOMMENT_STOPFORUMSPAM_THRESHOLD", "50"), 64)
+	if err != nil || sfsThreshold < 0 || sfsThreshold > 100 {
+		return nil, fmt.Errorf("STATICOMMENT_STOPFORUMSPAM_THRESHOLD must be a number between 0 and 100")
+	}
+	cfg.StopForumSpamThreshold = sfsThreshold
+	cfg.StopForumSpamAction = envOrDefault("STATICOMMENT_STOPFORUMSPAM_ACTION", StopForumSpamReject)
+	if cfg.StopForumSpamAction != StopForumSpamQuarantine && cfg.StopForumSpamAction != StopForumSpamReject {
+		return nil, fmt.Errorf("STATICOMMENT_STOPFORUMSPAM_ACTION must be %q or %q", StopForumSpamQuarantine, StopForumSpamReject)
+	}
+	sfsCacheTTL, err := strconv.Atoi(envOrDefault("STATICOMMENT_STOPFORUMSPAM_CACHE_TTL", "3600"))
+	if err != nil || sfsCacheTTL < 0 {
+		return nil, fmt.Errorf("STATICOMMENT_STOPFORUMSPAM_CACHE_TTL must be a non-negative integer")
+	}
+	cfg.StopForumSpamCacheTTL = sfsCacheTTL
+	cfg.StopForumSpamAPI = envOrDefault("STATICOMMENT_STOPFORUMSPAM_API", "https://api.stopforumspam.org/api")
+
+	cfg.Bayes = os.Getenv("STATICOMMENT_BAYES") == "1"
+	cfg.BayesInRepo = os.Getenv("STATICOMMENT_BAYES_IN_REPO") == "1"
+	if cfg.BayesInRepo {
+		// Committed beside subscriptions and bans
+		cfg.BayesPath = filepath.Clean(envOrDefault("STATICOMMENT_BAYES_PATH", filepath.Join(cfg.StatePath, bayesFile)))
+		if filepath.IsAbs(cfg.BayesPath) || strings.HasPrefix(cfg.BayesPath, "..") {
+			return nil, fmt.Errorf("STATICOMMENT_BAYES_PATH must be a path inside the repo with STATICOMMENT_BAYES_IN_REPO=1")
+		}
+	} else {
+		cfg.BayesPath = envOrDefault("STATICOMMENT_BAYES_PATH", filepath.Join(cfg.DataDir, bayesFile))
+	}
+	bayesThreshold, err := strconv.ParseFloat(envOrDefault("STATICOMMENT_BAYES_THRESHOLD", "0.9"), 64)
+	if err != nil || bayesThreshold <= 0 || bayesThreshold > 1 {
+		return nil, fmt.Errorf("STATICOMMENT_BAYES_THRESHOLD must be a number above 0 and up to 1")
+	}
+	cfg.BayesThreshold = bayesThreshold
+	cfg.BayesAction = envOrDefault("STATICOMMENT_BAYES_ACTION", BayesQuarantine)
+	if cfg.BayesAction != BayesQuarantine && cfg.BayesAction != BayesReject {
+		return nil, fmt.Errorf("STATICOMMENT_BAYES_ACTION must be %q or %q", BayesQuarantine, BayesReject)
+	}
+	bayesMinTraining, err := strconv.Atoi(envOrDefault("STATICOMMENT_BAYES_MIN_TRAINING", "20"))
+	if err != nil || bayesMinTraining < 1 {
+		return nil, fmt.Errorf("STATICOMMENT_BAYES_MIN_TRAINING must be a positive integer")
+	}
+	cfg.BayesMinTraining = bayesMinTraining
+
+	// Languages comments may be written in, by their primary subtags
+	for _, lang := range strings.Split(os.Getenv("STATICOMMENT_LANGUAGES"), ",") {
+		lang = strings.ToLower(strings.TrimSpace(lang))
+		if lang == "" {
+			continue
+		}
+		if !isValidLang(lang) || strings.Contains(lang, "-") {
+			return nil, fmt.Errorf("STATICOMMENT_LANGUAGES: invalid language %q: want a primary subtag like \"en\"", lang)
+		}
+		cfg.Languages = append(cfg.Languages, lang)
+	}
+	cfg.LanguageAction = envOrDefault("STATICOMMENT_LANGUAGE_ACTION", LanguageQuarantine)
+	if cfg.LanguageAction != LanguageQuarantine && cfg.LanguageAction != LanguageReject {
+		return nil, fmt.Errorf("STATICOMMENT_LANGUAGE_ACTION must be %q or %q", LanguageQuarantine, LanguageReject)
+	}
+
+	// DNS blocklists of IPs sending spam, like Spamhaus's
+	if cfg.DNSBLZones, err = ParseDNSBLZones(os.Getenv("STATICOMMENT_DNSBL")); err != nil {
+		return nil, fmt.Errorf("STATICOMMENT_DNSBL: %w", err)
+	}
+	cfg.DNSBLAction = envOrDefault("STATICOMMENT_DNSBL_ACTION", DNSBLReject)
+	if cfg.DNSBLAction != DNSBLQuarantine && cfg.DNSBLAction != DNSBLReject {
+		return nil, fmt.Errorf("STATICOMMENT_DNSBL_ACTION must be %q or %q", DNSBLQuarantine, DNSBLReject)
+	}
+	dnsblTimeout, err := strconv.Atoi(envOrDefault("STATICOMMENT_DNSBL_TIMEOUT", "2"))
+	if err != nil || dnsblTimeout < 1 {
+		return nil, fmt.Errorf("STATICOMMENT_DNSBL_TIMEOUT must be a positive integer")
+	}
+	cfg.DNSBLTimeout = dnsblTimeout
+	cfg.DNSBLResolver = os.Getenv("STATICOMMENT_DNSBL_RESOLVER")
+	if cfg.DNSBLResolver != "" {
+		if _, _, err := net.SplitHostPort(cfg.DNSBLResolver); err != nil {
+			return nil, fmt.Errorf("STATICOMMENT_DNSBL_RESOLVER must be host:port")
+		}
+	}
+
+	maxReplyDepth, err := strconv.Atoi(envOrDefault("STATICOMMENT_MAX_REPLY_DEPTH", "0"))
+	if err != nil || maxReplyDepth < 0 {
+		return nil, fmt.Errorf("STATICOMMENT_MAX_REPLY_DEPTH must be a non-negative integer")
+	}
+	cfg.MaxReplyDepth = maxReplyDepth
+	cfg.FlattenReplies = os.Getenv("STATICOMMENT_FLATTEN_REPLIES") == "1"
+	replyExcerpt, err := strconv.Atoi(envOrDefault("STATICOMMENT_REPLY_EXCERPT", "0"))
+	if err != nil || replyExcerpt < 0 {
+		return nil, fmt.Errorf("STATICOMMENT_REPLY_EXCERPT must be a non-negative integer")
+	}
+	cfg.ReplyExcerpt = replyExcerpt
+
+	cfg.BodyHTML = os.Getenv("STATICOMMENT_BODY_HTML") == "1"
+	cfg.Autolink = os.Getenv("STATICOMMENT_AUTOLINK") == "1"
+	if cfg.Autolink && !cfg.BodyHTML {
+		return nil, fmt.Errorf("STATICOMMENT_AUTOLINK requires STATICOMMENT_BODY_HTML=1")
+	}
+
+	cfg.ImagePolicy = envOrDefault("STATICOMMENT_IMAGE_POLICY", ImagePolicyStrip)
+	switch cfg.ImagePolicy {
+	case ImagePolicyStrip, ImagePolicyAllowlist:
+	case ImagePolicyProxy:
+		cfg.ImageProxy = os.Getenv("STATICOMMENT_IMAGE_PROXY")
+		if cfg.ImageProxy == "" {
+			return nil, fmt.Errorf("STATICOMMENT_IMAGE_POLICY=proxy requires STATICOMMENT_IMAGE_PROXY")
+		}
+	default:
+		return nil, fmt.Errorf("STATICOMMENT_IMAGE_POLICY must be strip, proxy or allowlist")
+	}
+	cfg.ImageDomains = splitDomains(os.Getenv("STATICOMMENT_IMAGE_DOMAINS"))
+	cfg.EmbedDomains = splitDomains(os.Getenv("STATICOMMENT_EMBED_DOMAINS"))
+
+	// HTML partial endpoint and embeddable widget, optionally themed with
+	// templates from the site repo
+	cfg.Widget = os.Getenv("STATICOMMENT_WIDGET") == "1"
+	if cfg.TemplatesPath = os.Getenv("STATICOMMENT_TEMPLATES_PATH"); cfg.TemplatesPath != "" {
+		if filepath.IsAbs(cfg.TemplatesPath) {
+			return nil, fmt.Errorf("STATICOMMENT_TEMPLATES_PATH must be a relative path")
+		}
+		cfg.TemplatesPath = filepath.Clean(cfg.TemplatesPath)
+		if strings.HasPrefix(cfg.TemplatesPath, "..") {
+			return nil, fmt.Errorf("STATICOMMENT_TEMPLATES_PATH must not escape the repo directory")
+		}
+	}
+
+	// Error responses link each invalid field to its input by id
+	cfg.FieldIDPrefix = envOrDefault("STATICOMMENT_FIELD_ID_PREFIX", "comment-")
+
+	cfg.MetricsEnabled = os.Getenv("STATICOMMENT_METRICS") == "1"
+	cfg.AuditLog = os.Getenv("STATICOMMENT_AUDIT_LOG") == "1"
+
+	// Spam corpus of rejected submissions, for tuning
+	cfg.CorpusDir = os.Getenv("STATICOMMENT_CORPUS_DIR")
+	corpusMax, err := strconv.Atoi(envOrDefault("STATICOMMENT_CORPUS_MAX", "10000"))
+	if err != nil || corpusMax <= 0 {
+		return nil, fmt.Errorf("STATICOMMENT_CORPUS_MAX must be a positive integer")
+	}
+	cfg.CorpusMax = corpusMax
+	corpusRetention, err := strconv.Atoi(envOrDefault("STATICOMMENT_CORPUS_RETENTION", "30"))
+	if err != nil || corpusRetention <= 0 {
+		return nil, fmt.Errorf("STATICOMMENT_CORPUS_RETENTION must be a positive integer")
+	}
+	cfg.CorpusRetention = corpusRetention
+
+	// Anonymized per-event analytics, POSTed and/or appended as NDJSON
+	cfg.AnalyticsURL = os.Getenv("STATICOMMENT_ANALYTICS_URL")
+	cfg.AnalyticsFile = os.Getenv("STATICOMMENT_ANALYTICS_FILE")
+
+	// A command run after each comment is pushed
+	cfg.PostPushCmd = os.Getenv("STATICOMMENT_POST_PUSH_CMD")
+	postPushTimeout, err := strconv.Atoi(envOrDefault("STATICOMMENT_POST_PUSH_TIMEOUT", "60"))
+	if err != nil || postPushTimeout <= 0 {
+		return nil, fmt.Errorf("STATICOMMENT_POST_PUSH_TIMEOUT must be a positive integer")
+	}
+	cfg.PostPushTimeout = postPushTimeout
+
+	// Notifications: email via SMTP and/or a webhook, sent in the background
+	cfg.NotifyEmails = splitDomains(os.Getenv("STATICOMMENT_NOTIFY_EMAIL"))
+	cfg.SMTPHost = os.Getenv("STATICOMMENT_SMTP_HOST")
+	smtpPort, err := strconv.Atoi(envOrDefault("STATICOMMENT_SMTP_PORT", "587"))
+	if err != nil || smtpPort <= 0 {
+		return nil, fmt.Errorf("STATICOMMENT_SMTP_PORT must be a positive integer")
+	}
+	cfg.SMTPPort = smtpPort
+	cfg.SMTPUser = os.Getenv("STATICOMMENT_SMTP_USER")
+	cfg.SMTPPassword = os.Getenv("STATICOMMENT_SMTP_PASSWORD")
+	cfg.SMTPFrom = os.Getenv("STATICOMMENT_SMTP_FROM")
+	if cfg.SMTPHost != "" && cfg.SMTPFrom == "" {
+		return nil, fmt.Errorf("STATICOMMENT_SMTP_HOST requires STATICOMMENT_SMTP_FROM")
+	}
+	cfg.NotifyWebhook = os.Getenv("STATICOMMENT_NOTIFY_WEBHOOK")
+	notifyRetries, err := strconv.Atoi(envOrDefault("STATICOMMENT_NOTIFY_RETRIES", "5"))
+	if err != nil || notifyRetries <= 0 {
+		return nil, fmt.Errorf("STATICOMMENT_NOTIFY_RETRIES must be a positive integer")
+	}
+	cfg.NotifyRetries = notifyRetries
+
+	cfg.AdminToken = os.Getenv("STATICOMMENT_ADMIN_TOKEN")
+	cfg.AdminTOTPSecret, cfg.AdminTOTPPeriod, err = adminTOTPConfig()
+	if err != nil {
+		return nil, err
+	}
+	// Several admin identities with roles, by token or OIDC ID token
+	if usersFile := os.Getenv("STATICOMMENT_ADMIN_USERS_FILE"); usersFile != "" {
+		if cfg.AdminUsers, err = LoadAdminUsers(usersFile); err != nil {
+			return nil, fmt.Errorf("STATICOMMENT_ADMIN_USERS_FILE: %w", err)
+		}
+	}
+	cfg.AdminOIDCIssuer = os.Getenv("STATICOMMENT_ADMIN_OIDC_ISSUER")
+	cfg.AdminOIDCAudience = os.Getenv("STATICOMMENT_ADMIN_OIDC_AUDIENCE")
+	if cfg.AdminOIDCIssuer != "" && cfg.AdminOIDCAudience == "" {
+		return nil, fmt.Errorf("STATICOMMENT_ADMIN_OIDC_ISSUER requires STATICOMMENT_ADMIN_OIDC_AUDIENCE")
+	}
+	for _, u := range cfg.AdminUsers {
+		if (u.Email != "" || u.Subject != "") && cfg.AdminOIDCIssuer == "" {
+			return nil, fmt.Errorf("STATICOMMENT_ADMIN_USERS_FILE: user %q is matched by OIDC, which needs STATICOMMENT_ADMIN_OIDC_ISSUER", u.Name)
+		}
+	}
+	// Browser login with the authorization code flow
+	cfg.AdminOIDCRedirectURL = os.Getenv("STATICOMMENT_ADMIN_OIDC_REDIRECT_URL")
+	cfg.AdminOIDCClientSecret = os.Getenv("STATICOMMENT_ADMIN_OIDC_CLIENT_SECRET")
+	cfg.AdminSessionSecret = os.Getenv("STATICOMMENT_ADMIN_SESSION_SECRET")
+	if cfg.AdminOIDCRedirectURL != "" {
+		if cfg.AdminOIDCIssuer == "" {
+			return nil, fmt.Errorf("STATICOMMENT_ADMIN_OIDC_REDIRECT_URL requires STATICOMMENT_ADMIN_OIDC_ISSUER")
+		}
+		u, err := url.Parse(cfg.AdminOIDCRedirectURL)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || !strings.HasSuffix(u.Path, "/admin/callback") {
+			return nil, fmt.Errorf("STATICOMMENT_ADMIN_OIDC_REDIRECT_URL must be an http(s) URL ending in /admin/callback")
+		}
+	}
+	if cfg.AdminSessionSecret != "" && len(cfg.AdminSessionSecret) < 32 {
+		return nil, fmt.Errorf("STATICOMMENT_ADMIN_SESSION_SECRET must be at least 32 characters")
+	}
+	sessionTTL, err := strconv.Atoi(envOrDefault("STATICOMMENT_ADMIN_SESSION_TTL", "28800"))
+	if err != nil || sessionTTL <= 0 {
+		return nil, fmt.Errorf("STATICOMMENT_ADMIN_SESSION_TTL must be a positive integer")
+	}
+	cfg.AdminSessionTTL = sessionTTL
+	cfg.SyncToken = os.Getenv("STATICOMMENT_SYNC_TOKEN")
+	pullInterval, err := strconv.Atoi(envOrDefault("STATICOMMENT_PULL_INTERVAL", "0"))
+	if err != nil || pullInterval < 0 {
+		return nil, fmt.Errorf("STATICOMMENT_PULL_INTERVAL must be a non-negative integer")
+	}
+	cfg.PullInterval = pullInterval
+	cfg.Maintenance = os.Getenv("STATICOMMENT_MAINTENANCE") == "1"
+	cfg.MaintenanceMessage = envOrDefault("STATICOMMENT_MAINTENANCE_MESSAGE", "Comments are temporarily closed. Please try again later.")
+
+	// security.txt is generated from the contacts unless a complete file
+	// (e.g. a signed one) is given
+	for _, c := range strings.Split(os.Getenv("STATICOMMENT_SECURITY_CONTACT"), ",") {
+		if c = strings.TrimSpace(c); c != "" {
+			if !strings.Contains(c, ":") {
+				// A bare address, as in NOTIFY_EMAIL
+				c = "mailto:" + c
+			}
+			cfg.SecurityContacts = append(cfg.SecurityContacts, c)
+		}
+	}
+	cfg.SecurityPolicy = os.Getenv("STATICOMMENT_SECURITY_POLICY")
+	if cfg.SecurityPolicy != "" && len(cfg.SecurityContacts) == 0 {
+		return nil, fmt.Errorf("STATICOMMENT_SECURITY_POLICY requires STATICOMMENT_SECURITY_CONTACT")
+	}
+	if path := os.Getenv("STATICOMMENT_SECURITY_TXT_FILE"); path != "" {
+		if cfg.SecurityTxt, err = os.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("STATICOMMENT_SECURITY_TXT_FILE: %w", err)
+		}
+	}
+	if path := os.Getenv("STATICOMMENT_ROBOTS_TXT_FILE"); path != "" {
+		if cfg.RobotsTxt, err = os.ReadFile(path); err != nil {
+			return nil, fmt.Errorf("STATICOMMENT_ROBOTS_TXT_FILE: %w", err)
+		}
+	}
+
+	// Email replies: the secret signs reply references and enables the webhook
+	cfg.ReplySecret = os.Getenv("STATICOMMENT_REPLY_SECRET")
+	cfg.InboundSigningKey = os.Getenv("STATICOMMENT_INBOUND_SIGNING_KEY")
+	cfg.OwnerEmails = splitDomains(os.Getenv("STATICOMMENT_OWNER_EMAILS"))
+	cfg.OwnerName = envOrDefault("STATICOMMENT_OWNER_NAME", "Site owner")
+	if cfg.ReplySecret != "" {
+		if cfg.InboundSigningKey == "" {
+			return nil, fmt.Errorf("STATICOMMENT_REPLY_SECRET requires STATICOMMENT_INBOUND_SIGNING_KEY")
+		}
+		if len(cfg.OwnerEmails) == 0 {
+			return nil, fmt.Errorf("STATICOMMENT_REPLY_SECRET requires STATICOMMENT_OWNER_EMAILS")
+		}
+	}
 
 	return cfg, nil
 }
 
+// splitDomains parses a comma-separated list of domains (or email
+// addresses), lowercased, with empty entries dropped.
+func splitDomains(s string) []string {
+	var domains []string
+	for _, d := range strings.Split(s, ",") {
+		d = strings.ToLower(strings.TrimSpace(d))
+		if d != "" {
+			domains = append(domains, d)
+		}
+	}
+	return domains
+}
+
+// envFileMode parses the octal permissions in key, which must include
+// those in need, the ones the server itself can't do without.
+func envFileMode(key string, fallback, need os.FileMode) (os.FileMode, error) {
+	v := os.Getenv(key)
+	if v == "" {
+		return fallback, nil
+	}
+	mode, err := strconv.ParseUint(v, 8, 32)
+	if err != nil || mode > 0777 || os.FileMode(mode)&need != need {
+		return 0, fmt.Errorf("%s must be an octal mode from %04o to 0777", key, need)
+	}
+	return os.FileMode(mode), nil
+}
+
+// defaultDataDir is where the clone and SSH files go by default: /app in
+// the image, and otherwise the user's config directory, such as
+// ~/.config/staticomment on Linux, ~/Library/Application Support/staticomment
+// on macOS and %AppData%\staticomment on Windows. Local mode keeps them in
+// .staticomment-local in the working directory, so each checkout or test
+// run has its own.
+func defaultDataDir(local bool) string {
+	if local {
+		return ".staticomment-local"
+	}
+	if fi, err := os.Stat("/app"); err == nil && fi.IsDir() {
+		return "/app"
+	}
+	if dir, err := os.UserConfigDir(); err == nil {
+		return filepath.Join(dir, "staticomment")
+	}
+	return ".staticomment-local"
+}
+
 func envOrDefault(key, fallback string) string {
 	if v := os.Getenv(key); v != "" {
 		return v
 	}
 	return fallback
 }
+
+// adminTOTPConfig reads the time-based admin token settings. They're read
+// on their own as well as by LoadConfig, since the admin-token command
+// needs them without the rest of the server's configuration.
+func adminTOTPConfig() (string, int, error) {
+	secret := os.Getenv("STATICOMMENT_ADMIN_TOTP_SECRET")
+	if secret != "" && len(secret) < 32 {
+		return "", 0, fmt.Errorf("STATICOMMENT_ADMIN_TOTP_SECRET must be at least 32 characters")
+	}
+	period, err := strconv.Atoi(envOrDefault("STATICOMMENT_ADMIN_TOTP_PERIOD", "300"))
+	if err != nil || period <= 0 {
+		return "", 0, fmt.Errorf("STATICOMMENT_ADMIN_TOTP_PERIOD must be a positive integer")
+	}
+	return secret, period, nil
+}
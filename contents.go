@@ -0,0 +1,565 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ContentsRepo is the Repo backend for STATICOMMENT_BACKEND=github and
+// gitea. It commits through the GitHub or Gitea/Forgejo REST contents API
+// with an access token, so it needs no clone, SSH key or git binary. The two
+// APIs are close enough that the differences are handled inline.
+//
+// The server still reads comments, index, state and template files from
+// disk, so the repo dir holds a mirror of just those directories, refreshed
+// from the branch's tree. Posts are mirrored as empty placeholder files, since only
+// their names matter. Each path is committed on its own, one commit per
+// file, so a comment with an index update produces two commits.
+type ContentsRepo struct {
+	cfg    *Config
+	api    string
+	client *http.Client
+
+	mu sync.Mutex
+	// shas maps repo paths to their blob SHA on the branch as of the last
+	// sync or write; a local file with a different SHA has unpushed changes
+	shas  map[string]string
+	posts map[string]bool
+	// version identifies the tree last synced: the tree's ETag on GitHub,
+	// the branch head commit on Gitea. Empty forces a full sync.
+	version string
+}
+
+func NewContentsRepo(cfg *Config) *ContentsRepo {
+	return &ContentsRepo{
+		cfg:    cfg,
+		api:    strings.TrimSuffix(cfg.ContentsAPI, "/") + "/repos/" + cfg.ContentsRepo,
+		client: &http.Client{Timeout: 30 * time.Second},
+		shas:   make(map[string]string),
+		posts:  make(map[string]bool),
+	}
+}
+
+// apiError is a non-2xx API response.
+type apiError struct {
+	Status  int
+	Message string
+}
+
+func (e *apiError) Error() string {
+	return fmt.Sprintf("contents api: %d %s", e.Status, e.Message)
+}
+
+func isStatus(err error, status ...int) bool {
+	var ge *apiError
+	if !errors.As(err, &ge) {
+		return false
+	}
+	for _, s := range status {
+		if ge.Status == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *ContentsRepo) gitea() bool {
+	return g.cfg.Backend == BackendGitea
+}
+
+func (g *ContentsRepo) newRequest(method, path string, in any) (*http.Request, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+	}
+	token, err := g.cfg.apiToken(g.cfg.ContentsToken)
+	if err != nil {
+		return nil, fmt.Errorf("contents api: %w", err)
+	}
+	req, err := http.NewRequest(method, g.api+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if g.gitea() {
+		req.Header.Set("Authorization", "token "+token)
+		req.Header.Set("Accept", "application/json")
+	} else {
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Accept", "application/vnd.github+json")
+		req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+// request sends in as the JSON body (if non-nil) and decodes a 2xx response
+// into out (if non-nil). Other statuses are returned as *apiError.
+func (g *ContentsRepo) request(method, path string, in, out any) error {
+	req, err := g.newRequest(method, path, in)
+	if err != nil {
+		return err
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("contents api: %w", err)
+	}
+	defer resp.Body.Close()
+	return decodeResponse(resp, out)
+}
+
+func decodeResponse(resp *http.Response, out any) error {
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var msg struct {
+			Message string `json:"message"`
+		}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		json.Unmarshal(data, &msg)
+		return &apiError{Status: resp.StatusCode, Message: msg.Message}
+	}
+	if out == nil {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("contents api: decoding response: %w", err)
+	}
+	return nil
+}
+
+// contentsPath returns the Contents API path for a repo-relative file.
+func contentsPath(relPath string) string {
+	parts := strings.Split(filepath.ToSlash(relPath), "/")
+	for i, p := range parts {
+		parts[i] = url.PathEscape(p)
+	}
+	return "/contents/" + strings.Join(parts, "/")
+}
+
+// blobSHA returns the git blob SHA of data, as GitHub reports it.
+func blobSHA(data []byte) string {
+	h := sha1.New()
+	fmt.Fprintf(h, "blob %d\x00", len(data))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// localSHA returns the blob SHA of the mirrored file, or "" if it doesn't
+// exist.
+func (g *ContentsRepo) localSHA(relPath string) (string, error) {
+	data, err := os.ReadFile(g.FullPath(relPath))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return blobSHA(data), nil
+}
+
+// CheckRemote verifies the repo and branch are reachable with the token.
+func (g *ContentsRepo) CheckRemote() error {
+	return g.request(http.MethodGet, "/branches/"+url.PathEscape(g.cfg.Branch), nil, nil)
+}
+
+// Clone starts a fresh mirror, discarding anything left in the repo dir.
+func (g *ContentsRepo) Clone() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if err := os.RemoveAll(g.cfg.RepoDir); err != nil {
+		return fmt.Errorf("clearing mirror dir: %w", err)
+	}
+	if err := makeDirs(g.cfg, g.cfg.RepoDir); err != nil {
+		return fmt.Errorf("creating mirror dir: %w", err)
+	}
+	log.Printf("%s: mirroring %s@%s via %s", g.cfg.Backend, g.cfg.ContentsRepo, g.cfg.Branch, g.cfg.ContentsAPI)
+	return g.syncLocked()
+}
+
+func (g *ContentsRepo) Pull() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.syncLocked()
+}
+
+// mirrored reports whether relPath's content is kept in the mirror of
+// ContentsRepo and BareRepo.
+func mirrored(cfg *Config, relPath string) bool {
+	return underDir(relPath, cfg.CommentsPath) || underDir(relPath, cfg.QuarantinePath) ||
+		underDir(relPath, cfg.IndexPath) || underDir(relPath, cfg.StatePath) || underDir(relPath, cfg.TemplatesPath)
+}
+
+func underDir(relPath, dir string) bool {
+	return dir != "" && strings.HasPrefix(relPath, filepath.ToSlash(dir)+"/")
+}
+
+type treeEntry struct {
+	Path string `json:"path"`
+	Type string `json:"type"`
+	SHA  string `json:"sha"`
+}
+
+type treeResponse struct {
+	Tree       []treeEntry `json:"tree"`
+	Truncated  bool        `json:"truncated"`
+	TotalCount int         `json:"total_count"`
+}
+
+// fetchTree lists every file on the branch, returning nil entries if the
+// branch hasn't changed since version.
+func (g *ContentsRepo) fetchTree() (entries []treeEntry, version string, err error) {
+	if g.gitea() {
+		return g.fetchGiteaTree()
+	}
+	req, err := g.newRequest(http.MethodGet, "/git/trees/"+url.PathEscape(g.cfg.Branch)+"?recursive=1", nil)
+	if err != nil {
+		return nil, "", err
+	}
+	if g.version != "" {
+		req.Header.Set("If-None-Match", g.version)
+	}
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return nil, "", fmt.Errorf("contents api: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, g.version, nil
+	}
+	var tree treeResponse
+	if err := decodeResponse(resp, &tree); err != nil {
+		return nil, "", fmt.Errorf("fetching tree: %w", err)
+	}
+	if tree.Truncated {
+		log.Printf("warning: %s: tree of %s is too large to list in full; some files may be missing from the mirror", g.cfg.Backend, g.cfg.Branch)
+	}
+	return tree.Tree, resp.Header.Get("ETag"), nil
+}
+
+// fetchGiteaTree checks the branch head first, since Gitea doesn't support
+// conditional requests, then pages through the tree at that commit.
+func (g *ContentsRepo) fetchGiteaTree() ([]treeEntry, string, error) {
+	var branch struct {
+		Commit struct {
+			ID string `json:"id"`
+		} `json:"commit"`
+	}
+	if err := g.request(http.MethodGet, "/branches/"+url.PathEscape(g.cfg.Branch), nil, &branch); err != nil {
+		return nil, "", fmt.Errorf("looking up branch %s: %w", g.cfg.Branch, err)
+	}
+	head := branch.Commit.ID
+	if head == g.version {
+		return nil, head, nil
+	}
+	entries := []treeEntry{}
+	for page := 1; ; page++ {
+		var tree treeResponse
+		path := fmt.Sprintf("/git/trees/%s?recursive=true&per_page=1000&page=%d", head, page)
+		if err := g.request(http.MethodGet, path, nil, &tree); err != nil {
+			return nil, "", fmt.Errorf("fetching tree: %w", err)
+		}
+		entries = append(entries, tree.Tree...)
+		if len(tree.Tree) == 0 || len(entries) >= tree.TotalCount {
+			return entries, head, nil
+		}
+	}
+}
+
+// syncLocked brings the mirror up to date with the branch. Only blobs whose
+// SHA changed are downloaded, and an unchanged branch costs a single
+// request. Like git pull --autostash, files with unpushed local changes are
+// left alone.
+func (g *ContentsRepo) syncLocked() error {
+	entries, version, err := g.fetchTree()
+	if err != nil {
+		return err
+	}
+	if entries == nil {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	for _, entry := range entries {
+		if entry.Type != "blob" {
+			continue
+		}
+		switch {
+		case mirrored(g.cfg, entry.Path):
+			seen[entry.Path] = true
+			if g.shas[entry.Path] == entry.SHA {
+				continue
+			}
+			local, err := g.localSHA(entry.Path)
+			if err != nil {
+				return err
+			}
+			if local != "" && local != g.shas[entry.Path] && local != entry.SHA {
+				log.Printf("%s: keeping unpushed local changes to %s", g.cfg.Backend, entry.Path)
+				continue
+			}
+			if err := g.download(entry.Path, entry.SHA); err != nil {
+				return err
+			}
+		case underDir(entry.Path, g.cfg.PostsPath):
+			seen[entry.Path] = true
+			if !g.posts[entry.Path] {
+				if err := writeMirrorFile(g.cfg, g.FullPath(entry.Path), nil); err != nil {
+					return err
+				}
+				g.posts[entry.Path] = true
+			}
+		}
+	}
+
+	// Drop files deleted upstream, unless they've changed locally since
+	for path, sha := range g.shas {
+		if !mirrored(g.cfg, path) || seen[path] {
+			continue
+		}
+		if local, err := g.localSHA(path); err == nil && (local == sha || local == "") {
+			os.Remove(g.FullPath(path))
+			delete(g.shas, path)
+		}
+	}
+	for path := range g.posts {
+		if !seen[path] {
+			os.Remove(g.FullPath(path))
+			delete(g.posts, path)
+		}
+	}
+
+	g.version = version
+	return nil
+}
+
+func (g *ContentsRepo) download(relPath, sha string) error {
+	var blob struct {
+		Content  string `json:"content"`
+		Encoding string `json:"encoding"`
+	}
+	if err := g.request(http.MethodGet, "/git/blobs/"+sha, nil, &blob); err != nil {
+		return fmt.Errorf("fetching %s: %w", relPath, err)
+	}
+	if blob.Encoding != "base64" {
+		return fmt.Errorf("fetching %s: unexpected encoding %q", relPath, blob.Encoding)
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(blob.Content, "\n", ""))
+	if err != nil {
+		return fmt.Errorf("decoding %s: %w", relPath, err)
+	}
+	if err := writeMirrorFile(g.cfg, g.FullPath(relPath), data); err != nil {
+		return err
+	}
+	g.shas[relPath] = sha
+	return nil
+}
+
+func writeMirrorFile(cfg *Config, fullPath string, data []byte) error {
+	if err := makeDirs(cfg, filepath.Dir(fullPath)); err != nil {
+		return fmt.Errorf("creating mirror dir: %w", err)
+	}
+	if err := writeFileAtomic(cfg, fullPath, data); err != nil {
+		return fmt.Errorf("writing mirror file: %w", err)
+	}
+	return nil
+}
+
+// CommitAndPush commits each of paths to the branch with msg, skipping files
+// that are already up to date, which makes retries safe.
+func (g *ContentsRepo) CommitAndPush(author Author, msg string, paths ...string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, p := range paths {
+		if err := g.putLocked(g.cfg.Branch, p, author, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// contentsBody starts a Contents API write. Without an author the commit
+// is attributed to the token's user.
+func contentsBody(author Author, msg, branch string) map[string]any {
+	body := map[string]any{"message": msg, "branch": branch}
+	if author != (Author{}) {
+		body["author"] = map[string]string{"name": author.Name, "email": author.Email}
+	}
+	return body
+}
+
+// remoteSHA returns the blob SHA of relPath on branch, or "" if it doesn't
+// exist there.
+func (g *ContentsRepo) remoteSHA(branch, relPath string) (string, error) {
+	var file struct {
+		SHA string `json:"sha"`
+	}
+	err := g.request(http.MethodGet, contentsPath(relPath)+"?ref="+url.QueryEscape(branch), nil, &file)
+	if isStatus(err, http.StatusNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("looking up %s: %w", relPath, err)
+	}
+	return file.SHA, nil
+}
+
+// putLocked creates, updates or deletes relPath on branch to match the
+// mirror. The Contents API needs the SHA being replaced; if the file has
+// changed upstream since, the write is retried against the current SHA.
+func (g *ContentsRepo) putLocked(branch, relPath string, author Author, msg string) error {
+	data, err := os.ReadFile(g.FullPath(relPath))
+	deleted := errors.Is(err, fs.ErrNotExist)
+	if err != nil && !deleted {
+		return fmt.Errorf("reading %s: %w", relPath, err)
+	}
+	want := ""
+	if !deleted {
+		want = blobSHA(data)
+	}
+
+	current, known := g.shas[relPath]
+	if branch != g.cfg.Branch {
+		if current, err = g.remoteSHA(branch, relPath); err != nil {
+			return err
+		}
+		known = true
+	}
+
+	for attempt := 0; attempt < g.cfg.PushRetries; attempt++ {
+		if known && current == want {
+			// Already committed, e.g. by an earlier attempt of this job
+			break
+		}
+		if deleted {
+			body := contentsBody(author, msg, branch)
+			body["sha"] = current
+			err = g.request(http.MethodDelete, contentsPath(relPath), body, nil)
+		} else {
+			body := contentsBody(author, msg, branch)
+			body["content"] = base64.StdEncoding.EncodeToString(data)
+			method := http.MethodPut
+			if current != "" {
+				body["sha"] = current
+			} else if g.gitea() {
+				// Gitea creates files with POST; PUT only updates
+				method = http.MethodPost
+			}
+			err = g.request(method, contentsPath(relPath), body, nil)
+		}
+		if err == nil {
+			current = want
+			break
+		}
+		if !isStatus(err, http.StatusConflict, http.StatusUnprocessableEntity) {
+			return fmt.Errorf("committing %s: %w", relPath, err)
+		}
+		log.Printf("%s: %s changed upstream (attempt %d), retrying: %v", g.cfg.Backend, relPath, attempt+1, err)
+		if current, err = g.remoteSHA(branch, relPath); err != nil {
+			return err
+		}
+		known = true
+	}
+	if current != want {
+		return fmt.Errorf("committing %s failed after %d attempts", relPath, g.cfg.PushRetries)
+	}
+
+	if branch == g.cfg.Branch {
+		if deleted {
+			delete(g.shas, relPath)
+		} else {
+			g.shas[relPath] = want
+		}
+	}
+	return nil
+}
+
+// CommitToBranch creates branch from the main branch if needed, calls write
+// to produce the paths to commit, and commits them to branch. The written
+// files are then removed from the mirror, which tracks the main branch.
+func (g *ContentsRepo) CommitToBranch(branch string, author Author, msg string, write func() ([]string, error)) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if err := g.ensureBranchLocked(branch); err != nil {
+		return err
+	}
+
+	paths, err := write()
+	defer func() {
+		for _, p := range paths {
+			os.Remove(g.FullPath(p))
+			if _, ok := g.shas[p]; ok {
+				// Existed on the main branch; fetch it again on the next sync
+				delete(g.shas, p)
+				g.version = ""
+			}
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		if err := g.putLocked(branch, p, author, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *ContentsRepo) ensureBranchLocked(branch string) error {
+	if g.gitea() {
+		body := map[string]string{"new_branch_name": branch, "old_branch_name": g.cfg.Branch}
+		err := g.request(http.MethodPost, "/branches", body, nil)
+		if err != nil && !isStatus(err, http.StatusConflict) {
+			return fmt.Errorf("creating branch %s: %w", branch, err)
+		}
+		return nil
+	}
+	err := g.request(http.MethodGet, "/git/ref/heads/"+branch, nil, nil)
+	if err == nil {
+		return nil
+	}
+	if !isStatus(err, http.StatusNotFound) {
+		return fmt.Errorf("looking up branch %s: %w", branch, err)
+	}
+	var base struct {
+		Object struct {
+			SHA string `json:"sha"`
+		} `json:"object"`
+	}
+	if err := g.request(http.MethodGet, "/git/ref/heads/"+g.cfg.Branch, nil, &base); err != nil {
+		return fmt.Errorf("looking up branch %s: %w", g.cfg.Branch, err)
+	}
+	body := map[string]string{"ref": "refs/heads/" + branch, "sha": base.Object.SHA}
+	err = g.request(http.MethodPost, "/git/refs", body, nil)
+	if err != nil && !isStatus(err, http.StatusUnprocessableEntity) {
+		return fmt.Errorf("creating branch %s: %w", branch, err)
+	}
+	return nil
+}
+
+// FullPath returns the absolute path for a file relative to the repo root.
+func (g *ContentsRepo) FullPath(relPath string) string {
+	return filepath.Join(g.cfg.RepoDir, relPath)
+}
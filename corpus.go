@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// corpusPruneInterval is how often old and excess corpus entries are removed.
+const corpusPruneInterval = time.Hour
+
+// Corpus labels assigned during review.
+const (
+	LabelSpam = "spam"
+	LabelHam  = "ham"
+)
+
+// CorpusEntry is a rejected submission kept for tuning the spam checks. The
+// IP, name and email are replaced by keyed hashes, so entries from the same
+// sender can be correlated without recording who sent them.
+type CorpusEntry struct {
+	ID        string    `json:"id"`
+	Time      time.Time `json:"time"`
+	Category  string    `json:"category"`
+	Reason    string    `json:"reason"`
+	IPHash    string    `json:"ip_hash,omitempty"`
+	NameHash  string    `json:"name_hash,omitempty"`
+	EmailHash string    `json:"email_hash,omitempty"`
+	Slug      string    `json:"slug,omitempty"`
+	Body      string    `json:"body"`
+	Label     string    `json:"label,omitempty"`
+}
+
+// Corpus is a directory of rejected submissions, one JSON file per entry.
+// Unlabeled entries are removed after the retention period or when there are
+// more than max; labeled entries are kept until deleted by hand.
+type Corpus struct {
+	dir       string
+	max       int
+	retention time.Duration
+	key       []byte
+	queue     chan CorpusEntry
+}
+
+// OpenCorpus opens (creating if needed) the corpus in dir. The hashing key
+// is generated on first use and kept in the directory, so hashes stay
+// comparable across restarts but can't be reversed without it.
+func OpenCorpus(dir string, max int, retention time.Duration) (*Corpus, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "tmp"), 0700); err != nil {
+		return nil, fmt.Errorf("creating corpus dir: %w", err)
+	}
+	keyPath := filepath.Join(dir, "hash.key")
+	key, err := os.ReadFile(keyPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("generating corpus key: %w", err)
+		}
+		if err := os.WriteFile(keyPath, key, 0600); err != nil {
+			return nil, fmt.Errorf("writing corpus key: %w", err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("reading corpus key: %w", err)
+	}
+	return &Corpus{dir: dir, max: max, retention: retention, key: key, queue: make(chan CorpusEntry, 100)}, nil
+}
+
+func (c *Corpus) hash(s string) string {
+	if s == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, c.key)
+	mac.Write([]byte(strings.ToLower(s)))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
+
+func (c *Corpus) path(id string) string {
+	return filepath.Join(c.dir, id+".json")
+}
+
+// HandleEvent is the event bus subscriber collecting rejections. Entries are
+// queued for the writer goroutine and dropped if it falls behind, so a spam
+// flood can't slow down request handling.
+func (c *Corpus) HandleEvent(e Event) {
+	// Comments turned away at capacity could be anyone's
+	if e.Type != EventRejected || e.Category == CategoryOverload || e.Comment == nil || e.Comment.Body == "" {
+		return
+	}
+	rnd, err := randomHex(4)
+	if err != nil {
+		return
+	}
+	entry := CorpusEntry{
+		ID:        e.Time.UTC().Format("20060102150405.000000") + "-" + rnd,
+		Time:      e.Time.UTC(),
+		Category:  e.Category,
+		Reason:    e.Reason,
+		IPHash:    c.hash(e.IP),
+		NameHash:  c.hash(e.Comment.Name),
+		EmailHash: c.hash(e.Comment.Email),
+		Slug:      e.Slug,
+		Body:      e.Comment.Body,
+	}
+	select {
+	case c.queue <- entry:
+	default:
+		log.Printf("warning: spam corpus queue full, dropping %s rejection", e.Reason)
+	}
+}
+
+// Run writes queued entries and prunes the corpus periodically.
+func (c *Corpus) Run() {
+	c.prune()
+	ticker := time.NewTicker(corpusPruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case entry := <-c.queue:
+			if err := c.write(entry); err != nil {
+				log.Printf("warning: writing spam corpus entry: %v", err)
+			}
+		case <-ticker.C:
+			c.prune()
+		}
+	}
+}
+
+func (c *Corpus) prune() {
+	if n, err := c.Prune(); err != nil {
+		log.Printf("warning: pruning spam corpus: %v", err)
+	} else if n > 0 {
+		log.Printf("corpus: pruned %d entries", n)
+	}
+}
+
+// write stores entry via a temp file and rename, so readers never see a
+// partial entry.
+func (c *Corpus) write(entry CorpusEntry) error {
+	data, err := json.MarshalIndent(entry, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshaling corpus entry: %w", err)
+	}
+	f, err := os.CreateTemp(filepath.Join(c.dir, "tmp"), entry.ID+".*")
+	if err != nil {
+		return fmt.Errorf("creating corpus temp file: %w", err)
+	}
+	tmp := f.Name()
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("writing corpus entry: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("writing corpus entry: %w", err)
+	}
+	if err := os.Rename(tmp, c.path(entry.ID)); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("renaming corpus entry: %w", err)
+	}
+	return nil
+}
+
+// List returns all entries, oldest first.
+func (c *Corpus) List() ([]CorpusEntry, error) {
+	matches, err := filepath.Glob(filepath.Join(c.dir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("listing corpus: %w", err)
+	}
+	sort.Strings(matches)
+	entries := make([]CorpusEntry, 0, len(matches))
+	for _, path := range matches {
+		entry, err := c.Get(strings.TrimSuffix(filepath.Base(path), ".json"))
+		if errors.Is(err, fs.ErrNotExist) {
+			// Pruned while listing
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (c *Corpus) Get(id string) (CorpusEntry, error) {
+	var entry CorpusEntry
+	data, err := os.ReadFile(c.path(id))
+	if err != nil {
+		return entry, fmt.Errorf("reading corpus entry %s: %w", id, err)
+	}
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return entry, fmt.Errorf("parsing corpus entry %s: %w", id, err)
+	}
+	return entry, nil
+}
+
+// Label sets an entry's label: LabelSpam, LabelHam, or "" to clear it.
+func (c *Corpus) Label(id, label string) error {
+	if label != LabelSpam && label != LabelHam && label != "" {
+		return fmt.Errorf("label must be %q or %q", LabelSpam, LabelHam)
+	}
+	entry, err := c.Get(id)
+	if err != nil {
+		return err
+	}
+	entry.Label = label
+	return c.write(entry)
+}
+
+// Prune removes unlabeled entries older than the retention period, then the
+// oldest unlabeled entries beyond max. It returns how many were removed.
+func (c *Corpus) Prune() (int, error) {
+	entries, err := c.List()
+	if err != nil {
+		return 0, err
+	}
+	cutoff := time.Now().Add(-c.retention)
+	var unlabeled []CorpusEntry
+	for _, e := range entries {
+		if e.Label == "" {
+			unlabeled = append(unlabeled, e)
+		}
+	}
+	removed := 0
+	for i, e := range unlabeled {
+		if e.Time.After(cutoff) && len(unlabeled)-i <= c.max {
+			break
+		}
+		if err := os.Remove(c.path(e.ID)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return removed, fmt.Errorf("removing corpus entry %s: %w", e.ID, err)
+		}
+		removed++
+	}
+	return removed, nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// demoSlug is the slug of the demo site's one post.
+const demoSlug = "hello-world"
+
+// demoDir is the throwaway directory of "staticomment demo", holding the
+// site repo and the clone. main serves the demo page when it's set.
+var demoDir string
+
+const demoUsage = `usage: staticomment demo [-port N]
+
+Serve a tiny example blog post with a working comment form on
+http://localhost:8080/, committing comments to a throwaway site repo. Any
+STATICOMMENT_* settings in the environment are ignored, and the repo is
+deleted when the server is stopped with Ctrl-C.
+`
+
+// demoFiles seed the demo site repo: a post and a comment on it.
+var demoFiles = map[string]string{
+	"_posts/2024-01-01-hello-world.md": "---\ntitle: Hello, world\n---\nThis is a post on a static site. Its comments live in the same repo.\n",
+	"_data/comments/hello-world/20240101120000-a1b2c3d4.yml": "name: Alice\n" +
+		"body: First! Comments are plain YAML files in the site's repo.\n" +
+		"date: \"2024-01-01T12:00:00Z\"\n" +
+		"slug: hello-world\n",
+}
+
+// demoCommand creates the demo site repo in a temporary directory and
+// configures the server for it through the environment, replacing any
+// STATICOMMENT_ settings. It returns 0 for main to start the server like
+// any other, or the exit code if it couldn't.
+func demoCommand(args []string, stderr io.Writer) int {
+	fs := flag.NewFlagSet("demo", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { fmt.Fprint(stderr, demoUsage) }
+	port := fs.Int("port", 8080, "port to listen on")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 {
+		return 2
+	}
+
+	dir, err := os.MkdirTemp("", "staticomment-demo-")
+	if err != nil {
+		fmt.Fprintf(stderr, "creating demo directory: %v\n", err)
+		return 1
+	}
+	site := filepath.Join(dir, "site.git")
+	if err := initDemoRepo(site, filepath.Join(dir, "seed")); err != nil {
+		os.RemoveAll(dir)
+		fmt.Fprintf(stderr, "creating demo repo: %v\n", err)
+		return 1
+	}
+
+	for _, kv := range os.Environ() {
+		if key, _, _ := strings.Cut(kv, "="); strings.HasPrefix(key, "STATICOMMENT_") {
+			os.Unsetenv(key)
+		}
+	}
+	p := strconv.Itoa(*port)
+	for key, value := range map[string]string{
+		"STATICOMMENT_GIT_REPO":        site,
+		"STATICOMMENT_BRANCH":          "main",
+		"STATICOMMENT_DATA_DIR":        dir,
+		"STATICOMMENT_PORT":            p,
+		"STATICOMMENT_ALLOWED_ORIGINS": "http://localhost:" + p + ",http://127.0.0.1:" + p,
+		"STATICOMMENT_POSTS_PATH":      "_posts",
+		"STATICOMMENT_WIDGET":          "1",
+	} {
+		os.Setenv(key, value)
+	}
+	demoDir = dir
+
+	// The repo is only for the demo, so it goes when the demo does
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt)
+	go func() {
+		<-stop
+		log.Printf("demo: removing %s", dir)
+		os.RemoveAll(dir)
+		os.Exit(0)
+	}()
+	return 0
+}
+
+// initDemoRepo creates a bare repo at site with demoFiles committed on
+// main, by committing them in a repo at seed and pushing that.
+func initDemoRepo(site, seed string) error {
+	branch := plumbing.NewBranchReferenceName("main")
+	if _, err := git.PlainInitWithOptions(site, &git.PlainInitOptions{
+		InitOptions: git.InitOptions{DefaultBranch: branch},
+		Bare:        true,
+	}); err != nil {
+		return err
+	}
+	repo, err := git.PlainInitWithOptions(seed, &git.PlainInitOptions{InitOptions: git.InitOptions{DefaultBranch: branch}})
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(seed)
+	wt, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	for name, content := range demoFiles {
+		path := filepath.Join(seed, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			return err
+		}
+		if _, err := wt.Add(name); err != nil {
+			return err
+		}
+	}
+	sig := &object.Signature{Name: "staticomment demo", Email: "demo@staticomment.invalid", When: time.Now()}
+	if _, err := wt.Commit("Create demo site", &git.CommitOptions{Author: sig, Committer: sig}); err != nil {
+		return err
+	}
+	if _, err := repo.CreateRemote(&gitconfig.RemoteConfig{Name: "origin", URLs: []string{site}}); err != nil {
+		return err
+	}
+	return repo.Push(&git.PushOptions{RemoteName: "origin"})
+}
+
+// demoPage is the demo site's post, with its comments rendered in and the
+// form posting to this server.
+var demoPage = template.Must(template.New("demo").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Hello, world · staticomment demo</title>
+<style>
+body { font: 16px/1.5 system-ui, sans-serif; max-width: 40em; margin: 2em auto; padding: 0 1em; color: #222; }
+.note { background: #f4f4f4; padding: .75em 1em; border-radius: 4px; font-size: .9em; }
+.status { padding: .75em 1em; border-radius: 4px; background: #e7f6e7; }
+.status.error { background: #fbe9e9; }
+.staticomment-list { list-style: none; padding: 0; }
+.staticomment-comment { border-top: 1px solid #ddd; padding: .5em 0; }
+.staticomment-meta { color: #666; font-size: .9em; margin: 0; }
+label { display: block; margin-top: .75em; }
+input, textarea { width: 100%; box-sizing: border-box; font: inherit; padding: .3em; }
+button { margin-top: 1em; font: inherit; padding: .4em 1.2em; }
+</style>
+</head>
+<body>
+<p class="note">This is the <strong>staticomment demo</strong>. Comments are committed to the site repo at
+<code>{{.Repo}}</code>; see them with <code>git -C {{.Repo}} log --stat</code>.</p>
+<h1>Hello, world</h1>
+<p>This is a post on a static site. Its comments live in the same repo.</p>
+<h2>Comments</h2>
+{{if .Error}}<p class="status error" role="alert">{{.Error}}</p>{{end}}
+<p class="status" id="status" hidden></p>
+{{.Comments}}
+<h2>Leave a comment</h2>
+<form method="post" action="/comment">
+<input type="hidden" name="slug" value="{{.Slug}}">
+<input type="hidden" name="url" value="{{.URL}}">
+<input type="hidden" name="_timestamp" value="{{.Timestamp}}">
+<div hidden><label>Website <input name="website" tabindex="-1" autocomplete="off"></label></div>
+<label>Name <input name="name" required></label>
+<label>Email (optional, never shown) <input name="email" type="email"></label>
+<label>Comment <textarea name="body" rows="5" required></textarea></label>
+<button type="submit">Post comment</button>
+</form>
+<script>
+var messages = {
+  "#comment-submitted": "Thanks! Your comment was committed and pushed.",
+  "#comment-pending": "Thanks! Your comment is held for review."
+};
+if (messages[location.hash]) {
+  var status = document.getElementById("status");
+  status.textContent = messages[location.hash];
+  status.hidden = false;
+}
+</script>
+</body>
+</html>
+`))
+
+// DemoHandler serves the demo page at /.
+type DemoHandler struct {
+	partial *PartialHandler
+	repo    string
+}
+
+func NewDemoHandler(partial *PartialHandler) *DemoHandler {
+	return &DemoHandler{partial: partial, repo: filepath.Join(demoDir, "site.git")}
+}
+
+func (h *DemoHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// The comments are rendered in rather than loaded by the widget, whose
+	// cached fragment would hide a new comment for a minute
+	data, err := h.partial.load(demoSlug)
+	var comments bytes.Buffer
+	if err == nil {
+		err = h.partial.templates.Get().ExecuteTemplate(&comments, "comments", data)
+	}
+	if err != nil {
+		log.Printf("demo: rendering comments: %v", err)
+		http.Error(w, "Failed to render comments", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	demoPage.Execute(w, map[string]any{
+		"Repo":      h.repo,
+		"Slug":      demoSlug,
+		"URL":       "http://" + r.Host + "/",
+		"Timestamp": time.Now().Unix(),
+		"Comments":  template.HTML(comments.String()),
+		"Error":     r.URL.Query().Get("comment_error"),
+	})
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const deployKeyUsage = `usage: staticomment deploy-key [-key PATH] [-repo URL] [-provider P] [-api URL] [-title T]
+
+Generate an ed25519 deploy key at -key, unless there's one already, and
+print its public key. With an API token in STATICOMMENT_DEPLOY_TOKEN, also
+add it to the repo as a deploy key with write access, through the GitHub,
+GitLab or Gitea/Forgejo API. The token needs to be allowed to manage the
+repo's deploy keys (admin on GitHub and Gitea, Maintainer on GitLab); it's
+only used for this and isn't needed afterwards.
+
+-key defaults to id_ed25519 in STATICOMMENT_SSH_DIR or the data directory's
+.ssh, where the server looks for it, and -repo to STATICOMMENT_GIT_REPO.
+The provider is github for github.com, gitlab for gitlab.com and gitea
+for codeberg.org; give it for other hosts. -api defaults to the
+provider's API on the repo's host.
+`
+
+func deployKeyCommand(args []string, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("deploy-key", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { fmt.Fprint(stderr, deployKeyUsage) }
+	sshDir := envOrDefault("STATICOMMENT_SSH_DIR", filepath.Join(envOrDefault("STATICOMMENT_DATA_DIR", defaultDataDir(false)), ".ssh"))
+	keyPath := fs.String("key", filepath.Join(sshDir, "id_ed25519"), "private key to generate or use")
+	repo := fs.String("repo", os.Getenv("STATICOMMENT_GIT_REPO"), "site repo URL")
+	provider := fs.String("provider", "", "github, gitlab or gitea")
+	api := fs.String("api", "", "API base URL")
+	title := fs.String("title", "staticomment", "title of the deploy key")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 {
+		return 2
+	}
+
+	pub, created, err := deployKey(*keyPath)
+	if err != nil {
+		fmt.Fprintf(stderr, "deploy key %s: %v\n", *keyPath, err)
+		return 1
+	}
+	if created {
+		fmt.Fprintf(stderr, "generated %s\n", *keyPath)
+	} else {
+		fmt.Fprintf(stderr, "using existing %s\n", *keyPath)
+	}
+	fmt.Fprintln(stdout, pub)
+
+	token := os.Getenv("STATICOMMENT_DEPLOY_TOKEN")
+	if token == "" {
+		fmt.Fprintln(stderr, "add it to the repo as a deploy key with write access, or set STATICOMMENT_DEPLOY_TOKEN to have it added")
+		return 0
+	}
+	if !isSSHRemote(*repo) {
+		fmt.Fprintln(stderr, "-repo (or STATICOMMENT_GIT_REPO) must be the repo's SSH URL to add the key to it")
+		return 2
+	}
+	host := extractHost(*repo)
+	if *provider == "" {
+		*provider = deployKeyProvider(host)
+	}
+	if *api == "" {
+		*api = deployKeyAPI(*provider, host)
+	}
+	if *api == "" {
+		fmt.Fprintf(stderr, "can't tell which API %s has; give -provider github, gitlab or gitea\n", host)
+		return 2
+	}
+	if err := registerDeployKey(*provider, strings.TrimSuffix(*api, "/"), repoPath(*repo), token, *title, pub); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	fmt.Fprintf(stderr, "added as deploy key %q with write access to %s\n", *title, repoPath(*repo))
+	return 0
+}
+
+// deployKey returns the public key of the private key at path, generating
+// the key first if there isn't one.
+func deployKey(path string) (pub string, created bool, err error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		pub, err := generateDeployKey(path)
+		return pub, true, err
+	}
+	if err != nil {
+		return "", false, err
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if err != nil {
+		return "", false, err
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))) + " staticomment", false, nil
+}
+
+// generateDeployKey writes a new ed25519 key to path, readable only by the
+// user, and returns its public key in authorized_keys form.
+func generateDeployKey(path string) (string, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	block, err := ssh.MarshalPrivateKey(priv, "staticomment")
+	if err != nil {
+		return "", err
+	}
+	sshPub, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPub))) + " staticomment", nil
+}
+
+// deployKeyProvider guesses the provider from the repo's host.
+func deployKeyProvider(host string) string {
+	switch host {
+	case "github.com":
+		return ProviderGitHub
+	case "gitlab.com":
+		return ProviderGitLab
+	case "codeberg.org":
+		return BackendGitea
+	}
+	return ""
+}
+
+// deployKeyAPI returns the usual API base URL of provider on host.
+func deployKeyAPI(provider, host string) string {
+	switch provider {
+	case ProviderGitHub:
+		if host == "github.com" {
+			return "https://api.github.com"
+		}
+		return "https://" + host + "/api/v3"
+	case ProviderGitLab:
+		return "https://" + host + "/api/v4"
+	case BackendGitea:
+		return "https://" + host + "/api/v1"
+	}
+	return ""
+}
+
+// registerDeployKey adds pub to repo (owner/name) as a deploy key that can
+// push.
+func registerDeployKey(provider, api, repo, token, title, pub string) error {
+	var endpoint string
+	payload := map[string]any{"title": title, "key": pub}
+	switch provider {
+	case ProviderGitHub, BackendGitea:
+		endpoint = api + "/repos/" + repo + "/keys"
+		payload["read_only"] = false
+	case ProviderGitLab:
+		endpoint = api + "/projects/" + url.PathEscape(repo) + "/deploy_keys"
+		payload["can_push"] = true
+	default:
+		return fmt.Errorf("unknown provider %q (want github, gitlab or gitea)", provider)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	switch provider {
+	case ProviderGitHub:
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Accept", "application/vnd.github+json")
+	case ProviderGitLab:
+		req.Header.Set("PRIVATE-TOKEN", token)
+	default:
+		req.Header.Set("Authorization", "token "+token)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("adding deploy key: %w", err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("adding deploy key: %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DNSBL actions: what happens to a submission from a listed IP
+// (STATICOMMENT_DNSBL_ACTION).
+const (
+	DNSBLQuarantine = "quarantine"
+	DNSBLReject     = "reject"
+)
+
+// DNSBLZone is a DNS blocklist, and which of its answers count as listed:
+// 127.0.0.<First> to 127.0.0.<Last>, or any in 127.0.0.0/8 if Last is 0.
+// Lists like Spamhaus ZEN combine several whose answers tell them apart.
+type DNSBLZone struct {
+	Name        string
+	First, Last int
+}
+
+// ParseDNSBLZones reads STATICOMMENT_DNSBL: zones separated by commas, each
+// optionally followed by "=" and the last octet of the answers that count,
+// or a range of them, like "zen.spamhaus.org=2-9".
+func ParseDNSBLZones(s string) ([]DNSBLZone, error) {
+	var zones []DNSBLZone
+	for _, z := range strings.Split(s, ",") {
+		z = strings.TrimSpace(z)
+		if z == "" {
+			continue
+		}
+		name, codes, found := strings.Cut(z, "=")
+		zone := DNSBLZone{Name: strings.Trim(name, ".")}
+		if zone.Name == "" {
+			return nil, fmt.Errorf("empty zone in %q", z)
+		}
+		if found {
+			first, last, isRange := strings.Cut(codes, "-")
+			if !isRange {
+				last = first
+			}
+			var err1, err2 error
+			zone.First, err1 = strconv.Atoi(first)
+			zone.Last, err2 = strconv.Atoi(last)
+			if err1 != nil || err2 != nil || zone.First < 1 || zone.Last > 255 || zone.First > zone.Last {
+				return nil, fmt.Errorf("invalid answers %q for %s: want a number from 1 to 255 or a range of them", codes, zone.Name)
+			}
+		}
+		zones = append(zones, zone)
+	}
+	return zones, nil
+}
+
+// listed reports whether the answer addr means an IP is listed. Answers
+// outside 127.0.0.0/8, and Spamhaus's 127.255.255.x error codes, don't.
+func (z DNSBLZone) listed(addr string) bool {
+	ip := net.ParseIP(addr).To4()
+	if ip == nil || ip[0] != 127 || (ip[1] == 255 && ip[2] == 255) {
+		return false
+	}
+	if z.Last == 0 {
+		return true
+	}
+	return ip[1] == 0 && ip[2] == 0 && int(ip[3]) >= z.First && int(ip[3]) <= z.Last
+}
+
+// dnsblAnswer is one zone's answer about an IP.
+type dnsblAnswer struct {
+	zone   string
+	listed bool
+	err    error
+}
+
+// DNSBL looks submitters' IPs up in DNS blocklists, all zones at once and
+// in the background while the other checks run, giving up after
+// STATICOMMENT_DNSBL_TIMEOUT.
+type DNSBL struct {
+	zones    []DNSBLZone
+	timeout  time.Duration
+	resolver *net.Resolver
+}
+
+// NewDNSBL asks the system's resolver, or the DNS server at resolver if
+// set. Public resolvers are often refused by blocklists, Spamhaus's
+// included, so a local caching resolver is best.
+func NewDNSBL(zones []DNSBLZone, timeout time.Duration, resolver string) *DNSBL {
+	d := &DNSBL{zones: zones, timeout: timeout, resolver: net.DefaultResolver}
+	if resolver != "" {
+		d.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, resolver)
+			},
+		}
+	}
+	return d
+}
+
+// Lookup starts looking ip up and returns a function that waits for the
+// answer: the first zone listing it, or "" if none does. Addresses that
+// aren't public, like a LAN's, are never listed and aren't looked up.
+func (d *DNSBL) Lookup(ctx context.Context, ip string) func() (zone string, err error) {
+	addr := net.ParseIP(ip)
+	if addr == nil || !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return func() (string, error) { return "", nil }
+	}
+	name := reverseIP(addr)
+	ctx, cancel := context.WithTimeout(ctx, d.timeout)
+	answers := make(chan dnsblAnswer, len(d.zones))
+	for _, zone := range d.zones {
+		go func() {
+			listed, err := d.query(ctx, zone, name+"."+zone.Name)
+			answers <- dnsblAnswer{zone: zone.Name, listed: listed, err: err}
+		}()
+	}
+	return func() (string, error) {
+		defer cancel()
+		var errs []error
+		for range d.zones {
+			a := <-answers
+			if a.listed {
+				return a.zone, nil
+			}
+			if a.err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", a.zone, a.err))
+			}
+		}
+		return "", errors.Join(errs...)
+	}
+}
+
+func (d *DNSBL) query(ctx context.Context, zone DNSBLZone, name string) (bool, error) {
+	addrs, err := d.resolver.LookupHost(ctx, name)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, addr := range addrs {
+		if zone.listed(addr) {
+			return true, nil
+		}
+	}
+	for _, addr := range addrs {
+		if strings.HasPrefix(addr, "127.255.255.") {
+			return false, fmt.Errorf("query refused with %s", addr)
+		}
+	}
+	return false, nil
+}
+
+// reverseIP returns the name ip is looked up under, its octets in reverse
+// for IPv4 and its nibbles in reverse for IPv6, without the zone.
+func reverseIP(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d", v4[3], v4[2], v4[1], v4[0])
+	}
+	const hex = "0123456789abcdef"
+	parts := make([]string, 0, 32)
+	for i := len(ip) - 1; i >= 0; i-- {
+		parts = append(parts, string(hex[ip[i]&0xf]), string(hex[ip[i]>>4]))
+	}
+	return strings.Join(parts, ".")
+}
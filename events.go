@@ -0,0 +1,126 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// EventType identifies a stage in the life of a comment submission.
+type EventType string
+
+const (
+	EventAccepted  EventType = "accepted"
+	EventRejected  EventType = "rejected"
+	EventPublished EventType = "published"
+	EventFailed    EventType = "failed"
+	// EventQuarantined is emitted instead of EventPublished when a comment
+	// was committed to the quarantine path for review.
+	EventQuarantined EventType = "quarantined"
+	// EventModeration is emitted instead of EventPublished when a comment
+	// was pushed to its own branch for review (STATICOMMENT_MODERATION).
+	EventModeration EventType = "moderation"
+	// EventClockSkew reports how far a submitter's clock was off from the
+	// server's, when that could be measured. It comes before the
+	// submission's outcome.
+	EventClockSkew EventType = "clock_skew"
+	// EventCanary reports a run of the self-test (STATICOMMENT_CANARY_INTERVAL),
+	// which failed if Err is set.
+	EventCanary EventType = "canary"
+	// EventNotificationFailed reports an attempt to send a notification
+	// that failed. It's about the notification, not a submission: Reason
+	// is the channel and Slug the comment's, if it was about one.
+	EventNotificationFailed EventType = "notification_failed"
+	// EventNotificationDeadLetter reports a notification given up on, its
+	// retries used up or its channel's queue full. Reason and Slug are as
+	// for EventNotificationFailed.
+	EventNotificationDeadLetter EventType = "notification_dead_letter"
+)
+
+// Rejection categories, so subscribers can tell spam apart from bad input,
+// and both from submissions turned away because the server is at capacity.
+const (
+	CategorySpam     = "spam"
+	CategoryInvalid  = "invalid"
+	CategoryOverload = "overload"
+)
+
+// Event describes something that happened to a submission. Fields that do not
+// apply to a given type are left zero, and only published events carry a
+// Duration. A rejection's Comment holds the fields as submitted, unvalidated
+// and without a date.
+type Event struct {
+	Type     EventType
+	Time     time.Time
+	Category string // rejected: CategorySpam, CategoryInvalid or CategoryOverload
+	Reason   string // rejected: reason code; failed: stage; notification_failed, notification_dead_letter: channel
+	Action   string // rejected: "tarpit" if the response was tarpitted; for honeypot hits, always how it was answered
+	IP       string
+	Slug     string
+	Comment  *Comment
+	Path     string        // published, quarantined, moderation: repo-relative path of the comment file
+	Branch   string        // moderation: review branch
+	URL      string        // moderation: pull request URL, if one was opened
+	Duration time.Duration // published: time from acceptance to push, zero when approved from quarantine; clock_skew: how far the client's clock was ahead
+	Err      error         // failed, notification_failed, notification_dead_letter: underlying error
+	Canary   bool          // published, failed: the comment was the self-test's, not a visitor's
+}
+
+// EventBus fans submission events out to subscribers. Metrics, audit logging,
+// notifiers and webhooks all hang off the bus instead of being called directly
+// from the handler, so adding an integration only means adding a subscriber.
+//
+// Subscribers are called synchronously in registration order and must not
+// block; anything slow should hand off to its own goroutine or queue.
+type EventBus struct {
+	mu   sync.RWMutex
+	subs []func(Event)
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{}
+}
+
+// Subscribe registers fn to receive every published event.
+func (b *EventBus) Subscribe(fn func(Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subs = append(b.subs, fn)
+}
+
+// Publish delivers e to all subscribers, stamping the time if unset.
+func (b *EventBus) Publish(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.mu.RLock()
+	subs := b.subs
+	b.mu.RUnlock()
+	for _, fn := range subs {
+		fn(e)
+	}
+}
+
+// logEvent is the audit log subscriber: one line per submission event.
+func logEvent(e Event) {
+	switch e.Type {
+	case EventRejected:
+		log.Printf("audit: rejected (%s: %s) slug=%q ip=%s", e.Category, e.Reason, e.Slug, e.IP)
+	case EventFailed:
+		log.Printf("audit: failed at %s slug=%q ip=%s: %v", e.Reason, e.Slug, e.IP, e.Err)
+	case EventPublished:
+		log.Printf("audit: published %s slug=%q ip=%s in %s", e.Path, e.Slug, e.IP, e.Duration.Round(time.Millisecond))
+	case EventQuarantined:
+		log.Printf("audit: quarantined %s slug=%q ip=%s", e.Path, e.Slug, e.IP)
+	case EventModeration:
+		log.Printf("audit: pending moderation %s on %s slug=%q ip=%s", e.Path, e.Branch, e.Slug, e.IP)
+	case EventClockSkew:
+		// A measurement, not something that happened to the submission
+	case EventCanary:
+		// Logged by the canary itself
+	case EventNotificationFailed, EventNotificationDeadLetter:
+		// Logged by the dispatcher
+	default:
+		log.Printf("audit: %s slug=%q ip=%s", e.Type, e.Slug, e.IP)
+	}
+}
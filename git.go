@@ -1,70 +1,193 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// What a pull does with a file changed both in a local commit and upstream,
+// selected by STATICOMMENT_CONFLICT_STRATEGY. Comment files have unique
+// names, so new ones never conflict; this is for the index and for comment
+// files edited upstream while a change to them was waiting to be pushed.
+const (
+	ConflictLocal  = "local"  // the local change wins
+	ConflictRemote = "remote" // the upstream change wins
+	ConflictFail   = "fail"   // the pull fails, leaving the clone as it was
 )
 
+// Storage backends selected by STATICOMMENT_BACKEND.
 const (
-	repoDir        = "/app/repo"
-	knownHostsPath = "/app/.ssh/known_hosts"
+	BackendGit    = "git"    // local clone, via go-git or the git CLI
+	BackendGitHub = "github" // GitHub REST API, no clone or git binary
+	BackendGitea  = "gitea"  // Gitea/Forgejo REST API, likewise
 )
 
+// Repo is the site repository comments are committed to. Either way the
+// files the server reads live under STATICOMMENT_REPO_DIR, so callers use
+// FullPath and the filesystem; only fetching and committing differ between
+// backends.
+type Repo interface {
+	Clone() error
+	Pull() error
+	CheckRemote() error
+	CommitAndPush(author Author, msg string, paths ...string) error
+	CommitToBranch(branch string, author Author, msg string, write func() ([]string, error)) error
+	FullPath(relPath string) string
+}
+
+// Author is who a commit is attributed to. The zero Author means the
+// server's own identity, which is always the committer.
+type Author struct {
+	Name  string
+	Email string
+}
+
+// commitArgs returns the git commit command line for msg and author, dated
+// when.
+func commitArgs(author Author, msg string, when time.Time) []string {
+	args := []string{"commit", "-m", msg, "--date", gitDate(when)}
+	if author != (Author{}) {
+		args = append(args, "--author", author.Name+" <"+author.Email+">")
+	}
+	return args
+}
+
+// gitDate formats t the way git reads dates internally.
+func gitDate(t time.Time) string {
+	return fmt.Sprintf("@%d %s", t.Unix(), t.Format("-0700"))
+}
+
+// GitRepo drives the git CLI over SSH. It is kept for compatibility behind
+// STATICOMMENT_GIT_CLI=1; the default is GoGitRepo, which needs neither git
+// nor ssh installed.
 type GitRepo struct {
-	cfg *Config
-	mu  sync.Mutex
+	cfg     *Config
+	mu      sync.Mutex
+	mirrors *Mirrors
+	clock   Clock
 }
 
 func NewGitRepo(cfg *Config) *GitRepo {
-	return &GitRepo{cfg: cfg}
+	g := &GitRepo{cfg: cfg, clock: NewClock(cfg)}
+	if len(cfg.GitMirrors) > 0 {
+		g.mirrors = NewMirrors(cfg.GitMirrors, g.pushMirror)
+		go g.mirrors.Run()
+	}
+	return g
 }
 
+// sshCommand returns the ssh command line for git. With several keys, ssh
+// offers each in turn until the server accepts one.
 func (g *GitRepo) sshCommand() string {
+	cmd := "ssh"
+	for _, key := range g.cfg.SSHKeyPaths {
+		cmd += " -i " + shellQuote(key)
+	}
 	if g.cfg.SSHInsecure {
-		return fmt.Sprintf("ssh -i %s -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null", g.cfg.SSHKeyPath)
+		return cmd + " -o StrictHostKeyChecking=no -o UserKnownHostsFile=/dev/null"
 	}
-	return fmt.Sprintf("ssh -i %s -o UserKnownHostsFile=%s", g.cfg.SSHKeyPath, knownHostsPath)
+	return fmt.Sprintf("%s -o UserKnownHostsFile=%s", cmd, shellQuote(g.cfg.KnownHostsPath))
 }
 
-// ensureHostKeys checks whether the configured git host is already in known_hosts.
-// If not, it runs ssh-keyscan to fetch the host keys. This runs once at startup
-// so that any git host (GitHub, GitLab, Gitea, self-hosted, etc.) works without
-// manual known_hosts configuration.
-func (g *GitRepo) ensureHostKeys() error {
-	if g.cfg.SSHInsecure {
+// shellQuote quotes s for the shell git runs GIT_SSH_COMMAND with, so paths
+// with spaces, or with backslashes on Windows, come through intact.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// writeSSHKey writes the deploy key given in STATICOMMENT_SSH_KEY to a file
+// only we can read, in memory-backed /dev/shm where there is one so it never
+// reaches a disk, and uses it as the only key. The variables are then
+// cleared, so git and ssh processes don't inherit the key.
+func writeSSHKey(cfg *Config) error {
+	dir := "/dev/shm"
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		dir = os.TempDir()
+	}
+	// CreateTemp creates the file with mode 0600
+	f, err := os.CreateTemp(dir, "staticomment-ssh-key-")
+	if err != nil {
+		return fmt.Errorf("creating SSH key file: %w", err)
+	}
+	if _, err := f.Write(cfg.SSHKey); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return fmt.Errorf("writing SSH key file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("writing SSH key file: %w", err)
+	}
+	cfg.SSHKeyPaths = []string{f.Name()}
+	os.Unsetenv("STATICOMMENT_SSH_KEY")
+	os.Unsetenv("STATICOMMENT_SSH_KEY_BASE64")
+	return nil
+}
+
+// ensureHostKeys checks whether the hosts of the configured git repo and
+// mirrors are already in known_hosts. If not, it scans them for their keys.
+// This runs once at startup so that any git host (GitHub, GitLab, Gitea,
+// self-hosted, etc.) works without manual known_hosts configuration.
+func ensureHostKeys(cfg *Config) error {
+	for _, remote := range append([]string{cfg.GitRepo}, cfg.GitMirrors...) {
+		if err := ensureHostKey(cfg, remote); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ensureHostKey(cfg *Config, remote string) error {
+	// In local mode known_hosts is the user's own, so it's left to ssh
+	if cfg.SSHInsecure || cfg.Local || !isSSHRemote(remote) {
 		return nil
 	}
-	host := extractHost(g.cfg.GitRepo)
+	host := extractHost(remote)
 	if host == "" {
-		return fmt.Errorf("could not extract host from repo URL: %s", g.cfg.GitRepo)
+		return fmt.Errorf("could not extract host from repo URL: %s", remote)
 	}
-	if hostInKnownHosts(host) {
+	if hostInKnownHosts(cfg.KnownHostsPath, host) {
 		log.Printf("git: host key for %s already in known_hosts", host)
 		return nil
 	}
-	log.Printf("git: host key for %s not found, running ssh-keyscan", host)
-	return scanAndAppendHostKeys(host)
+	log.Printf("git: host key for %s not found, scanning", host)
+	return scanAndAppendHostKeys(cfg.KnownHostsPath, host, cfg.HostKeyPins)
 }
 
 // refreshHostKeys replaces the host keys for the configured git host.
 // Used as a fallback when a git operation fails due to stale keys.
-func (g *GitRepo) refreshHostKeys() error {
-	host := extractHost(g.cfg.GitRepo)
+func refreshHostKeys(cfg *Config) error {
+	if cfg.Local {
+		return fmt.Errorf("host keys in %s aren't replaced in local mode", cfg.KnownHostsPath)
+	}
+	host := extractHost(cfg.GitRepo)
 	if host == "" {
-		return fmt.Errorf("could not extract host from repo URL: %s", g.cfg.GitRepo)
+		return fmt.Errorf("could not extract host from repo URL: %s", cfg.GitRepo)
 	}
 	log.Printf("git: refreshing SSH host keys for %s", host)
 	// Overwrite rather than append to replace potentially stale keys
-	return scanAndWriteHostKeys(host)
+	return scanAndWriteHostKeys(cfg.KnownHostsPath, host, cfg.HostKeyPins)
 }
 
-func hostInKnownHosts(host string) bool {
+func hostInKnownHosts(knownHostsPath, host string) bool {
 	data, err := os.ReadFile(knownHostsPath)
 	if err != nil {
 		return false
@@ -77,17 +200,50 @@ func hostInKnownHosts(host string) bool {
 	return false
 }
 
-func scanHostKeys(host string) ([]byte, error) {
-	cmd := exec.Command("ssh-keyscan", host)
-	out, err := cmd.Output()
-	if err != nil {
-		return nil, fmt.Errorf("ssh-keyscan %s: %w", host, err)
+// errKeyScanned aborts a scanning connection once the host key is known.
+var errKeyScanned = errors.New("host key scanned")
+
+// scanHostKeys fetches host's SSH host keys in known_hosts format, like
+// ssh-keyscan but without needing it installed. Each key type takes its own
+// connection, since a server only presents one per handshake. With pins,
+// the SHA256 fingerprints from STATICOMMENT_SSH_HOST_FINGERPRINTS, keys
+// without one of them are left out, and it's an error if none are left.
+func scanHostKeys(host string, pins []string) ([]byte, error) {
+	var out bytes.Buffer
+	var lastErr error
+	var unpinned []string
+	for _, algo := range []string{ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA256, ssh.KeyAlgoRSASHA512} {
+		var key ssh.PublicKey
+		_, err := ssh.Dial("tcp", net.JoinHostPort(host, "22"), &ssh.ClientConfig{
+			HostKeyAlgorithms: []string{algo},
+			HostKeyCallback: func(_ string, _ net.Addr, k ssh.PublicKey) error {
+				key = k
+				return errKeyScanned
+			},
+			Timeout: 10 * time.Second,
+		})
+		if key == nil {
+			lastErr = err
+			continue
+		}
+		if fp := ssh.FingerprintSHA256(key); len(pins) > 0 && !contains(pins, fp) {
+			log.Printf("warning: %s host key for %s (%s) doesn't match STATICOMMENT_SSH_HOST_FINGERPRINTS, not trusting it", key.Type(), host, fp)
+			unpinned = append(unpinned, fp)
+			continue
+		}
+		out.WriteString(knownhosts.Line([]string{host}, key) + "\n")
+	}
+	if out.Len() == 0 && len(unpinned) > 0 {
+		return nil, fmt.Errorf("no host key for %s matches STATICOMMENT_SSH_HOST_FINGERPRINTS (got %s)", host, strings.Join(unpinned, ", "))
+	}
+	if out.Len() == 0 {
+		return nil, fmt.Errorf("scanning host keys for %s: %w", host, lastErr)
 	}
-	return out, nil
+	return out.Bytes(), nil
 }
 
-func scanAndAppendHostKeys(host string) error {
-	out, err := scanHostKeys(host)
+func scanAndAppendHostKeys(knownHostsPath, host string, pins []string) error {
+	out, err := scanHostKeys(host, pins)
 	if err != nil {
 		return err
 	}
@@ -105,8 +261,8 @@ func scanAndAppendHostKeys(host string) error {
 	return nil
 }
 
-func scanAndWriteHostKeys(host string) error {
-	out, err := scanHostKeys(host)
+func scanAndWriteHostKeys(knownHostsPath, host string, pins []string) error {
+	out, err := scanHostKeys(host, pins)
 	if err != nil {
 		return err
 	}
@@ -136,6 +292,35 @@ func extractHost(repo string) string {
 	return u.Hostname()
 }
 
+// isSSHRemote reports whether a git remote URL is reached over SSH, either
+// as ssh:// or in scp-like git@host:path form.
+func isSSHRemote(repo string) bool {
+	ep, err := transport.NewEndpoint(repo)
+	return err == nil && ep.Protocol == "ssh"
+}
+
+// isHTTPRemote reports whether a git remote URL is http:// or https://.
+func isHTTPRemote(repo string) bool {
+	ep, err := transport.NewEndpoint(repo)
+	return err == nil && (ep.Protocol == "https" || ep.Protocol == "http")
+}
+
+// credentialHelper answers git's credential requests with
+// STATICOMMENT_GIT_TOKEN. The token is read from the environment when the
+// helper runs, so it never appears in a command line or on disk. It's only
+// configured for the repo's own host, so mirrors elsewhere never see it.
+const credentialHelper = `!f() { test "$1" = get && printf 'username=%s\npassword=%s\n' "$STATICOMMENT_GIT_USERNAME" "$STATICOMMENT_GIT_TOKEN"; }; f`
+
+// credentialScope is the scheme and host of an HTTPS remote, which scopes
+// git credential config to it.
+func credentialScope(remote string) string {
+	u, err := url.Parse(remote)
+	if err != nil {
+		return remote
+	}
+	return u.Scheme + "://" + u.Host
+}
+
 // sanitizeArgs redacts credentials from URL-like arguments for safe logging.
 func sanitizeArgs(args []string) []string {
 	safe := make([]string, len(args))
@@ -152,114 +337,506 @@ func sanitizeArgs(args []string) []string {
 	return safe
 }
 
-func (g *GitRepo) run(dir string, name string, args ...string) error {
-	cmd := exec.Command(name, args...)
+// gitContext bounds a git command or network operation by
+// STATICOMMENT_GIT_TIMEOUT, so a hung remote can't hold the repo's lock
+// forever.
+func gitContext(cfg *Config) (context.Context, context.CancelFunc) {
+	if cfg.GitTimeout == 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), time.Duration(cfg.GitTimeout)*time.Second)
+}
+
+// timedOut turns the error of an operation cut off by ctx's deadline into
+// one saying so.
+func timedOut(ctx context.Context, cfg *Config, what string, err error) error {
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%s timed out after %ds", what, cfg.GitTimeout)
+	}
+	return err
+}
+
+func (g *GitRepo) command(ctx context.Context, dir string, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	// Once git is killed, don't wait long for an ssh it started to let go
+	// of the output
+	cmd.WaitDelay = 5 * time.Second
 	cmd.Dir = dir
-	cmd.Env = append(os.Environ(), "GIT_SSH_COMMAND="+g.sshCommand())
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), "GIT_SSH_COMMAND="+g.sshCommand(), "GIT_TERMINAL_PROMPT=0", "GIT_COMMITTER_DATE="+gitDate(g.clock.Now()))
+	if token := g.cfg.gitToken(); token != "" {
+		// Config from the environment applies to every command without
+		// being saved in the clone; the empty helper first clears any
+		// configured ones
+		cmd.Env = append(cmd.Env,
+			"STATICOMMENT_GIT_USERNAME="+g.cfg.GitUsername,
+			"STATICOMMENT_GIT_TOKEN="+token,
+			"GIT_CONFIG_COUNT=2",
+			"GIT_CONFIG_KEY_0=credential.helper", "GIT_CONFIG_VALUE_0=",
+			"GIT_CONFIG_KEY_1=credential."+credentialScope(g.cfg.GitRepo)+".helper", "GIT_CONFIG_VALUE_1="+credentialHelper)
+	}
+	return cmd
+}
+
+// gitOutputLimit is how much of a failed command's output is kept in its
+// error. The end is kept, since that's where git says what went wrong.
+const gitOutputLimit = 4096
+
+// GitError is a git command that failed, with what it printed, credentials
+// removed, so logs and dead letters say why and not just "exit status 1".
+type GitError struct {
+	Command string
+	Output  string
+	Err     error
+}
+
+func (e *GitError) Error() string {
+	if e.Output == "" {
+		return fmt.Sprintf("%s: %v", e.Command, e.Err)
+	}
+	return fmt.Sprintf("%s: %v: %s", e.Command, e.Err, e.Output)
+}
+
+func (e *GitError) Unwrap() error { return e.Err }
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	mu  sync.Mutex
+	buf []byte
+	max int
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.max {
+		t.buf = t.buf[len(t.buf)-t.max:]
+	}
+	return len(p), nil
+}
+
+// urlCredentials matches the user info of URLs in git's output.
+var urlCredentials = regexp.MustCompile(`([a-zA-Z][a-zA-Z0-9+.-]*://)[^/@\s]+@`)
+
+// githubTokens matches GitHub tokens, such as GitHub App installation
+// tokens, which change too often to be redacted by value.
+var githubTokens = regexp.MustCompile(`\bgh[opsu]_[A-Za-z0-9]{20,}`)
+
+// redactOutput removes the configured token, GitHub tokens and any URL
+// credentials from command output, and puts it on one line for the logs.
+func (g *GitRepo) redactOutput(out string) string {
+	if g.cfg.GitToken != "" {
+		out = strings.ReplaceAll(out, g.cfg.GitToken, "REDACTED")
+	}
+	out = githubTokens.ReplaceAllString(out, "REDACTED")
+	var lines []string
+	for _, line := range strings.Split(out, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return urlCredentials.ReplaceAllString(strings.Join(lines, "; "), "${1}REDACTED@")
+}
+
+// run runs a command in dir. Its output still goes to ours, for the logs,
+// and the end of it is kept in the GitError returned if it fails.
+func (g *GitRepo) run(dir string, name string, args ...string) error {
+	ctx, cancel := gitContext(g.cfg)
+	defer cancel()
+	cmd := g.command(ctx, dir, name, args...)
+	out := &tailBuffer{max: gitOutputLimit}
+	cmd.Stdout = io.MultiWriter(os.Stdout, out)
+	cmd.Stderr = io.MultiWriter(os.Stderr, out)
 	log.Printf("git: running %s %v in %s", name, sanitizeArgs(args), dir)
-	return cmd.Run()
+	err := cmd.Run()
+	if err == nil {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return timedOut(ctx, g.cfg, name+" "+args[0], err)
+	}
+	return &GitError{
+		Command: name + " " + args[0],
+		Output:  g.redactOutput(string(out.buf)),
+		Err:     err,
+	}
+}
+
+// CheckRemote verifies the remote is reachable and has the configured
+// branch. It doesn't touch the working copy, so it doesn't take the lock,
+// and it runs quietly since it's polled by the status page.
+func (g *GitRepo) CheckRemote() error {
+	ctx, cancel := gitContext(g.cfg)
+	defer cancel()
+	cmd := g.command(ctx, g.cfg.RepoDir, "git", "ls-remote", "--exit-code", "origin", "refs/heads/"+g.cfg.Branch)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		if ctx.Err() != nil {
+			return timedOut(ctx, g.cfg, "git ls-remote", err)
+		}
+		return &GitError{Command: "git ls-remote", Output: g.redactOutput(string(out)), Err: err}
+	}
+	return nil
 }
 
 func (g *GitRepo) Clone() error {
 	g.mu.Lock()
 	defer g.mu.Unlock()
+	return g.cloneLocked()
+}
 
+func (g *GitRepo) cloneLocked() error {
 	// Ensure the configured git host is in known_hosts before any SSH operation.
 	// For hosts baked into the image (GitHub, GitLab), this is a no-op.
-	// For self-hosted or other providers, this runs ssh-keyscan automatically.
-	if err := g.ensureHostKeys(); err != nil {
+	// For self-hosted or other providers, the keys are scanned automatically.
+	if err := ensureHostKeys(g.cfg); err != nil {
 		log.Printf("warning: could not ensure host keys: %v", err)
 	}
 
-	if _, err := os.Stat(filepath.Join(repoDir, ".git")); err == nil {
+	if _, err := os.Stat(filepath.Join(g.cfg.RepoDir, ".git")); err == nil {
 		log.Println("git: repo already cloned, pulling instead")
-		return g.pullLocked()
+		if err := g.recoverLocked(); err != nil {
+			return err
+		}
+		if err := g.configure(); err != nil {
+			return err
+		}
+		if err := g.sparseCheckout(); err != nil {
+			return err
+		}
+		if err := g.pullLocked(); err != nil {
+			return err
+		}
+		return g.checkoutPreviewBranch()
 	}
 
-	if err := os.MkdirAll(repoDir, 0755); err != nil {
+	if err := makeDirs(g.cfg, g.cfg.RepoDir); err != nil {
 		return fmt.Errorf("creating repo dir: %w", err)
 	}
 
-	cloneArgs := []string{"clone", "--branch", g.cfg.Branch, "--single-branch", g.cfg.GitRepo, repoDir}
-	err := g.run("/app", "git", cloneArgs...)
-	if err != nil && !g.cfg.SSHInsecure {
+	cloneArgs := []string{"clone", "--branch", g.cfg.Branch, "--single-branch"}
+	if g.cfg.CloneDepth > 0 {
+		cloneArgs = append(cloneArgs, "--depth", strconv.Itoa(g.cfg.CloneDepth))
+	}
+	if g.cfg.CloneFilter != "" {
+		// Blobs outside the checkout are fetched on demand from origin
+		cloneArgs = append(cloneArgs, "--filter="+g.cfg.CloneFilter)
+	}
+	if g.cfg.SparseCheckout {
+		// Only files at the top level are checked out until sparseCheckout
+		// adds the directories
+		cloneArgs = append(cloneArgs, "--sparse")
+	}
+	cloneArgs = append(cloneArgs, g.cfg.GitRepo, g.cfg.RepoDir)
+	err := g.run(filepath.Dir(g.cfg.RepoDir), "git", cloneArgs...)
+	if err != nil && !g.cfg.SSHInsecure && isSSHRemote(g.cfg.GitRepo) {
 		// Clone failed — possibly stale host keys. Refresh and retry once.
 		log.Printf("git clone failed, refreshing SSH host keys and retrying")
-		if scanErr := g.refreshHostKeys(); scanErr != nil {
-			log.Printf("ssh-keyscan failed: %v", scanErr)
+		if scanErr := refreshHostKeys(g.cfg); scanErr != nil {
+			log.Printf("host key scan failed: %v", scanErr)
 			return fmt.Errorf("git clone: %w", err)
 		}
-		if rmErr := os.RemoveAll(repoDir); rmErr != nil {
+		if rmErr := os.RemoveAll(g.cfg.RepoDir); rmErr != nil {
 			return fmt.Errorf("removing repo dir before retry: %w", rmErr)
 		}
-		if mkErr := os.MkdirAll(repoDir, 0755); mkErr != nil {
+		if mkErr := makeDirs(g.cfg, g.cfg.RepoDir); mkErr != nil {
 			return fmt.Errorf("creating repo dir before retry: %w", mkErr)
 		}
-		err = g.run("/app", "git", cloneArgs...)
+		err = g.run(filepath.Dir(g.cfg.RepoDir), "git", cloneArgs...)
 	}
 	if err != nil {
 		return fmt.Errorf("git clone: %w", err)
 	}
 
-	// Configure git user for commits
-	if err := g.run(repoDir, "git", "config", "user.email", "staticomment@quietlife.net"); err != nil {
-		return fmt.Errorf("git config email: %w", err)
+	if err := g.configure(); err != nil {
+		return err
+	}
+	if err := g.sparseCheckout(); err != nil {
+		return err
+	}
+
+	return g.checkoutPreviewBranch()
+}
+
+// Reclone discards the clone, including any unpushed commits, and clones
+// the repo afresh.
+func (g *GitRepo) Reclone() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.recloneLocked()
+}
+
+func (g *GitRepo) recloneLocked() error {
+	log.Printf("git: removing the clone in %s", g.cfg.RepoDir)
+	if err := emptyDir(g.cfg, g.cfg.RepoDir); err != nil {
+		return fmt.Errorf("removing clone: %w", err)
+	}
+	return g.cloneLocked()
+}
+
+// recoverLocked repairs the clone if an interrupted operation left it
+// broken, keeping the working tree content of paths; see recoverClone.
+func (g *GitRepo) recoverLocked(paths ...string) error {
+	// Until checkoutPreviewBranch has run, a clone for preview mode is still
+	// on the branch
+	branches := []string{g.workBranch(), g.cfg.Branch}
+	return recoverClone(g.cfg, branches, paths, g.forceCheckoutLocked, g.recloneLocked)
+}
+
+// forceCheckoutLocked checks out the work branch, discarding changes to the
+// working tree.
+func (g *GitRepo) forceCheckoutLocked() error {
+	if err := g.run(g.cfg.RepoDir, "git", "checkout", "--force", g.workBranch()); err != nil {
+		return fmt.Errorf("git checkout %s: %w", g.workBranch(), err)
+	}
+	return nil
+}
+
+// configure sets the identity commits are made as and whether they're
+// signed. Like sparseCheckout it's rerun on every start, so config changes
+// apply to an existing clone.
+func (g *GitRepo) configure() error {
+	settings := [][2]string{
+		{"user.name", g.cfg.GitName},
+		{"user.email", g.cfg.GitEmail},
+		{"commit.gpgsign", "false"},
+	}
+	if g.cfg.SigningKey != "" {
+		// git signs through ssh-keygen -Y sign, given the private key file
+		settings = append(settings[:2],
+			[2]string{"gpg.format", SigningSSH},
+			[2]string{"user.signingkey", g.cfg.SigningKey},
+			[2]string{"commit.gpgsign", "true"})
+	}
+	for _, kv := range settings {
+		if err := g.run(g.cfg.RepoDir, "git", "config", kv[0], kv[1]); err != nil {
+			return fmt.Errorf("git config %s: %w", kv[0], err)
+		}
+	}
+	return nil
+}
+
+// sparseCheckout limits the working tree to the directories the server
+// reads and writes, so a site's media and other content are never written
+// to disk. It's rerun on every start, so the checkout follows path changes.
+func (g *GitRepo) sparseCheckout() error {
+	if !g.cfg.SparseCheckout {
+		return nil
+	}
+	args := []string{"sparse-checkout", "set", "--cone"}
+	for _, dir := range []string{g.cfg.CommentsPath, g.cfg.QuarantinePath, g.cfg.PostsPath,
+		g.cfg.IndexPath, g.cfg.StatePath, g.cfg.TemplatesPath} {
+		if dir != "" {
+			args = append(args, filepath.ToSlash(dir))
+		}
 	}
-	if err := g.run(repoDir, "git", "config", "user.name", "staticomment"); err != nil {
-		return fmt.Errorf("git config name: %w", err)
+	if err := g.run(g.cfg.RepoDir, "git", args...); err != nil {
+		return fmt.Errorf("git sparse-checkout: %w", err)
 	}
+	return nil
+}
 
+// checkoutPreviewBranch switches the clone to the local-only preview branch
+// when preview mode is enabled. The branch is created from the current HEAD
+// if it does not already exist, and is never pushed.
+func (g *GitRepo) checkoutPreviewBranch() error {
+	if !g.cfg.PreviewMode {
+		return nil
+	}
+	branch := g.cfg.PreviewBranch
+	if err := g.run(g.cfg.RepoDir, "git", "rev-parse", "--verify", "--quiet", "refs/heads/"+branch); err == nil {
+		if err := g.run(g.cfg.RepoDir, "git", "checkout", branch); err != nil {
+			return fmt.Errorf("git checkout %s: %w", branch, err)
+		}
+		return nil
+	}
+	if err := g.run(g.cfg.RepoDir, "git", "checkout", "-b", branch); err != nil {
+		return fmt.Errorf("git checkout -b %s: %w", branch, err)
+	}
+	log.Printf("git: preview mode, committing to local branch %s", branch)
 	return nil
 }
 
 func (g *GitRepo) pullLocked() error {
-	return g.run(repoDir, "git", "pull", "--rebase")
+	// Autostash so uncommitted edits to tracked files (e.g. the comment index)
+	// don't block the rebase
+	args := []string{"pull", "--rebase", "--autostash"}
+	// While rebasing, "theirs" is the commit being replayed, ours
+	switch g.cfg.Conflicts {
+	case ConflictLocal:
+		args = append(args, "-X", "theirs")
+	case ConflictRemote:
+		args = append(args, "-X", "ours")
+	}
+	if g.cfg.PreviewMode {
+		// The preview branch has no upstream; rebase onto the remote branch explicitly
+		args = append(args, "origin", g.cfg.Branch)
+	}
+	err := g.run(g.cfg.RepoDir, "git", args...)
+	if err != nil && g.rebasing() {
+		// Conflicts the strategy didn't settle leave the rebase stopped
+		// partway; abort it so the branch is back as it was
+		g.run(g.cfg.RepoDir, "git", "rebase", "--abort")
+	}
+	return err
+}
+
+// rebasing reports whether a rebase is stopped partway in the clone.
+func (g *GitRepo) rebasing() bool {
+	for _, name := range []string{"rebase-merge", "rebase-apply"} {
+		if _, err := os.Stat(filepath.Join(g.cfg.RepoDir, ".git", name)); err == nil {
+			return true
+		}
+	}
+	return false
 }
 
 func (g *GitRepo) Pull() error {
 	g.mu.Lock()
 	defer g.mu.Unlock()
+	if err := g.recoverLocked(); err != nil {
+		return err
+	}
 	return g.pullLocked()
 }
 
-const pushMaxRetries = 3
+// pushBackoff is how long to wait after the attempt'th failed push, from
+// STATICOMMENT_PUSH_BACKOFF doubling up to STATICOMMENT_PUSH_MAX_BACKOFF.
+func pushBackoff(cfg *Config, attempt int) time.Duration {
+	return jitteredBackoff(time.Duration(cfg.PushBackoff)*time.Second, time.Duration(cfg.PushMaxBackoff)*time.Second, attempt)
+}
 
-func (g *GitRepo) CommitAndPush(filePath, slug string) error {
+// CommitAndPush commits the given repo-relative paths with msg and pushes,
+// rebasing and retrying if the remote has moved on.
+func (g *GitRepo) CommitAndPush(author Author, msg string, paths ...string) error {
 	g.mu.Lock()
 	defer g.mu.Unlock()
 
+	if err := g.recoverLocked(paths...); err != nil {
+		return err
+	}
 	if err := g.pullLocked(); err != nil {
 		return fmt.Errorf("git pull before commit: %w", err)
 	}
 
-	if err := g.run(repoDir, "git", "add", filePath); err != nil {
+	if err := g.run(g.cfg.RepoDir, "git", append([]string{"add", "--"}, paths...)...); err != nil {
 		return fmt.Errorf("git add: %w", err)
 	}
 
-	msg := fmt.Sprintf("Add comment on %s", slug)
-	if err := g.run(repoDir, "git", "commit", "-m", msg); err != nil {
-		return fmt.Errorf("git commit: %w", err)
+	if g.cfg.PreviewMode {
+		msg = "[preview] " + msg
+	}
+	// Nothing staged means a retried publish whose commit already exists
+	// locally or upstream; skip straight to pushing
+	if err := g.run(g.cfg.RepoDir, "git", "diff", "--cached", "--quiet"); err != nil {
+		if err := g.run(g.cfg.RepoDir, "git", commitArgs(author, msg, g.clock.Now())...); err != nil {
+			return fmt.Errorf("git commit: %w", err)
+		}
+	}
+
+	if g.cfg.PreviewMode {
+		log.Printf("git: preview mode, skipping push (committed to %s)", g.cfg.PreviewBranch)
+		return nil
 	}
 
-	// Retry push with rebase on failure (e.g. non-fast-forward rejection)
-	for attempt := 0; attempt < pushMaxRetries; attempt++ {
-		err := g.run(repoDir, "git", "push")
-		if err == nil {
+	// Retry push with rebase on failure (e.g. non-fast-forward rejection),
+	// backing off in case the remote is down
+	var err error
+	for attempt := 1; attempt <= g.cfg.PushRetries; attempt++ {
+		if err = g.run(g.cfg.RepoDir, "git", "push"); err == nil {
+			g.mirrors.Notify()
 			return nil
 		}
-		log.Printf("git push attempt %d failed: %v, retrying after pull --rebase", attempt+1, err)
+		if attempt == g.cfg.PushRetries {
+			break
+		}
+		backoff := pushBackoff(g.cfg, attempt)
+		log.Printf("git push attempt %d failed: %v, retrying in %s after pull --rebase", attempt, err, backoff.Round(time.Millisecond))
+		time.Sleep(backoff)
 		if pullErr := g.pullLocked(); pullErr != nil {
-			// Rebase may have left a conflicted state — abort it
-			g.run(repoDir, "git", "rebase", "--abort")
-			return fmt.Errorf("git pull during push retry: %w", pullErr)
+			log.Printf("git pull during push retry failed: %v", pullErr)
 		}
 	}
-	return fmt.Errorf("git push failed after %d attempts", pushMaxRetries)
+	return fmt.Errorf("git push failed after %d attempts: %w", g.cfg.PushRetries, err)
+}
+
+// pushMirror pushes the branch, as last pushed to the repo, to a
+// STATICOMMENT_GIT_MIRRORS remote. Local commits that didn't make it to the
+// repo stay off the mirror.
+func (g *GitRepo) pushMirror(remote string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.run(g.cfg.RepoDir, "git", "push", remote, "refs/remotes/origin/"+g.cfg.Branch+":refs/heads/"+g.cfg.Branch)
+}
+
+// workBranch is the branch the clone normally has checked out.
+func (g *GitRepo) workBranch() string {
+	if g.cfg.PreviewMode {
+		return g.cfg.PreviewBranch
+	}
+	return g.cfg.Branch
+}
+
+// CommitToBranch checks out branch, creating it from the current branch if
+// it doesn't exist yet, calls write to produce the repo-relative paths to
+// commit, then commits, pushes the branch and switches back. Reusing an
+// existing branch makes retries safe: an already-committed file leaves
+// nothing to commit and the push is a no-op.
+func (g *GitRepo) CommitToBranch(branch string, author Author, msg string, write func() ([]string, error)) (err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if err := g.recoverLocked(); err != nil {
+		return err
+	}
+	if err := g.pullLocked(); err != nil {
+		return fmt.Errorf("git pull before commit: %w", err)
+	}
+
+	if g.run(g.cfg.RepoDir, "git", "rev-parse", "--verify", "--quiet", "refs/heads/"+branch) == nil {
+		err = g.run(g.cfg.RepoDir, "git", "checkout", branch)
+	} else {
+		err = g.run(g.cfg.RepoDir, "git", "checkout", "-b", branch)
+	}
+	if err != nil {
+		return fmt.Errorf("git checkout %s: %w", branch, err)
+	}
+	defer func() {
+		if err != nil {
+			// Drop anything half-staged so it doesn't follow us back
+			g.run(g.cfg.RepoDir, "git", "reset", "--hard")
+		}
+		if coErr := g.run(g.cfg.RepoDir, "git", "checkout", g.workBranch()); coErr != nil && err == nil {
+			err = fmt.Errorf("git checkout %s: %w", g.workBranch(), coErr)
+		}
+	}()
+
+	paths, err := write()
+	if err != nil {
+		return err
+	}
+	if err := g.run(g.cfg.RepoDir, "git", append([]string{"add", "--"}, paths...)...); err != nil {
+		return fmt.Errorf("git add: %w", err)
+	}
+	if g.cfg.PreviewMode {
+		msg = "[preview] " + msg
+	}
+	if err := g.run(g.cfg.RepoDir, "git", "diff", "--cached", "--quiet"); err != nil {
+		if err := g.run(g.cfg.RepoDir, "git", commitArgs(author, msg, g.clock.Now())...); err != nil {
+			return fmt.Errorf("git commit: %w", err)
+		}
+	}
+
+	if g.cfg.PreviewMode {
+		log.Printf("git: preview mode, skipping push of %s", branch)
+		return nil
+	}
+	if err := g.run(g.cfg.RepoDir, "git", "push", "origin", branch); err != nil {
+		return fmt.Errorf("git push %s: %w", branch, err)
+	}
+	return nil
 }
 
 // FullPath returns the absolute path for a file relative to the repo root.
 func (g *GitRepo) FullPath(relPath string) string {
-	return filepath.Join(repoDir, relPath)
+	return filepath.Join(g.cfg.RepoDir, relPath)
 }
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// githubAppTokenMargin is how long before it expires an installation token
+// is replaced, so a token is never handed out to expire mid-push.
+const githubAppTokenMargin = 5 * time.Minute
+
+// GitHubApp authenticates as an installation of a GitHub App: requests are
+// made with installation tokens, which last an hour and are minted as
+// needed with a JWT signed by the app's private key. This takes the place
+// of a personal access token or deploy key tied to someone's account.
+type GitHubApp struct {
+	api          string
+	appID        string
+	installation string // looked up from repo when not configured
+	repo         string
+	key          *rsa.PrivateKey
+	client       *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// LoadGitHubApp reads the app's private key, as downloaded from its
+// settings page, for acting on repo (owner/name) through api.
+func LoadGitHubApp(api, appID, installation, keyPath, repo string) (*GitHubApp, error) {
+	if _, err := strconv.ParseInt(appID, 10, 64); err != nil {
+		return nil, fmt.Errorf("app ID must be a number")
+	}
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading private key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("private key %s is not PEM", keyPath)
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		parsed, err8 := x509.ParsePKCS8PrivateKey(block.Bytes)
+		var ok bool
+		if key, ok = parsed.(*rsa.PrivateKey); err8 != nil || !ok {
+			return nil, fmt.Errorf("private key %s is not an RSA key", keyPath)
+		}
+	}
+	return &GitHubApp{
+		api:          strings.TrimSuffix(api, "/"),
+		appID:        appID,
+		installation: installation,
+		repo:         repo,
+		key:          key,
+		client:       &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// Token returns an installation token, minting a new one when the last is
+// about to expire.
+func (a *GitHubApp) Token() (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.token != "" && time.Until(a.expires) > githubAppTokenMargin {
+		return a.token, nil
+	}
+	jwt, err := a.jwt(time.Now())
+	if err != nil {
+		return "", err
+	}
+	if a.installation == "" {
+		var inst struct {
+			ID int64 `json:"id"`
+		}
+		if err := a.request(http.MethodGet, "/repos/"+a.repo+"/installation", jwt, &inst); err != nil {
+			return "", fmt.Errorf("finding the app's installation on %s: %w", a.repo, err)
+		}
+		a.installation = strconv.FormatInt(inst.ID, 10)
+		log.Printf("github app: installation %s for %s", a.installation, a.repo)
+	}
+	var minted struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+	if err := a.request(http.MethodPost, "/app/installations/"+a.installation+"/access_tokens", jwt, &minted); err != nil {
+		return "", fmt.Errorf("minting installation token: %w", err)
+	}
+	if minted.Token == "" {
+		return "", fmt.Errorf("minting installation token: no token in response")
+	}
+	a.token, a.expires = minted.Token, minted.ExpiresAt
+	return a.token, nil
+}
+
+// jwt returns the app's JWT for now, good for nine minutes. It's dated a
+// minute back, as GitHub suggests, in case our clock is ahead of theirs.
+func (a *GitHubApp) jwt(now time.Time) (string, error) {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]any{
+		"iss": a.appID,
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+	})
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("signing app JWT: %w", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// request makes an API request as the app and decodes the response into
+// out.
+func (a *GitHubApp) request(method, path, jwt string, out any) error {
+	req, err := http.NewRequest(method, a.api+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+jwt)
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("X-GitHub-Api-Version", "2022-11-28")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	return json.Unmarshal(data, out)
+}
+
+// apiToken returns static, or without one, an installation token of the
+// configured GitHub App.
+func (c *Config) apiToken(static string) (string, error) {
+	if static == "" && c.GitHubApp != nil {
+		return c.GitHubApp.Token()
+	}
+	return static, nil
+}
+
+// gitToken returns the token HTTPS remotes authenticate with, if any. A
+// GitHub App token that can't be minted is logged and left out, so the git
+// command fails and is retried like any other.
+func (c *Config) gitToken() string {
+	token, err := c.apiToken(c.GitToken)
+	if err != nil {
+		log.Printf("warning: github app: %v", err)
+	}
+	return token
+}
+
+// hasPRToken reports whether moderation pull requests and issues can be
+// opened: with STATICOMMENT_PR_TOKEN, or on GitHub as the app.
+func (c *Config) hasPRToken() bool {
+	return c.PRToken != "" || (c.GitHubApp != nil && c.PRProvider == ProviderGitHub)
+}
@@ -0,0 +1,816 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	git "github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"github.com/go-git/go-git/v5/utils/merkletrie"
+	"golang.org/x/crypto/ssh"
+)
+
+// GoGitRepo is the default Repo for STATICOMMENT_BACKEND=git. It keeps the
+// same clone in STATICOMMENT_REPO_DIR as GitRepo, but talks to the remote
+// with go-git, so the binary has no runtime dependency on git or ssh
+// executables (except for local file:// remotes, which go-git serves through
+// git-upload-pack).
+//
+// go-git has no rebase or stash, so pulls replay local commits onto the
+// fetched branch themselves; see pullLocked.
+type GoGitRepo struct {
+	cfg     *Config
+	mu      sync.Mutex
+	repo    *git.Repository
+	signer  git.Signer
+	mirrors *Mirrors
+	clock   Clock
+}
+
+func NewGoGitRepo(cfg *Config) *GoGitRepo {
+	g := &GoGitRepo{cfg: cfg, clock: NewClock(cfg)}
+	if len(cfg.GitMirrors) > 0 {
+		g.mirrors = NewMirrors(cfg.GitMirrors, g.pushMirror)
+		go g.mirrors.Run()
+	}
+	return g
+}
+
+// auth returns the credentials for the remote: the SSH key, checked against
+// known_hosts, for SSH URLs, STATICOMMENT_GIT_TOKEN for HTTPS URLs, and
+// nothing otherwise.
+func (g *GoGitRepo) auth() (transport.AuthMethod, error) {
+	return g.authFor(g.cfg.GitRepo)
+}
+
+// authFor returns the credentials for remote, as auth does for the repo.
+// The token is only sent to the repo's own host; other HTTPS remotes get
+// whatever credentials their URL carries.
+func (g *GoGitRepo) authFor(remote string) (transport.AuthMethod, error) {
+	ep, err := transport.NewEndpoint(remote)
+	if err != nil {
+		return nil, fmt.Errorf("parsing repo URL: %w", err)
+	}
+	if ep.Protocol == "https" || ep.Protocol == "http" {
+		if token := g.cfg.gitToken(); token != "" && ep.Host == extractHost(g.cfg.GitRepo) {
+			return &githttp.BasicAuth{Username: g.cfg.GitUsername, Password: token}, nil
+		}
+	}
+	if ep.Protocol != "ssh" {
+		return nil, nil
+	}
+	user := ep.User
+	if user == "" {
+		user = "git"
+	}
+	signers, err := sshSigners(g.cfg.SSHKeyPaths)
+	if err != nil {
+		return nil, err
+	}
+	// The server is offered each key in turn until it accepts one
+	auth := &gitssh.PublicKeysCallback{User: user, Callback: func() ([]ssh.Signer, error) { return signers, nil }}
+	if g.cfg.SSHInsecure {
+		auth.HostKeyCallback = ssh.InsecureIgnoreHostKey()
+		return auth, nil
+	}
+	// Read known_hosts afresh each time so refreshed keys are picked up
+	db, err := gitssh.NewKnownHostsDb(g.cfg.KnownHostsPath)
+	if err != nil {
+		return nil, fmt.Errorf("loading known_hosts: %w", err)
+	}
+	port := ep.Port
+	if port == 0 {
+		port = 22
+	}
+	auth.HostKeyCallback = db.HostKeyCallback()
+	// Only offer the key types we have, or the server may pick another
+	// and fail verification
+	auth.HostKeyAlgorithms = db.HostKeyAlgorithms(net.JoinHostPort(ep.Host, strconv.Itoa(port)))
+	return auth, nil
+}
+
+// sshSigners loads the deploy keys at paths. A missing key is skipped, so
+// during a rotation the new key can be listed before it's in place and the
+// old one removed before it's unlisted; one that can't be parsed is skipped
+// with a warning.
+func sshSigners(paths []string) ([]ssh.Signer, error) {
+	var signers []ssh.Signer
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("loading SSH key: %w", err)
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			log.Printf("warning: skipping SSH key %s: %v", path, err)
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("loading SSH key: none of %s found", strings.Join(paths, ", "))
+	}
+	return signers, nil
+}
+
+func (g *GoGitRepo) signature() *object.Signature {
+	return &object.Signature{Name: g.cfg.GitName, Email: g.cfg.GitEmail, When: g.clock.Now()}
+}
+
+// authorSignature returns the signature for author, defaulting to ours.
+func (g *GoGitRepo) authorSignature(author Author) *object.Signature {
+	if author == (Author{}) {
+		return g.signature()
+	}
+	return &object.Signature{Name: author.Name, Email: author.Email, When: g.clock.Now()}
+}
+
+// CheckRemote verifies the remote is reachable and has the configured
+// branch. It lists the remote's refs without touching the clone, so it
+// doesn't take the lock.
+func (g *GoGitRepo) CheckRemote() error {
+	auth, err := g.auth()
+	if err != nil {
+		return err
+	}
+	remote := git.NewRemote(memory.NewStorage(), &gitconfig.RemoteConfig{Name: "origin", URLs: []string{g.cfg.GitRepo}})
+	ctx, cancel := gitContext(g.cfg)
+	defer cancel()
+	refs, err := remote.ListContext(ctx, &git.ListOptions{Auth: auth})
+	if err != nil {
+		return fmt.Errorf("git ls-remote: %w", timedOut(ctx, g.cfg, "listing remote refs", err))
+	}
+	want := plumbing.NewBranchReferenceName(g.cfg.Branch)
+	for _, ref := range refs {
+		if ref.Name() == want {
+			return nil
+		}
+	}
+	return fmt.Errorf("git ls-remote: branch %s not found", g.cfg.Branch)
+}
+
+func (g *GoGitRepo) Clone() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.cloneLocked()
+}
+
+func (g *GoGitRepo) cloneLocked() error {
+	if err := ensureHostKeys(g.cfg); err != nil {
+		log.Printf("warning: could not ensure host keys: %v", err)
+	}
+	if g.cfg.SigningKey != "" && g.signer == nil {
+		signer, err := NewCommitSigner(g.cfg)
+		if err != nil {
+			return err
+		}
+		g.signer = signer
+	}
+
+	if _, err := os.Stat(filepath.Join(g.cfg.RepoDir, ".git")); err == nil {
+		log.Println("git: repo already cloned, pulling instead")
+		if g.repo, err = git.PlainOpen(g.cfg.RepoDir); err != nil {
+			log.Printf("git: opening the clone failed (%v), cloning afresh", err)
+			return g.recloneLocked()
+		}
+		if err := g.recoverLocked(); err != nil {
+			return err
+		}
+		if err := g.pullLocked(); err != nil {
+			return err
+		}
+		return g.checkoutPreviewBranch()
+	}
+
+	if err := makeDirs(g.cfg, g.cfg.RepoDir); err != nil {
+		return fmt.Errorf("creating repo dir: %w", err)
+	}
+	err := g.clone()
+	if err != nil && !g.cfg.SSHInsecure {
+		// Clone failed — possibly stale host keys. Refresh and retry once.
+		log.Printf("git clone failed (%v), refreshing SSH host keys and retrying", err)
+		if scanErr := refreshHostKeys(g.cfg); scanErr != nil {
+			log.Printf("host key scan failed: %v", scanErr)
+			return fmt.Errorf("git clone: %w", err)
+		}
+		if rmErr := os.RemoveAll(g.cfg.RepoDir); rmErr != nil {
+			return fmt.Errorf("removing repo dir before retry: %w", rmErr)
+		}
+		if mkErr := makeDirs(g.cfg, g.cfg.RepoDir); mkErr != nil {
+			return fmt.Errorf("creating repo dir before retry: %w", mkErr)
+		}
+		err = g.clone()
+	}
+	if err != nil {
+		return fmt.Errorf("git clone: %w", err)
+	}
+	return g.checkoutPreviewBranch()
+}
+
+func (g *GoGitRepo) clone() error {
+	auth, err := g.auth()
+	if err != nil {
+		return err
+	}
+	log.Printf("git: cloning %s (branch %s) into %s", sanitizeArgs([]string{g.cfg.GitRepo})[0], g.cfg.Branch, g.cfg.RepoDir)
+	ctx, cancel := gitContext(g.cfg)
+	defer cancel()
+	repo, err := git.PlainCloneContext(ctx, g.cfg.RepoDir, false, &git.CloneOptions{
+		URL:           g.cfg.GitRepo,
+		Auth:          auth,
+		ReferenceName: plumbing.NewBranchReferenceName(g.cfg.Branch),
+		SingleBranch:  true,
+		Depth:         g.cfg.CloneDepth,
+	})
+	if err != nil {
+		return timedOut(ctx, g.cfg, "clone", err)
+	}
+	g.repo = repo
+
+	// Set the identity in the clone too, so switching to the CLI backend
+	// later can commit in it
+	cfg, err := repo.Config()
+	if err != nil {
+		return fmt.Errorf("git config: %w", err)
+	}
+	cfg.User.Name = g.cfg.GitName
+	cfg.User.Email = g.cfg.GitEmail
+	if err := repo.SetConfig(cfg); err != nil {
+		return fmt.Errorf("git config: %w", err)
+	}
+	return nil
+}
+
+// Reclone discards the clone, including any unpushed commits, and clones
+// the repo afresh.
+func (g *GoGitRepo) Reclone() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.recloneLocked()
+}
+
+func (g *GoGitRepo) recloneLocked() error {
+	log.Printf("git: removing the clone in %s", g.cfg.RepoDir)
+	if err := emptyDir(g.cfg, g.cfg.RepoDir); err != nil {
+		return fmt.Errorf("removing clone: %w", err)
+	}
+	return g.cloneLocked()
+}
+
+// recoverLocked repairs the clone if an interrupted operation left it
+// broken, keeping the working tree content of paths; see recoverClone.
+func (g *GoGitRepo) recoverLocked(paths ...string) error {
+	// Until checkoutPreviewBranch has run, a clone for preview mode is still
+	// on the branch
+	branches := []string{g.workBranch(), g.cfg.Branch}
+	return recoverClone(g.cfg, branches, paths, g.forceCheckoutLocked, g.recloneLocked)
+}
+
+// forceCheckoutLocked checks out the work branch, discarding changes to the
+// working tree.
+func (g *GoGitRepo) forceCheckoutLocked() error {
+	wt, err := g.repo.Worktree()
+	if err != nil {
+		return err
+	}
+	if err := wt.Checkout(&git.CheckoutOptions{Branch: plumbing.NewBranchReferenceName(g.workBranch()), Force: true}); err != nil {
+		return fmt.Errorf("git checkout %s: %w", g.workBranch(), err)
+	}
+	return nil
+}
+
+// checkoutPreviewBranch switches the clone to the local-only preview branch
+// when preview mode is enabled, creating it from HEAD if needed.
+func (g *GoGitRepo) checkoutPreviewBranch() error {
+	if !g.cfg.PreviewMode {
+		return nil
+	}
+	wt, err := g.repo.Worktree()
+	if err != nil {
+		return err
+	}
+	ref := plumbing.NewBranchReferenceName(g.cfg.PreviewBranch)
+	_, refErr := g.repo.Reference(ref, false)
+	if err := wt.Checkout(&git.CheckoutOptions{Branch: ref, Create: refErr != nil, Keep: true}); err != nil {
+		return fmt.Errorf("git checkout %s: %w", g.cfg.PreviewBranch, err)
+	}
+	if refErr != nil {
+		log.Printf("git: preview mode, committing to local branch %s", g.cfg.PreviewBranch)
+	}
+	return nil
+}
+
+// pullLocked fetches the branch and brings the checked-out branch up to
+// date with it, like git pull --rebase --autostash: local commits that
+// aren't upstream yet are replayed on top, and uncommitted changes are
+// carried over.
+func (g *GoGitRepo) pullLocked() error {
+	auth, err := g.auth()
+	if err != nil {
+		return err
+	}
+	log.Printf("git: pulling %s", g.cfg.Branch)
+	tracking := plumbing.NewRemoteReferenceName("origin", g.cfg.Branch)
+	var prev plumbing.Hash
+	if ref, err := g.repo.Reference(tracking, true); err == nil {
+		prev = ref.Hash()
+	}
+	spec := gitconfig.RefSpec("+refs/heads/" + g.cfg.Branch + ":" + tracking.String())
+	ctx, cancel := gitContext(g.cfg)
+	defer cancel()
+	err = g.repo.FetchContext(ctx, &git.FetchOptions{RemoteName: "origin", Auth: auth, RefSpecs: []gitconfig.RefSpec{spec}})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return fmt.Errorf("git fetch: %w", timedOut(ctx, g.cfg, "fetch", err))
+	}
+	upstream, err := g.repo.Reference(tracking, true)
+	if err != nil {
+		return fmt.Errorf("git fetch: %w", err)
+	}
+	if err := g.rebaseLocked(prev, upstream.Hash()); err != nil {
+		// The branch is back where it was, so the tracking ref goes back
+		// too, or the next pull would take prev for its fork point
+		if !prev.IsZero() {
+			if refErr := g.repo.Storer.SetReference(plumbing.NewHashReference(tracking, prev)); refErr != nil {
+				log.Printf("warning: restoring %s: %v", tracking.Short(), refErr)
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+// rebaseLocked moves the checked-out branch onto onto, replaying any commits
+// of its own on top. Where a replayed commit touches a file that also
+// changed upstream, STATICOMMENT_CONFLICT_STRATEGY picks the version kept;
+// an uncommitted change always wins, as it's about to be committed. On
+// failure the branch is put back as it was.
+//
+// Our own commits are the ones since prev, where origin/<branch> pointed
+// before the fetch, like git's fork point. Unlike a merge base that needs
+// no history beyond them, so it works in shallow clones. If prev isn't in
+// the branch's history after all, the merge base is used instead.
+func (g *GoGitRepo) rebaseLocked(prev, onto plumbing.Hash) (err error) {
+	head, err := g.repo.Head()
+	if err != nil {
+		return fmt.Errorf("git rev-parse HEAD: %w", err)
+	}
+	if head.Hash() == onto {
+		return nil
+	}
+	c, err := g.repo.CommitObject(head.Hash())
+	if err != nil {
+		return err
+	}
+	if prev.IsZero() {
+		// No tracking ref to go by, e.g. a clone made elsewhere
+		if prev, err = g.mergeBase(c, onto); err != nil {
+			return err
+		}
+	}
+
+	// Our commits since the fork point, oldest first
+	local, ahead, err := commitsSince(c, prev, onto)
+	if err != nil {
+		base, baseErr := g.mergeBase(c, onto)
+		if baseErr != nil {
+			return fmt.Errorf("git rebase: %s has no history in common with origin/%s, reclone to recover: %w", head.Name().Short(), g.cfg.Branch, err)
+		}
+		if local, ahead, err = commitsSince(c, base, onto); err != nil {
+			return fmt.Errorf("git rebase: %w", err)
+		}
+	}
+	if ahead {
+		// Only ahead of upstream; nothing to pull
+		return nil
+	}
+
+	stash, err := g.stashLocked()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			// Put the branch back so unpushed commits aren't lost
+			g.resetLocked(head.Hash())
+		}
+		if stashErr := g.unstashLocked(stash); stashErr != nil && err == nil {
+			err = stashErr
+		}
+	}()
+	if err := g.resetLocked(onto); err != nil {
+		return err
+	}
+	for _, c := range local {
+		if err := g.replayLocked(c); err != nil {
+			return fmt.Errorf("git rebase: replaying %s: %w", c.Hash, err)
+		}
+	}
+	if len(local) > 0 {
+		log.Printf("git: replayed %d local commit(s) onto origin/%s", len(local), g.cfg.Branch)
+	}
+	return nil
+}
+
+// commitsSince returns c and its first-parent ancestors down to, not
+// including, base, oldest first. ahead is true if onto is among them, as
+// then there's nothing to replay.
+func commitsSince(c *object.Commit, base, onto plumbing.Hash) (local []*object.Commit, ahead bool, err error) {
+	for c.Hash != base {
+		if c.Hash == onto {
+			return nil, true, nil
+		}
+		local = append([]*object.Commit{c}, local...)
+		if c, err = c.Parent(0); err != nil {
+			return nil, false, err
+		}
+	}
+	return local, false, nil
+}
+
+func (g *GoGitRepo) mergeBase(c *object.Commit, onto plumbing.Hash) (plumbing.Hash, error) {
+	other, err := g.repo.CommitObject(onto)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	bases, err := c.MergeBase(other)
+	if err != nil {
+		return plumbing.ZeroHash, fmt.Errorf("git merge-base: %w", err)
+	}
+	if len(bases) == 0 {
+		return plumbing.ZeroHash, fmt.Errorf("git merge-base: no history in common with origin/%s", g.cfg.Branch)
+	}
+	return bases[0].Hash, nil
+}
+
+func (g *GoGitRepo) resetLocked(hash plumbing.Hash) error {
+	wt, err := g.repo.Worktree()
+	if err != nil {
+		return err
+	}
+	if err := wt.Reset(&git.ResetOptions{Commit: hash, Mode: git.HardReset}); err != nil {
+		return fmt.Errorf("git reset: %w", err)
+	}
+	return nil
+}
+
+// replayLocked applies c's changes to the working tree and commits them
+// with c's author and message. A commit whose changes are already upstream
+// leaves nothing to commit and is dropped, as git rebase does.
+func (g *GoGitRepo) replayLocked(c *object.Commit) error {
+	parent, err := c.Parent(0)
+	if err != nil {
+		return err
+	}
+	from, err := parent.Tree()
+	if err != nil {
+		return err
+	}
+	to, err := c.Tree()
+	if err != nil {
+		return err
+	}
+	changes, err := object.DiffTree(from, to)
+	if err != nil {
+		return err
+	}
+	var paths []string
+	for _, ch := range changes {
+		action, err := ch.Action()
+		if err != nil {
+			return err
+		}
+		name := ch.To.Name
+		if action == merkletrie.Delete {
+			name = ch.From.Name
+		}
+		conflict, err := g.conflicts(name, ch, from, to)
+		if err != nil {
+			return err
+		}
+		if conflict {
+			switch g.cfg.Conflicts {
+			case ConflictFail:
+				return fmt.Errorf("%s was changed upstream too", name)
+			case ConflictRemote:
+				log.Printf("git: %s was changed upstream too, keeping the upstream version", name)
+				continue
+			}
+			log.Printf("git: %s was changed upstream too, keeping the local version", name)
+		}
+		if action == merkletrie.Delete {
+			if err := os.Remove(g.FullPath(ch.From.Name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			paths = append(paths, ch.From.Name)
+			continue
+		}
+		f, err := to.File(ch.To.Name)
+		if err != nil {
+			return err
+		}
+		data, err := f.Contents()
+		if err != nil {
+			return err
+		}
+		if err := makeDirs(g.cfg, filepath.Dir(g.FullPath(ch.To.Name))); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(g.cfg, g.FullPath(ch.To.Name), []byte(data)); err != nil {
+			return err
+		}
+		paths = append(paths, ch.To.Name)
+	}
+	return g.commitLocked(c.Message, &c.Author, paths)
+}
+
+// conflicts reports whether name, the file ch changes, has also been
+// changed in the working tree, that is upstream, to something other than
+// what ch changes it to.
+func (g *GoGitRepo) conflicts(name string, ch *object.Change, from, to *object.Tree) (bool, error) {
+	base, err := treeFile(from, ch.From.Name)
+	if err != nil {
+		return false, err
+	}
+	ours, err := treeFile(to, ch.To.Name)
+	if err != nil {
+		return false, err
+	}
+	data, err := os.ReadFile(g.FullPath(name))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false, err
+	}
+	var current *string
+	if err == nil {
+		s := string(data)
+		current = &s
+	}
+	same := func(a, b *string) bool { return a == nil && b == nil || a != nil && b != nil && *a == *b }
+	return !same(current, base) && !same(current, ours), nil
+}
+
+// treeFile returns the content of name in t, or nil if name is empty or t
+// has no such file.
+func treeFile(t *object.Tree, name string) (*string, error) {
+	if name == "" {
+		return nil, nil
+	}
+	f, err := t.File(name)
+	if errors.Is(err, object.ErrFileNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, err := f.Contents()
+	if err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
+
+// stashLocked saves the uncommitted changes in the working tree: each
+// changed file's content, or nil for a deleted one.
+func (g *GoGitRepo) stashLocked() (map[string][]byte, error) {
+	wt, err := g.repo.Worktree()
+	if err != nil {
+		return nil, err
+	}
+	status, err := wt.Status()
+	if err != nil {
+		return nil, fmt.Errorf("git status: %w", err)
+	}
+	stash := make(map[string][]byte)
+	for path, s := range status {
+		if s.Worktree == git.Unmodified && s.Staging == git.Unmodified {
+			continue
+		}
+		data, err := os.ReadFile(g.FullPath(path))
+		if errors.Is(err, os.ErrNotExist) {
+			stash[path] = nil
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("git stash: %w", err)
+		}
+		stash[path] = data
+	}
+	return stash, nil
+}
+
+func (g *GoGitRepo) unstashLocked(stash map[string][]byte) error {
+	if err := writeFiles(g.cfg, g.cfg.RepoDir, stash); err != nil {
+		return fmt.Errorf("git stash pop: %w", err)
+	}
+	return nil
+}
+
+// commitLocked stages paths, removing any that no longer exist, and commits
+// them. Nothing staged means a retried publish whose commit already exists,
+// which isn't an error.
+func (g *GoGitRepo) commitLocked(msg string, author *object.Signature, paths []string) error {
+	wt, err := g.repo.Worktree()
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		if _, err := os.Stat(g.FullPath(p)); errors.Is(err, os.ErrNotExist) {
+			if _, err := wt.Remove(p); err != nil && !errors.Is(err, index.ErrEntryNotFound) {
+				return fmt.Errorf("git rm %s: %w", p, err)
+			}
+			continue
+		}
+		if _, err := wt.Add(p); err != nil {
+			return fmt.Errorf("git add %s: %w", p, err)
+		}
+	}
+	_, err = wt.Commit(msg, &git.CommitOptions{Author: author, Committer: g.signature(), Signer: g.signer})
+	if err != nil && !errors.Is(err, git.ErrEmptyCommit) {
+		return fmt.Errorf("git commit: %w", err)
+	}
+	return nil
+}
+
+func (g *GoGitRepo) pushLocked(branch string) error {
+	auth, err := g.auth()
+	if err != nil {
+		return err
+	}
+	log.Printf("git: pushing %s", branch)
+	ref := plumbing.NewBranchReferenceName(branch)
+	spec := gitconfig.RefSpec(ref + ":" + ref)
+	ctx, cancel := gitContext(g.cfg)
+	defer cancel()
+	err = g.repo.PushContext(ctx, &git.PushOptions{RemoteName: "origin", Auth: auth, RefSpecs: []gitconfig.RefSpec{spec}})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return timedOut(ctx, g.cfg, "push", err)
+	}
+	return nil
+}
+
+func (g *GoGitRepo) Pull() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if err := g.recoverLocked(); err != nil {
+		return err
+	}
+	return g.pullLocked()
+}
+
+// CommitAndPush commits the given repo-relative paths with msg and pushes,
+// replaying onto the remote branch and retrying if it has moved on.
+func (g *GoGitRepo) CommitAndPush(author Author, msg string, paths ...string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if err := g.recoverLocked(paths...); err != nil {
+		return err
+	}
+	if err := g.pullLocked(); err != nil {
+		return fmt.Errorf("git pull before commit: %w", err)
+	}
+	if g.cfg.PreviewMode {
+		msg = "[preview] " + msg
+	}
+	if err := g.commitLocked(msg, g.authorSignature(author), paths); err != nil {
+		return err
+	}
+
+	if g.cfg.PreviewMode {
+		log.Printf("git: preview mode, skipping push (committed to %s)", g.cfg.PreviewBranch)
+		return nil
+	}
+
+	var err error
+	for attempt := 1; attempt <= g.cfg.PushRetries; attempt++ {
+		if err = g.pushLocked(g.cfg.Branch); err == nil {
+			g.mirrors.Notify()
+			return nil
+		}
+		if attempt == g.cfg.PushRetries {
+			break
+		}
+		backoff := pushBackoff(g.cfg, attempt)
+		log.Printf("git push attempt %d failed: %v, retrying in %s after pull", attempt, err, backoff.Round(time.Millisecond))
+		time.Sleep(backoff)
+		if pullErr := g.pullLocked(); pullErr != nil {
+			log.Printf("git pull during push retry failed: %v", pullErr)
+		}
+	}
+	return fmt.Errorf("git push failed after %d attempts: %w", g.cfg.PushRetries, err)
+}
+
+// pushMirror pushes the branch, as last pushed to the repo, to a
+// STATICOMMENT_GIT_MIRRORS remote. Local commits that didn't make it to the
+// repo stay off the mirror.
+func (g *GoGitRepo) pushMirror(remote string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	auth, err := g.authFor(remote)
+	if err != nil {
+		return err
+	}
+	// An anonymous remote with no fetch refspecs, so pushing doesn't touch
+	// origin's tracking branch
+	mirror := git.NewRemote(g.repo.Storer, &gitconfig.RemoteConfig{Name: "mirror", URLs: []string{remote}})
+	spec := gitconfig.RefSpec(plumbing.NewRemoteReferenceName("origin", g.cfg.Branch) + ":" + plumbing.NewBranchReferenceName(g.cfg.Branch))
+	ctx, cancel := gitContext(g.cfg)
+	defer cancel()
+	err = mirror.PushContext(ctx, &git.PushOptions{RemoteName: "mirror", Auth: auth, RefSpecs: []gitconfig.RefSpec{spec}})
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return timedOut(ctx, g.cfg, "push", err)
+	}
+	return nil
+}
+
+// workBranch is the branch the clone normally has checked out.
+func (g *GoGitRepo) workBranch() string {
+	if g.cfg.PreviewMode {
+		return g.cfg.PreviewBranch
+	}
+	return g.cfg.Branch
+}
+
+// CommitToBranch checks out branch, creating it from the current branch if
+// it doesn't exist yet, calls write to produce the repo-relative paths to
+// commit, then commits, pushes the branch and switches back. Uncommitted
+// changes on the work branch are set aside meanwhile and restored after.
+func (g *GoGitRepo) CommitToBranch(branch string, author Author, msg string, write func() ([]string, error)) (err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if err := g.recoverLocked(); err != nil {
+		return err
+	}
+	if err := g.pullLocked(); err != nil {
+		return fmt.Errorf("git pull before commit: %w", err)
+	}
+	wt, err := g.repo.Worktree()
+	if err != nil {
+		return err
+	}
+	stash, err := g.stashLocked()
+	if err != nil {
+		return err
+	}
+
+	ref := plumbing.NewBranchReferenceName(branch)
+	_, refErr := g.repo.Reference(ref, false)
+	if err := wt.Checkout(&git.CheckoutOptions{Branch: ref, Create: refErr != nil, Force: true}); err != nil {
+		g.unstashLocked(stash)
+		return fmt.Errorf("git checkout %s: %w", branch, err)
+	}
+	defer func() {
+		// Force drops anything half-written so it doesn't follow us back
+		coErr := wt.Checkout(&git.CheckoutOptions{Branch: plumbing.NewBranchReferenceName(g.workBranch()), Force: true})
+		if coErr == nil {
+			coErr = g.unstashLocked(stash)
+		}
+		if coErr != nil && err == nil {
+			err = fmt.Errorf("git checkout %s: %w", g.workBranch(), coErr)
+		}
+	}()
+
+	paths, err := write()
+	if err != nil {
+		return err
+	}
+	if g.cfg.PreviewMode {
+		msg = "[preview] " + msg
+	}
+	if err := g.commitLocked(msg, g.authorSignature(author), paths); err != nil {
+		return err
+	}
+
+	if g.cfg.PreviewMode {
+		log.Printf("git: preview mode, skipping push of %s", branch)
+		return nil
+	}
+	if err := g.pushLocked(branch); err != nil {
+		return fmt.Errorf("git push %s: %w", branch, err)
+	}
+	return nil
+}
+
+// FullPath returns the absolute path for a file relative to the repo root.
+func (g *GoGitRepo) FullPath(relPath string) string {
+	return filepath.Join(g.cfg.RepoDir, relPath)
+}
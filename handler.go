@@ -1,38 +1,98 @@
 package main
 
 import (
+	"context"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"net/url"
-	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
-
-	"gopkg.in/yaml.v3"
 )
 
 const defaultMaxBodyLen = 10000
 
 type Comment struct {
-	Name    string `yaml:"name"`
-	Email   string `yaml:"email,omitempty"`
-	Body    string `yaml:"body"`
-	Date    string `yaml:"date"`
-	Slug    string `yaml:"slug"`
-	ReplyTo string `yaml:"reply_to,omitempty"`
+	Name     string `yaml:"name"`
+	Email    string `yaml:"email,omitempty"`
+	Body     string `yaml:"body"`
+	BodyHTML string `yaml:"body_html,omitempty"`
+	Date     string `yaml:"date"`
+	Slug     string `yaml:"slug"`
+	ReplyTo  string `yaml:"reply_to,omitempty"`
+	Lang     string `yaml:"lang,omitempty"`
+	Dir      string `yaml:"dir,omitempty"`
+	// QuotedExcerpt is the start of a reply's parent's body, with
+	// STATICOMMENT_REPLY_EXCERPT set
+	QuotedExcerpt string `yaml:"quoted_excerpt,omitempty"`
+	// Author marks the site owner's own comments, posted by email reply or
+	// through the admin API
+	Author bool `yaml:"author,omitempty"`
+	// Moderation is only set on quarantined comments, and dropped when
+	// they're approved
+	Moderation *ModerationInfo `yaml:"moderation,omitempty"`
+}
+
+// ModerationInfo is the moderation block of a quarantined comment: why it
+// was held, and keyed hashes of the client that sent it, so comments from
+// the same sender can be told apart without recording who that is.
+type ModerationInfo struct {
+	Reason        string      `yaml:"reason"` // "rule", "score", "bayes", "dnsbl", "stopforumspam" or "akismet"
+	Rule          string      `yaml:"rule,omitempty"`
+	Score         int         `yaml:"score"`
+	Checks        []ScoreItem `yaml:"checks,omitempty"`
+	IPHash        string      `yaml:"ip_hash,omitempty"`
+	UserAgentHash string      `yaml:"user_agent_hash,omitempty"`
 }
 
 type CommentHandler struct {
 	cfg         *Config
-	repo        *GitRepo
-	rateLimiter *RateLimiter
+	repo        Repo
+	posts       Repo // where posts are read from; usually repo
+	origins     *Origins
+	rateLimiter RateLimiter
+	postLimiter *PostRateLimiter
+	globalLimit RateLimiter
+	inFlight    chan struct{} // nil without STATICOMMENT_MAX_IN_FLIGHT
+	events      *EventBus
+	publisher   *Publisher
+	state       *StateStore
+	tokens      *FormTokens
+	pow         *ProofOfWork
+	tarpit      *Tarpit
+	reputation  *Reputation
+	maintenance *Maintenance
+	akismet     *Akismet
+	recaptcha   *Recaptcha
+	hcaptcha    *HCaptcha
+	sfs         *StopForumSpam
+	bayes       *Bayes // nil without the classifier
+	clock       Clock
+	dnsbl       *DNSBL       // nil without blocklists
+	idempotency *Idempotency // nil when idempotency keys are ignored
 }
 
-func NewCommentHandler(cfg *Config, repo *GitRepo, rl *RateLimiter) *CommentHandler {
-	return &CommentHandler{cfg: cfg, repo: repo, rateLimiter: rl}
+func NewCommentHandler(cfg *Config, repo, posts Repo, origins *Origins, rl RateLimiter, postRL *PostRateLimiter, globalRL RateLimiter, events *EventBus, publisher *Publisher, state *StateStore, tokens *FormTokens, pow *ProofOfWork, reputation *Reputation, maintenance *Maintenance, akismet *Akismet, bayes *Bayes) *CommentHandler {
+	h := &CommentHandler{cfg: cfg, repo: repo, posts: posts, origins: origins, rateLimiter: rl, postLimiter: postRL, globalLimit: globalRL, events: events, publisher: publisher, state: state, tokens: tokens, pow: pow, tarpit: NewTarpit(cfg), reputation: reputation, maintenance: maintenance, akismet: akismet, bayes: bayes, recaptcha: NewRecaptcha(cfg), hcaptcha: NewHCaptcha(cfg), sfs: NewStopForumSpam(cfg), clock: NewClock(cfg)}
+	if len(cfg.DNSBLZones) > 0 {
+		h.dnsbl = NewDNSBL(cfg.DNSBLZones, time.Duration(cfg.DNSBLTimeout)*time.Second, cfg.DNSBLResolver)
+	}
+	if cfg.MaxInFlight > 0 {
+		h.inFlight = make(chan struct{}, cfg.MaxInFlight)
+	}
+	if cfg.IdempotencyWindow > 0 {
+		h.idempotency = NewIdempotency(time.Duration(cfg.IdempotencyWindow) * time.Second)
+	}
+	return h
 }
 
 func (h *CommentHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -41,8 +101,15 @@ func (h *CommentHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Listed addresses are turned away before the request is looked at
+	if ip := extractIP(r.RemoteAddr); !h.ipAllowed(ip) {
+		h.events.Publish(Event{Type: EventRejected, Category: CategorySpam, Reason: "ip_denied", IP: ip})
+		h.plainError(w, r, formError{Status: http.StatusForbidden, Code: "forbidden", Message: "Forbidden"})
+		return
+	}
+
 	if !h.checkOrigin(r) {
-		http.Error(w, "Forbidden: origin not allowed", http.StatusForbidden)
+		h.plainError(w, r, formError{Status: http.StatusForbidden, Code: "origin_not_allowed", Message: "Forbidden: origin not allowed"})
 		return
 	}
 
@@ -50,28 +117,126 @@ func (h *CommentHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	r.Body = http.MaxBytesReader(w, r.Body, 64*1024)
 
 	if err := r.ParseForm(); err != nil {
-		http.Error(w, "Bad request", http.StatusBadRequest)
+		h.plainError(w, r, newFormError("bad_request", "Bad request"))
+		return
+	}
+
+	// Past STATICOMMENT_MAX_IN_FLIGHT submissions being processed, more
+	// are turned away rather than queued behind git
+	if h.inFlight != nil {
+		select {
+		case h.inFlight <- struct{}{}:
+			var once sync.Once
+			release := func() { once.Do(func() { <-h.inFlight }) }
+			defer release()
+			r = r.WithContext(context.WithValue(r.Context(), inFlightKey{}, release))
+		default:
+			h.reject(r, CategoryOverload, "busy")
+			w.Header().Set("Retry-After", "5")
+			h.plainError(w, r, formError{Status: http.StatusTooManyRequests, Code: "busy", Message: "Too many comments being posted, try again shortly"})
+			return
+		}
+	}
+
+	// A retried submission gets the first one's answer rather than posting
+	// the comment twice
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" {
+		key = r.FormValue(idempotencyField)
+	}
+	if key == "" || h.idempotency == nil {
+		h.submit(w, r)
 		return
 	}
+	if !validIdempotencyKey(key) {
+		h.plainError(w, r, newFormError("invalid_idempotency_key", "Invalid idempotency key"))
+		return
+	}
+	err := h.idempotency.Do(extractIP(r.RemoteAddr)+" "+key, submissionFingerprint(r), w, r, h.submit)
+	if errors.Is(err, errIdempotencyConflict) {
+		h.plainError(w, r, formError{Status: http.StatusUnprocessableEntity, Code: "idempotency_key_reused", Message: "Idempotency key already used for another comment"})
+	}
+}
 
-	// Honeypot check — silently discard if filled (bots see fake success)
-	if checkHoneypot(r, h.cfg.HoneypotField) {
+// ipAllowed checks ip against STATICOMMENT_IP_ALLOWLIST and
+// STATICOMMENT_IP_DENYLIST. The denylist wins, so a range can be allowed
+// with parts of it denied.
+func (h *CommentHandler) ipAllowed(ip string) bool {
+	if len(h.cfg.IPAllowlist) > 0 && !h.cfg.IPAllowlist.Contains(ip) {
+		return false
+	}
+	return !h.cfg.IPDenylist.Contains(ip)
+}
+
+// submit handles a comment submission whose form has been parsed.
+func (h *CommentHandler) submit(w http.ResponseWriter, r *http.Request) {
+	// In maintenance mode nobody gets further, and the visitor is sent back
+	// to the post if it's one of ours
+	if h.maintenance.Enabled() {
 		redirectURL := strings.TrimSpace(r.FormValue("url"))
-		if redirectURL != "" {
-			u, err := url.Parse(redirectURL)
-			if err == nil {
-				u.Fragment = "comment-submitted"
-				http.Redirect(w, r, u.String(), http.StatusSeeOther)
-				return
-			}
+		if !h.isAllowedRedirect(redirectURL) {
+			redirectURL = ""
 		}
-		w.WriteHeader(http.StatusOK)
+		w.Header().Set("Retry-After", "3600")
+		h.errorResponse(w, r, redirectURL, formError{Status: http.StatusServiceUnavailable, Code: "comments_closed", Message: h.cfg.MaintenanceMessage})
+		return
+	}
+
+	// Operator rules run before the spam pipeline. Allow skips spam checks,
+	// deny rejects outright, quarantine holds the comment for review.
+	verdict := h.cfg.Rules.Evaluate(Submission{
+		IP:     extractIP(r.RemoteAddr),
+		Email:  strings.TrimSpace(r.FormValue("email")),
+		Name:   strings.TrimSpace(r.FormValue("name")),
+		Body:   strings.TrimSpace(r.FormValue("body")),
+		Origin: requestOrigin(r),
+	})
+	// Recent spam from the same address or network counts against it
+	if h.reputation != nil {
+		if score := h.reputation.Score(extractIP(r.RemoteAddr)); score != 0 {
+			verdict.Score += score
+			verdict.Scores = append(verdict.Scores, ScoreItem{Name: "reputation", Score: score})
+		}
+	}
+	if verdict.Action == ActionDeny {
+		log.Printf("submission denied by rule %q", verdict.Rule)
+		h.spam(w, r, "rule_deny", func(w http.ResponseWriter) {
+			h.plainError(w, r, formError{Status: http.StatusForbidden, Code: "forbidden", Message: "Forbidden"})
+		})
+		return
+	}
+	checkSpam := verdict.Action != ActionAllow
+
+	// Banned submitters are turned away regardless of rules
+	ban, banned, err := h.state.Banned(extractIP(r.RemoteAddr), strings.TrimSpace(r.FormValue("email")))
+	if err != nil {
+		log.Printf("warning: checking ban list: %v", err)
+	}
+	if banned {
+		log.Printf("submission from banned submitter (%s)", ban.Reason)
+		h.spam(w, r, "banned", func(w http.ResponseWriter) {
+			h.plainError(w, r, formError{Status: http.StatusForbidden, Code: "forbidden", Message: "Forbidden"})
+		})
+		return
+	}
+
+	// Blocklists are asked now and answer while the other checks run
+	var dnsblListing func() (string, error)
+	if checkSpam && h.dnsbl != nil {
+		dnsblListing = h.dnsbl.Lookup(r.Context(), extractIP(r.RemoteAddr))
+	}
+
+	// Honeypot check — discard if filled, answering as configured
+	if checkSpam && checkHoneypot(r, h.cfg.HoneypotField) {
+		h.honeypot(w, r)
 		return
 	}
 
 	// Rate limiting by IP
-	if !h.rateLimiter.Allow(extractIP(r.RemoteAddr)) {
-		http.Error(w, "Too many requests", http.StatusTooManyRequests)
+	if checkSpam && !h.rateLimiter.Allow(extractIP(r.RemoteAddr)) {
+		h.spam(w, r, "rate_limit", func(w http.ResponseWriter) {
+			h.plainError(w, r, formError{Status: http.StatusTooManyRequests, Code: "rate_limit", Message: "Too many requests"})
+		})
 		return
 	}
 
@@ -80,170 +245,561 @@ func (h *CommentHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	body := strings.TrimSpace(r.FormValue("body"))
 	slug := strings.TrimSpace(r.FormValue("slug"))
 	replyTo := strings.TrimSpace(r.FormValue("reply_to"))
+	lang := strings.TrimSpace(r.FormValue("lang"))
 	redirectURL := strings.TrimSpace(r.FormValue("url"))
 
 	// Validate redirect URL against allowed origins before using it in any redirect
 	if redirectURL != "" && !h.isAllowedRedirect(redirectURL) {
-		http.Error(w, "Forbidden: redirect URL origin not allowed", http.StatusForbidden)
+		h.reject(r, CategoryInvalid, "redirect_origin")
+		h.plainError(w, r, formError{Status: http.StatusForbidden, Code: "redirect_origin", Message: "Forbidden: redirect URL origin not allowed"})
 		return
 	}
 
+	// A form without a slug is for the post at its URL
+	if slug == "" && redirectURL != "" && h.cfg.SlugMapping != nil {
+		if slug = h.cfg.SlugMapping.Slug(redirectURL); slug == "" {
+			h.reject(r, CategoryInvalid, "invalid_slug")
+			h.errorResponse(w, r, redirectURL, newFormError("invalid_slug", "No post slug in the page URL",
+				field("slug", "invalid", "No post slug in the page URL")))
+			return
+		}
+	}
+
 	// Validate required fields
 	if name == "" || body == "" || slug == "" || redirectURL == "" {
-		h.errorRedirect(w, r, redirectURL, "Missing required fields (name, body, slug, url)")
+		h.reject(r, CategoryInvalid, "missing_fields")
+		h.errorResponse(w, r, redirectURL, requiredFields(name, body, slug, redirectURL))
 		return
 	}
 
+	// Signed form token — each one is accepted once, within its lifetime
+	var issued time.Time
+	if checkSpam && h.tokens != nil {
+		var err error
+		issued, err = h.tokens.Verify(strings.TrimSpace(r.FormValue("_token")))
+		switch {
+		case errors.Is(err, errInvalidToken), errors.Is(err, errTokenReplay):
+			reason := "invalid_token"
+			if errors.Is(err, errTokenReplay) {
+				reason = "token_replay"
+			}
+			h.spam(w, r, reason, func(w http.ResponseWriter) {
+				h.errorResponse(w, r, redirectURL, newFormError(reason, "Form expired, please reload the page and try again"))
+			})
+			return
+		case err != nil:
+			// The nonce store failed; don't turn the visitor away for it
+			log.Printf("warning: verifying form token: %v", err)
+		}
+	}
+
 	// Timestamp check — reject submissions that are too fast
-	if checkTimestamp(r, h.cfg.MinSubmitTime) {
-		h.errorRedirect(w, r, redirectURL, "Submission too fast")
+	if skew, ok := clientClockSkew(r, issued); ok {
+		h.events.Publish(Event{Type: EventClockSkew, IP: extractIP(r.RemoteAddr), Slug: slug, Duration: skew})
+	}
+	if checkSpam && checkTimestamp(r, h.cfg.MinSubmitTime, h.cfg.ClockSkew, issued) {
+		h.spam(w, r, "too_fast", func(w http.ResponseWriter) {
+			h.errorResponse(w, r, redirectURL, newFormError("too_fast", "Submission too fast"))
+		})
 		return
 	}
 
+	// Proof of work, solved by the visitor's browser
+	if checkSpam && h.pow != nil {
+		switch err := h.pow.Verify(strings.TrimSpace(r.FormValue(powField))); {
+		case errors.Is(err, errPowFailed):
+			h.spam(w, r, "pow", func(w http.ResponseWriter) {
+				h.errorResponse(w, r, redirectURL, newFormError("pow", "Verification failed, please reload the page and try again"))
+			})
+			return
+		case err != nil:
+			// The nonce store failed; don't turn the visitor away for it
+			log.Printf("warning: verifying proof of work: %v", err)
+		}
+	}
+
+	// CAPTCHAs: the reCAPTCHA v3 score and the hCaptcha verdict. The
+	// provider being unreachable doesn't close the form.
+	if checkSpam && h.cfg.RecaptchaSecret != "" {
+		score, err := h.recaptcha.Verify(strings.TrimSpace(r.FormValue(recaptchaField)), extractIP(r.RemoteAddr))
+		if err == nil && score < h.cfg.RecaptchaMinScore {
+			err = fmt.Errorf("recaptcha: %w: score %g below %g", errCaptchaFailed, score, h.cfg.RecaptchaMinScore)
+		}
+		if h.captchaFailed(w, r, redirectURL, "recaptcha", err) {
+			return
+		}
+	}
+	if checkSpam && h.cfg.HCaptchaSecret != "" {
+		err := h.hcaptcha.Verify(strings.TrimSpace(r.FormValue(hcaptchaField)), extractIP(r.RemoteAddr))
+		if h.captchaFailed(w, r, redirectURL, "hcaptcha", err) {
+			return
+		}
+	}
+
 	// Validate body length
 	if len(body) > defaultMaxBodyLen {
-		h.errorRedirect(w, r, redirectURL, "Comment body too long")
+		h.reject(r, CategoryInvalid, "body_too_long")
+		h.errorResponse(w, r, redirectURL, newFormError("body_too_long", "Comment body too long",
+			field("body", "too_long", fmt.Sprintf("Comment must be %d characters or fewer", defaultMaxBodyLen))))
 		return
 	}
 
 	// Content checks — links and blocked patterns
-	if msg := checkBodyContent(body, h.cfg.MaxLinks, h.cfg.BlockedPatterns); msg != "" {
-		h.errorRedirect(w, r, redirectURL, msg)
+	if checkSpam {
+		limits := h.cfg.Content.For(extractIP(r.RemoteAddr), lang)
+		if reason, msg := checkBodyContent(body, limits.MaxLinks, limits.BlockedPatterns); msg != "" {
+			h.spam(w, r, reason, func(w http.ResponseWriter) {
+				h.errorResponse(w, r, redirectURL, newFormError(reason, msg, field("body", reason, msg)))
+			})
+			return
+		}
+	}
+
+	// Accumulated rule score — reject or hold high-scoring submissions
+	if checkSpam && h.cfg.ScoreReject > 0 && verdict.Score >= h.cfg.ScoreReject {
+		h.spam(w, r, "score", func(w http.ResponseWriter) {
+			h.errorResponse(w, r, redirectURL, newFormError("score", "Comment rejected as spam"))
+		})
 		return
 	}
+	quarantine := verdict.Action == ActionQuarantine ||
+		(checkSpam && h.cfg.ScoreQuarantine > 0 && verdict.Score >= h.cfg.ScoreQuarantine)
 
 	// Sanitize slug — reject path traversal
 	if !isValidSlug(slug) {
-		h.errorRedirect(w, r, redirectURL, "Invalid slug")
+		h.reject(r, CategoryInvalid, "invalid_slug")
+		h.errorResponse(w, r, redirectURL, newFormError("invalid_slug", "Invalid slug", field("slug", "invalid", "Invalid slug")))
 		return
 	}
 
 	// Validate reply_to format if provided
 	if replyTo != "" && !isValidSlug(replyTo) {
-		h.errorRedirect(w, r, redirectURL, "Invalid reply_to")
+		h.reject(r, CategoryInvalid, "invalid_reply_to")
+		h.errorResponse(w, r, redirectURL, newFormError("invalid_reply_to", "Invalid reply_to", field("reply_to", "invalid", "Invalid reply_to")))
+		return
+	}
+
+	// Validate the language tag if provided
+	if lang != "" && !isValidLang(lang) {
+		h.reject(r, CategoryInvalid, "invalid_lang")
+		h.errorResponse(w, r, redirectURL, newFormError("invalid_lang", "Invalid lang", field("lang", "invalid", "Invalid lang")))
+		return
+	}
+
+	// Rate limiting per post, by IP and in all
+	if checkSpam && !h.postLimiter.Allow(extractIP(r.RemoteAddr), slug) {
+		h.spam(w, r, "rate_limit", func(w http.ResponseWriter) {
+			h.plainError(w, r, formError{Status: http.StatusTooManyRequests, Code: "rate_limit", Message: "Too many comments on this post"})
+		})
 		return
 	}
 
 	// Validate that a post matching this slug exists in the repo
 	if h.cfg.PostsPath != "" {
 		// Pull to ensure the local clone has the latest posts
-		if err := h.repo.Pull(); err != nil {
+		if err := h.posts.Pull(); err != nil {
 			log.Printf("warning: git pull before post validation failed: %v", err)
 		}
 		found, err := h.postExists(slug)
 		if err != nil {
 			log.Printf("error checking post existence for %s: %v", slug, err)
-			h.errorRedirect(w, r, redirectURL, "Failed to validate post")
+			h.fail(r, "validate_post", err)
+			h.errorResponse(w, r, redirectURL, serverError("validate_post", "Failed to validate post"))
 			return
 		}
 		if !found {
-			h.errorRedirect(w, r, redirectURL, "Post not found")
+			h.reject(r, CategoryInvalid, "post_not_found")
+			h.errorResponse(w, r, redirectURL, newFormError("post_not_found", "Post not found", field("slug", "not_found", "Post not found")))
+			return
+		}
+	}
+
+	// Enforce maximum reply depth, flattening deep replies if configured
+	if replyTo != "" {
+		resolved, err := h.resolveReplyTo(slug, replyTo)
+		if errors.Is(err, errReplyTooDeep) {
+			h.reject(r, CategoryInvalid, "reply_too_deep")
+			h.errorResponse(w, r, redirectURL, newFormError("reply_too_deep", "Reply nesting too deep",
+				field("reply_to", "too_deep", "Replies can't be nested this deep")))
+			return
+		}
+		if err != nil {
+			log.Printf("error resolving reply thread for %s: %v", slug, err)
+			h.fail(r, "thread", err)
+			h.errorResponse(w, r, redirectURL, serverError("thread", "Failed to validate reply"))
+			return
+		}
+		if resolved != replyTo {
+			log.Printf("flattening reply on %s: reply_to %s -> %s", slug, replyTo, resolved)
+			replyTo = resolved
+		}
+	}
+
+	// The services below can hold a comment for review; heldBy says which
+	var heldBy string
+
+	// Text too short or too mixed to tell the language of passes
+	if checkSpam && len(h.cfg.Languages) > 0 {
+		if lang := detectLanguage(body); lang != "" && !slices.Contains(h.cfg.Languages, lang) {
+			log.Printf("language: comment on %s detected as %s", slug, lang)
+			if h.cfg.LanguageAction == LanguageReject {
+				h.spam(w, r, "language", func(w http.ResponseWriter) {
+					h.errorResponse(w, r, redirectURL, newFormError("language", "Comments in this language are not accepted"))
+				})
+				return
+			}
+			quarantine, heldBy = true, "language"
+		}
+	}
+
+	// The classifier only goes by what it has been taught, so it failing
+	// to read its model doesn't close the form
+	if checkSpam && h.bayes != nil {
+		p, ok, err := h.bayes.Score(body)
+		switch {
+		case err != nil:
+			log.Printf("warning: %v", err)
+		case !ok || p < h.cfg.BayesThreshold:
+		case h.cfg.BayesAction == BayesReject:
+			log.Printf("bayes: spam probability %.3f", p)
+			h.spam(w, r, "bayes", func(w http.ResponseWriter) {
+				h.errorResponse(w, r, redirectURL, newFormError("bayes", "Comment rejected as spam"))
+			})
+			return
+		default:
+			quarantine, heldBy = true, "bayes"
+		}
+	}
+
+	// A blocklist not answering in time doesn't close the form either
+	if dnsblListing != nil {
+		zone, err := dnsblListing()
+		switch {
+		case err != nil:
+			log.Printf("warning: dnsbl: %v", err)
+		case zone == "":
+		case h.cfg.DNSBLAction == DNSBLReject:
+			log.Printf("dnsbl: submitter listed on %s", zone)
+			h.spam(w, r, "dnsbl", func(w http.ResponseWriter) {
+				h.errorResponse(w, r, redirectURL, newFormError("dnsbl", "Comment rejected as spam"))
+			})
+			return
+		default:
+			quarantine, heldBy = true, "dnsbl"
+		}
+	}
+
+	// StopForumSpam knows IPs and emails seen spamming elsewhere. It being
+	// unreachable doesn't close the form.
+	if checkSpam && h.cfg.StopForumSpam {
+		confidence, err := h.sfs.Confidence(extractIP(r.RemoteAddr), email)
+		switch {
+		case err != nil:
+			log.Printf("warning: %v", err)
+		case confidence < h.cfg.StopForumSpamThreshold:
+		case h.cfg.StopForumSpamAction == StopForumSpamReject:
+			log.Printf("stopforumspam: submitter listed with confidence %g", confidence)
+			h.spam(w, r, "stopforumspam", func(w http.ResponseWriter) {
+				h.errorResponse(w, r, redirectURL, newFormError("stopforumspam", "Comment rejected as spam"))
+			})
 			return
+		default:
+			quarantine, heldBy = true, "stopforumspam"
 		}
 	}
 
+	// Akismet has the last word on what the local checks let through. It
+	// being unreachable doesn't close the form.
+	var akismet *AkismetCheck
+	if checkSpam && h.akismet != nil {
+		check, err := h.akismet.Check(r, Comment{Name: name, Email: email, Body: body, ReplyTo: replyTo, Lang: lang}, redirectURL)
+		switch {
+		case err != nil:
+			log.Printf("warning: %v", err)
+		case check.Spam && (check.Discard || h.cfg.AkismetAction == AkismetReject):
+			h.spam(w, r, "akismet", func(w http.ResponseWriter) {
+				h.errorResponse(w, r, redirectURL, newFormError("akismet", "Comment rejected as spam"))
+			})
+			return
+		case check.Spam:
+			quarantine, heldBy = true, "akismet"
+		}
+		akismet = check
+	}
+
+	// Every check passed. The global limit only counts comments that get
+	// this far, since they're the ones costing a commit and push.
+	if !h.globalLimit.Allow(globalRateLimitKey) {
+		h.reject(r, CategoryOverload, "global_rate_limit")
+		// On average, another comment is allowed that much later
+		retry := max(1, (h.cfg.RateLimitWindow+h.cfg.RateLimitGlobalMax-1)/h.cfg.RateLimitGlobalMax)
+		w.Header().Set("Retry-After", strconv.Itoa(retry))
+		h.plainError(w, r, formError{Status: http.StatusTooManyRequests, Code: "global_rate_limit", Message: "Too many comments being posted, try again shortly"})
+		return
+	}
+	// A tenant host says when the tenant's monthly quota is used up
+	if h.cfg.Tenant != "" && r.Header.Get(tenantQuotaHeader) != "" {
+		h.reject(r, CategoryOverload, "quota")
+		h.errorResponse(w, r, redirectURL, formError{Status: http.StatusTooManyRequests, Code: "quota", Message: "This site isn't taking more comments this month"})
+		return
+	}
+
+	// From here on, any failure is user-visible
+	acceptedAt := h.clock.Now()
+
 	// Build comment
 	comment := Comment{
 		Name:    name,
 		Email:   email,
 		Body:    body,
-		Date:    time.Now().UTC().Format(time.RFC3339),
+		Date:    acceptedAt.UTC().Format(time.RFC3339),
 		Slug:    slug,
 		ReplyTo: replyTo,
+		Lang:    lang,
+		Dir:     textDirection(body, lang),
+
+		QuotedExcerpt: h.quotedExcerpt(slug, replyTo),
+	}
+	if h.cfg.BodyHTML {
+		comment.BodyHTML = renderBodyHTML(body, h.cfg)
+	}
+	if quarantine {
+		comment.Moderation = h.moderation(r, verdict, heldBy)
+	}
+	h.events.Publish(Event{Type: EventAccepted, Time: acceptedAt, IP: extractIP(r.RemoteAddr), Slug: slug, Comment: &comment})
+	if h.cfg.Tenant != "" {
+		// Counted against the quota by the host, which drops the header
+		w.Header().Set(tenantAcceptedHeader, "1")
 	}
 
-	// Write YAML file
-	relPath, err := h.writeComment(comment)
+	job, err := h.publisher.NewJob(comment, extractIP(r.RemoteAddr), quarantine, acceptedAt)
 	if err != nil {
-		log.Printf("error writing comment: %v", err)
-		h.errorRedirect(w, r, redirectURL, "Failed to save comment")
+		log.Printf("error preparing comment: %v", err)
+		h.fail(r, "write", err)
+		h.errorResponse(w, r, redirectURL, serverError("write", "Failed to save comment"))
 		return
 	}
+	job.Subscribe = r.FormValue("subscribe") == "1"
+	job.Scores = verdict.Scores
+	if akismet != nil {
+		if err := h.akismet.Remember(job.Path, akismet); err != nil {
+			log.Printf("warning: akismet: keeping submission for %s: %v", job.Path, err)
+		}
+	}
 
-	// Git commit and push
-	if err := h.repo.CommitAndPush(relPath, slug); err != nil {
-		log.Printf("error committing comment: %v", err)
-		h.errorRedirect(w, r, redirectURL, "Failed to publish comment")
+	// Write, commit and push, or leave that to the outbox worker
+	fragment := "comment-submitted"
+	var queued bool
+	if h.cfg.AsyncPublish {
+		err = h.publisher.Enqueue(job)
+	} else {
+		queued, err = h.publisher.Submit(job)
+	}
+	switch {
+	case queued:
+		// Stored in the outbox, or committed and waiting for the remote;
+		// it will be published on a retry
+		if err != nil {
+			log.Printf("comment %s queued for retry: %v", job.ID, err)
+		}
+		fragment = "comment-pending"
+	case err != nil:
+		log.Printf("error publishing comment: %v", err)
+		fe := serverError("push", "Failed to publish comment")
+		var pe *publishError
+		if errors.As(err, &pe) {
+			fe.Code = pe.stage
+			if pe.stage == "write" {
+				fe.Message = "Failed to save comment"
+			}
+		}
+		h.errorResponse(w, r, redirectURL, fe)
 		return
+	case quarantine:
+		fragment = "comment-pending"
+	case job.Moderated:
+		fragment = "comment-pending-moderation"
 	}
 
-	log.Printf("comment saved and pushed: %s", relPath)
+	h.successResponse(w, r, redirectURL, fragment)
+}
 
-	// Redirect back to the post
-	u, err := url.Parse(redirectURL)
-	if err != nil {
-		http.Error(w, "Bad redirect URL", http.StatusBadRequest)
-		return
-	}
-	u.Fragment = "comment-submitted"
-	http.Redirect(w, r, u.String(), http.StatusSeeOther)
+// moderation records why a submission is being quarantined: a rule, the
+// score, or failing that, heldBy, the service that called it spam.
+func (h *CommentHandler) moderation(r *http.Request, v Verdict, heldBy string) *ModerationInfo {
+	m := &ModerationInfo{
+		Reason:        "score",
+		Score:         v.Score,
+		Checks:        v.Scores,
+		IPHash:        clientHash(h.cfg.ClientHashKey, extractIP(r.RemoteAddr)),
+		UserAgentHash: clientHash(h.cfg.ClientHashKey, r.UserAgent()),
+	}
+	switch {
+	case v.Action == ActionQuarantine:
+		m.Reason, m.Rule = "rule", v.Rule
+	case heldBy != "" && (h.cfg.ScoreQuarantine == 0 || v.Score < h.cfg.ScoreQuarantine):
+		m.Reason = heldBy
+	}
+	return m
 }
 
-func (h *CommentHandler) writeComment(c Comment) (string, error) {
-	// Build the directory path: <comments_path>/<slug>/
-	dir := filepath.Join(h.cfg.CommentsPath, c.Slug)
-	fullDir := h.repo.FullPath(dir)
-	if err := os.MkdirAll(fullDir, 0755); err != nil {
-		return "", fmt.Errorf("creating comment dir: %w", err)
+// clientHash is a keyed hash of s, comparable between comments hashed with
+// the same key but not reversible without it.
+func clientHash(key []byte, s string) string {
+	if s == "" {
+		return ""
 	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(s))
+	return hex.EncodeToString(mac.Sum(nil))[:16]
+}
 
-	// Generate filename: <timestamp>-<random>.yml
-	ts := time.Now().UTC().Format("20060102150405")
-	rnd, err := randomHex(4)
-	if err != nil {
-		return "", fmt.Errorf("generating random id: %w", err)
+// reject reports a submission turned away by a spam or validation check.
+func (h *CommentHandler) reject(r *http.Request, category, reason string) {
+	h.events.Publish(rejection(r, category, reason))
+}
+
+// rejection builds the EventRejected for a submission, carrying the fields
+// as submitted.
+func rejection(r *http.Request, category, reason string) Event {
+	return Event{
+		Type:     EventRejected,
+		Category: category,
+		Reason:   reason,
+		IP:       extractIP(r.RemoteAddr),
+		Slug:     strings.TrimSpace(r.FormValue("slug")),
+		Comment: &Comment{
+			Name:    strings.TrimSpace(r.FormValue("name")),
+			Email:   strings.TrimSpace(r.FormValue("email")),
+			Body:    strings.TrimSpace(r.FormValue("body")),
+			Slug:    strings.TrimSpace(r.FormValue("slug")),
+			ReplyTo: strings.TrimSpace(r.FormValue("reply_to")),
+		},
 	}
-	filename := fmt.Sprintf("%s-%s.yml", ts, rnd)
-	relPath := filepath.Join(dir, filename)
-	fullPath := h.repo.FullPath(relPath)
+}
 
-	data, err := yaml.Marshal(c)
-	if err != nil {
-		return "", fmt.Errorf("marshaling comment: %w", err)
+// spam reports a submission rejected by a spam check and answers it with
+// respond, drip-fed if the tarpit is set up for reason and has room.
+func (h *CommentHandler) spam(w http.ResponseWriter, r *http.Request, reason string, respond func(http.ResponseWriter)) {
+	e := rejection(r, CategorySpam, reason)
+	tarpit := h.tarpit.acquire(reason)
+	if tarpit {
+		defer h.tarpit.release()
+		e.Action = HoneypotTarpit // named like the honeypot action, so metrics agree
+	}
+	h.events.Publish(e)
+	if tarpit {
+		leaveInFlight(r)
+		h.tarpit.serve(w, r, respond)
+		return
 	}
+	respond(w)
+}
 
-	if err := os.WriteFile(fullPath, data, 0644); err != nil {
-		return "", fmt.Errorf("writing comment file: %w", err)
+type inFlightKey struct{}
+
+// leaveInFlight gives up r's STATICOMMENT_MAX_IN_FLIGHT slot before the
+// handler is done, for a rejection about to be drip-fed by the tarpit, so
+// bots held there don't turn real visitors away as busy.
+func leaveInFlight(r *http.Request) {
+	if release, ok := r.Context().Value(inFlightKey{}).(func()); ok {
+		release()
 	}
+}
 
-	return relPath, nil
+// captchaFailed answers a submission that failed the CAPTCHA check reason
+// with err as spam, reporting whether it did. Other errors are only logged.
+func (h *CommentHandler) captchaFailed(w http.ResponseWriter, r *http.Request, redirectURL, reason string, err error) bool {
+	switch {
+	case errors.Is(err, errCaptchaFailed):
+		log.Print(err)
+		h.spam(w, r, reason, func(w http.ResponseWriter) {
+			h.errorResponse(w, r, redirectURL, newFormError(reason, "CAPTCHA verification failed, please reload the page and try again"))
+		})
+		return true
+	case err != nil:
+		log.Printf("warning: %v", err)
+	}
+	return false
 }
 
-func (h *CommentHandler) checkOrigin(r *http.Request) bool {
-	origin := r.Header.Get("Origin")
-	if origin == "" {
-		// Fall back to Referer
-		ref := r.Header.Get("Referer")
-		if ref == "" {
-			return false
+// honeypot answers a submission that filled in the honeypot field according
+// to STATICOMMENT_HONEYPOT_ACTION. Accept and tarpit look like a successful
+// submission, so the bot has no reason to adapt.
+func (h *CommentHandler) honeypot(w http.ResponseWriter, r *http.Request) {
+	respond := func(w http.ResponseWriter) {
+		redirectURL := strings.TrimSpace(r.FormValue("url"))
+		if _, err := url.Parse(redirectURL); redirectURL != "" && err == nil {
+			h.successResponse(w, r, redirectURL, "comment-submitted")
+			return
 		}
-		u, err := url.Parse(ref)
-		if err != nil {
-			return false
+		w.WriteHeader(http.StatusOK)
+	}
+	action := h.cfg.HoneypotAction
+	if action == HoneypotReject {
+		respond = func(w http.ResponseWriter) {
+			h.plainError(w, r, formError{Status: http.StatusForbidden, Code: "honeypot", Message: "Forbidden"})
 		}
-		origin = u.Scheme + "://" + u.Host
+	}
+	tarpit := h.tarpit.acquire("honeypot")
+	if tarpit {
+		defer h.tarpit.release()
+	} else if action == HoneypotTarpit {
+		// The tarpit is full; answer at once
+		action = HoneypotAccept
 	}
 
-	for _, allowed := range h.cfg.AllowedOrigins {
-		if origin == allowed {
-			return true
-		}
+	e := rejection(r, CategorySpam, "honeypot")
+	e.Action = action
+	h.events.Publish(e)
+	if tarpit {
+		leaveInFlight(r)
+		h.tarpit.serve(w, r, respond)
+		return
 	}
-	return false
+	respond(w)
 }
 
-func (h *CommentHandler) errorRedirect(w http.ResponseWriter, r *http.Request, redirectURL, msg string) {
-	if redirectURL != "" {
-		u, err := url.Parse(redirectURL)
-		if err == nil {
-			q := u.Query()
-			q.Set("comment_error", msg)
-			u.RawQuery = q.Encode()
-			http.Redirect(w, r, u.String(), http.StatusSeeOther)
-			return
-		}
+// fail reports a server-side failure while handling a legitimate submission.
+func (h *CommentHandler) fail(r *http.Request, stage string, err error) {
+	h.events.Publish(Event{
+		Type:   EventFailed,
+		Reason: stage,
+		IP:     extractIP(r.RemoteAddr),
+		Slug:   strings.TrimSpace(r.FormValue("slug")),
+		Err:    err,
+	})
+}
+
+// requestOrigin returns the Origin header, falling back to the scheme and
+// host of the Referer. Returns "" if neither is usable.
+func requestOrigin(r *http.Request) string {
+	origin := r.Header.Get("Origin")
+	if origin != "" {
+		return origin
+	}
+	ref := r.Header.Get("Referer")
+	if ref == "" {
+		return ""
 	}
-	http.Error(w, msg, http.StatusBadRequest)
+	u, err := url.Parse(ref)
+	if err != nil {
+		return ""
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// allowCORS lets the request's origin read the response if it's one of the
+// allowed origins.
+func allowCORS(w http.ResponseWriter, r *http.Request, origins *Origins) {
+	if origin := r.Header.Get("Origin"); origins.Allowed(origin) {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+	}
+	w.Header().Set("Vary", "Origin")
+}
+
+func (h *CommentHandler) checkOrigin(r *http.Request) bool {
+	return h.origins.Allowed(requestOrigin(r))
 }
 
 func (h *CommentHandler) isAllowedRedirect(rawURL string) bool {
@@ -251,34 +807,37 @@ func (h *CommentHandler) isAllowedRedirect(rawURL string) bool {
 	if err != nil {
 		return false
 	}
-	origin := u.Scheme + "://" + u.Host
-	for _, allowed := range h.cfg.AllowedOrigins {
-		if origin == allowed {
-			return true
-		}
-	}
-	return false
+	return h.origins.Allowed(u.Scheme + "://" + u.Host)
 }
 
 func (h *CommentHandler) postExists(slug string) (bool, error) {
-	basePath := h.repo.FullPath(h.cfg.PostsPath)
+	path, err := findPost(h.posts.FullPath(h.cfg.PostsPath), slug)
+	return path != "", err
+}
+
+// findPost returns the file in dir for the post slug, or "" if there's none.
+func findPost(dir, slug string) (string, error) {
 	// Try exact match first (e.g. 2024-01-02-my-post.md), then
 	// date-prefixed match (e.g. *-my-post.md) for Jekyll-style filenames
-	// where the slug may not include the date prefix.
+	// where the slug may not include the date prefix, then an index page
+	// in a directory named for the post (e.g. my-post/index.md, a Hugo
+	// page bundle).
 	patterns := []string{
-		filepath.Join(basePath, slug+".*"),
-		filepath.Join(basePath, "*-"+slug+".*"),
+		filepath.Join(dir, slug+".*"),
+		filepath.Join(dir, "*-"+slug+".*"),
+		filepath.Join(dir, slug, "index.*"),
+		filepath.Join(dir, "*-"+slug, "index.*"),
 	}
 	for _, pattern := range patterns {
 		matches, err := filepath.Glob(pattern)
 		if err != nil {
-			return false, fmt.Errorf("globbing pattern %q: %w", pattern, err)
+			return "", fmt.Errorf("globbing pattern %q: %w", pattern, err)
 		}
 		if len(matches) > 0 {
-			return true, nil
+			return matches[0], nil
 		}
 	}
-	return false, nil
+	return "", nil
 }
 
 func isValidSlug(slug string) bool {
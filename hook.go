@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// PostPushHook is the event bus subscriber running STATICOMMENT_POST_PUSH_CMD
+// after each comment is pushed, for purging a CDN, rebuilding a site served
+// from the clone and the like. The command is run by sh (cmd on Windows),
+// one at a time from a queue, with what was pushed in its environment. Like
+// analytics, a full queue drops runs rather than hold up publishing, and
+// failed runs are logged but not retried.
+type PostPushHook struct {
+	cfg   *Config
+	queue chan Event
+}
+
+func NewPostPushHook(cfg *Config) *PostPushHook {
+	return &PostPushHook{cfg: cfg, queue: make(chan Event, 100)}
+}
+
+// HandleEvent is the event bus subscriber.
+func (h *PostPushHook) HandleEvent(e Event) {
+	if e.Canary {
+		return
+	}
+	switch e.Type {
+	case EventPublished, EventQuarantined, EventModeration:
+	default:
+		return
+	}
+	select {
+	case h.queue <- e:
+	default:
+		log.Printf("warning: post-push command queue full, skipping it for %s", e.Path)
+	}
+}
+
+// Run runs the command for queued events.
+func (h *PostPushHook) Run() {
+	for e := range h.queue {
+		start := time.Now()
+		if out, err := h.run(e); err != nil {
+			log.Printf("warning: post-push command for %s failed: %v: %s", e.Path, err, out)
+		} else {
+			log.Printf("post-push command for %s finished in %s", e.Path, time.Since(start).Round(time.Millisecond))
+		}
+	}
+}
+
+// run runs the command for e, returning the end of its output.
+func (h *PostPushHook) run(e Event) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(h.cfg.PostPushTimeout)*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", h.cfg.PostPushCmd)
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", h.cfg.PostPushCmd)
+	}
+	cmd.WaitDelay = 5 * time.Second
+	cmd.Dir = h.cfg.RepoDir
+	cmd.Env = hookEnv(os.Environ())
+	cmd.Env = append(cmd.Env,
+		"STATICOMMENT_EVENT="+string(e.Type),
+		"STATICOMMENT_SLUG="+e.Slug,
+		"STATICOMMENT_PATH="+e.Path,
+		"STATICOMMENT_REPO_DIR="+h.cfg.RepoDir,
+		"STATICOMMENT_REVIEW_BRANCH="+e.Branch,
+		"STATICOMMENT_REVIEW_URL="+e.URL,
+	)
+	out := &tailBuffer{max: gitOutputLimit}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	err := cmd.Run()
+	if err != nil && ctx.Err() != nil {
+		err = fmt.Errorf("timed out after %ds: %w", h.cfg.PostPushTimeout, err)
+	}
+	var lines []string
+	for _, line := range strings.Split(string(out.buf), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return strings.Join(lines, "; "), err
+}
+
+// hookEnv returns env without the server's own STATICOMMENT_ settings, so
+// the tokens and keys among them aren't handed to the command.
+func hookEnv(env []string) []string {
+	var kept []string
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, "STATICOMMENT_") {
+			kept = append(kept, kv)
+		}
+	}
+	return kept
+}
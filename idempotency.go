@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// idempotencyField is the form field alternative to the Idempotency-Key
+// header, for plain HTML forms and for scripts on another origin, where a
+// custom header would need a CORS preflight.
+const idempotencyField = "_idempotency_key"
+
+// maxIdempotencyKeys bounds the keys remembered; when full, the oldest is
+// forgotten even if its window hasn't passed.
+const maxIdempotencyKeys = 10000
+
+// maxIdempotentBody is the most of a response kept for replaying. Answers
+// to submissions are far smaller.
+const maxIdempotentBody = 64 * 1024
+
+// retryableCodes are refusals a retry of the same submission can get past,
+// with a fresh form token or challenge, or just by coming later, so their
+// answers aren't replayed.
+var retryableCodes = map[string]bool{
+	"invalid_token": true,
+	"token_replay":  true,
+	"too_fast":      true,
+	"pow":           true,
+	"recaptcha":     true,
+	"hcaptcha":      true,
+}
+
+// errIdempotencyConflict is returned for a key already used for a
+// different submission.
+var errIdempotencyConflict = errors.New("idempotency key used for another submission")
+
+// validIdempotencyKey accepts up to 255 printable ASCII characters.
+func validIdempotencyKey(key string) bool {
+	if len(key) > 255 {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x21 || key[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// submissionFingerprint identifies what was submitted, to tell a retry
+// from a different comment sent with the same key. Tokens and the like
+// are left out, as a retry may fetch fresh ones.
+func submissionFingerprint(r *http.Request) string {
+	v := url.Values{}
+	for _, f := range []string{"name", "email", "body", "slug", "reply_to", "url", "lang", "subscribe"} {
+		v.Set(f, r.FormValue(f))
+	}
+	sum := sha256.Sum256([]byte(v.Encode()))
+	return hex.EncodeToString(sum[:])
+}
+
+// idempotentResponse is a recorded answer to a submission.
+type idempotentResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+type idempotencyEntry struct {
+	key         string
+	fingerprint string
+	expires     time.Time
+	done        chan struct{} // closed once resp is set or the entry dropped
+	resp        *idempotentResponse
+	retryable   bool // set by allowRetry while the answer is written
+}
+
+type idempotencyEntryKey struct{}
+
+// allowRetry marks the answer to r, if it's being recorded for an
+// idempotency key, as one a retry may get past, so it isn't replayed.
+func allowRetry(r *http.Request) {
+	if e, ok := r.Context().Value(idempotencyEntryKey{}).(*idempotencyEntry); ok {
+		e.retryable = true
+	}
+}
+
+// Idempotency remembers the answers to submissions sent with an
+// idempotency key for a window, in memory, so that a client retrying after
+// a dropped connection, or a visitor clicking twice, gets the first answer
+// again rather than posting the comment twice. A retry arriving while the
+// first is still being handled waits for it. Only answers a retry would
+// get anyway are remembered: not server errors, rate limits, or failed
+// form tokens and challenges, so the submission can be retried.
+type Idempotency struct {
+	window  time.Duration
+	mu      sync.Mutex
+	order   *list.List // of *idempotencyEntry, oldest at the front
+	entries map[string]*list.Element
+}
+
+func NewIdempotency(window time.Duration) *Idempotency {
+	return &Idempotency{window: window, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+// Do answers r, sent with key, with serve, or with the recorded answer to
+// the first submission with key. It returns errIdempotencyConflict,
+// without answering, if that submission had another fingerprint.
+func (s *Idempotency) Do(key, fingerprint string, w http.ResponseWriter, r *http.Request, serve http.HandlerFunc) error {
+	for {
+		e, first, err := s.claim(key, fingerprint)
+		if err != nil {
+			return err
+		}
+		if first {
+			s.record(e, w, r, serve)
+			return nil
+		}
+		select {
+		case <-e.done:
+		case <-r.Context().Done():
+			return r.Context().Err()
+		}
+		if e.resp != nil {
+			for k, v := range e.resp.header {
+				w.Header()[k] = v
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(e.resp.status)
+			w.Write(e.resp.body)
+			return nil
+		}
+		// The first failed; this one takes its place
+	}
+}
+
+// claim returns the live entry for key, creating it if there's none, in
+// which case first is set and the caller must record the answer.
+func (s *Idempotency) claim(key, fingerprint string) (e *idempotencyEntry, first bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if el, ok := s.entries[key]; ok {
+		e := el.Value.(*idempotencyEntry)
+		if now.Before(e.expires) {
+			if e.fingerprint != fingerprint {
+				return nil, false, errIdempotencyConflict
+			}
+			return e, false, nil
+		}
+		s.order.Remove(el)
+		delete(s.entries, key)
+	}
+
+	// Drop expired keys from the old end, then make room
+	for el := s.order.Front(); el != nil; el = s.order.Front() {
+		old := el.Value.(*idempotencyEntry)
+		if now.Before(old.expires) && s.order.Len() < maxIdempotencyKeys {
+			break
+		}
+		s.order.Remove(el)
+		delete(s.entries, old.key)
+	}
+
+	e = &idempotencyEntry{key: key, fingerprint: fingerprint, expires: now.Add(s.window), done: make(chan struct{})}
+	s.entries[key] = s.order.PushBack(e)
+	return e, true, nil
+}
+
+// record answers with serve, keeping the answer in e unless a retry might
+// get another, in which case e is dropped.
+func (s *Idempotency) record(e *idempotencyEntry, w http.ResponseWriter, r *http.Request, serve http.HandlerFunc) {
+	rec := &responseRecorder{ResponseWriter: w}
+	defer func() {
+		s.mu.Lock()
+		keep := rec.status != 0 && rec.status < 500 && rec.status != http.StatusTooManyRequests && !e.retryable
+		if keep && rec.body.Len() <= maxIdempotentBody {
+			e.resp = &idempotentResponse{status: rec.status, header: rec.header, body: rec.body.Bytes()}
+		} else if el, ok := s.entries[e.key]; ok && el.Value == e {
+			s.order.Remove(el)
+			delete(s.entries, e.key)
+		}
+		s.mu.Unlock()
+		close(e.done)
+	}()
+	serve(rec, r.WithContext(context.WithValue(r.Context(), idempotencyEntryKey{}, e)))
+}
+
+// responseRecorder passes a response through, keeping a copy.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+		rec.header = rec.Header().Clone()
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.WriteHeader(http.StatusOK)
+	}
+	if rec.body.Len() <= maxIdempotentBody {
+		rec.body.Write(b)
+	}
+	return rec.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, for the
+// tarpit's flushes.
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+)
+
+// Comment ID formats: how comment files are named
+// (STATICOMMENT_COMMENT_ID).
+const (
+	CommentIDTimestamp  = "timestamp"
+	CommentIDULID       = "ulid"
+	CommentIDSnowflake  = "snowflake"
+	CommentIDSequential = "sequential"
+)
+
+// Clock tells the time comments are accepted, dated, named and committed
+// at. Tests swap in a fixed one for reproducible files and commits.
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// fixedClock is always at the same time.
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time { return time.Time(c) }
+
+// NewClock returns the real clock, or one stopped at
+// STATICOMMENT_FIXED_TIME if that is set.
+func NewClock(cfg *Config) Clock {
+	if !cfg.FixedTime.IsZero() {
+		return fixedClock(cfg.FixedTime)
+	}
+	return systemClock{}
+}
+
+// IDGenerator names comment files: NewID returns the name, without .yml, of
+// a comment accepted at t. Names have to be unique and valid slugs, since
+// reply_to refers to them, and should sort in the order comments arrive,
+// which is the order themes list them in.
+type IDGenerator interface {
+	NewID(t time.Time) (string, error)
+}
+
+// NewIDGenerator returns the generator for STATICOMMENT_COMMENT_ID.
+func NewIDGenerator(cfg *Config) IDGenerator {
+	switch cfg.CommentIDFormat {
+	case CommentIDULID:
+		return &ulidIDs{}
+	case CommentIDSnowflake:
+		node := cfg.CommentIDNode
+		if node < 0 {
+			host, _ := os.Hostname()
+			h := fnv.New32a()
+			h.Write([]byte(host))
+			node = int(h.Sum32() % (snowflakeMaxNode + 1))
+		}
+		return &snowflakeIDs{node: int64(node)}
+	case CommentIDSequential:
+		return &sequentialIDs{}
+	}
+	return timestampIDs{}
+}
+
+// timestampIDs are the time to the second and eight random hex digits,
+// like 20240115103000-9f86d081.
+type timestampIDs struct{}
+
+func (timestampIDs) NewID(t time.Time) (string, error) {
+	rnd, err := randomHex(4)
+	if err != nil {
+		return "", fmt.Errorf("generating random id: %w", err)
+	}
+	return t.UTC().Format("20060102150405") + "-" + rnd, nil
+}
+
+// sequentialIDs are timestampIDs with a counter from 1 in place of the
+// random digits. Together with a fixed clock they name comments the same
+// way every run, which is only of use to tests: a restarted server starts
+// counting again, over files it wrote before.
+type sequentialIDs struct {
+	mu sync.Mutex
+	n  uint32
+}
+
+func (s *sequentialIDs) NewID(t time.Time) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.n++
+	return fmt.Sprintf("%s-%08x", t.UTC().Format("20060102150405"), s.n), nil
+}
+
+// crockford is the ULID alphabet, Crockford's base32, in lower case.
+const crockford = "0123456789abcdefghjkmnpqrstvwxyz"
+
+// ulidIDs are ULIDs (https://github.com/ulid/spec) in lower case: 48 bits
+// of milliseconds and 80 random, like 01hmb7yq5ksx3jv4d9w2t8n6ce. Within a
+// millisecond the random part is incremented, so they still sort in order.
+type ulidIDs struct {
+	mu   sync.Mutex
+	ms   int64
+	rand [10]byte
+}
+
+func (u *ulidIDs) NewID(t time.Time) (string, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if ms := t.UnixMilli(); ms > u.ms {
+		if _, err := rand.Read(u.rand[:]); err != nil {
+			return "", fmt.Errorf("generating random id: %w", err)
+		}
+		u.ms = ms
+	} else if !increment(u.rand[:]) {
+		// A clock stepping back keeps the last millisecond, so names
+		// still sort
+		return "", errors.New("generating ulid: too many in one millisecond")
+	}
+
+	var b [16]byte
+	for i := range 6 {
+		b[i] = byte(u.ms >> (40 - 8*i))
+	}
+	copy(b[6:], u.rand[:])
+	n := new(big.Int).SetBytes(b[:])
+	id := make([]byte, 26)
+	for i := len(id) - 1; i >= 0; i-- {
+		id[i] = crockford[n.Uint64()&31]
+		n.Rsh(n, 5)
+	}
+	return string(id), nil
+}
+
+// increment adds one to the big-endian number b, reporting false if it
+// wrapped around to zero.
+func increment(b []byte) bool {
+	for i := len(b) - 1; i >= 0; i-- {
+		b[i]++
+		if b[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	snowflakeMaxNode = 1<<10 - 1
+	snowflakeMaxSeq  = 1<<12 - 1
+)
+
+// snowflakeEpoch is the time snowflake IDs count from.
+var snowflakeEpoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// snowflakeIDs are Twitter-style snowflake IDs: 41 bits of milliseconds
+// since snowflakeEpoch, 10 of the node (STATICOMMENT_COMMENT_ID_NODE) and 12
+// of a sequence within the millisecond, in decimal padded to 19 digits so
+// they sort as numbers. Past 4096 in a millisecond, the next millisecond is
+// borrowed rather than waited for.
+type snowflakeIDs struct {
+	mu   sync.Mutex
+	node int64
+	ms   int64
+	seq  int64
+}
+
+func (s *snowflakeIDs) NewID(t time.Time) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ms := t.Sub(snowflakeEpoch).Milliseconds()
+	if ms < 0 {
+		return "", fmt.Errorf("generating snowflake id: %s is before %s", t.UTC().Format(time.RFC3339), snowflakeEpoch.Format(time.RFC3339))
+	}
+	switch {
+	case ms > s.ms:
+		s.ms, s.seq = ms, 0
+	case s.seq < snowflakeMaxSeq:
+		s.seq++
+	default:
+		s.ms, s.seq = s.ms+1, 0
+	}
+	if s.ms >= 1<<41 {
+		return "", errors.New("generating snowflake id: out of timestamp bits")
+	}
+	return fmt.Sprintf("%019d", s.ms<<22|s.node<<12|s.seq), nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// inboundMaxAge bounds how old a webhook timestamp may be, so a captured
+// request can't be replayed indefinitely, and each webhook's token is
+// remembered for as long to refuse replays within it.
+const inboundMaxAge = 5 * time.Minute
+
+// replyReference returns the message reference for comment id on slug, e.g.
+// <reply.my-post.20240101120000-abcd1234.SIG@staticomment>. Notification
+// emails carry it as their Message-ID so that a reply's In-Reply-To or
+// References header identifies the comment being answered.
+func replyReference(secret, slug, id string) string {
+	return "<reply." + slug + "." + id + "." + replySignature(secret, slug, id) + "@staticomment>"
+}
+
+// replySignature is the first 128 bits of HMAC-SHA256(secret, "slug/id"),
+// hex encoded.
+func replySignature(secret, slug, id string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(slug + "/" + id))
+	return hex.EncodeToString(mac.Sum(nil))[:32]
+}
+
+// parseReplyReference finds the first correctly signed reference in a
+// References or In-Reply-To header value.
+func parseReplyReference(secret, header string) (slug, id string, ok bool) {
+	for _, ref := range strings.Fields(header) {
+		ref = strings.TrimSuffix(strings.TrimPrefix(ref, "<"), ">")
+		local, found := strings.CutSuffix(ref, "@staticomment")
+		if !found {
+			continue
+		}
+		// Slugs and ids never contain dots, so the parts split cleanly
+		parts := strings.Split(local, ".")
+		if len(parts) != 4 || parts[0] != "reply" || !isValidSlug(parts[1]) || !isValidSlug(parts[2]) {
+			continue
+		}
+		want := replySignature(secret, parts[1], parts[2])
+		if hmac.Equal([]byte(parts[3]), []byte(want)) {
+			return parts[1], parts[2], true
+		}
+	}
+	return "", "", false
+}
+
+// InboundMailHandler serves POST /inbound/email, a Mailgun-style inbound
+// route webhook. A reply from an owner address to a notification email
+// becomes a new comment replying to the referenced comment.
+type InboundMailHandler struct {
+	cfg      *Config
+	comments *CommentHandler
+	nonces   NonceStore
+}
+
+func NewInboundMailHandler(cfg *Config, comments *CommentHandler, nonces NonceStore) *InboundMailHandler {
+	return &InboundMailHandler{cfg: cfg, comments: comments, nonces: nonces}
+}
+
+// Responses follow Mailgun's conventions: 200 accepts the message, 406
+// rejects it without retrying, and any other error is retried later.
+func (h *InboundMailHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 10*1024*1024)
+	if err := r.ParseMultipartForm(1024 * 1024); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	if !h.verifySignature(r) {
+		log.Printf("inbound email: invalid webhook signature from %s", extractIP(r.RemoteAddr))
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	// Mailgun's token is new for every webhook, so one seen before is a
+	// captured request sent again. A timestamp may be up to inboundMaxAge
+	// ahead, so its token is remembered for up to twice that.
+	token := "inbound:" + r.FormValue("token")
+	fresh, err := h.nonces.Consume(token, time.Now().Add(2*inboundMaxAge))
+	if err != nil {
+		log.Printf("inbound email: checking webhook token: %v", err)
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	if !fresh {
+		log.Printf("inbound email: replayed webhook from %s", extractIP(r.RemoteAddr))
+		http.Error(w, "Webhook already received", http.StatusNotAcceptable)
+		return
+	}
+
+	sender := strings.ToLower(strings.TrimSpace(r.FormValue("sender")))
+	if !h.isOwner(sender) {
+		log.Printf("inbound email: ignoring message from non-owner %q", sender)
+		http.Error(w, "Sender not allowed", http.StatusNotAcceptable)
+		return
+	}
+
+	slug, replyTo, ok := h.reference(r)
+	if !ok {
+		log.Printf("inbound email: no valid reply reference in message from %s", sender)
+		http.Error(w, "No valid reply reference", http.StatusNotAcceptable)
+		return
+	}
+
+	// Prefer the reply with quoted text and signature stripped
+	body := strings.TrimSpace(r.FormValue("stripped-text"))
+	if body == "" {
+		body = strings.TrimSpace(r.FormValue("body-plain"))
+	}
+	if body == "" || len(body) > defaultMaxBodyLen {
+		log.Printf("inbound email: empty or oversized reply to %s/%s", slug, replyTo)
+		http.Error(w, "Invalid reply body", http.StatusNotAcceptable)
+		return
+	}
+
+	if err := h.comments.repo.Pull(); err != nil {
+		log.Printf("warning: git pull before inbound reply failed: %v", err)
+	}
+	parent := h.comments.repo.FullPath(filepath.Join(h.cfg.CommentsPath, slug, replyTo+".yml"))
+	if _, err := os.Stat(parent); err != nil {
+		log.Printf("inbound email: comment %s/%s not found: %v", slug, replyTo, err)
+		http.Error(w, "Comment not found", http.StatusNotAcceptable)
+		return
+	}
+
+	resolved, err := h.comments.resolveReplyTo(slug, replyTo)
+	if errors.Is(err, errReplyTooDeep) {
+		http.Error(w, "Reply nesting too deep", http.StatusNotAcceptable)
+		return
+	}
+	if err != nil {
+		log.Printf("error resolving reply thread for %s: %v", slug, err)
+		h.release(token)
+		http.Error(w, "Failed to validate reply", http.StatusInternalServerError)
+		return
+	}
+
+	acceptedAt := h.comments.clock.Now()
+	comment := Comment{
+		Name:    h.cfg.OwnerName,
+		Email:   sender,
+		Body:    body,
+		Date:    acceptedAt.UTC().Format(time.RFC3339),
+		Slug:    slug,
+		ReplyTo: resolved,
+		Dir:     textDirection(body, ""),
+		Author:  true,
+
+		QuotedExcerpt: h.comments.quotedExcerpt(slug, resolved),
+	}
+	if h.cfg.BodyHTML {
+		comment.BodyHTML = renderBodyHTML(body, h.cfg)
+	}
+	ip := extractIP(r.RemoteAddr)
+	h.comments.events.Publish(Event{Type: EventAccepted, Time: acceptedAt, IP: ip, Slug: slug, Comment: &comment})
+
+	job, err := h.comments.publisher.NewJob(comment, ip, false, acceptedAt)
+	if err != nil {
+		log.Printf("error preparing inbound reply: %v", err)
+		h.release(token)
+		http.Error(w, "Failed to save reply", http.StatusInternalServerError)
+		return
+	}
+	// The owner's own replies don't need moderating
+	job.Moderated = false
+	queued, err := h.comments.publisher.Submit(job)
+	if err != nil && !queued {
+		log.Printf("error publishing inbound reply: %v", err)
+		h.release(token)
+		http.Error(w, "Failed to publish reply", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("inbound email: reply from %s accepted on %s", sender, slug)
+	w.WriteHeader(http.StatusOK)
+}
+
+// release forgets a webhook's token when the reply failed with a 5xx, so
+// Mailgun's retry of it isn't refused as a replay.
+func (h *InboundMailHandler) release(token string) {
+	if err := h.nonces.Release(token); err != nil {
+		log.Printf("inbound email: releasing webhook token: %v", err)
+	}
+}
+
+// verifySignature checks Mailgun's webhook signature: HMAC-SHA256 of
+// timestamp+token with the signing key.
+func (h *InboundMailHandler) verifySignature(r *http.Request) bool {
+	timestamp := r.FormValue("timestamp")
+	token := r.FormValue("token")
+	signature := r.FormValue("signature")
+	if timestamp == "" || token == "" || signature == "" {
+		return false
+	}
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := time.Since(time.Unix(ts, 0)); age > inboundMaxAge || age < -inboundMaxAge {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(h.cfg.InboundSigningKey))
+	mac.Write([]byte(timestamp + token))
+	return hmac.Equal([]byte(signature), []byte(hex.EncodeToString(mac.Sum(nil))))
+}
+
+func (h *InboundMailHandler) isOwner(sender string) bool {
+	for _, owner := range h.cfg.OwnerEmails {
+		if sender == owner {
+			return true
+		}
+	}
+	return false
+}
+
+// reference extracts the signed reply reference from the message headers.
+// Mailgun forwards headers as a JSON list of [name, value] pairs; plain
+// In-Reply-To and References fields are accepted too.
+func (h *InboundMailHandler) reference(r *http.Request) (slug, id string, ok bool) {
+	var candidates []string
+	var headers [][2]string
+	if raw := r.FormValue("message-headers"); raw != "" {
+		if err := json.Unmarshal([]byte(raw), &headers); err != nil {
+			log.Printf("inbound email: parsing message-headers: %v", err)
+		}
+	}
+	for _, hdr := range headers {
+		if strings.EqualFold(hdr[0], "In-Reply-To") || strings.EqualFold(hdr[0], "References") {
+			candidates = append(candidates, hdr[1])
+		}
+	}
+	candidates = append(candidates, r.FormValue("In-Reply-To"), r.FormValue("References"))
+	for _, c := range candidates {
+		if slug, id, ok := parseReplyReference(h.cfg.ReplySecret, c); ok {
+			return slug, id, true
+		}
+	}
+	return "", "", false
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// SlugIndex is the per-slug summary written to STATICOMMENT_INDEX_PATH so
+// templates can show counts and order threads without loading every comment.
+type SlugIndex struct {
+	Slug   string   `yaml:"slug"`
+	Count  int      `yaml:"count"`
+	Latest string   `yaml:"latest"`
+	Roots  []string `yaml:"roots"`
+}
+
+// commentID is the identifier themes use for a comment: its filename without
+// the .yml extension, which is what reply_to refers to.
+func commentID(relPath string) string {
+	base := filepath.Base(relPath)
+	return strings.TrimSuffix(base, filepath.Ext(base))
+}
+
+// indexPath returns the repo-relative path of slug's index file.
+func (p *Publisher) indexPath(slug string) string {
+	return filepath.Join(p.cfg.IndexPath, slug+".yml")
+}
+
+// updateIndex records a newly written comment in its slug's index file and
+// returns the index's repo-relative path. A missing index is rebuilt from the
+// comment files on disk, so enabling indexing on an existing site just works.
+func (p *Publisher) updateIndex(c Comment, relPath string) (string, error) {
+	p.indexMu.Lock()
+	defer p.indexMu.Unlock()
+
+	indexRel := p.indexPath(c.Slug)
+	indexFull := p.repo.FullPath(indexRel)
+
+	var idx SlugIndex
+	data, err := os.ReadFile(indexFull)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		// The new comment is already on disk, so the rebuild includes it
+		idx, err = p.buildIndex(c.Slug)
+		if err != nil {
+			return "", err
+		}
+	case err != nil:
+		return "", fmt.Errorf("reading index: %w", err)
+	default:
+		if err := yaml.Unmarshal(data, &idx); err != nil {
+			return "", fmt.Errorf("parsing index: %w", err)
+		}
+		idx.Count++
+		if c.Date > idx.Latest {
+			idx.Latest = c.Date
+		}
+		if c.ReplyTo == "" {
+			idx.Roots = append(idx.Roots, commentID(relPath))
+		}
+	}
+
+	return indexRel, p.writeIndex(indexFull, idx)
+}
+
+// rebuildIndex rewrites slug's index from the comment files on disk and
+// returns its repo-relative path.
+func (p *Publisher) rebuildIndex(slug string) (string, error) {
+	p.indexMu.Lock()
+	defer p.indexMu.Unlock()
+
+	idx, err := p.buildIndex(slug)
+	if err != nil {
+		return "", err
+	}
+	indexRel := p.indexPath(slug)
+	return indexRel, p.writeIndex(p.repo.FullPath(indexRel), idx)
+}
+
+func (p *Publisher) writeIndex(indexFull string, idx SlugIndex) error {
+	if err := makeDirs(p.cfg, filepath.Dir(indexFull)); err != nil {
+		return fmt.Errorf("creating index dir: %w", err)
+	}
+	out, err := yaml.Marshal(idx)
+	if err != nil {
+		return fmt.Errorf("marshaling index: %w", err)
+	}
+	if err := writeFileAtomic(p.cfg, indexFull, out); err != nil {
+		return fmt.Errorf("writing index: %w", err)
+	}
+	return nil
+}
+
+// buildIndex scans every comment file for slug. Roots are ordered by
+// filename, which sorts by submission time.
+func (p *Publisher) buildIndex(slug string) (SlugIndex, error) {
+	idx := SlugIndex{Slug: slug, Roots: []string{}}
+	dir := p.repo.FullPath(filepath.Join(p.cfg.CommentsPath, slug))
+	matches, err := filepath.Glob(filepath.Join(dir, "*.yml"))
+	if err != nil {
+		return idx, fmt.Errorf("listing comments: %w", err)
+	}
+	sort.Strings(matches)
+	for _, path := range matches {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return idx, fmt.Errorf("reading %s: %w", path, err)
+		}
+		var c Comment
+		if err := yaml.Unmarshal(data, &c); err != nil {
+			return idx, fmt.Errorf("parsing %s: %w", path, err)
+		}
+		idx.Count++
+		if c.Date > idx.Latest {
+			idx.Latest = c.Date
+		}
+		if c.ReplyTo == "" {
+			idx.Roots = append(idx.Roots, commentID(path))
+		}
+	}
+	return idx, nil
+}
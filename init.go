@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+const initUsage = `usage: staticomment init [-o FILE] [-form FILE] [-force]
+
+Set up staticomment interactively: asks for the site repo, branch, paths
+and origins, generates a deploy key if there isn't one, checks the repo can
+be reached with it, and writes the settings as an env file (for docker
+--env-file, a compose env_file, or "set -a; . FILE") and an example
+comment form.
+`
+
+// initSettings are the answers to staticomment init, in the order they're
+// written to the env file.
+var initSettings = []string{
+	"STATICOMMENT_GIT_REPO",
+	"STATICOMMENT_BRANCH",
+	"STATICOMMENT_COMMENTS_PATH",
+	"STATICOMMENT_POSTS_PATH",
+	"STATICOMMENT_ALLOWED_ORIGINS",
+	"STATICOMMENT_DATA_DIR",
+	"STATICOMMENT_GIT_TOKEN",
+}
+
+// prompter asks questions on a terminal.
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+// ask returns the answer to question, or def for an empty one.
+func (p *prompter) ask(question, def string) (string, error) {
+	if def != "" {
+		fmt.Fprintf(p.out, "%s [%s]: ", question, def)
+	} else {
+		fmt.Fprintf(p.out, "%s: ", question)
+	}
+	line, err := p.in.ReadString('\n')
+	if err != nil && (!errors.Is(err, io.EOF) || line == "") {
+		return "", fmt.Errorf("reading answer: %w", err)
+	}
+	if line = strings.TrimSpace(line); line != "" {
+		return line, nil
+	}
+	return def, nil
+}
+
+// require asks until it gets an answer valid accepts, saying why others
+// aren't.
+func (p *prompter) require(question, def string, valid func(string) error) (string, error) {
+	for {
+		answer, err := p.ask(question, def)
+		if err != nil {
+			return "", err
+		}
+		if answer == "" {
+			fmt.Fprintln(p.out, "  An answer is required.")
+			continue
+		}
+		if err := valid(answer); err != nil {
+			fmt.Fprintf(p.out, "  %v\n", err)
+			continue
+		}
+		return answer, nil
+	}
+}
+
+// confirm asks a yes or no question.
+func (p *prompter) confirm(question string, def bool) (bool, error) {
+	hint := "y/N"
+	if def {
+		hint = "Y/n"
+	}
+	answer, err := p.ask(question+" ("+hint+")", "")
+	if err != nil {
+		return false, err
+	}
+	switch strings.ToLower(answer) {
+	case "":
+		return def, nil
+	case "y", "yes":
+		return true, nil
+	}
+	return false, nil
+}
+
+func initCommand(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("init", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { fmt.Fprint(stderr, initUsage) }
+	envPath := fs.String("o", "staticomment.env", "env file to write")
+	formPath := fs.String("form", "comment-form.html", "example form to write")
+	force := fs.Bool("force", false, "overwrite existing files")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 {
+		return 2
+	}
+	if !*force {
+		for _, path := range []string{*envPath, *formPath} {
+			if _, err := os.Stat(path); err == nil {
+				fmt.Fprintf(stderr, "%s already exists (use -force to overwrite it)\n", path)
+				return 1
+			}
+		}
+	}
+
+	p := &prompter{in: bufio.NewReader(stdin), out: stdout}
+	settings, server, err := askSettings(p)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	if err := writeEnvFile(*envPath, settings); err != nil {
+		fmt.Fprintf(stderr, "writing %s: %v\n", *envPath, err)
+		return 1
+	}
+	if err := writeExampleForm(*formPath, server, strings.Split(settings["STATICOMMENT_ALLOWED_ORIGINS"], ",")[0]); err != nil {
+		fmt.Fprintf(stderr, "writing %s: %v\n", *formPath, err)
+		return 1
+	}
+	fmt.Fprintf(stdout, "\nWrote %s and %s. Start the server with:\n\n", *envPath, *formPath)
+	fmt.Fprintf(stdout, "  set -a; . ./%s; set +a; staticomment\n\n", filepath.Base(*envPath))
+	fmt.Fprintf(stdout, "or with Docker, mounting the data directory at the same path:\n\n")
+	fmt.Fprintf(stdout, "  docker run -d --env-file %s -v %s:%s -p 8080:8080 ghcr.io/cwage/staticomment:latest\n",
+		*envPath, settings["STATICOMMENT_DATA_DIR"], settings["STATICOMMENT_DATA_DIR"])
+	return 0
+}
+
+// askSettings runs the questions, returning the settings and the URL the
+// server will be reached at.
+func askSettings(p *prompter) (map[string]string, string, error) {
+	s := make(map[string]string)
+	var err error
+	fmt.Fprintln(p.out, "This sets up staticomment for your site's repo. Press Enter to accept a [default].")
+	fmt.Fprintln(p.out)
+
+	if s["STATICOMMENT_GIT_REPO"], err = p.require("Site repo URL (git@host:owner/repo.git or https://...)", "", func(repo string) error {
+		if strings.HasPrefix(repo, "http://") {
+			return fmt.Errorf("http:// remotes aren't supported; use https:// or SSH")
+		}
+		return nil
+	}); err != nil {
+		return nil, "", err
+	}
+	if s["STATICOMMENT_BRANCH"], err = p.ask("Branch", "main"); err != nil {
+		return nil, "", err
+	}
+	if s["STATICOMMENT_COMMENTS_PATH"], err = p.ask("Directory for comments in the repo", "_data/comments"); err != nil {
+		return nil, "", err
+	}
+	posts, err := p.ask("Directory of posts, to refuse comments on posts that don't exist (\"none\" to skip)", "_posts")
+	if err != nil {
+		return nil, "", err
+	}
+	if posts != "none" {
+		s["STATICOMMENT_POSTS_PATH"] = posts
+	}
+	if s["STATICOMMENT_ALLOWED_ORIGINS"], err = p.require("Your site's origin(s), comma-separated (e.g. https://example.com)", "", func(origins string) error {
+		for _, o := range strings.Split(origins, ",") {
+			if u, err := url.Parse(strings.TrimSpace(o)); err != nil || u.Scheme == "" || u.Host == "" {
+				return fmt.Errorf("%q is not an origin like https://example.com", strings.TrimSpace(o))
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, "", err
+	}
+	server, err := p.require("URL the server will be reachable at, for the example form", "http://localhost:8080", func(string) error { return nil })
+	if err != nil {
+		return nil, "", err
+	}
+	if s["STATICOMMENT_DATA_DIR"], err = p.ask("Data directory for the clone and SSH files", defaultDataDir(false)); err != nil {
+		return nil, "", err
+	}
+	if s["STATICOMMENT_DATA_DIR"], err = filepath.Abs(s["STATICOMMENT_DATA_DIR"]); err != nil {
+		return nil, "", err
+	}
+
+	switch repo := s["STATICOMMENT_GIT_REPO"]; {
+	case isHTTPRemote(repo):
+		if s["STATICOMMENT_GIT_TOKEN"], err = p.ask("Access token with write access to the repo (blank for none)", ""); err != nil {
+			return nil, "", err
+		}
+	case isSSHRemote(repo):
+		key := filepath.Join(s["STATICOMMENT_DATA_DIR"], ".ssh", "id_ed25519")
+		if err := offerDeployKey(p, key); err != nil {
+			return nil, "", err
+		}
+	}
+
+	for {
+		fmt.Fprintln(p.out, "\nChecking the repo can be reached...")
+		err := checkInitRemote(s)
+		if err == nil {
+			fmt.Fprintf(p.out, "OK: branch %s found.\n", s["STATICOMMENT_BRANCH"])
+			break
+		}
+		fmt.Fprintf(p.out, "Failed: %v\n", err)
+		retry, err := p.confirm("Try again?", true)
+		if err != nil {
+			return nil, "", err
+		}
+		if !retry {
+			fmt.Fprintln(p.out, "Writing the settings anyway; the server checks the repo again when it starts.")
+			break
+		}
+	}
+	return s, server, nil
+}
+
+// offerDeployKey generates a deploy key at path if there isn't one there,
+// and shows its public half to add to the repo.
+func offerDeployKey(p *prompter, path string) error {
+	if _, err := os.Stat(path); err == nil {
+		fmt.Fprintf(p.out, "Using the deploy key at %s.\n", path)
+		return nil
+	}
+	generate, err := p.confirm(fmt.Sprintf("No deploy key at %s. Generate one?", path), true)
+	if err != nil || !generate {
+		return err
+	}
+	pub, err := generateDeployKey(path)
+	if err != nil {
+		return fmt.Errorf("generating deploy key: %w", err)
+	}
+	fmt.Fprintf(p.out, "\nAdd this public key to the repo as a deploy key with write access\n(on GitHub: Settings > Deploy keys > Add deploy key, with \"Allow write access\"):\n\n%s\n", pub)
+	_, err = p.ask("Press Enter once it's added", "")
+	return err
+}
+
+// checkInitRemote checks the repo and branch can be reached with exactly
+// settings, as the server would, scanning the host keys into known_hosts
+// as it does on startup.
+func checkInitRemote(settings map[string]string) error {
+	for _, kv := range os.Environ() {
+		if key, _, _ := strings.Cut(kv, "="); strings.HasPrefix(key, "STATICOMMENT_") {
+			os.Unsetenv(key)
+		}
+	}
+	for key, value := range settings {
+		os.Setenv(key, value)
+	}
+	// Nobody wants to wait out the server's five minutes at a prompt
+	os.Setenv("STATICOMMENT_GIT_TIMEOUT", "30")
+	cfg, err := LoadConfig()
+	if err != nil {
+		return err
+	}
+	if err := ensureHostKeys(cfg); err != nil {
+		return err
+	}
+	return NewGoGitRepo(cfg).CheckRemote()
+}
+
+// writeEnvFile writes settings as KEY=value lines. It may hold a token, so
+// only the user can read it.
+func writeEnvFile(path string, settings map[string]string) error {
+	var b strings.Builder
+	b.WriteString("# staticomment settings, written by staticomment init. See the README\n# for the rest.\n")
+	for _, key := range initSettings {
+		if value := settings[key]; value != "" {
+			fmt.Fprintf(&b, "%s=%s\n", key, value)
+		}
+	}
+	return os.WriteFile(path, []byte(b.String()), 0600)
+}
+
+// exampleForm is the comment form written by staticomment init, for
+// pasting into a post layout.
+var exampleForm = template.Must(template.New("form").Parse(`<!-- staticomment comment form: put this in your post layout, and set the
+     slug to something unique to each post (in Jekyll, {{"{{"}} page.slug {{"}}"}}). -->
+<form id="comment-form" method="post" action="{{html .Action}}">
+  <input type="hidden" name="slug" value="my-post">
+  <input type="hidden" name="url" value="{{html .Origin}}/my-post/">
+  <!-- Visitors must spend a few seconds on the form before posting -->
+  <input type="hidden" name="_timestamp">
+  <script>document.querySelector("#comment-form [name=_timestamp]").value = Math.floor(Date.now() / 1000);</script>
+  <!-- Hidden from people; bots that fill it in are turned away -->
+  <div hidden><label>Website <input name="website" tabindex="-1" autocomplete="off"></label></div>
+  <label>Name <input id="comment-name" name="name" required></label>
+  <label>Email (optional, never shown) <input id="comment-email" name="email" type="email"></label>
+  <label>Comment <textarea id="comment-body" name="body" rows="5" required></textarea></label>
+  <button type="submit">Post comment</button>
+</form>
+`))
+
+// writeExampleForm writes the example form, posting to the server at
+// server and coming back to a page on origin.
+func writeExampleForm(path, server, origin string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := exampleForm.Execute(f, map[string]string{
+		"Action": strings.TrimSuffix(server, "/") + "/comment",
+		"Origin": strings.TrimSuffix(strings.TrimSpace(origin), "/"),
+	}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
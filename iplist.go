@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// IPList is a set of addresses and CIDR ranges.
+type IPList []*net.IPNet
+
+// LoadIPList reads the list in the environment variable name, addresses and
+// ranges separated by commas, together with the file named by name_FILE, one
+// per line with # starting a comment.
+func LoadIPList(name string) (IPList, error) {
+	var list IPList
+	add := func(s string) error {
+		if s = strings.TrimSpace(s); s == "" {
+			return nil
+		}
+		ipNet, err := parseIPOrCIDR(s)
+		if err != nil {
+			return err
+		}
+		list = append(list, ipNet)
+		return nil
+	}
+	for _, s := range strings.Split(os.Getenv(name), ",") {
+		if err := add(s); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	path := os.Getenv(name + "_FILE")
+	if path == "" {
+		return list, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("%s_FILE: %w", name, err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		s, _, _ := strings.Cut(scanner.Text(), "#")
+		if err := add(s); err != nil {
+			return nil, fmt.Errorf("%s_FILE: line %d: %w", name, line, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s_FILE: %w", name, err)
+	}
+	return list, nil
+}
+
+// Contains reports whether ip is in one of the list's ranges.
+func (l IPList) Contains(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, ipNet := range l {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedRemoteAddr replaces the address of requests from trusted proxies
+// with the client's, as the proxy reported it, so rate limits and every
+// other check see the visitor rather than the proxy. Headers from anyone
+// else are ignored, since a client can send whatever it likes.
+func forwardedRemoteAddr(trusted IPList, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if trusted.Contains(extractIP(r.RemoteAddr)) {
+			if ip := forwardedClientIP(r.Header, trusted); ip != "" {
+				r.RemoteAddr = net.JoinHostPort(ip, "0")
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// forwardedClientIP returns the client's address from a trusted proxy's
+// request, or "" if it gave none. X-Forwarded-For is read from the right,
+// where the nearest proxy appended, past any more trusted proxies, since
+// entries to the left of one it doesn't trust may be made up; X-Real-IP
+// and CF-Connecting-IP are used for proxies that only set those.
+func forwardedClientIP(header http.Header, trusted IPList) string {
+	var hops []string
+	for _, v := range header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(v, ",")...)
+	}
+	client := ""
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		client = ip.String()
+		if !trusted.Contains(client) {
+			break
+		}
+	}
+	if client != "" {
+		return client
+	}
+	for _, name := range []string{"X-Real-IP", "CF-Connecting-IP"} {
+		if ip := net.ParseIP(strings.TrimSpace(header.Get(name))); ip != nil {
+			return ip.String()
+		}
+	}
+	return ""
+}
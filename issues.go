@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// issueMarker starts the hidden line in an issue body that names the
+// quarantined comment file the issue is about.
+const issueMarker = "<!-- staticomment quarantine: "
+
+// moderatorAssociations are the author associations GitHub reports for
+// users with a say over the repo; commands from anyone else are ignored.
+var moderatorAssociations = map[string]bool{"OWNER": true, "MEMBER": true, "COLLABORATOR": true}
+
+// IssueModerator opens a GitHub issue for each quarantined comment and acts
+// on "/approve" and "/reject" commands that repo collaborators leave on it,
+// delivered as issue_comment events to POST /webhooks/github. Approving
+// moves the comment into the comments path; rejecting deletes it. Either
+// way the issue is then closed.
+type IssueModerator struct {
+	cfg       *Config
+	publisher *Publisher
+	issues    *githubIssues
+	mu        sync.Mutex
+}
+
+func NewIssueModerator(cfg *Config, publisher *Publisher) *IssueModerator {
+	return &IssueModerator{
+		cfg:       cfg,
+		publisher: publisher,
+		issues:    newGitHubIssues(cfg.PRAPI, cfg.PRRepo, func() (string, error) { return cfg.apiToken(cfg.PRToken) }),
+	}
+}
+
+// HandleEvent is the event bus subscriber that opens an issue for each
+// quarantined comment.
+func (m *IssueModerator) HandleEvent(e Event) {
+	if e.Type != EventQuarantined || e.Comment == nil {
+		return
+	}
+	c := *e.Comment
+	go func() {
+		title := fmt.Sprintf("Quarantined comment on %s by %s", c.Slug, c.Name)
+		issueURL, err := m.issues.Open(title, issueDescription(c, e.Path))
+		if err != nil {
+			log.Printf("error opening moderation issue for %s: %v", e.Path, err)
+			return
+		}
+		log.Printf("moderation issue for %s: %s", e.Path, issueURL)
+	}()
+}
+
+// issueDescription is the issue body for a quarantined comment.
+func issueDescription(c Comment, relPath string) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "A comment on **%s** by **%s** was quarantined", c.Slug, c.Name)
+	if c.ReplyTo != "" {
+		fmt.Fprintf(&sb, ", replying to `%s`", c.ReplyTo)
+	}
+	switch m := c.Moderation; {
+	case m == nil:
+	case m.Reason == "rule":
+		fmt.Fprintf(&sb, " by rule `%s`", m.Rule)
+	default:
+		fmt.Fprintf(&sb, " with a spam score of %d", m.Score)
+		for i, s := range m.Checks {
+			sep := ", "
+			if i == 0 {
+				sep = " ("
+			}
+			fmt.Fprintf(&sb, "%s`%s` %+d", sep, s.Name, s.Score)
+		}
+		if len(m.Checks) > 0 {
+			sb.WriteString(")")
+		}
+	}
+	sb.WriteString(".\n\n")
+	for _, line := range strings.Split(c.Body, "\n") {
+		sb.WriteString("> " + line + "\n")
+	}
+	fmt.Fprintf(&sb, "\nFile: `%s`\n\nComment `/approve` to publish it or `/reject` to delete it.\n\n", relPath)
+	sb.WriteString(issueMarker + filepath.ToSlash(relPath) + " -->\n")
+	return sb.String()
+}
+
+// issueCommentEvent is the part of GitHub's issue_comment payload we read.
+type issueCommentEvent struct {
+	Action string `json:"action"`
+	Issue  struct {
+		Number int    `json:"number"`
+		State  string `json:"state"`
+		Body   string `json:"body"`
+	} `json:"issue"`
+	Comment struct {
+		Body              string `json:"body"`
+		AuthorAssociation string `json:"author_association"`
+		User              struct {
+			Login string `json:"login"`
+		} `json:"user"`
+	} `json:"comment"`
+}
+
+// HandleIssueComment handles issue_comment webhook deliveries. Anything
+// other than a moderation command on one of our issues is ignored.
+func (m *IssueModerator) HandleIssueComment(w http.ResponseWriter, payload []byte) {
+	var ev issueCommentEvent
+	if err := json.Unmarshal(payload, &ev); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	command, _, _ := strings.Cut(strings.TrimSpace(ev.Comment.Body), "\n")
+	command = strings.TrimSpace(command)
+	relPath, ok := m.quarantinedPath(ev.Issue.Body)
+	if ev.Action != "created" || ev.Issue.State != "open" || !ok || (command != "/approve" && command != "/reject") {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if !moderatorAssociations[ev.Comment.AuthorAssociation] {
+		log.Printf("ignoring %s on issue #%d from %s (%s)", command, ev.Issue.Number, ev.Comment.User.Login, ev.Comment.AuthorAssociation)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var reply, reason string
+	var err error
+	if command == "/approve" {
+		var published string
+		published, err = m.publisher.Approve(relPath)
+		reply, reason = fmt.Sprintf("Published as `%s`.", published), "completed"
+	} else {
+		err = m.publisher.Discard(relPath)
+		reply, reason = "Deleted.", "not_planned"
+	}
+	switch {
+	case errors.Is(err, errNotQuarantined):
+		reply, reason = fmt.Sprintf("`%s` is no longer in quarantine; nothing to do.", relPath), "not_planned"
+	case err != nil:
+		log.Printf("error handling %s on issue #%d for %s: %v", command, ev.Issue.Number, relPath, err)
+		http.Error(w, "Failed to update the repo", http.StatusInternalServerError)
+		return
+	default:
+		log.Printf("%s by %s on issue #%d: %s", command, ev.Comment.User.Login, ev.Issue.Number, relPath)
+	}
+
+	if err := m.issues.Close(ev.Issue.Number, reply, reason); err != nil {
+		log.Printf("warning: closing moderation issue #%d: %v", ev.Issue.Number, err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// quarantinedPath extracts the comment file named in an issue body, which
+// must be <quarantine path>/<slug>/<id>.yml.
+func (m *IssueModerator) quarantinedPath(body string) (string, bool) {
+	_, rest, found := strings.Cut(body, issueMarker)
+	if !found {
+		return "", false
+	}
+	rel, _, found := strings.Cut(rest, " -->")
+	if !found {
+		return "", false
+	}
+	rel = filepath.FromSlash(strings.TrimSpace(rel))
+	dir, file := filepath.Split(rel)
+	slug := filepath.Base(dir)
+	if filepath.Clean(dir) != filepath.Join(m.cfg.QuarantinePath, slug) || !isValidSlug(slug) ||
+		filepath.Ext(file) != ".yml" || !isValidSlug(commentID(file)) {
+		return "", false
+	}
+	return rel, true
+}
+
+// githubIssues opens and closes issues through the GitHub REST API.
+type githubIssues struct {
+	api    string
+	repo   string
+	token  func() (string, error)
+	client *http.Client
+}
+
+func newGitHubIssues(api, repo string, token func() (string, error)) *githubIssues {
+	return &githubIssues{
+		api:    strings.TrimSuffix(api, "/"),
+		repo:   repo,
+		token:  token,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Open creates an issue and returns its URL.
+func (g *githubIssues) Open(title, body string) (string, error) {
+	var issue struct {
+		HTMLURL string `json:"html_url"`
+	}
+	if err := g.request(http.MethodPost, "/issues", map[string]string{"title": title, "body": body}, &issue); err != nil {
+		return "", fmt.Errorf("opening issue: %w", err)
+	}
+	return issue.HTMLURL, nil
+}
+
+// Close comments on an issue and closes it with the given state reason.
+func (g *githubIssues) Close(number int, comment, reason string) error {
+	if err := g.request(http.MethodPost, fmt.Sprintf("/issues/%d/comments", number), map[string]string{"body": comment}, nil); err != nil {
+		return fmt.Errorf("commenting on issue: %w", err)
+	}
+	if err := g.request(http.MethodPatch, fmt.Sprintf("/issues/%d", number), map[string]string{"state": "closed", "state_reason": reason}, nil); err != nil {
+		return fmt.Errorf("closing issue: %w", err)
+	}
+	return nil
+}
+
+func (g *githubIssues) request(method, path string, body, out any) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	token, err := g.token()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, g.api+"/repos/"+g.repo+path, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "token "+token)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// langPattern accepts BCP 47-style language tags such as "en", "pt-BR" or
+// "zh-Hant-TW".
+var langPattern = regexp.MustCompile(`^[A-Za-z]{2,3}(-[A-Za-z0-9]{1,8})*$`)
+
+// isValidLang reports whether lang looks like a language tag.
+func isValidLang(lang string) bool {
+	return len(lang) <= 35 && langPattern.MatchString(lang)
+}
+
+// rtlScripts are the scripts written right to left.
+var rtlScripts = []*unicode.RangeTable{
+	unicode.Arabic, unicode.Hebrew, unicode.Syriac, unicode.Thaana, unicode.Nko,
+	unicode.Samaritan, unicode.Mandaic, unicode.Adlam, unicode.Hanifi_Rohingya,
+}
+
+// rtlLanguages are primary language subtags normally written right to left,
+// used when the text itself has no letters to go by.
+var rtlLanguages = map[string]bool{
+	"ar": true, "arc": true, "ckb": true, "dv": true, "fa": true, "he": true,
+	"ps": true, "sd": true, "syr": true, "ug": true, "ur": true, "yi": true,
+}
+
+// textDirection returns "rtl" if most of body's letters are in a
+// right-to-left script, and "" (left to right, the default) otherwise.
+// Counting every letter rather than taking the first keeps an Arabic or
+// Hebrew comment that opens with a Latin name or URL right to left.
+func textDirection(body, lang string) string {
+	var rtl, ltr int
+	for _, r := range body {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		if unicode.IsOneOf(rtlScripts, r) {
+			rtl++
+		} else {
+			ltr++
+		}
+	}
+	if rtl == 0 && ltr == 0 {
+		primary, _, _ := strings.Cut(strings.ToLower(lang), "-")
+		if rtlLanguages[primary] {
+			return "rtl"
+		}
+		return ""
+	}
+	if rtl > ltr {
+		return "rtl"
+	}
+	return ""
+}
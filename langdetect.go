@@ -0,0 +1,141 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Language filter actions: what happens to a comment in a language not on
+// STATICOMMENT_LANGUAGES (STATICOMMENT_LANGUAGE_ACTION).
+const (
+	LanguageQuarantine = "quarantine"
+	LanguageReject     = "reject"
+)
+
+// minDetectLetters is how many letters a text needs before its language is
+// guessed at all.
+const minDetectLetters = 20
+
+// scriptLanguages are scripts written by one language above all others,
+// with that language. Kana is Japanese whatever else is mixed in, so it
+// comes before Han.
+var scriptLanguages = []struct {
+	script *unicode.RangeTable
+	lang   string
+}{
+	{unicode.Hiragana, "ja"}, {unicode.Katakana, "ja"}, {unicode.Hangul, "ko"},
+	{unicode.Han, "zh"}, {unicode.Cyrillic, "ru"}, {unicode.Greek, "el"},
+	{unicode.Arabic, "ar"}, {unicode.Hebrew, "he"}, {unicode.Thai, "th"},
+	{unicode.Devanagari, "hi"}, {unicode.Bengali, "bn"}, {unicode.Tamil, "ta"},
+	{unicode.Georgian, "ka"}, {unicode.Armenian, "hy"},
+}
+
+// stopwords are frequent short words of languages written in Latin script.
+// A text is in the language whose words it uses most.
+var stopwords = map[string][]string{
+	"en": {"the", "and", "is", "are", "was", "this", "that", "with", "for", "you", "have", "but", "not", "of", "what", "would", "it's", "i'm"},
+	"de": {"der", "die", "das", "und", "ist", "nicht", "ein", "eine", "ich", "mit", "auf", "für", "auch", "sich", "dem", "den", "wie"},
+	"fr": {"le", "la", "les", "et", "est", "une", "des", "pas", "qui", "pour", "dans", "sur", "avec", "je", "ce", "c'est", "du"},
+	"es": {"el", "los", "las", "que", "del", "una", "por", "con", "para", "muy", "pero", "como", "está", "son", "y", "lo"},
+	"pt": {"não", "que", "uma", "com", "para", "os", "das", "dos", "por", "mais", "muito", "é", "está", "são", "isso", "você"},
+	"it": {"il", "che", "della", "non", "una", "sono", "per", "con", "gli", "anche", "questo", "molto", "è", "come", "di"},
+	"nl": {"het", "een", "van", "niet", "ik", "dat", "zijn", "met", "voor", "ook", "maar", "wel", "deze", "je"},
+	"pl": {"nie", "się", "jest", "że", "na", "jak", "ale", "czy", "tak", "już", "bardzo", "to", "w"},
+	"tr": {"ve", "bir", "bu", "için", "çok", "ile", "ama", "değil", "gibi", "daha", "ne", "da"},
+	"sv": {"och", "att", "det", "är", "som", "inte", "för", "med", "jag", "har", "till", "den"},
+	"id": {"yang", "dan", "di", "ini", "itu", "dengan", "untuk", "tidak", "dari", "ada", "saya"},
+	"vi": {"và", "của", "là", "có", "không", "những", "một", "được", "cho", "này", "người"},
+}
+
+// stopwordLangs indexes stopwords by word.
+var stopwordLangs = func() map[string][]string {
+	m := make(map[string][]string)
+	for lang, words := range stopwords {
+		for _, w := range words {
+			m[w] = append(m[w], lang)
+		}
+	}
+	return m
+}()
+
+// detectLanguage guesses the primary language subtag of text, or returns
+// "" if it can't tell: the text is too short, or its words don't favor one
+// language. Scripts used by one language decide it outright; Cyrillic is
+// Ukrainian with the letters only Ukrainian has and Russian otherwise, and
+// Arabic script Persian with Persian letters and Arabic otherwise. Latin
+// script goes by stopwords, so it's only as good as the text is long.
+func detectLanguage(text string) string {
+	counts := make(map[string]int)
+	var latin, letters int
+	for _, r := range text {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+		if unicode.Is(unicode.Latin, r) {
+			latin++
+			continue
+		}
+		for _, s := range scriptLanguages {
+			if unicode.Is(s.script, r) {
+				counts[s.lang]++
+				break
+			}
+		}
+	}
+	if letters < minDetectLetters {
+		return ""
+	}
+
+	// Japanese mixes kana with Han, often fewer of them
+	if counts["ja"] > 0 {
+		counts["ja"] += counts["zh"]
+		delete(counts, "zh")
+	}
+	best, most := "", latin
+	for lang, n := range counts {
+		if n > most {
+			best, most = lang, n
+		}
+	}
+	switch best {
+	case "ru":
+		if strings.ContainsAny(text, "іїєґІЇЄҐ") {
+			return "uk"
+		}
+	case "ar":
+		if strings.ContainsAny(text, "پچژگ") {
+			return "fa"
+		}
+	case "":
+		return latinLanguage(text)
+	}
+	return best
+}
+
+// latinLanguage guesses the language of text in Latin script by its
+// stopwords, requiring at least two and a clear winner.
+func latinLanguage(text string) string {
+	hits := make(map[string]int)
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && r != '\''
+	})
+	for _, w := range words {
+		for _, lang := range stopwordLangs[w] {
+			hits[lang]++
+		}
+	}
+	best, most, tied := "", 0, false
+	for lang, n := range hits {
+		switch {
+		case n > most:
+			best, most, tied = lang, n, false
+		case n == most:
+			tied = true
+		}
+	}
+	if most < 2 || tied {
+		return ""
+	}
+	return best
+}
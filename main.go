@@ -3,29 +3,137 @@ package main
 import (
 	"log"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lshortfile)
+	runCommand(os.Args[1:])
+	if dir := os.Getenv("STATICOMMENT_TENANTS_DIR"); dir != "" {
+		runTenantHost(dir)
+	}
 
 	cfg, err := LoadConfig()
 	if err != nil {
 		log.Fatalf("config error: %v", err)
 	}
 
+	if cfg.PreviewMode {
+		log.SetPrefix("[preview] ")
+	}
+	if cfg.Tenant != "" {
+		log.SetPrefix(log.Prefix() + "[" + cfg.Tenant + "] ")
+		go watchTenantHost()
+	}
+
 	log.Printf("staticomment starting on :%s", cfg.Port)
-	log.Printf("  repo: %s (branch: %s)", cfg.GitRepo, cfg.Branch)
+	if cfg.Backend == BackendGitHub || cfg.Backend == BackendGitea {
+		log.Printf("  repo: %s via %s API %s (branch: %s)", cfg.ContentsRepo, cfg.Backend, cfg.ContentsAPI, cfg.Branch)
+	} else {
+		client := "go-git"
+		if cfg.GitCLI {
+			client = "git CLI"
+		}
+		if cfg.GitBare {
+			client = "git CLI, bare clone"
+		}
+		log.Printf("  repo: %s (branch: %s, via %s)", sanitizeArgs([]string{cfg.GitRepo})[0], cfg.Branch, client)
+		if cfg.GitToken != "" {
+			log.Printf("  https auth: token as %s", cfg.GitUsername)
+		}
+		if len(cfg.GitMirrors) > 0 {
+			log.Printf("  mirrors: %v", sanitizeArgs(cfg.GitMirrors))
+		}
+		if cfg.CloneDepth > 0 {
+			log.Printf("  clone depth: %d", cfg.CloneDepth)
+		}
+		if cfg.CloneFilter != "" {
+			log.Printf("  clone filter: %s", cfg.CloneFilter)
+		}
+		if cfg.SparseCheckout {
+			log.Printf("  sparse checkout: enabled")
+		}
+		log.Printf("  committer: %s <%s>", cfg.GitName, cfg.GitEmail)
+		if cfg.SigningKey != "" {
+			log.Printf("  commit signing: %s key %s", cfg.SigningFormat, cfg.SigningKey)
+		}
+	}
+	if cfg.GitHubApp != nil {
+		log.Printf("  auth: GitHub App %s installation tokens", cfg.GitHubApp.appID)
+	}
+	if cfg.Local {
+		log.Printf("  local mode: data dir %s, SSH keys and known_hosts from %s", cfg.DataDir, cfg.SSHDir)
+	}
+	log.Printf("  repo dir: %s (files %04o, directories %04o)", cfg.RepoDir, cfg.FileMode, cfg.DirMode)
+	if cfg.FileUID >= 0 {
+		log.Printf("  file owner: %d:%d", cfg.FileUID, cfg.FileGID)
+	}
 	log.Printf("  comments path: %s", cfg.CommentsPath)
+	if cfg.IndexPath != "" {
+		log.Printf("  index path: %s", cfg.IndexPath)
+	}
+	log.Printf("  state path: %s (subscriptions encrypted: %v)", cfg.StatePath, cfg.StateKey != nil)
+	if cfg.SQLitePath != "" {
+		log.Printf("  sqlite state: %s (rate limits, subscriptions)", cfg.SQLitePath)
+	}
+	if cfg.RedisURL != "" {
+		log.Printf("  redis: %s (rate limits, form token nonces; keys prefixed %q)", sanitizeArgs([]string{cfg.RedisURL})[0], cfg.RedisPrefix)
+	}
+	if cfg.OutboxDir != "" {
+		log.Printf("  outbox: %s (lease %ds)", cfg.OutboxDir, cfg.OutboxLease)
+		if cfg.AsyncPublish {
+			log.Printf("  async publish: enabled (retry every %ds)", cfg.OutboxRetry)
+		}
+	}
+	if cfg.Moderation {
+		prs := "disabled (no STATICOMMENT_PR_TOKEN)"
+		if cfg.hasPRToken() {
+			prs = cfg.PRProvider + " " + cfg.PRAPI + " " + cfg.PRRepo
+		}
+		log.Printf("  moderation: branches %s*, pull requests %s", cfg.ModerationPrefix, prs)
+		if cfg.WebhookSecret != "" {
+			log.Printf("  moderation: merged pull requests reported at /webhooks/%s", cfg.PRProvider)
+		}
+	}
+	if cfg.CommitAsCommenter {
+		log.Printf("  commit author: commenter (when an email is given)")
+	}
+	if cfg.IssueModeration {
+		log.Printf("  issue moderation: quarantined comments open issues on %s %s", cfg.PRAPI, cfg.PRRepo)
+	}
+	if cfg.PreviewMode {
+		log.Printf("  preview mode: committing to local branch %s, pushes disabled", cfg.PreviewBranch)
+	}
 	if cfg.PostsPath != "" {
 		log.Printf("  posts path: %s (post existence validation enabled)", cfg.PostsPath)
+		if cfg.PostsRepo != "" {
+			log.Printf("  posts repo: %s (branch: %s)", sanitizeArgs([]string{cfg.PostsRepo})[0], cfg.PostsBranch)
+		}
 	}
 	log.Printf("  allowed origins: %v", cfg.AllowedOrigins)
+	if cfg.DNSOriginToken != "" {
+		log.Printf("  dns origins: https sites with TXT %s<host> \"staticomment=%s\"", dnsOriginPrefix, cfg.DNSOriginToken)
+	}
 	if cfg.HoneypotField != "" {
-		log.Printf("  honeypot field: %s", cfg.HoneypotField)
+		log.Printf("  honeypot field: %s (action: %s)", cfg.HoneypotField, cfg.HoneypotAction)
+	}
+	if len(cfg.TarpitReasons) > 0 {
+		log.Printf("  tarpit: %v (%ds, max %d at once)", cfg.TarpitReasons, cfg.TarpitDuration, cfg.TarpitMax)
 	}
 	if cfg.RateLimitMax > 0 {
-		log.Printf("  rate limit: %d requests per %d seconds", cfg.RateLimitMax, cfg.RateLimitWindow)
+		log.Printf("  rate limit: %d requests per %d seconds (%s)", cfg.RateLimitMax, cfg.RateLimitWindow, cfg.RateLimitAlgorithm)
+	}
+	if cfg.RateLimitPostIPMax > 0 || cfg.RateLimitPostMax > 0 {
+		log.Printf("  post rate limit: %d per IP, %d in all, per post per %d seconds (0 is unlimited)", cfg.RateLimitPostIPMax, cfg.RateLimitPostMax, cfg.RateLimitWindow)
+	}
+	if cfg.RateLimitGlobalMax > 0 {
+		log.Printf("  global rate limit: %d comments per %d seconds", cfg.RateLimitGlobalMax, cfg.RateLimitWindow)
+	}
+	if cfg.MaxInFlight > 0 {
+		log.Printf("  max in flight: %d submissions", cfg.MaxInFlight)
 	}
 	if cfg.MaxLinks > 0 {
 		log.Printf("  max links: %d", cfg.MaxLinks)
@@ -33,14 +141,203 @@ func main() {
 	if len(cfg.BlockedPatterns) > 0 {
 		log.Printf("  blocked patterns: %d", len(cfg.BlockedPatterns))
 	}
+	if n := len(cfg.Content.overrides); n > 0 {
+		log.Printf("  content overrides: %d", n)
+	}
 	if cfg.MinSubmitTime > 0 {
-		log.Printf("  min submit time: %ds", cfg.MinSubmitTime)
+		log.Printf("  min submit time: %ds (clock skew allowed: %ds)", cfg.MinSubmitTime, cfg.ClockSkew)
+	}
+	if cfg.FormSecret != "" {
+		log.Printf("  form tokens: required (valid %ds)", cfg.FormTokenTTL)
+	}
+	if cfg.PowEnabled {
+		log.Printf("  proof of work: required (up to %d hashes, valid %ds)", cfg.PowMaxNumber, cfg.PowTTL)
+	}
+	if cfg.CanaryInterval > 0 {
+		log.Printf("  canary: every %ds on %s", cfg.CanaryInterval, cfg.CanarySlug)
+	}
+	if cfg.CommentIDFormat != CommentIDTimestamp {
+		log.Printf("  comment IDs: %s", cfg.CommentIDFormat)
+	}
+	if !cfg.FixedTime.IsZero() {
+		log.Printf("  WARNING: clock fixed at %s for comments", cfg.FixedTime.Format(time.RFC3339))
+	}
+	if len(cfg.IPAllowlist) > 0 {
+		log.Printf("  IP allowlist: %d entries", len(cfg.IPAllowlist))
+	}
+	if len(cfg.IPDenylist) > 0 {
+		log.Printf("  IP denylist: %d entries", len(cfg.IPDenylist))
+	}
+	if len(cfg.TrustedProxies) > 0 {
+		log.Printf("  trusted proxies: %d entries", len(cfg.TrustedProxies))
+	}
+	if cfg.Rules != nil {
+		log.Printf("  rules: %d (quarantine at score %d, reject at %d)", len(cfg.Rules.Rules), cfg.ScoreQuarantine, cfg.ScoreReject)
+	}
+	if cfg.Reputation {
+		log.Printf("  reputation: weight %d, half-life %dh", cfg.ReputationWeight, cfg.ReputationHalfLife)
+		if cfg.ASNDB != "" {
+			log.Printf("  ASN database: %s (weight %d)", cfg.ASNDB, cfg.ReputationASNWeight)
+		}
+	}
+	if len(cfg.DNSBLZones) > 0 {
+		names := make([]string, len(cfg.DNSBLZones))
+		for i, z := range cfg.DNSBLZones {
+			names[i] = z.Name
+		}
+		log.Printf("  dnsbl: %s (%s)", strings.Join(names, ", "), cfg.DNSBLAction)
+	}
+	if len(cfg.Languages) > 0 {
+		log.Printf("  languages: %s (%s otherwise)", strings.Join(cfg.Languages, ", "), cfg.LanguageAction)
+	}
+	if cfg.Bayes {
+		log.Printf("  bayes: %s, spam probability %g and up (%s)", cfg.BayesPath, cfg.BayesThreshold, cfg.BayesAction)
+	}
+	if cfg.StopForumSpam {
+		log.Printf("  stopforumspam: confidence %g and up (%s)", cfg.StopForumSpamThreshold, cfg.StopForumSpamAction)
+	}
+	if cfg.AkismetKey != "" {
+		log.Printf("  akismet: checking as %s (spam: %s)", cfg.AkismetBlog, cfg.AkismetAction)
+	}
+	if cfg.RecaptchaSecret != "" {
+		log.Printf("  recaptcha: minimum score %g", cfg.RecaptchaMinScore)
+	}
+	if cfg.HCaptchaSiteKey != "" {
+		log.Printf("  hcaptcha: site key %s", cfg.HCaptchaSiteKey)
+	} else if cfg.HCaptchaSecret != "" {
+		log.Printf("  hcaptcha: enabled")
+	}
+	if cfg.MaxReplyDepth > 0 {
+		log.Printf("  max reply depth: %d (flatten: %v)", cfg.MaxReplyDepth, cfg.FlattenReplies)
+	}
+	if cfg.BodyHTML {
+		log.Printf("  body_html: enabled (autolink: %v, images: %s, embed domains: %v)", cfg.Autolink, cfg.ImagePolicy, cfg.EmbedDomains)
+	}
+	if cfg.Widget {
+		templates := "built-in"
+		if cfg.TemplatesPath != "" {
+			templates = cfg.TemplatesPath + " in the repo"
+		}
+		log.Printf("  widget: enabled at /comments/{slug} and /widget.js (templates: %s)", templates)
+	}
+	if cfg.MetricsEnabled {
+		log.Printf("  metrics: enabled at /metrics")
+	}
+	if cfg.AuditLog {
+		log.Printf("  audit log: enabled")
+	}
+	if cfg.CorpusDir != "" {
+		log.Printf("  spam corpus: %s (max %d entries, %d days)", cfg.CorpusDir, cfg.CorpusMax, cfg.CorpusRetention)
+	}
+	if cfg.AnalyticsURL != "" {
+		log.Printf("  analytics: POST to %s", cfg.AnalyticsURL)
+	}
+	if cfg.AnalyticsFile != "" {
+		log.Printf("  analytics: appending to %s", cfg.AnalyticsFile)
+	}
+	if cfg.SMTPHost != "" {
+		log.Printf("  email notifications: via %s:%d to %v and reply subscribers", cfg.SMTPHost, cfg.SMTPPort, cfg.NotifyEmails)
+	}
+	if cfg.NotifyWebhook != "" {
+		log.Printf("  webhook notifications: enabled")
+	}
+	if cfg.AdminToken != "" || cfg.AdminTOTPSecret != "" || len(cfg.AdminUsers) > 0 {
+		log.Printf("  admin API: enabled at /admin/")
+	}
+	if len(cfg.AdminUsers) > 0 {
+		log.Printf("  admin API: %d users", len(cfg.AdminUsers))
+	}
+	if cfg.AdminOIDCIssuer != "" {
+		log.Printf("  admin API: OIDC ID tokens from %s", cfg.AdminOIDCIssuer)
+	}
+	if cfg.AdminOIDCRedirectURL != "" {
+		log.Printf("  admin API: OIDC login at /admin/login, sessions last %ds", cfg.AdminSessionTTL)
+	}
+	if cfg.AdminTOTPSecret != "" {
+		log.Printf("  admin API: time-based tokens valid for %ds", cfg.AdminTOTPPeriod)
+	}
+	if cfg.Maintenance {
+		log.Printf("  maintenance mode: enabled, comments are closed")
+	}
+	if cfg.SyncToken != "" {
+		log.Printf("  repo sync: enabled at /sync")
+	}
+	if cfg.PullInterval > 0 {
+		log.Printf("  background pull: every %dm", cfg.PullInterval)
+	}
+	if cfg.BatchInterval > 0 {
+		log.Printf("  commit batching: %ds, up to %d comments", cfg.BatchInterval, cfg.BatchMax)
+		if cfg.BatchThreshold > 0 {
+			log.Printf("  commit batching from %d comments in %ds", cfg.BatchThreshold, cfg.BatchThresholdWindow)
+		}
+	}
+	if cfg.CloneRetry {
+		log.Printf("  clone retry: enabled (timeout %ds, 0 = none)", cfg.CloneRetryTimeout)
+	}
+	if cfg.ReplySecret != "" {
+		log.Printf("  email replies: enabled at /inbound/email (owners: %v)", cfg.OwnerEmails)
 	}
 
-	repo := NewGitRepo(cfg)
-	if err := repo.Clone(); err != nil {
+	if cfg.SSHKey != nil && cfg.Backend == BackendGit {
+		if err := writeSSHKey(cfg); err != nil {
+			log.Fatalf("ssh key error: %v", err)
+		}
+		log.Printf("  ssh key: from the environment, written to %s", cfg.SSHKeyPaths[0])
+	}
+
+	repo := openRepo(cfg)
+	// Posts are read from the repo unless they're kept elsewhere
+	posts := repo
+	if cfg.PostsRepo != "" {
+		posts = NewGoGitRepo(postsConfig(cfg))
+		if cfg.GitCLI {
+			posts = NewGitRepo(postsConfig(cfg))
+		}
+	}
+
+	// A tenant's instance is only reached through its host
+	listenHost := ""
+	if cfg.Tenant != "" {
+		listenHost = "127.0.0.1"
+	}
+	startup := NewStartup()
+	srv := &http.Server{
+		Addr:              listenHost + ":" + cfg.Port,
+		Handler:           startup,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      60 * time.Second,
+		IdleTimeout:       120 * time.Second,
+	}
+	serveErr := make(chan error, 1)
+	serve := func() {
+		log.Printf("listening on %s", srv.Addr)
+		go func() { serveErr <- srv.ListenAndServe() }()
+	}
+
+	if cfg.CloneRetry {
+		// Listen first, so /health answers while the clone is retried
+		serve()
+		if err := cloneWithRetry(repo, time.Duration(cfg.CloneRetryTimeout)*time.Second); err != nil {
+			log.Fatalf("git clone failed, giving up: %v", err)
+		}
+	} else if err := repo.Clone(); err != nil {
 		log.Fatalf("git clone failed: %v", err)
 	}
+	if posts != repo {
+		if cfg.CloneRetry {
+			err = cloneWithRetry(posts, time.Duration(cfg.CloneRetryTimeout)*time.Second)
+		} else {
+			err = posts.Clone()
+		}
+		if err != nil {
+			log.Fatalf("git clone of the posts repo failed: %v", err)
+		}
+	}
+	repos := []Repo{repo}
+	if posts != repo {
+		repos = append(repos, posts)
+	}
 
 	mux := http.NewServeMux()
 
@@ -48,21 +345,223 @@ func main() {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("ok"))
 	})
+	mux.HandleFunc("GET /schema.json", serveSchema(cfg))
+	mux.HandleFunc("GET /robots.txt", serveRobotsTxt(cfg))
+	if cfg.SecurityTxt != nil || len(cfg.SecurityContacts) > 0 {
+		mux.HandleFunc("GET /.well-known/security.txt", serveSecurityTxt(cfg))
+	}
+	if cfg.SyncToken != "" {
+		mux.Handle("POST /sync", NewSyncHandler(repos, cfg.SyncToken))
+	}
+	if cfg.PullInterval > 0 {
+		go pullPeriodically(repos, time.Duration(cfg.PullInterval)*time.Minute)
+	}
 
-	rateLimiter := NewRateLimiter(cfg.RateLimitWindow, cfg.RateLimitMax)
-	mux.Handle("POST /comment", NewCommentHandler(cfg, repo, rateLimiter))
+	events := NewEventBus()
+	metrics := NewMetrics()
+	events.Subscribe(metrics.HandleEvent)
+	if cfg.MetricsEnabled {
+		mux.Handle("GET /metrics", metrics)
+	}
+	if cfg.AuditLog {
+		events.Subscribe(logEvent)
+	}
+	if cfg.CorpusDir != "" {
+		corpus, err := OpenCorpus(cfg.CorpusDir, cfg.CorpusMax, time.Duration(cfg.CorpusRetention)*24*time.Hour)
+		if err != nil {
+			log.Fatalf("spam corpus error: %v", err)
+		}
+		events.Subscribe(corpus.HandleEvent)
+		go corpus.Run()
+	}
+	if cfg.AnalyticsURL != "" || cfg.AnalyticsFile != "" {
+		analytics := NewAnalytics(cfg.AnalyticsURL, cfg.AnalyticsFile)
+		events.Subscribe(analytics.HandleEvent)
+		go analytics.Run()
+	}
+	if cfg.PostPushCmd != "" {
+		hook := NewPostPushHook(cfg)
+		events.Subscribe(hook.HandleEvent)
+		go hook.Run()
+	}
 
-	srv := &http.Server{
-		Addr:              ":" + cfg.Port,
-		Handler:           mux,
-		ReadHeaderTimeout: 10 * time.Second,
-		ReadTimeout:       30 * time.Second,
-		WriteTimeout:      60 * time.Second,
-		IdleTimeout:       120 * time.Second,
+	var outbox *Outbox
+	if cfg.OutboxDir != "" {
+		outbox, err = NewOutbox(cfg.OutboxDir, time.Duration(cfg.OutboxLease)*time.Second)
+		if err != nil {
+			log.Fatalf("outbox error: %v", err)
+		}
+	}
+
+	state, err := NewStateStore(cfg, repo)
+	if err != nil {
+		log.Fatalf("state store error: %v", err)
 	}
 
-	log.Printf("listening on :%s", cfg.Port)
-	if err := srv.ListenAndServe(); err != nil {
-		log.Fatalf("server error: %v", err)
+	var subs SubscriptionStore = state
+	var nonces NonceStore = NewMemoryNonceStore(cfg.NonceCacheSize)
+	rateLimiter := NewRateLimiter(cfg)
+	postRateLimiter := NewPostRateLimiter(cfg)
+	globalRateLimiter := NewGlobalRateLimiter(cfg)
+	if cfg.SQLitePath != "" {
+		db, err := OpenSQLiteStore(cfg.SQLitePath)
+		if err != nil {
+			log.Fatalf("sqlite error: %v", err)
+		}
+		subs = db
+		nonces = db
+		rateLimiter = db.RateLimiter(cfg)
+		postRateLimiter = db.PostRateLimiter(cfg)
+		globalRateLimiter = db.GlobalRateLimiter(cfg)
+	}
+	if cfg.RedisURL != "" {
+		rdb, err := NewRedisStore(cfg)
+		if err != nil {
+			log.Fatalf("redis error: %v", err)
+		}
+		if err := rdb.Ping(); err != nil {
+			log.Printf("warning: redis: %v; rate limits are off until it's reachable", err)
+		}
+		nonces = rdb
+		rateLimiter = rdb.RateLimiter(cfg)
+		postRateLimiter = rdb.PostRateLimiter(cfg)
+		globalRateLimiter = rdb.GlobalRateLimiter(cfg)
+	}
+
+	origins := NewOrigins(cfg)
+	var tokens *FormTokens
+	if cfg.FormSecret != "" {
+		tokens = NewFormTokens(cfg.FormSecret, time.Duration(cfg.FormTokenTTL)*time.Second, nonces)
+		mux.Handle("GET /token", NewTokenHandler(cfg, origins, tokens))
+	}
+	var pow *ProofOfWork
+	if cfg.PowEnabled {
+		pow = NewProofOfWork(cfg.PowKey, cfg.PowMaxNumber, time.Duration(cfg.PowTTL)*time.Second, nonces)
+		mux.Handle("GET /challenge", NewChallengeHandler(cfg, origins, pow))
+	}
+
+	var channels []Channel
+	if cfg.SMTPHost != "" {
+		channels = append(channels, &emailChannel{cfg: cfg})
+	}
+	if cfg.NotifyWebhook != "" {
+		channels = append(channels, newWebhookChannel(cfg.NotifyWebhook))
+	}
+	var dispatcher *Dispatcher
+	if len(channels) > 0 {
+		dispatcher = NewDispatcher(cfg, subs, events, channels...)
+		events.Subscribe(dispatcher.HandleEvent)
+		dispatcher.Start()
+	}
+	var akismet *Akismet
+	if cfg.AkismetKey != "" {
+		akismet, err = NewAkismet(cfg)
+		if err != nil {
+			log.Fatalf("akismet error: %v", err)
+		}
+		go akismet.Run()
+	}
+	publisher := NewPublisher(cfg, repo, posts, events, outbox, subs, akismet)
+	status := NewStatusHandler(repo, publisher)
+	events.Subscribe(status.HandleEvent)
+	mux.Handle("GET /status", status)
+	maintenance := NewMaintenance(cfg.Maintenance)
+	var bayes *Bayes
+	if cfg.Bayes {
+		bayes = NewBayes(cfg, bayesPath(cfg, repo))
+	}
+	if cfg.WebhookSecret != "" && cfg.Moderation && cfg.PRProvider == ProviderGitLab {
+		webhook := NewGitLabWebhook(cfg.WebhookSecret)
+		webhook.Handle("Merge Request Hook", NewReviewWatcher(cfg, publisher).HandleMergeRequest)
+		mux.Handle("POST /webhooks/gitlab", webhook)
+	} else if cfg.WebhookSecret != "" && (cfg.IssueModeration || cfg.Moderation) {
+		webhook := NewGitHubWebhook(cfg.WebhookSecret)
+		if cfg.IssueModeration {
+			moderator := NewIssueModerator(cfg, publisher)
+			events.Subscribe(moderator.HandleEvent)
+			webhook.Handle("issue_comment", moderator.HandleIssueComment)
+		}
+		if cfg.Moderation {
+			webhook.Handle("pull_request", NewReviewWatcher(cfg, publisher).HandlePullRequest)
+		}
+		mux.Handle("POST /webhooks/github", webhook)
+	}
+	if cfg.AsyncPublish {
+		go publisher.Run()
+	} else {
+		publisher.ReplayOutbox()
+	}
+	if cfg.CanaryInterval > 0 {
+		go NewCanary(cfg, publisher, events).Run()
+	}
+
+	var reputation *Reputation
+	if cfg.Reputation {
+		reputation, err = NewReputation(cfg)
+		if err != nil {
+			log.Fatalf("reputation error: %v", err)
+		}
+		events.Subscribe(reputation.HandleEvent)
+	}
+
+	comments := NewCommentHandler(cfg, repo, posts, origins, rateLimiter, postRateLimiter, globalRateLimiter, events, publisher, state, tokens, pow, reputation, maintenance, akismet, bayes)
+	mux.Handle("POST /comment", comments)
+	registerAdmin(mux, cfg, repo, dispatcher, maintenance, publisher, bayes, comments)
+	if cfg.ReplySecret != "" {
+		mux.Handle("POST /inbound/email", NewInboundMailHandler(cfg, comments, nonces))
+	}
+	if cfg.Widget {
+		templates, err := NewTemplates(cfg, repo)
+		if err != nil {
+			log.Fatalf("templates error: %v", err)
+		}
+		partial := NewPartialHandler(cfg, repo, origins, templates)
+		mux.Handle("GET /comments/{slug}", partial)
+		mux.HandleFunc("GET /widget.js", serveWidget)
+		if demoDir != "" {
+			mux.Handle("GET /{$}", NewDemoHandler(partial))
+			log.Printf("demo: open http://localhost:%s/ to leave a comment; the site repo is %s", cfg.Port, filepath.Join(demoDir, "site.git"))
+		}
+	}
+
+	var handler http.Handler = mux
+	if cfg.PreviewMode {
+		handler = previewHeader(mux)
+	}
+	if len(cfg.TrustedProxies) > 0 {
+		handler = forwardedRemoteAddr(cfg.TrustedProxies, handler)
+	}
+	if cfg.Tenant != "" {
+		handler = tenantRemoteAddr(cfg.TenantSecret, handler)
+	}
+
+	startup.Ready(handler)
+	if cfg.CloneRetry {
+		log.Printf("ready")
+	} else {
+		serve()
+	}
+	log.Fatalf("server error: %v", <-serveErr)
+}
+
+// previewHeader marks every response as coming from a preview instance so
+// staging traffic is easy to tell apart from production.
+func previewHeader(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Staticomment-Preview", "1")
+		next.ServeHTTP(w, r)
+	})
+}
+
+// openRepo returns the Repo for the configured backend and git client.
+func openRepo(cfg *Config) Repo {
+	switch {
+	case cfg.Backend == BackendGitHub || cfg.Backend == BackendGitea:
+		return NewContentsRepo(cfg)
+	case cfg.GitBare:
+		return NewBareRepo(cfg)
+	case cfg.GitCLI:
+		return NewGitRepo(cfg)
 	}
+	return NewGoGitRepo(cfg)
 }
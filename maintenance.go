@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+// Maintenance is the maintenance mode switch. While it's on, POST /comment
+// turns submissions away before touching git. It starts as
+// STATICOMMENT_MAINTENANCE sets it and can be flipped through the admin API;
+// the admin setting lasts until restart.
+type Maintenance struct {
+	on atomic.Bool
+}
+
+func NewMaintenance(on bool) *Maintenance {
+	m := &Maintenance{}
+	m.on.Store(on)
+	return m
+}
+
+func (m *Maintenance) Enabled() bool {
+	return m.on.Load()
+}
+
+func (m *Maintenance) Set(on bool) {
+	if m.on.Swap(on) == on {
+		return
+	}
+	if on {
+		log.Printf("maintenance mode enabled")
+	} else {
+		log.Printf("maintenance mode disabled")
+	}
+}
+
+// maintenanceStatus is the admin API's view of the switch.
+type maintenanceStatus struct {
+	Enabled bool `json:"enabled"`
+}
+
+// ServeHTTP handles GET and PUT /admin/maintenance.
+func (m *Maintenance) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		var status maintenanceStatus
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&status); err != nil {
+			http.Error(w, "Bad request", http.StatusBadRequest)
+			return
+		}
+		m.Set(status.Enabled)
+	}
+	writeJSON(w, maintenanceStatus{Enabled: m.Enabled()})
+}
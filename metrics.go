@@ -0,0 +1,260 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// publishDurationBuckets are tuned for SLOs such as "99% of accepted comments
+// pushed within 60s": most pushes finish in a few seconds, slow ones in tens.
+var publishDurationBuckets = []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// clockSkewBuckets span clients an hour behind to an hour ahead; anything
+// within a couple of seconds is a clock in sync.
+var clockSkewBuckets = []float64{-3600, -300, -60, -10, -2, 2, 10, 60, 300, 3600}
+
+// counterVec is a Prometheus-style counter partitioned by label values.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+// Inc increments the counter for the given label values, which must match
+// the labels the counter was declared with.
+func (c *counterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add adds v to the counter for the given label values.
+func (c *counterVec) Add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.mu.Lock()
+	c.values[key] += v
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(sb *strings.Builder) {
+	fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.labels) == 0 {
+		fmt.Fprintf(sb, "%s %g\n", c.name, c.values[""])
+		return
+	}
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(sb, "%s{%s} %g\n", c.name, formatLabels(c.labels, strings.Split(k, "\xff")), c.values[k])
+	}
+}
+
+// histogram is a Prometheus-style cumulative histogram without labels.
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64
+	mu      sync.Mutex
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	return &histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+// Observe records a single value.
+func (h *histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(sb *strings.Builder) {
+	fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, b := range h.buckets {
+		fmt.Fprintf(sb, "%s_bucket{le=\"%g\"} %d\n", h.name, b, h.counts[i])
+	}
+	fmt.Fprintf(sb, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(sb, "%s_sum %g\n", h.name, h.sum)
+	fmt.Fprintf(sb, "%s_count %d\n", h.name, h.count)
+}
+
+// gauge is a Prometheus-style gauge without labels.
+type gauge struct {
+	name  string
+	help  string
+	mu    sync.Mutex
+	value float64
+}
+
+func newGauge(name, help string) *gauge {
+	return &gauge{name: name, help: help}
+}
+
+// Set replaces the gauge's value.
+func (g *gauge) Set(v float64) {
+	g.mu.Lock()
+	g.value = v
+	g.mu.Unlock()
+}
+
+func (g *gauge) write(sb *strings.Builder) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	fmt.Fprintf(sb, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", g.name, g.help, g.name, g.name, g.value)
+}
+
+func formatLabels(names, values []string) string {
+	parts := make([]string, len(names))
+	for i, n := range names {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		v = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+		parts[i] = fmt.Sprintf(`%s="%s"`, n, v)
+	}
+	return strings.Join(parts, ",")
+}
+
+// metric is anything that can render itself in the text exposition format.
+type metric interface {
+	write(sb *strings.Builder)
+}
+
+// Metrics holds the service counters exposed at GET /metrics.
+//
+// User-visible failures (a comment passed every check but could not be
+// published) are counted separately from spam and validation rejections so
+// that SLOs can be expressed directly, e.g. published / accepted.
+type Metrics struct {
+	Accepted           *counterVec
+	Published          *counterVec
+	Quarantined        *counterVec
+	Moderation         *counterVec
+	PublishFailures    *counterVec
+	NotifyFailures     *counterVec
+	NotifyDeadLetters  *counterVec
+	SpamRejections     *counterVec
+	HoneypotHits       *counterVec
+	Tarpitted          *counterVec
+	InvalidSubmissions *counterVec
+	OverloadRejections *counterVec
+	PublishDuration    *histogram
+	ClientClockSkew    *histogram
+	CanaryRuns         *counterVec
+	CanaryDuration     *histogram
+	CanaryLastSuccess  *gauge
+
+	all []metric
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		Accepted:           newCounterVec("staticomment_comments_accepted_total", "Comments that passed all validation and spam checks."),
+		Published:          newCounterVec("staticomment_comments_published_total", "Accepted comments successfully committed and pushed."),
+		Quarantined:        newCounterVec("staticomment_comments_quarantined_total", "Comments committed to the quarantine path for review."),
+		Moderation:         newCounterVec("staticomment_comments_moderation_total", "Comments pushed to a review branch for moderation."),
+		PublishFailures:    newCounterVec("staticomment_publish_failures_total", "Legitimate submissions that failed on the server side, by stage.", "stage"),
+		NotifyFailures:     newCounterVec("staticomment_notification_failures_total", "Attempts to send a notification that failed, by channel.", "channel"),
+		NotifyDeadLetters:  newCounterVec("staticomment_notification_dead_letters_total", "Notifications given up on and dead-lettered, by channel.", "channel"),
+		SpamRejections:     newCounterVec("staticomment_spam_rejections_total", "Submissions rejected by spam checks, by reason.", "reason"),
+		HoneypotHits:       newCounterVec("staticomment_honeypot_hits_total", "Submissions that filled in the honeypot field, by how they were answered.", "action"),
+		Tarpitted:          newCounterVec("staticomment_tarpitted_total", "Spam rejections answered through the tarpit, by reason.", "reason"),
+		InvalidSubmissions: newCounterVec("staticomment_invalid_submissions_total", "Submissions rejected by input validation, by reason.", "reason"),
+		OverloadRejections: newCounterVec("staticomment_overload_rejections_total", "Submissions turned away by the global rate limit, in-flight cap or a tenant's quota, by reason.", "reason"),
+		PublishDuration:    newHistogram("staticomment_publish_duration_seconds", "Time from acceptance to successful push.", publishDurationBuckets),
+		ClientClockSkew:    newHistogram("staticomment_client_clock_skew_seconds", "How far submitters' clocks were ahead of the server's (negative if behind), where measurable.", clockSkewBuckets),
+		CanaryRuns:         newCounterVec("staticomment_canary_runs_total", "Self-test runs, by result and, for failures, the stage that failed.", "result", "stage"),
+		CanaryDuration:     newHistogram("staticomment_canary_duration_seconds", "Time for the self-test's comment to be committed and pushed.", publishDurationBuckets),
+		CanaryLastSuccess:  newGauge("staticomment_canary_last_success_timestamp_seconds", "Unix time of the last successful self-test, 0 if none yet."),
+	}
+	m.all = []metric{m.Accepted, m.Published, m.Quarantined, m.Moderation, m.PublishFailures, m.NotifyFailures, m.NotifyDeadLetters, m.SpamRejections, m.HoneypotHits, m.Tarpitted, m.InvalidSubmissions, m.OverloadRejections, m.PublishDuration, m.ClientClockSkew, m.CanaryRuns, m.CanaryDuration, m.CanaryLastSuccess}
+	return m
+}
+
+// ServeHTTP writes all metrics in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var sb strings.Builder
+	for _, mt := range m.all {
+		mt.write(&sb)
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(sb.String()))
+}
+
+// HandleEvent is the event bus subscriber that keeps the counters current.
+func (m *Metrics) HandleEvent(e Event) {
+	if e.Canary {
+		// The self-test's own comment isn't a visitor's, so it's only
+		// counted as a canary run
+		return
+	}
+	switch e.Type {
+	case EventAccepted:
+		m.Accepted.Inc()
+	case EventRejected:
+		switch e.Category {
+		case CategorySpam:
+			m.SpamRejections.Inc(e.Reason)
+			if e.Reason == "honeypot" {
+				m.HoneypotHits.Inc(e.Action)
+			}
+			if e.Action == HoneypotTarpit {
+				m.Tarpitted.Inc(e.Reason)
+			}
+		case CategoryOverload:
+			m.OverloadRejections.Inc(e.Reason)
+		default:
+			m.InvalidSubmissions.Inc(e.Reason)
+		}
+	case EventPublished:
+		m.Published.Inc()
+		// Comments approved from quarantine carry no duration
+		if e.Duration > 0 {
+			m.PublishDuration.Observe(e.Duration.Seconds())
+		}
+	case EventQuarantined:
+		m.Quarantined.Inc()
+	case EventModeration:
+		m.Moderation.Inc()
+	case EventFailed:
+		m.PublishFailures.Inc(e.Reason)
+	case EventNotificationFailed:
+		m.NotifyFailures.Inc(e.Reason)
+	case EventNotificationDeadLetter:
+		m.NotifyDeadLetters.Inc(e.Reason)
+	case EventClockSkew:
+		m.ClientClockSkew.Observe(e.Duration.Seconds())
+	case EventCanary:
+		if e.Err != nil {
+			m.CanaryRuns.Inc("failure", e.Reason)
+			return
+		}
+		m.CanaryRuns.Inc("success", "")
+		m.CanaryDuration.Observe(e.Duration.Seconds())
+		m.CanaryLastSuccess.Set(float64(e.Time.Unix()))
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	mirrorRetryBaseBackoff = 5 * time.Second
+	mirrorRetryMaxBackoff  = 5 * time.Minute
+)
+
+// Mirrors pushes the branch to the STATICOMMENT_GIT_MIRRORS remotes in the
+// background after each push to the repo, so a slow or unreachable mirror
+// never holds up a comment. A mirror whose push fails is retried with
+// backoff until it succeeds; since each push sends the whole branch, a
+// mirror that missed several catches up in one.
+type Mirrors struct {
+	urls []string
+	push func(url string) error
+
+	mu      sync.Mutex
+	pending map[string]bool
+	wake    chan struct{}
+}
+
+func NewMirrors(urls []string, push func(url string) error) *Mirrors {
+	return &Mirrors{urls: urls, push: push, pending: make(map[string]bool), wake: make(chan struct{}, 1)}
+}
+
+// Notify marks every mirror as behind. It's a no-op on a nil Mirrors, so
+// repos without mirrors can call it unconditionally.
+func (m *Mirrors) Notify() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	for _, url := range m.urls {
+		m.pending[url] = true
+	}
+	m.mu.Unlock()
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run pushes to the mirrors that are behind whenever notified, and retries
+// failed ones.
+func (m *Mirrors) Run() {
+	backoff := mirrorRetryBaseBackoff
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-m.wake:
+		case <-retry:
+		}
+		m.mu.Lock()
+		var urls []string
+		for url := range m.pending {
+			urls = append(urls, url)
+			delete(m.pending, url)
+		}
+		m.mu.Unlock()
+
+		failed := false
+		for _, url := range urls {
+			if err := m.push(url); err != nil {
+				log.Printf("warning: pushing to mirror %s failed: %v", sanitizeArgs([]string{url})[0], err)
+				m.mu.Lock()
+				m.pending[url] = true
+				m.mu.Unlock()
+				failed = true
+			}
+		}
+		if !failed {
+			backoff = mirrorRetryBaseBackoff
+			retry = nil
+			continue
+		}
+		log.Printf("mirror: retrying in %s", backoff)
+		retry = time.After(backoff)
+		backoff = min(backoff*2, mirrorRetryMaxBackoff)
+	}
+}
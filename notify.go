@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"mime"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	notifyBaseBackoff = 2 * time.Second
+	notifyMaxBackoff  = 5 * time.Minute
+	// deadLetterLimit bounds how many failed deliveries are kept for the
+	// admin API; older ones remain in the log only.
+	deadLetterLimit = 500
+)
+
+// Delivery is one notification on one channel. Email deliveries have a
+// single recipient, so a failing address is retried on its own.
+type Delivery struct {
+	ID        string    `json:"id"`
+	Channel   string    `json:"channel"`
+	Kind      string    `json:"kind"`
+	To        string    `json:"to,omitempty"`
+	Subject   string    `json:"subject"`
+	Body      string    `json:"body"`
+	MessageID string    `json:"message_id,omitempty"`
+	Event     Event     `json:"-"`
+	Created   time.Time `json:"created"`
+	Attempts  int       `json:"attempts"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// Channel sends deliveries over one transport.
+type Channel interface {
+	Name() string
+	Send(d *Delivery) error
+}
+
+// Dispatcher turns submission events into notifications and sends them from
+// background workers, one per channel, so a slow or failing channel never
+// delays the HTTP response, the git push, or the other channels. Failed
+// deliveries are retried with exponential backoff and jitter; once retries
+// are exhausted they go to the dead-letter list served by the admin API.
+type Dispatcher struct {
+	cfg      *Config
+	subs     SubscriptionStore
+	bus      *EventBus
+	channels map[string]Channel
+	queues   map[string]chan *Delivery
+	events   chan Event
+
+	// canaryFailing is whether the last self-test failed; only the planner
+	// goroutine touches it
+	canaryFailing bool
+
+	mu          sync.Mutex
+	deadLetters []*Delivery
+}
+
+func NewDispatcher(cfg *Config, subs SubscriptionStore, bus *EventBus, channels ...Channel) *Dispatcher {
+	d := &Dispatcher{
+		cfg:      cfg,
+		subs:     subs,
+		bus:      bus,
+		channels: make(map[string]Channel),
+		queues:   make(map[string]chan *Delivery),
+		events:   make(chan Event, 100),
+	}
+	for _, ch := range channels {
+		d.channels[ch.Name()] = ch
+		d.queues[ch.Name()] = make(chan *Delivery, 100)
+	}
+	return d
+}
+
+// Start launches the planner and one worker per channel.
+func (d *Dispatcher) Start() {
+	go d.plan()
+	for name, q := range d.queues {
+		go d.work(d.channels[name], q)
+	}
+}
+
+// HandleEvent is the event bus subscriber. It only queues the event; the
+// subscription lookups and sends happen on the dispatcher's goroutines.
+func (d *Dispatcher) HandleEvent(e Event) {
+	switch {
+	case e.Canary:
+		// The self-test's own comment is nobody's business
+		return
+	case e.Type == EventPublished, e.Type == EventModeration, e.Type == EventQuarantined, e.Type == EventCanary:
+	default:
+		return
+	}
+	select {
+	case d.events <- e:
+	default:
+		log.Printf("warning: notification queue full, dropping %s event for %s", e.Type, e.Slug)
+	}
+}
+
+func (d *Dispatcher) plan() {
+	for e := range d.events {
+		for _, dl := range d.deliveries(e) {
+			d.enqueue(dl)
+		}
+	}
+}
+
+// deliveries builds the notifications for e: one to the site owner per
+// channel, plus an email to each subscriber of the comment being replied to.
+func (d *Dispatcher) deliveries(e Event) []*Delivery {
+	if e.Type == EventCanary {
+		return d.canaryDeliveries(e)
+	}
+	c := e.Comment
+	if c == nil {
+		return nil
+	}
+	id := commentID(e.Path)
+	var messageID string
+	if d.cfg.ReplySecret != "" && e.Type == EventPublished {
+		messageID = replyReference(d.cfg.ReplySecret, c.Slug, id)
+	}
+
+	subject := fmt.Sprintf("New comment on %s by %s", c.Slug, c.Name)
+	switch e.Type {
+	case EventModeration:
+		subject = fmt.Sprintf("Comment awaiting moderation on %s by %s", c.Slug, c.Name)
+	case EventQuarantined:
+		subject = fmt.Sprintf("Comment quarantined on %s by %s", c.Slug, c.Name)
+	}
+	body := notificationBody(e)
+
+	var out []*Delivery
+	add := func(channel, kind, to, subject string) {
+		out = append(out, &Delivery{
+			ID:        fmt.Sprintf("%s-%s-%d", id, channel, len(out)),
+			Channel:   channel,
+			Kind:      kind,
+			To:        to,
+			Subject:   subject,
+			Body:      body,
+			MessageID: messageID,
+			Event:     e,
+			Created:   time.Now(),
+		})
+	}
+
+	if _, ok := d.channels["email"]; ok {
+		for _, to := range d.cfg.NotifyEmails {
+			add("email", string(e.Type), to, subject)
+		}
+		if e.Type == EventPublished && c.ReplyTo != "" {
+			subs, err := d.subs.Subscriptions(c.Slug)
+			if err != nil {
+				log.Printf("warning: loading subscriptions for %s: %v", c.Slug, err)
+			}
+			for _, sub := range subs {
+				if sub.Comment == c.ReplyTo && !strings.EqualFold(sub.Email, c.Email) {
+					add("email", "reply", sub.Email, fmt.Sprintf("%s replied to your comment on %s", c.Name, c.Slug))
+				}
+			}
+		}
+	}
+	if _, ok := d.channels["webhook"]; ok {
+		add("webhook", string(e.Type), "", subject)
+	}
+	return out
+}
+
+// canaryDeliveries tells the site owner when the self-test starts failing
+// and when it passes again, but not about every run in between.
+func (d *Dispatcher) canaryDeliveries(e Event) []*Delivery {
+	failing := e.Err != nil
+	if failing == d.canaryFailing {
+		return nil
+	}
+	d.canaryFailing = failing
+
+	subject := "Comment self-test passing again"
+	body := fmt.Sprintf("A test comment on %s was published in %s.\n", e.Slug, e.Duration.Round(time.Millisecond))
+	if failing {
+		subject = "Comment self-test failing"
+		body = fmt.Sprintf("A test comment on %s couldn't be published, so visitors' comments probably can't either.\n\nFailed at: %s\nError: %v\n", e.Slug, e.Reason, e.Err)
+	}
+	id := fmt.Sprintf("canary-%d", e.Time.UnixNano())
+	var out []*Delivery
+	add := func(channel, to string) {
+		out = append(out, &Delivery{
+			ID:      fmt.Sprintf("%s-%s-%d", id, channel, len(out)),
+			Channel: channel,
+			Kind:    string(EventCanary),
+			To:      to,
+			Subject: subject,
+			Body:    body,
+			Event:   e,
+			Created: time.Now(),
+		})
+	}
+	if _, ok := d.channels["email"]; ok {
+		for _, to := range d.cfg.NotifyEmails {
+			add("email", to)
+		}
+	}
+	if _, ok := d.channels["webhook"]; ok {
+		add("webhook", "")
+	}
+	return out
+}
+
+func notificationBody(e Event) string {
+	c := e.Comment
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s wrote on %s:\n\n%s\n\n", c.Name, c.Slug, c.Body)
+	if e.Branch != "" {
+		fmt.Fprintf(&sb, "Review branch: %s\n", e.Branch)
+	}
+	if e.URL != "" {
+		fmt.Fprintf(&sb, "Pull request: %s\n", e.URL)
+	}
+	fmt.Fprintf(&sb, "File: %s\n", e.Path)
+	return sb.String()
+}
+
+func (d *Dispatcher) enqueue(dl *Delivery) {
+	select {
+	case d.queues[dl.Channel] <- dl:
+	default:
+		dl.LastError = "queue full"
+		d.deadLetter(dl)
+	}
+}
+
+func (d *Dispatcher) work(ch Channel, queue chan *Delivery) {
+	for dl := range queue {
+		dl.Attempts++
+		err := ch.Send(dl)
+		if err == nil {
+			continue
+		}
+		dl.LastError = err.Error()
+		d.bus.Publish(Event{Type: EventNotificationFailed, Reason: ch.Name(), Slug: dl.Event.Slug, Err: err})
+		if dl.Attempts >= d.cfg.NotifyRetries {
+			d.deadLetter(dl)
+			continue
+		}
+		// Retry later without holding up the rest of the channel's queue
+		backoff := notificationBackoff(dl.Attempts)
+		log.Printf("notify: %s delivery %s failed (attempt %d), retrying in %s: %v", ch.Name(), dl.ID, dl.Attempts, backoff.Round(time.Second), err)
+		time.AfterFunc(backoff, func() { d.enqueue(dl) })
+	}
+}
+
+// notificationBackoff doubles from notifyBaseBackoff per attempt, capped at
+// notifyMaxBackoff, with up to 50% jitter so retries don't synchronize.
+func notificationBackoff(attempt int) time.Duration {
+	return jitteredBackoff(notifyBaseBackoff, notifyMaxBackoff, attempt)
+}
+
+// jitteredBackoff doubles from base per attempt, starting at 1, capped at
+// max, and takes off up to half at random.
+func jitteredBackoff(base, max time.Duration, attempt int) time.Duration {
+	backoff := base << (attempt - 1)
+	if backoff <= 0 || backoff > max {
+		backoff = max
+	}
+	return backoff/2 + rand.N(backoff/2+1)
+}
+
+func (d *Dispatcher) deadLetter(dl *Delivery) {
+	log.Printf("notify: dead letter: %s delivery %s (%s to %q) after %d attempts: %s", dl.Channel, dl.ID, dl.Kind, dl.To, dl.Attempts, dl.LastError)
+	d.bus.Publish(Event{Type: EventNotificationDeadLetter, Reason: dl.Channel, Slug: dl.Event.Slug, Err: errors.New(dl.LastError)})
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.deadLetters = append(d.deadLetters, dl)
+	if len(d.deadLetters) > deadLetterLimit {
+		d.deadLetters = d.deadLetters[len(d.deadLetters)-deadLetterLimit:]
+	}
+}
+
+// DeadLetters returns the failed deliveries, oldest first.
+func (d *Dispatcher) DeadLetters() []*Delivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]*Delivery(nil), d.deadLetters...)
+}
+
+// emailChannel sends deliveries through an SMTP server. STARTTLS is used
+// when the server offers it.
+type emailChannel struct {
+	cfg *Config
+}
+
+func (c *emailChannel) Name() string { return "email" }
+
+func (c *emailChannel) Send(d *Delivery) error {
+	var auth smtp.Auth
+	if c.cfg.SMTPUser != "" {
+		auth = smtp.PlainAuth("", c.cfg.SMTPUser, c.cfg.SMTPPassword, c.cfg.SMTPHost)
+	}
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", headerValue(c.cfg.SMTPFrom))
+	fmt.Fprintf(&msg, "To: %s\r\n", headerValue(d.To))
+	// The subject includes the commenter's name, so it must not be able to
+	// break out of the header
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", headerValue(d.Subject)))
+	fmt.Fprintf(&msg, "Date: %s\r\n", d.Created.Format(time.RFC1123Z))
+	if d.MessageID != "" {
+		fmt.Fprintf(&msg, "Message-ID: %s\r\n", d.MessageID)
+	}
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(d.Body, "\n", "\r\n"))
+	addr := fmt.Sprintf("%s:%d", c.cfg.SMTPHost, c.cfg.SMTPPort)
+	if err := smtp.SendMail(addr, auth, c.cfg.SMTPFrom, []string{d.To}, msg.Bytes()); err != nil {
+		return fmt.Errorf("sending mail to %s: %w", d.To, err)
+	}
+	return nil
+}
+
+// headerValue strips line breaks so user input can't inject mail headers.
+func headerValue(s string) string {
+	return strings.Join(strings.FieldsFunc(s, func(r rune) bool { return r == '\r' || r == '\n' }), " ")
+}
+
+// webhookChannel POSTs a JSON summary of each notification.
+type webhookChannel struct {
+	url    string
+	client *http.Client
+}
+
+func newWebhookChannel(url string) *webhookChannel {
+	return &webhookChannel{url: url, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (c *webhookChannel) Name() string { return "webhook" }
+
+func (c *webhookChannel) Send(d *Delivery) error {
+	// Self-test notifications are about no comment; their text is the body
+	comment := &Comment{Body: d.Body}
+	if d.Event.Comment != nil {
+		comment = d.Event.Comment
+	}
+	payload, err := json.Marshal(map[string]string{
+		"type":     d.Kind,
+		"subject":  d.Subject,
+		"slug":     d.Event.Slug,
+		"path":     d.Event.Path,
+		"branch":   d.Event.Branch,
+		"url":      d.Event.URL,
+		"name":     comment.Name,
+		"body":     comment.Body,
+		"reply_to": comment.ReplyTo,
+	})
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Post(c.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("posting webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("posting webhook: %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// oidcRefreshInterval limits how often the signing keys are refetched
+	// for a token signed with a key we don't have.
+	oidcRefreshInterval = time.Minute
+	// oidcLeeway allows for clocks being a little apart when checking
+	// expiry.
+	oidcLeeway = time.Minute
+)
+
+// OIDCClaims are the ID token claims admin users are matched on.
+type OIDCClaims struct {
+	Issuer        string `json:"iss"`
+	Subject       string `json:"sub"`
+	Audience      any    `json:"aud"` // a string or a list of them
+	Expiry        int64  `json:"exp"`
+	NotBefore     int64  `json:"nbf"`
+	Email         string `json:"email"`
+	EmailVerified any    `json:"email_verified"` // some providers send "true"
+	Nonce         string `json:"nonce"`
+}
+
+// oidcDiscovery is the part of a provider's discovery document we use.
+type oidcDiscovery struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// OIDCVerifier checks ID tokens issued by an OpenID Connect provider
+// (Google, Keycloak, Authentik, Auth0 and so on) for the admin API. The
+// provider's signing keys are found through its discovery document and
+// cached, and refetched when a token names a key that isn't cached, as
+// after a key rotation. Only RS256 and ES256 signatures are accepted.
+type OIDCVerifier struct {
+	issuer   string
+	audience string
+	client   *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]crypto.PublicKey
+	fetched   time.Time
+}
+
+func NewOIDCVerifier(issuer, audience string) *OIDCVerifier {
+	return &OIDCVerifier{
+		issuer:   strings.TrimSuffix(issuer, "/"),
+		audience: audience,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Verify checks token's signature, issuer, audience and validity period and
+// returns its claims.
+func (v *OIDCVerifier) Verify(token string) (*OIDCClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("token header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("token signature: %w", err)
+	}
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig) != nil {
+			return nil, fmt.Errorf("bad %s signature", header.Alg)
+		}
+	case *ecdsa.PublicKey:
+		// JWS ECDSA signatures are r and s concatenated, not ASN.1
+		if header.Alg != "ES256" || len(sig) != 64 ||
+			!ecdsa.Verify(k, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return nil, fmt.Errorf("bad %s signature", header.Alg)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key type for %s", header.Alg)
+	}
+
+	var claims OIDCClaims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("token claims: %w", err)
+	}
+	now := time.Now()
+	switch {
+	case strings.TrimSuffix(claims.Issuer, "/") != v.issuer:
+		return nil, fmt.Errorf("issued by %q", claims.Issuer)
+	case !claims.hasAudience(v.audience):
+		return nil, fmt.Errorf("not issued for %q", v.audience)
+	case now.After(time.Unix(claims.Expiry, 0).Add(oidcLeeway)):
+		return nil, fmt.Errorf("expired")
+	case claims.NotBefore != 0 && now.Add(oidcLeeway).Before(time.Unix(claims.NotBefore, 0)):
+		return nil, fmt.Errorf("not valid yet")
+	}
+	return &claims, nil
+}
+
+func (c *OIDCClaims) hasAudience(aud string) bool {
+	switch a := c.Audience.(type) {
+	case string:
+		return a == aud
+	case []any:
+		for _, v := range a {
+			if v == aud {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// EmailIsVerified reports whether the provider vouches for the email claim.
+func (c *OIDCClaims) EmailIsVerified() bool {
+	return c.EmailVerified == true || c.EmailVerified == "true"
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// key returns the signing key kid, fetching the provider's keys if it isn't
+// cached and they weren't fetched in the last oidcRefreshInterval.
+func (v *OIDCVerifier) key(kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(v.fetched) < oidcRefreshInterval {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	v.fetched = time.Now()
+	keys, err := v.fetchKeys()
+	if err != nil {
+		return nil, fmt.Errorf("fetching signing keys: %w", err)
+	}
+	v.keys = keys
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// jwk is the part of a JSON Web Key we use.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// Discovery returns the provider's discovery document, fetching it the
+// first time.
+func (v *OIDCVerifier) Discovery() (*oidcDiscovery, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.discoverLocked()
+}
+
+func (v *OIDCVerifier) discoverLocked() (*oidcDiscovery, error) {
+	if v.discovery != nil {
+		return v.discovery, nil
+	}
+	var d oidcDiscovery
+	if err := v.getJSON(v.issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return nil, err
+	}
+	if d.JWKSURI == "" {
+		return nil, fmt.Errorf("no jwks_uri in discovery document")
+	}
+	v.discovery = &d
+	return v.discovery, nil
+}
+
+func (v *OIDCVerifier) fetchKeys() (map[string]crypto.PublicKey, error) {
+	discovery, err := v.discoverLocked()
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := v.getJSON(discovery.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		if key := k.publicKey(); key != nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+// publicKey returns the RSA or P-256 key k describes, or nil for any other
+// or a malformed one.
+func (k jwk) publicKey() crypto.PublicKey {
+	b64 := func(s string) *big.Int {
+		data, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil || len(data) == 0 {
+			return nil
+		}
+		return new(big.Int).SetBytes(data)
+	}
+	switch {
+	case k.Kty == "RSA":
+		n, e := b64(k.N), b64(k.E)
+		if n == nil || e == nil || !e.IsInt64() {
+			return nil
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}
+	case k.Kty == "EC" && k.Crv == "P-256":
+		x, y := b64(k.X), b64(k.Y)
+		if x == nil || y == nil || !elliptic.P256().IsOnCurve(x, y) {
+			return nil
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+	}
+	return nil
+}
+
+func (v *OIDCVerifier) getJSON(url string, out any) error {
+	resp, err := v.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1024*1024)).Decode(out)
+}
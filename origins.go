@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// dnsOriginPrefix is the label under a site's host holding its TXT
+	// record, as in _staticomment.example.com.
+	dnsOriginPrefix = "_staticomment."
+	// dnsOriginTimeout bounds a TXT lookup, made while a request waits.
+	dnsOriginTimeout = 2 * time.Second
+	// maxDNSOriginCache bounds the cached answers, since any request can
+	// name an origin to look up.
+	maxDNSOriginCache = 10000
+)
+
+// Origins decides which sites may submit comments, be redirected back to,
+// and read the responses of the endpoints their pages call: those in
+// STATICOMMENT_ALLOWED_ORIGINS and, with STATICOMMENT_DNS_ORIGIN_TOKEN set,
+// HTTPS sites whose owners added a TXT record naming this instance.
+type Origins struct {
+	static []string
+	dns    *DNSOrigins // nil without DNS verification
+}
+
+func NewOrigins(cfg *Config) *Origins {
+	o := &Origins{static: cfg.AllowedOrigins}
+	if cfg.DNSOriginToken != "" {
+		o.dns = NewDNSOrigins(cfg.DNSOriginToken, time.Duration(cfg.DNSOriginCacheTTL)*time.Second)
+	}
+	return o
+}
+
+// Allowed reports whether origin, like https://example.com, is allowed.
+func (o *Origins) Allowed(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	if slices.Contains(o.static, origin) {
+		return true
+	}
+	return o.dns != nil && o.dns.Allowed(origin)
+}
+
+type dnsOriginAnswer struct {
+	allowed bool
+	expires time.Time
+}
+
+// DNSOrigins onboards sites without a restart: an HTTPS origin is allowed
+// if its host has a TXT record at _staticomment.<host> reading
+// "staticomment=<token>", which only whoever controls the domain can add.
+// Answers, yes or no, are cached for the TTL; failed lookups aren't, and
+// deny the request at hand.
+type DNSOrigins struct {
+	record   string
+	ttl      time.Duration
+	resolver *net.Resolver
+
+	mu    sync.Mutex
+	cache map[string]dnsOriginAnswer
+}
+
+func NewDNSOrigins(token string, ttl time.Duration) *DNSOrigins {
+	return &DNSOrigins{
+		record:   "staticomment=" + token,
+		ttl:      ttl,
+		resolver: net.DefaultResolver,
+		cache:    make(map[string]dnsOriginAnswer),
+	}
+}
+
+// Allowed looks origin's TXT record up, or answers from the cache.
+func (d *DNSOrigins) Allowed(origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme != "https" || u.Hostname() == "" || u.Path != "" || net.ParseIP(u.Hostname()) != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+
+	now := time.Now()
+	d.mu.Lock()
+	answer, found := d.cache[host]
+	d.mu.Unlock()
+	if found && now.Before(answer.expires) {
+		return answer.allowed
+	}
+
+	allowed, err := d.lookup(host)
+	if err != nil {
+		log.Printf("warning: dns origin %s: %v", origin, err)
+		return false
+	}
+	if allowed {
+		log.Printf("dns origin %s verified", origin)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.cache) >= maxDNSOriginCache {
+		for h, a := range d.cache {
+			if !now.Before(a.expires) {
+				delete(d.cache, h)
+			}
+		}
+	}
+	if len(d.cache) < maxDNSOriginCache {
+		d.cache[host] = dnsOriginAnswer{allowed: allowed, expires: now.Add(d.ttl)}
+	}
+	return allowed
+}
+
+func (d *DNSOrigins) lookup(host string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsOriginTimeout)
+	defer cancel()
+	records, err := d.resolver.LookupTXT(ctx, dnsOriginPrefix+host)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, r := range records {
+		if strings.TrimSpace(r) == d.record {
+			return true, nil
+		}
+	}
+	return false, nil
+}
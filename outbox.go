@@ -0,0 +1,263 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// errAlreadyClaimed is returned by Claim when another worker (possibly in
+// another process sharing the outbox directory) took the entry first.
+var errAlreadyClaimed = errors.New("outbox entry already claimed")
+
+// errNotInOutbox is returned for an ID with no entry, pending or claimed,
+// say because it has been published since it was listed.
+var errNotInOutbox = errors.New("no such outbox entry")
+
+// Outbox is a durable directory-backed queue of publish jobs. It is safe for
+// several processes sharing the same directory (e.g. instances overlapping
+// during a rolling deploy):
+//
+//   - entries are written to tmp/ and renamed into pending/, so readers never
+//     see partial files
+//   - a worker claims an entry by renaming it from pending/ to claimed/;
+//     rename is atomic, so exactly one claimant wins
+//   - claims older than the lease are assumed abandoned by a dead process
+//     and are renamed back to pending/
+//
+// IDs embed the hostname and PID so concurrent writers never collide.
+type Outbox struct {
+	dir   string
+	lease time.Duration
+}
+
+func NewOutbox(dir string, lease time.Duration) (*Outbox, error) {
+	for _, sub := range []string{"tmp", "pending", "claimed"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, fmt.Errorf("creating outbox dir: %w", err)
+		}
+	}
+	return &Outbox{dir: dir, lease: lease}, nil
+}
+
+func (o *Outbox) path(state, id string) string {
+	return filepath.Join(o.dir, state, id+".json")
+}
+
+// newJobID returns an ID unique across processes and hosts sharing the
+// outbox. IDs sort by creation time.
+func newJobID() (string, error) {
+	host, _ := os.Hostname()
+	host = strings.Map(func(c rune) rune {
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '-' {
+			return c
+		}
+		return '_'
+	}, host)
+	rnd, err := randomHex(4)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s-%s-%d-%s", time.Now().UTC().Format("20060102150405.000000"), host, os.Getpid(), rnd), nil
+}
+
+// writeAtomic writes job to tmp/, fsyncs it, and renames it to dest.
+func (o *Outbox) writeAtomic(job *PublishJob, dest string) error {
+	data, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshaling outbox entry: %w", err)
+	}
+	f, err := os.CreateTemp(filepath.Join(o.dir, "tmp"), job.ID+".*")
+	if err != nil {
+		return fmt.Errorf("creating outbox temp file: %w", err)
+	}
+	tmp := f.Name()
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("writing outbox entry: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("syncing outbox entry: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("closing outbox entry: %w", err)
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("renaming outbox entry: %w", err)
+	}
+	return nil
+}
+
+// Put durably enqueues a new job.
+func (o *Outbox) Put(job *PublishJob) error {
+	return o.writeAtomic(job, o.path("pending", job.ID))
+}
+
+// Pending returns the IDs of unclaimed entries, oldest first.
+func (o *Outbox) Pending() ([]string, error) {
+	return o.list("pending")
+}
+
+func (o *Outbox) list(state string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(o.dir, state, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, len(matches))
+	for i, m := range matches {
+		ids[i] = strings.TrimSuffix(filepath.Base(m), ".json")
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// validOutboxID reports whether id could name an entry, rejecting anything
+// that would reach outside the outbox's directories.
+func validOutboxID(id string) bool {
+	return id != "" && !strings.HasPrefix(id, ".") && filepath.Base(id) == id
+}
+
+// OutboxEntry is an entry as listed by Entries. Job is nil, and Err set,
+// for an entry that couldn't be read.
+type OutboxEntry struct {
+	ID        string
+	State     string // "pending" or "claimed"
+	ClaimedAt time.Time
+	Job       *PublishJob
+	Err       error
+}
+
+// Entries returns every entry, pending ones first, each oldest first.
+func (o *Outbox) Entries() ([]OutboxEntry, error) {
+	var entries []OutboxEntry
+	for _, state := range []string{"pending", "claimed"} {
+		ids, err := o.list(state)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			e := OutboxEntry{ID: id, State: state}
+			info, err := os.Stat(o.path(state, id))
+			if errors.Is(err, fs.ErrNotExist) {
+				// Published or moved on since it was listed
+				continue
+			}
+			if err == nil && state == "claimed" {
+				// Claim touches the entry when it takes it
+				e.ClaimedAt = info.ModTime()
+			}
+			e.Job, e.Err = o.read(state, id)
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+func (o *Outbox) read(state, id string) (*PublishJob, error) {
+	data, err := os.ReadFile(o.path(state, id))
+	if err != nil {
+		return nil, fmt.Errorf("reading outbox entry: %w", err)
+	}
+	var job PublishJob
+	if err := json.Unmarshal(data, &job); err != nil {
+		return nil, fmt.Errorf("parsing outbox entry %s: %w", id, err)
+	}
+	return &job, nil
+}
+
+// claimError tells, for an entry Claim couldn't take, whether another
+// worker has it or it's gone altogether.
+func (o *Outbox) claimError(id string) error {
+	if _, err := os.Stat(o.path("claimed", id)); errors.Is(err, fs.ErrNotExist) {
+		return errNotInOutbox
+	}
+	return errAlreadyClaimed
+}
+
+// Discard deletes a pending entry without publishing it. It returns
+// errAlreadyClaimed for an entry being published, which can't be stopped.
+func (o *Outbox) Discard(id string) error {
+	// Claim it first, so no worker can pick it up while it's removed
+	claimed := o.path("claimed", id)
+	if err := os.Rename(o.path("pending", id), claimed); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return o.claimError(id)
+		}
+		return fmt.Errorf("claiming outbox entry: %w", err)
+	}
+	if err := os.Remove(claimed); err != nil {
+		return fmt.Errorf("removing outbox entry: %w", err)
+	}
+	return nil
+}
+
+// Claim takes exclusive ownership of a pending entry and returns it.
+func (o *Outbox) Claim(id string) (*PublishJob, error) {
+	claimed := o.path("claimed", id)
+	if err := os.Rename(o.path("pending", id), claimed); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, errAlreadyClaimed
+		}
+		return nil, fmt.Errorf("claiming outbox entry: %w", err)
+	}
+	// Start the lease now; rename preserves the original mtime
+	now := time.Now()
+	if err := os.Chtimes(claimed, now, now); err != nil {
+		return nil, fmt.Errorf("touching outbox entry: %w", err)
+	}
+	return o.read("claimed", id)
+}
+
+// Complete removes a claimed entry after it was published.
+func (o *Outbox) Complete(id string) error {
+	if err := os.Remove(o.path("claimed", id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("removing outbox entry: %w", err)
+	}
+	return nil
+}
+
+// Release returns a claimed entry to pending, saving its updated attempt
+// count and error so the next claimant sees the history.
+func (o *Outbox) Release(job *PublishJob) error {
+	// Update in place, then move: there is never a moment where the entry
+	// exists in both claimed/ and pending/
+	claimed := o.path("claimed", job.ID)
+	if err := o.writeAtomic(job, claimed); err != nil {
+		return err
+	}
+	if err := os.Rename(claimed, o.path("pending", job.ID)); err != nil {
+		return fmt.Errorf("releasing outbox entry: %w", err)
+	}
+	return nil
+}
+
+// ReclaimStale moves claims older than the lease back to pending, recovering
+// entries from processes that died mid-publish. Returns how many were moved.
+func (o *Outbox) ReclaimStale() (int, error) {
+	ids, err := o.list("claimed")
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, id := range ids {
+		info, err := os.Stat(o.path("claimed", id))
+		if err != nil || time.Since(info.ModTime()) < o.lease {
+			continue
+		}
+		if err := os.Rename(o.path("claimed", id), o.path("pending", id)); err == nil {
+			n++
+		}
+	}
+	return n, nil
+}
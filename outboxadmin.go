@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+)
+
+// OutboxAdmin serves the admin API's view of the outbox, so an operator
+// can see why comments are stuck and publish or drop them without a shell
+// in the container.
+type OutboxAdmin struct {
+	outbox    *Outbox
+	publisher *Publisher
+}
+
+func NewOutboxAdmin(outbox *Outbox, publisher *Publisher) *OutboxAdmin {
+	return &OutboxAdmin{outbox: outbox, publisher: publisher}
+}
+
+// outboxItem is an entry as listed by the admin API. The commenter's email
+// and IP are left out.
+type outboxItem struct {
+	ID         string     `json:"id"`
+	State      string     `json:"state"`
+	ClaimedAt  *time.Time `json:"claimed_at,omitempty"`
+	Path       string     `json:"path,omitempty"`
+	Slug       string     `json:"slug,omitempty"`
+	Name       string     `json:"name,omitempty"`
+	AcceptedAt *time.Time `json:"accepted_at,omitempty"`
+	Quarantine bool       `json:"quarantine,omitempty"`
+	Moderated  bool       `json:"moderated,omitempty"`
+	Attempts   int        `json:"attempts"`
+	LastError  string     `json:"last_error,omitempty"`
+	Errors     []JobError `json:"errors,omitempty"`
+	ReadError  string     `json:"read_error,omitempty"`
+}
+
+// ServeList handles GET /admin/outbox, listing every entry, pending and
+// claimed, with its failed attempts.
+func (a *OutboxAdmin) ServeList(w http.ResponseWriter, r *http.Request) {
+	entries, err := a.outbox.Entries()
+	if err != nil {
+		log.Printf("listing outbox: %v", err)
+		http.Error(w, "Failed to list the outbox", http.StatusInternalServerError)
+		return
+	}
+	items := make([]outboxItem, 0, len(entries))
+	for _, e := range entries {
+		item := outboxItem{ID: e.ID, State: e.State}
+		if !e.ClaimedAt.IsZero() {
+			item.ClaimedAt = &e.ClaimedAt
+		}
+		if e.Err != nil {
+			item.ReadError = e.Err.Error()
+		}
+		if job := e.Job; job != nil {
+			item.Path = job.Path
+			item.Slug = job.Comment.Slug
+			item.Name = job.Comment.Name
+			item.AcceptedAt = &job.AcceptedAt
+			item.Quarantine = job.Quarantine
+			item.Moderated = job.Moderated
+			item.Attempts = job.Attempts
+			item.LastError = job.LastError
+			item.Errors = job.Errors
+		}
+		items = append(items, item)
+	}
+	writeJSON(w, items)
+}
+
+// ServeRetry handles POST /admin/outbox/{id}/retry, publishing the entry
+// now.
+func (a *OutboxAdmin) ServeRetry(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !validOutboxID(id) {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	err := a.publisher.RetryJob(id)
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, errNotInOutbox):
+		http.Error(w, "No such entry; it may have been published", http.StatusNotFound)
+	case errors.Is(err, errAlreadyClaimed):
+		http.Error(w, "Entry is being published", http.StatusConflict)
+	default:
+		http.Error(w, "Publish failed: "+err.Error(), http.StatusBadGateway)
+	}
+}
+
+// ServeRetryAll handles POST /admin/outbox/retry, working through the
+// whole outbox now rather than at the next scheduled retry, and returns
+// how many entries are left.
+func (a *OutboxAdmin) ServeRetryAll(w http.ResponseWriter, r *http.Request) {
+	a.publisher.ReplayOutbox()
+	ids, err := a.outbox.Pending()
+	if err != nil {
+		log.Printf("listing outbox: %v", err)
+		http.Error(w, "Failed to list the outbox", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, map[string]int{"pending": len(ids)})
+}
+
+// ServeDiscard handles DELETE /admin/outbox/{id}, dropping the entry's
+// comment for good.
+func (a *OutboxAdmin) ServeDiscard(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !validOutboxID(id) {
+		http.Error(w, "Invalid ID", http.StatusBadRequest)
+		return
+	}
+	err := a.outbox.Discard(id)
+	switch {
+	case err == nil:
+		log.Printf("outbox: discarded %s", id)
+		w.WriteHeader(http.StatusNoContent)
+	case errors.Is(err, errNotInOutbox):
+		http.Error(w, "No such entry; it may have been published", http.StatusNotFound)
+	case errors.Is(err, errAlreadyClaimed):
+		http.Error(w, "Entry is being published", http.StatusConflict)
+	default:
+		log.Printf("discarding outbox entry %s: %v", id, err)
+		http.Error(w, "Failed to discard the entry", http.StatusInternalServerError)
+	}
+}
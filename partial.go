@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// partialPullInterval bounds how often serving the partial pulls the repo,
+// so comments merged or edited upstream show up without a pull per request.
+const partialPullInterval = time.Minute
+
+// partialData is passed to the "comments" template.
+type partialData struct {
+	Slug     string
+	Count    int
+	Comments []*partialComment
+}
+
+// partialComment is one published comment. Email addresses are never
+// exposed to templates.
+type partialComment struct {
+	ID       string
+	Name     string
+	Date     string
+	Time     time.Time
+	BodyHTML template.HTML
+	ReplyTo  string
+	Lang     string
+	Dir      string
+	Author   bool
+	Replies  []*partialComment
+
+	QuotedExcerpt string
+}
+
+// PartialHandler serves GET /comments/{slug}: the slug's published comments
+// as a threaded HTML fragment, for the widget or for fetching at build time.
+type PartialHandler struct {
+	cfg       *Config
+	repo      Repo
+	origins   *Origins
+	templates *Templates
+
+	mu       sync.Mutex
+	lastPull time.Time
+}
+
+func NewPartialHandler(cfg *Config, repo Repo, origins *Origins, templates *Templates) *PartialHandler {
+	return &PartialHandler{cfg: cfg, repo: repo, origins: origins, templates: templates, lastPull: time.Now()}
+}
+
+func (h *PartialHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	slug := r.PathValue("slug")
+	if !isValidSlug(slug) {
+		http.NotFound(w, r)
+		return
+	}
+	h.refresh()
+
+	data, err := h.load(slug)
+	if err != nil {
+		log.Printf("error loading comments for %s: %v", slug, err)
+		http.Error(w, "Failed to load comments", http.StatusInternalServerError)
+		return
+	}
+	// Render to a buffer so a failing site template doesn't leave a
+	// half-written response
+	var buf bytes.Buffer
+	if err := h.templates.Get().ExecuteTemplate(&buf, "comments", data); err != nil {
+		log.Printf("error rendering comments for %s: %v", slug, err)
+		http.Error(w, "Failed to render comments", http.StatusInternalServerError)
+		return
+	}
+	allowCORS(w, r, h.origins)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	buf.WriteTo(w)
+}
+
+// refresh pulls the repo if it hasn't been pulled for partialPullInterval.
+func (h *PartialHandler) refresh() {
+	h.mu.Lock()
+	due := time.Since(h.lastPull) >= partialPullInterval
+	if due {
+		h.lastPull = time.Now()
+	}
+	h.mu.Unlock()
+	if due {
+		if err := h.repo.Pull(); err != nil {
+			log.Printf("warning: git pull before serving comments failed: %v", err)
+		}
+	}
+}
+
+// load reads slug's comments and threads them. Replies whose parent is
+// missing are shown at the top level rather than dropped.
+func (h *PartialHandler) load(slug string) (partialData, error) {
+	data := partialData{Slug: slug}
+	dir := h.repo.FullPath(filepath.Join(h.cfg.CommentsPath, slug))
+	matches, err := filepath.Glob(filepath.Join(dir, "*.yml"))
+	if err != nil {
+		return data, fmt.Errorf("listing comments: %w", err)
+	}
+	// Filenames start with the submission time, so this is oldest first
+	sort.Strings(matches)
+
+	byID := make(map[string]*partialComment, len(matches))
+	var all []*partialComment
+	for _, path := range matches {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return data, fmt.Errorf("reading %s: %w", path, err)
+		}
+		var c Comment
+		if err := yaml.Unmarshal(raw, &c); err != nil {
+			log.Printf("warning: skipping unparseable comment %s: %v", path, err)
+			continue
+		}
+		pc := &partialComment{
+			ID:      commentID(path),
+			Name:    c.Name,
+			Date:    c.Date,
+			ReplyTo: c.ReplyTo,
+			Lang:    c.Lang,
+			Dir:     c.Dir,
+			Author:  c.Author,
+
+			QuotedExcerpt: c.QuotedExcerpt,
+		}
+		pc.Time, _ = time.Parse(time.RFC3339, c.Date)
+		if c.BodyHTML != "" {
+			pc.BodyHTML = template.HTML(c.BodyHTML)
+		} else {
+			pc.BodyHTML = template.HTML(renderBodyHTML(c.Body, h.cfg))
+		}
+		byID[pc.ID] = pc
+		all = append(all, pc)
+	}
+
+	for _, pc := range all {
+		if parent, ok := byID[pc.ReplyTo]; ok && parent != pc {
+			parent.Replies = append(parent.Replies, pc)
+		} else {
+			data.Comments = append(data.Comments, pc)
+		}
+	}
+	data.Count = len(all)
+	return data, nil
+}
+
+// widgetScript fills every element with a data-staticomment="<slug>"
+// attribute with that slug's comments partial, fetched from the server the
+// script itself was loaded from.
+const widgetScript = `(function () {
+  var script = document.currentScript;
+  var base = script.src.replace(/\/widget\.js(\?.*)?$/, "");
+  function load(el) {
+    var slug = el.getAttribute("data-staticomment");
+    fetch(base + "/comments/" + encodeURIComponent(slug))
+      .then(function (r) {
+        if (!r.ok) throw new Error("HTTP " + r.status);
+        return r.text();
+      })
+      .then(function (html) { el.innerHTML = html; })
+      .catch(function (err) { console.error("staticomment: loading comments for " + slug + ": " + err.message); });
+  }
+  function run() {
+    document.querySelectorAll("[data-staticomment]").forEach(load);
+  }
+  if (document.readyState === "loading") {
+    document.addEventListener("DOMContentLoaded", run);
+  } else {
+    run();
+  }
+})();
+`
+
+func serveWidget(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Write([]byte(widgetScript))
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// powField is the form field carrying the solution, as the ALTCHA widget
+// names it.
+const powField = "altcha"
+
+// errPowFailed is returned for a missing, wrong, forged, expired or reused
+// proof-of-work solution.
+var errPowFailed = errors.New("proof of work failed")
+
+// powChallenge is a challenge as served by GET /challenge, in ALTCHA's
+// format: find the number up to MaxNumber for which the SHA-256 of salt
+// followed by the number is Challenge.
+type powChallenge struct {
+	Algorithm string `json:"algorithm"`
+	Challenge string `json:"challenge"`
+	MaxNumber int    `json:"maxnumber"`
+	Salt      string `json:"salt"`
+	Signature string `json:"signature"`
+}
+
+// powSolution is the base64 JSON a solver submits in powField.
+type powSolution struct {
+	Algorithm string `json:"algorithm"`
+	Challenge string `json:"challenge"`
+	Number    int    `json:"number"`
+	Salt      string `json:"salt"`
+	Signature string `json:"signature"`
+}
+
+// ProofOfWork issues and verifies proof-of-work challenges compatible with
+// ALTCHA (https://altcha.org). The visitor's browser spends a moment
+// hashing to find the secret number, which costs a person nothing but
+// makes each submission from a bot farm cost CPU time. No third party is
+// involved. Challenges are signed, so the server keeps no state until one
+// is solved; the expiry is in the salt, and solved challenges are
+// remembered in the nonce store until then so one can't be reused.
+type ProofOfWork struct {
+	key       []byte
+	maxNumber int
+	ttl       time.Duration
+	nonces    NonceStore
+}
+
+func NewProofOfWork(key []byte, maxNumber int, ttl time.Duration, nonces NonceStore) *ProofOfWork {
+	return &ProofOfWork{key: key, maxNumber: maxNumber, ttl: ttl, nonces: nonces}
+}
+
+func (p *ProofOfWork) sign(challenge string) string {
+	mac := hmac.New(sha256.New, p.key)
+	mac.Write([]byte(challenge))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func powHash(salt string, number int) string {
+	sum := sha256.Sum256([]byte(salt + strconv.Itoa(number)))
+	return hex.EncodeToString(sum[:])
+}
+
+// Issue returns a new challenge.
+func (p *ProofOfWork) Issue() (powChallenge, error) {
+	nonce, err := randomHex(12)
+	if err != nil {
+		return powChallenge{}, err
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(p.maxNumber)+1))
+	if err != nil {
+		return powChallenge{}, err
+	}
+	salt := nonce + "?expires=" + strconv.FormatInt(time.Now().Add(p.ttl).Unix(), 10)
+	challenge := powHash(salt, int(n.Int64()))
+	return powChallenge{
+		Algorithm: "SHA-256",
+		Challenge: challenge,
+		MaxNumber: p.maxNumber,
+		Salt:      salt,
+		Signature: p.sign(challenge),
+	}, nil
+}
+
+// Verify checks a submitted solution and consumes its challenge. It
+// returns errPowFailed for a bad one, and any other error if the nonce
+// store failed.
+func (p *ProofOfWork) Verify(payload string) error {
+	if payload == "" {
+		return fmt.Errorf("%w: no solution", errPowFailed)
+	}
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return fmt.Errorf("%w: not base64", errPowFailed)
+	}
+	var s powSolution
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("%w: not JSON", errPowFailed)
+	}
+	if s.Algorithm != "SHA-256" {
+		return fmt.Errorf("%w: algorithm %q", errPowFailed, s.Algorithm)
+	}
+	if !hmac.Equal([]byte(s.Signature), []byte(p.sign(s.Challenge))) {
+		return fmt.Errorf("%w: bad signature", errPowFailed)
+	}
+	_, query, _ := strings.Cut(s.Salt, "?")
+	params, _ := url.ParseQuery(query)
+	unix, err := strconv.ParseInt(params.Get("expires"), 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: no expiry", errPowFailed)
+	}
+	expires := time.Unix(unix, 0)
+	if time.Now().After(expires) {
+		return fmt.Errorf("%w: expired", errPowFailed)
+	}
+	if powHash(s.Salt, s.Number) != s.Challenge {
+		return fmt.Errorf("%w: wrong number", errPowFailed)
+	}
+	fresh, err := p.nonces.Consume("pow:"+s.Challenge, expires)
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return fmt.Errorf("%w: already used", errPowFailed)
+	}
+	return nil
+}
+
+// ChallengeHandler serves GET /challenge, which the comment form calls from
+// the site's pages, so it answers CORS requests from the allowed origins.
+type ChallengeHandler struct {
+	cfg     *Config
+	origins *Origins
+	pow     *ProofOfWork
+}
+
+func NewChallengeHandler(cfg *Config, origins *Origins, pow *ProofOfWork) *ChallengeHandler {
+	return &ChallengeHandler{cfg: cfg, origins: origins, pow: pow}
+}
+
+func (h *ChallengeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	allowCORS(w, r, h.origins)
+	w.Header().Set("Cache-Control", "no-store")
+
+	challenge, err := h.pow.Issue()
+	if err != nil {
+		http.Error(w, "Failed to issue challenge", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(challenge)
+}
@@ -0,0 +1,896 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+)
+
+// maxIdentLen bounds the commenter's name and email in a commit author.
+const maxIdentLen = 100
+
+// PublishJob is an accepted comment on its way into the repo. The file path
+// is chosen at acceptance so a retried job rewrites the same file rather than
+// creating a duplicate.
+type PublishJob struct {
+	ID         string      `json:"id"`
+	Path       string      `json:"path"`
+	Message    string      `json:"message"`
+	Comment    Comment     `json:"comment"`
+	Quarantine bool        `json:"quarantine,omitempty"`
+	Subscribe  bool        `json:"subscribe,omitempty"`
+	Moderated  bool        `json:"moderated,omitempty"`
+	Scores     []ScoreItem `json:"scores,omitempty"`
+	IP         string      `json:"ip,omitempty"`
+	AcceptedAt time.Time   `json:"accepted_at"`
+	Attempts   int         `json:"attempts"`
+	LastError  string      `json:"last_error,omitempty"`
+	Errors     []JobError  `json:"errors,omitempty"`
+	Canary     bool        `json:"canary,omitempty"`
+}
+
+// maxJobErrors is how many of a job's failed attempts are kept, the most
+// recent.
+const maxJobErrors = 10
+
+// JobError is a failed attempt to publish a job.
+type JobError struct {
+	Time  time.Time `json:"time"`
+	Error string    `json:"error"`
+}
+
+// publishError records which stage of publishing failed.
+type publishError struct {
+	stage string
+	err   error
+}
+
+func (e *publishError) Error() string { return e.stage + ": " + e.err.Error() }
+func (e *publishError) Unwrap() error { return e.err }
+
+// Publisher writes accepted comments into the repo and pushes them. With an
+// outbox configured, jobs are persisted before any git work so a failed or
+// interrupted publish is replayed instead of lost.
+type Publisher struct {
+	cfg     *Config
+	repo    Repo
+	posts   Repo
+	events  *EventBus
+	outbox  *Outbox
+	subs    SubscriptionStore
+	reviews ReviewRequester
+	akismet *Akismet
+	batch   *CommitQueue
+	clock   Clock
+	ids     IDGenerator
+	wake    chan struct{}
+	indexMu sync.Mutex
+
+	retrying atomic.Int64 // jobs waiting in retryLater
+}
+
+func NewPublisher(cfg *Config, repo, posts Repo, events *EventBus, outbox *Outbox, subs SubscriptionStore, akismet *Akismet) *Publisher {
+	p := &Publisher{cfg: cfg, repo: repo, posts: posts, events: events, outbox: outbox, subs: subs, akismet: akismet, clock: NewClock(cfg), ids: NewIDGenerator(cfg), wake: make(chan struct{}, 1)}
+	if cfg.Moderation && cfg.hasPRToken() {
+		p.reviews = newReviewRequester(cfg)
+	}
+	if cfg.BatchInterval > 0 {
+		p.batch = NewCommitQueue(repo, time.Duration(cfg.BatchInterval)*time.Second, cfg.BatchMax, cfg.BatchThreshold, time.Duration(cfg.BatchThresholdWindow)*time.Second)
+	}
+	return p
+}
+
+// NewJob prepares a job for c, choosing its file name now.
+func (p *Publisher) NewJob(c Comment, ip string, quarantine bool, acceptedAt time.Time) (*PublishJob, error) {
+	id, err := newJobID()
+	if err != nil {
+		return nil, fmt.Errorf("generating job id: %w", err)
+	}
+	base, msg := p.cfg.CommentsPath, fmt.Sprintf("Add comment on %s", c.Slug)
+	if quarantine {
+		base, msg = p.cfg.QuarantinePath, fmt.Sprintf("Quarantine comment on %s", c.Slug)
+	}
+	relPath, err := p.newCommentPath(base, c.Slug, acceptedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &PublishJob{
+		ID:         id,
+		Path:       relPath,
+		Message:    msg,
+		Comment:    c,
+		Quarantine: quarantine,
+		Moderated:  p.cfg.Moderation && !quarantine,
+		IP:         ip,
+		AcceptedAt: acceptedAt,
+	}, nil
+}
+
+// Submit publishes job. With an outbox, the job is persisted first; if
+// publishing fails it stays in the outbox for replay and queued is true.
+// Without one, a job whose push failed is retried in the background, and
+// queued is true too.
+func (p *Publisher) Submit(job *PublishJob) (queued bool, err error) {
+	if p.outbox == nil {
+		err := p.publish(job)
+		if pushFailed(err) {
+			p.retryLater(job)
+			return true, err
+		}
+		return false, err
+	}
+	if err := p.outbox.Put(job); err != nil {
+		return false, &publishError{stage: "outbox", err: err}
+	}
+	claimed, err := p.outbox.Claim(job.ID)
+	if errors.Is(err, errAlreadyClaimed) {
+		// Another instance sharing the outbox picked it up first
+		return true, nil
+	}
+	if err != nil {
+		return true, err
+	}
+	return p.runClaimed(claimed)
+}
+
+// Enqueue stores job in the outbox for Run to publish, without waiting.
+func (p *Publisher) Enqueue(job *PublishJob) error {
+	if err := p.outbox.Put(job); err != nil {
+		return &publishError{stage: "outbox", err: err}
+	}
+	select {
+	case p.wake <- struct{}{}:
+	default:
+		// The worker is already due to look at the outbox
+	}
+	return nil
+}
+
+// Run is the background worker for STATICOMMENT_ASYNC_PUBLISH. It works
+// through the outbox at startup, whenever a comment is enqueued, and every
+// STATICOMMENT_OUTBOX_RETRY seconds to retry failed entries and pick up
+// ones abandoned by other instances.
+func (p *Publisher) Run() {
+	ticker := time.NewTicker(time.Duration(p.cfg.OutboxRetry) * time.Second)
+	defer ticker.Stop()
+	for {
+		p.ReplayOutbox()
+		select {
+		case <-p.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// retryLater publishes job again after a backoff, and again until it's
+// pushed, so a remote outage doesn't lose a comment when there's no outbox
+// to replay it from. Retries are kept only in memory, so they don't survive
+// a restart. The first failure was reported already; later ones are only
+// logged, unless the job is given up on.
+func (p *Publisher) retryLater(job *PublishJob) {
+	if job.Attempts == 0 {
+		p.retrying.Add(1)
+	}
+	job.Attempts++
+	backoff := pushBackoff(p.cfg, job.Attempts)
+	log.Printf("publish: %s not pushed (attempt %d), retrying in %s", job.ID, job.Attempts, backoff.Round(time.Second))
+	time.AfterFunc(backoff, func() {
+		err := p.publish(job)
+		switch {
+		case err == nil:
+			p.retrying.Add(-1)
+			log.Printf("publish: pushed %s", job.ID)
+		case pushFailed(err):
+			p.retryLater(job)
+		default:
+			p.retrying.Add(-1)
+			log.Printf("error publishing %s, giving up: %v", job.ID, err)
+			var pe *publishError
+			if errors.As(err, &pe) {
+				p.report(job, pe.stage, pe.err)
+			}
+		}
+	})
+}
+
+// Pending returns the number of comments accepted but not yet published:
+// those in the outbox, or without one, those waiting to be retried.
+func (p *Publisher) Pending() int {
+	if p.outbox == nil {
+		return int(p.retrying.Load())
+	}
+	ids, err := p.outbox.Pending()
+	if err != nil {
+		return 0
+	}
+	return len(ids)
+}
+
+// pushFailed reports whether err is a publish that failed while committing
+// and pushing, which is worth retrying once the remote is back.
+func pushFailed(err error) bool {
+	var pe *publishError
+	return errors.As(err, &pe) && pe.stage == "push"
+}
+
+// runClaimed publishes a claimed outbox entry, completing it on success or
+// releasing it back to pending with its error on failure.
+func (p *Publisher) runClaimed(job *PublishJob) (queued bool, err error) {
+	err = p.publish(job)
+	if err == nil {
+		if cerr := p.outbox.Complete(job.ID); cerr != nil {
+			log.Printf("warning: completing outbox entry %s: %v", job.ID, cerr)
+		}
+		return false, nil
+	}
+	job.Attempts++
+	job.LastError = err.Error()
+	job.Errors = append(job.Errors, JobError{Time: p.clock.Now().UTC(), Error: job.LastError})
+	if len(job.Errors) > maxJobErrors {
+		job.Errors = job.Errors[len(job.Errors)-maxJobErrors:]
+	}
+	if rerr := p.outbox.Release(job); rerr != nil {
+		log.Printf("error returning %s to outbox: %v", job.ID, rerr)
+	}
+	return true, err
+}
+
+// ReplayOutbox publishes entries left behind by earlier failures or by a
+// process that died mid-publish, and with STATICOMMENT_ASYNC_PUBLISH, those
+// waiting to be published. Safe to run from several instances at once.
+func (p *Publisher) ReplayOutbox() {
+	if p.outbox == nil {
+		return
+	}
+	if n, err := p.outbox.ReclaimStale(); err != nil {
+		log.Printf("warning: reclaiming stale outbox entries: %v", err)
+	} else if n > 0 {
+		log.Printf("outbox: reclaimed %d stale entries", n)
+	}
+	ids, err := p.outbox.Pending()
+	if err != nil {
+		log.Printf("error listing outbox: %v", err)
+		return
+	}
+	var wg sync.WaitGroup
+	for _, id := range ids {
+		job, err := p.outbox.Claim(id)
+		if errors.Is(err, errAlreadyClaimed) {
+			continue
+		}
+		if err != nil {
+			log.Printf("error claiming outbox entry %s: %v", id, err)
+			continue
+		}
+		replay := func() {
+			if _, err := p.runClaimed(job); err != nil {
+				log.Printf("outbox: %s still pending after attempt %d: %v", job.ID, job.Attempts, err)
+			} else {
+				log.Printf("outbox: published %s", job.ID)
+			}
+		}
+		if p.batch == nil {
+			replay()
+			continue
+		}
+		// Replayed together, the entries go out in as few commits as they can
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			replay()
+		}()
+	}
+	wg.Wait()
+}
+
+// RetryJob publishes the pending outbox entry id now, for an operator who
+// has fixed whatever kept it from going out. It returns errAlreadyClaimed
+// if it's being published already, and errNotInOutbox if it's gone.
+func (p *Publisher) RetryJob(id string) error {
+	job, err := p.outbox.Claim(id)
+	if errors.Is(err, errAlreadyClaimed) {
+		return p.outbox.claimError(id)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := p.runClaimed(job); err != nil {
+		log.Printf("outbox: %s still pending after attempt %d: %v", job.ID, job.Attempts, err)
+		return err
+	}
+	log.Printf("outbox: published %s", job.ID)
+	return nil
+}
+
+// publish writes the comment file, updates the index, commits and pushes.
+// It is idempotent: replaying a job whose file is already committed just
+// pushes any outstanding local commits.
+func (p *Publisher) publish(job *PublishJob) error {
+	if job.Moderated {
+		return p.publishForReview(job)
+	}
+	c := job.Comment
+	_, statErr := os.Stat(p.repo.FullPath(job.Path))
+	existed := statErr == nil
+
+	if err := p.writeCommentFile(job.Path, c); err != nil {
+		p.failed(job, "write", err)
+		return &publishError{stage: "write", err: err}
+	}
+
+	// Update the per-slug index in the same commit; a stale index is better
+	// than losing the comment, so failures here are only logged
+	paths := []string{job.Path}
+	if !job.Quarantine && p.cfg.IndexPath != "" {
+		if existed {
+			// A retry: the index already counts this comment, but may not
+			// have been committed yet
+			if _, err := os.Stat(p.repo.FullPath(p.indexPath(c.Slug))); err == nil {
+				paths = append(paths, p.indexPath(c.Slug))
+			}
+		} else if indexPath, err := p.updateIndex(c, job.Path); err != nil {
+			log.Printf("warning: updating comment index for %s: %v", c.Slug, err)
+		} else {
+			paths = append(paths, indexPath)
+		}
+	}
+
+	// Repo-backed reply subscriptions are committed alongside the comment;
+	// adding one is a no-op on retry, so the path is simply re-added
+	if subPath := p.subscribe(job); subPath != "" {
+		paths = append(paths, subPath)
+	}
+
+	commit := p.repo.CommitAndPush
+	if p.batch != nil {
+		commit = p.batch.CommitAndPush
+	}
+	if err := commit(p.commitAuthor(c), job.Message, paths...); err != nil {
+		p.failed(job, "push", err)
+		return &publishError{stage: "push", err: err}
+	}
+
+	if job.Quarantine {
+		log.Printf("comment quarantined: %s", job.Path)
+		p.events.Publish(Event{Type: EventQuarantined, IP: job.IP, Slug: c.Slug, Comment: &c, Path: job.Path})
+		return nil
+	}
+	log.Printf("comment saved and pushed: %s", job.Path)
+	p.events.Publish(Event{
+		Type:     EventPublished,
+		IP:       job.IP,
+		Slug:     c.Slug,
+		Comment:  &c,
+		Path:     job.Path,
+		Duration: time.Since(job.AcceptedAt),
+		Canary:   job.Canary,
+	})
+	return nil
+}
+
+// publishForReview pushes the comment to its own branch and opens a pull
+// request against the main branch, so it only goes live once merged.
+func (p *Publisher) publishForReview(job *PublishJob) error {
+	c := job.Comment
+	branch := reviewBranch(p.cfg.ModerationPrefix, c, job.Path)
+	err := p.repo.CommitToBranch(branch, p.commitAuthor(c), job.Message, func() ([]string, error) {
+		if err := p.writeCommentFile(job.Path, c); err != nil {
+			return nil, &publishError{stage: "write", err: err}
+		}
+		return []string{job.Path}, nil
+	})
+	if err != nil {
+		var pe *publishError
+		if !errors.As(err, &pe) {
+			pe = &publishError{stage: "push", err: err}
+		}
+		p.failed(job, pe.stage, pe.err)
+		return pe
+	}
+
+	var prURL string
+	if p.reviews != nil && !p.cfg.PreviewMode {
+		title := fmt.Sprintf("Comment on %s by %s", c.Slug, c.Name)
+		prURL, err = p.reviews.Open(branch, p.cfg.Branch, title, reviewDescription(job, p.postTitle(c.Slug)))
+		if err != nil {
+			p.failed(job, "review", err)
+			return &publishError{stage: "review", err: err}
+		}
+	}
+
+	// Subscriptions aren't site content, so they don't wait for review
+	if subPath := p.subscribe(job); subPath != "" {
+		msg := fmt.Sprintf("Add reply subscription on %s", c.Slug)
+		if err := p.repo.CommitAndPush(Author{}, msg, subPath); err != nil {
+			log.Printf("warning: committing reply subscription on %s: %v", c.Slug, err)
+		}
+	}
+
+	log.Printf("comment pushed for review: %s on %s %s", job.Path, branch, prURL)
+	p.events.Publish(Event{Type: EventModeration, IP: job.IP, Slug: c.Slug, Comment: &c, Path: job.Path, Branch: branch, URL: prURL})
+	return nil
+}
+
+// errNotQuarantined is returned when approving or discarding a comment that
+// isn't (or is no longer) in quarantine.
+var errNotQuarantined = errors.New("comment not in quarantine")
+
+// Approve publishes a quarantined comment, moving its file from the
+// quarantine path to the comments path under the same name and updating the
+// index, and returns the new path.
+func (p *Publisher) Approve(relPath string) (string, error) {
+	if err := p.repo.Pull(); err != nil {
+		log.Printf("warning: git pull before approving %s: %v", relPath, err)
+	}
+	c, dest, paths, err := p.moveToComments(relPath)
+	if err != nil {
+		return "", err
+	}
+	if err := p.repo.CommitAndPush(p.commitAuthor(c), fmt.Sprintf("Approve comment on %s", c.Slug), paths...); err != nil {
+		return "", err
+	}
+
+	log.Printf("quarantined comment approved: %s", dest)
+	p.ReportSpam(false, dest)
+	p.events.Publish(Event{Type: EventPublished, Slug: c.Slug, Comment: &c, Path: dest})
+	return dest, nil
+}
+
+// ApproveAll publishes every quarantined comment on slug in a single
+// commit, returning how many there were.
+func (p *Publisher) ApproveAll(slug string) (int, error) {
+	if err := p.repo.Pull(); err != nil {
+		log.Printf("warning: git pull before approving comments on %s: %v", slug, err)
+	}
+	matches, err := filepath.Glob(filepath.Join(p.repo.FullPath(filepath.Join(p.cfg.QuarantinePath, slug)), "*.yml"))
+	if err != nil {
+		return 0, fmt.Errorf("listing quarantined comments: %w", err)
+	}
+	sort.Strings(matches)
+	type approved struct {
+		comment Comment
+		path    string
+	}
+	var done []approved
+	seen := make(map[string]bool)
+	var paths []string
+	for _, match := range matches {
+		c, dest, changed, err := p.moveToComments(filepath.Join(p.cfg.QuarantinePath, slug, filepath.Base(match)))
+		if err != nil {
+			return 0, err
+		}
+		done = append(done, approved{c, dest})
+		for _, path := range changed {
+			if !seen[path] {
+				seen[path] = true
+				paths = append(paths, path)
+			}
+		}
+	}
+	if len(done) == 0 {
+		return 0, nil
+	}
+	msg := fmt.Sprintf("Approve quarantined comments on %s\n\n%s approved in bulk", slug, countComments(len(done)))
+	if err := p.repo.CommitAndPush(Author{}, msg, paths...); err != nil {
+		return 0, err
+	}
+
+	log.Printf("approved %d quarantined comments on %s", len(done), slug)
+	for _, a := range done {
+		p.ReportSpam(false, a.path)
+		p.events.Publish(Event{Type: EventPublished, Slug: slug, Comment: &a.comment, Path: a.path})
+	}
+	return len(done), nil
+}
+
+// moveToComments moves a quarantined comment file to the comments path and
+// updates the index, returning the comment, its new path and the paths to
+// commit.
+func (p *Publisher) moveToComments(relPath string) (Comment, string, []string, error) {
+	var c Comment
+	data, err := os.ReadFile(p.repo.FullPath(relPath))
+	if errors.Is(err, os.ErrNotExist) {
+		return c, "", nil, errNotQuarantined
+	}
+	if err != nil {
+		return c, "", nil, fmt.Errorf("reading quarantined comment: %w", err)
+	}
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return c, "", nil, fmt.Errorf("parsing quarantined comment: %w", err)
+	}
+	rel, err := filepath.Rel(p.cfg.QuarantinePath, relPath)
+	if err != nil {
+		return c, "", nil, err
+	}
+	dest := filepath.Join(p.cfg.CommentsPath, rel)
+
+	// Why it was held is for moderators, not the site
+	c.Moderation = nil
+	if err := p.writeCommentFile(dest, c); err != nil {
+		return c, "", nil, err
+	}
+	if err := os.Remove(p.repo.FullPath(relPath)); err != nil {
+		return c, "", nil, fmt.Errorf("removing quarantined comment: %w", err)
+	}
+	paths := []string{dest, relPath}
+	if p.cfg.IndexPath != "" {
+		if indexPath, err := p.updateIndex(c, dest); err != nil {
+			log.Printf("warning: updating comment index for %s: %v", c.Slug, err)
+		} else {
+			paths = append(paths, indexPath)
+		}
+	}
+	return c, dest, paths, nil
+}
+
+// Discard deletes a quarantined comment.
+func (p *Publisher) Discard(relPath string) error {
+	if err := p.repo.Pull(); err != nil {
+		log.Printf("warning: git pull before discarding %s: %v", relPath, err)
+	}
+	if err := os.Remove(p.repo.FullPath(relPath)); errors.Is(err, os.ErrNotExist) {
+		return errNotQuarantined
+	} else if err != nil {
+		return fmt.Errorf("removing quarantined comment: %w", err)
+	}
+	slug := filepath.Base(filepath.Dir(relPath))
+	if err := p.repo.CommitAndPush(Author{}, fmt.Sprintf("Discard quarantined comment on %s", slug), relPath); err != nil {
+		return err
+	}
+	log.Printf("quarantined comment discarded: %s", relPath)
+	p.ReportSpam(true, relPath)
+	return nil
+}
+
+// ReportSpam passes a moderator's verdict on comments to Akismet, if it's
+// configured, so it learns from the ones it got wrong.
+func (p *Publisher) ReportSpam(spam bool, relPaths ...string) {
+	if p.akismet == nil {
+		return
+	}
+	for _, relPath := range relPaths {
+		p.akismet.Report(relPath, spam)
+	}
+}
+
+// StoredComment is a comment file in the repo, published or quarantined.
+type StoredComment struct {
+	Path        string
+	Quarantined bool
+	Comment
+}
+
+// StoredComments reads the comment files dated since or later from the
+// comments and quarantine paths, oldest first within each.
+func (p *Publisher) StoredComments(since time.Time) ([]StoredComment, error) {
+	var comments []StoredComment
+	for _, base := range []string{p.cfg.CommentsPath, p.cfg.QuarantinePath} {
+		matches, err := filepath.Glob(filepath.Join(p.repo.FullPath(base), "*", "*.yml"))
+		if err != nil {
+			return nil, fmt.Errorf("listing comments: %w", err)
+		}
+		sort.Strings(matches)
+		for _, path := range matches {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return nil, fmt.Errorf("reading %s: %w", path, err)
+			}
+			var c Comment
+			if err := yaml.Unmarshal(data, &c); err != nil {
+				log.Printf("warning: skipping unparseable comment %s: %v", path, err)
+				continue
+			}
+			if date, err := time.Parse(time.RFC3339, c.Date); err != nil || date.Before(since) {
+				continue
+			}
+			rel, err := filepath.Rel(p.repo.FullPath(""), path)
+			if err != nil {
+				return nil, err
+			}
+			comments = append(comments, StoredComment{Path: rel, Quarantined: base == p.cfg.QuarantinePath, Comment: c})
+		}
+	}
+	return comments, nil
+}
+
+// Remove deletes the given comment files, published or quarantined, in a
+// single commit with msg, rebuilding the index of every slug that lost a
+// published comment. Files already gone are skipped; it returns how many
+// were removed.
+func (p *Publisher) Remove(relPaths []string, msg string) (int, error) {
+	if err := p.repo.Pull(); err != nil {
+		log.Printf("warning: git pull before removing comments: %v", err)
+	}
+	var paths []string
+	slugs := make(map[string]bool)
+	for _, rel := range relPaths {
+		rel = filepath.Clean(rel)
+		dir := filepath.Dir(filepath.Dir(rel))
+		if filepath.Ext(rel) != ".yml" || (dir != p.cfg.CommentsPath && dir != p.cfg.QuarantinePath) {
+			return 0, fmt.Errorf("not a comment file: %s", rel)
+		}
+		if err := os.Remove(p.repo.FullPath(rel)); errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return 0, fmt.Errorf("removing %s: %w", rel, err)
+		}
+		paths = append(paths, rel)
+		if dir == p.cfg.CommentsPath {
+			slugs[filepath.Base(filepath.Dir(rel))] = true
+		}
+	}
+	if len(paths) == 0 {
+		return 0, nil
+	}
+	removed := len(paths)
+	if p.cfg.IndexPath != "" {
+		for slug := range slugs {
+			if indexPath, err := p.rebuildIndex(slug); err != nil {
+				log.Printf("warning: updating comment index for %s: %v", slug, err)
+			} else {
+				paths = append(paths, indexPath)
+			}
+		}
+	}
+	if err := p.repo.CommitAndPush(Author{}, msg, paths...); err != nil {
+		return 0, err
+	}
+	log.Printf("removed %d comments", removed)
+	return removed, nil
+}
+
+// Rewrite applies edit to each of the given comment files, published or
+// quarantined, and commits the changed ones in a single commit with msg.
+// Files already gone are skipped; it returns how many were changed.
+func (p *Publisher) Rewrite(relPaths []string, edit func(*Comment), msg string) (int, error) {
+	if err := p.repo.Pull(); err != nil {
+		log.Printf("warning: git pull before rewriting comments: %v", err)
+	}
+	var paths []string
+	for _, rel := range relPaths {
+		rel = filepath.Clean(rel)
+		dir := filepath.Dir(filepath.Dir(rel))
+		if filepath.Ext(rel) != ".yml" || (dir != p.cfg.CommentsPath && dir != p.cfg.QuarantinePath) {
+			return 0, fmt.Errorf("not a comment file: %s", rel)
+		}
+		data, err := os.ReadFile(p.repo.FullPath(rel))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return 0, fmt.Errorf("reading %s: %w", rel, err)
+		}
+		var c Comment
+		if err := yaml.Unmarshal(data, &c); err != nil {
+			return 0, fmt.Errorf("parsing %s: %w", rel, err)
+		}
+		edit(&c)
+		if err := p.writeCommentFile(rel, c); err != nil {
+			return 0, fmt.Errorf("%s: %w", rel, err)
+		}
+		paths = append(paths, rel)
+	}
+	if len(paths) == 0 {
+		return 0, nil
+	}
+	if err := p.repo.CommitAndPush(Author{}, msg, paths...); err != nil {
+		return 0, err
+	}
+	log.Printf("rewrote %d comments", len(paths))
+	return len(paths), nil
+}
+
+// PublishMerged completes a moderated comment whose pull request was
+// merged: the index, which moderation leaves alone, is rebuilt for the slug
+// and the comment is announced as published.
+func (p *Publisher) PublishMerged(slug, id string) error {
+	if err := p.repo.Pull(); err != nil {
+		return fmt.Errorf("git pull: %w", err)
+	}
+	relPath := filepath.Join(p.cfg.CommentsPath, slug, id+".yml")
+	data, err := os.ReadFile(p.repo.FullPath(relPath))
+	if err != nil {
+		return fmt.Errorf("reading merged comment: %w", err)
+	}
+	var c Comment
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return fmt.Errorf("parsing merged comment: %w", err)
+	}
+
+	if p.cfg.IndexPath != "" {
+		// Rebuilding rather than counting keeps a redelivered webhook from
+		// counting the comment twice
+		if indexPath, err := p.rebuildIndex(slug); err != nil {
+			log.Printf("warning: updating comment index for %s: %v", slug, err)
+		} else if err := p.repo.CommitAndPush(Author{}, fmt.Sprintf("Update comment index for %s", slug), indexPath); err != nil {
+			log.Printf("warning: committing comment index for %s: %v", slug, err)
+		}
+	}
+
+	log.Printf("moderated comment merged: %s", relPath)
+	p.events.Publish(Event{Type: EventPublished, Slug: slug, Comment: &c, Path: relPath})
+	return nil
+}
+
+// subscribe records the job's reply subscription, if it asked for one, and
+// returns the path of any repo file to commit.
+func (p *Publisher) subscribe(job *PublishJob) string {
+	c := job.Comment
+	if !job.Subscribe || job.Quarantine || c.Email == "" {
+		return ""
+	}
+	sub := Subscription{Email: c.Email, Slug: c.Slug, Comment: commentID(job.Path)}
+	subPath, err := p.subs.AddSubscription(sub)
+	if err != nil {
+		log.Printf("warning: recording reply subscription on %s: %v", c.Slug, err)
+		return ""
+	}
+	return subPath
+}
+
+// commitAuthor attributes c's commit to the commenter with
+// STATICOMMENT_COMMIT_AS_COMMENTER, or to the server if they left no email.
+func (p *Publisher) commitAuthor(c Comment) Author {
+	if !p.cfg.CommitAsCommenter {
+		return Author{}
+	}
+	name, email := sanitizeIdent(c.Name), sanitizeIdent(c.Email)
+	if name == "" || !strings.Contains(email, "@") || strings.Contains(email, " ") {
+		return Author{}
+	}
+	return Author{Name: name, Email: email}
+}
+
+// sanitizeIdent makes s safe for a commit author line: angle brackets and
+// control characters, which would break the "Name <email>" format, are
+// dropped and runs of whitespace collapsed.
+func sanitizeIdent(s string) string {
+	s = strings.Map(func(r rune) rune {
+		switch {
+		case r == '<' || r == '>':
+			return -1
+		case unicode.IsControl(r):
+			return ' '
+		}
+		return r
+	}, s)
+	s = strings.Join(strings.Fields(s), " ")
+	if runes := []rune(s); len(runes) > maxIdentLen {
+		s = strings.TrimSpace(string(runes[:maxIdentLen]))
+	}
+	return s
+}
+
+// failed reports a failed attempt to publish job. Only the first is
+// reported, so a comment retried for hours counts, and notifies, once.
+func (p *Publisher) failed(job *PublishJob, stage string, err error) {
+	if job.Attempts == 0 {
+		p.report(job, stage, err)
+	}
+}
+
+func (p *Publisher) report(job *PublishJob, stage string, err error) {
+	p.events.Publish(Event{Type: EventFailed, Reason: stage, IP: job.IP, Slug: job.Comment.Slug, Err: err, Canary: job.Canary})
+}
+
+// newCommentPath returns <base>/<slug>/<id>.yml for a comment accepted at t.
+func (p *Publisher) newCommentPath(base, slug string, t time.Time) (string, error) {
+	id, err := p.ids.NewID(t)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(base, slug, id+".yml"), nil
+}
+
+func (p *Publisher) writeCommentFile(relPath string, c Comment) error {
+	fullPath := p.repo.FullPath(relPath)
+	if err := makeDirs(p.cfg, filepath.Dir(fullPath)); err != nil {
+		return fmt.Errorf("creating comment dir: %w", err)
+	}
+
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("marshaling comment: %w", err)
+	}
+
+	if err := writeFileAtomic(p.cfg, fullPath, data); err != nil {
+		return fmt.Errorf("writing comment file: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic replaces path with data, so that after a crash the file
+// is either as it was or complete, never truncated: data goes to a temp
+// file beside it, which is synced and renamed over path, and then the
+// directory is synced so the rename itself survives. The file gets
+// STATICOMMENT_FILE_MODE and STATICOMMENT_FILE_OWNER.
+func writeFileAtomic(cfg *Config, path string, data []byte) error {
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	// Set explicitly, since creating the file applies the umask
+	if err := f.Chmod(cfg.FileMode); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if cfg.FileUID >= 0 || cfg.FileGID >= 0 {
+		if err := f.Chown(cfg.FileUID, cfg.FileGID); err != nil {
+			f.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		// Directories can't be synced there; the rename is flushed with
+		// the file system's metadata
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err := d.Sync(); err != nil {
+		d.Close()
+		return err
+	}
+	return d.Close()
+}
+
+// makeDirs creates dir and any missing parents, like os.MkdirAll, giving
+// the ones it creates STATICOMMENT_DIR_MODE and STATICOMMENT_FILE_OWNER.
+func makeDirs(cfg *Config, dir string) error {
+	// Find the closest existing ancestor; everything below it is new
+	top := dir
+	for {
+		if _, err := os.Stat(top); err == nil || filepath.Dir(top) == top {
+			break
+		}
+		top = filepath.Dir(top)
+	}
+	if err := os.MkdirAll(dir, cfg.DirMode); err != nil {
+		return err
+	}
+	for d := dir; d != top; d = filepath.Dir(d) {
+		if err := os.Chmod(d, cfg.DirMode); err != nil {
+			return err
+		}
+		if cfg.FileUID >= 0 || cfg.FileGID >= 0 {
+			if err := os.Chown(d, cfg.FileUID, cfg.FileGID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter decides whether a client identified by key (normally its IP)
+// may submit another comment.
+type RateLimiter interface {
+	// Allow reports whether the request is within the limit, recording it
+	// if so.
+	Allow(key string) bool
+}
+
+// NewRateLimiter builds the limiter selected by STATICOMMENT_RATE_LIMIT_ALGORITHM.
+// If RateLimitMax is 0, limiting is disabled.
+func NewRateLimiter(cfg *Config) RateLimiter {
+	return newRateLimiter(cfg, cfg.RateLimitMax, cfg.RateLimitBurst)
+}
+
+// newRateLimiter builds the limiter selected by
+// STATICOMMENT_RATE_LIMIT_ALGORITHM allowing max requests per window.
+func newRateLimiter(cfg *Config, max, burst int) RateLimiter {
+	switch cfg.RateLimitAlgorithm {
+	case "token-bucket":
+		return NewTokenBucketLimiter(cfg.RateLimitWindow, max, burst)
+	default:
+		return NewSlidingWindowLimiter(cfg.RateLimitWindow, max)
+	}
+}
+
+// NewGlobalRateLimiter builds the limiter on submissions from everyone
+// together, STATICOMMENT_RATE_LIMIT_GLOBAL_MAX per window, checked with
+// globalRateLimitKey.
+func NewGlobalRateLimiter(cfg *Config) RateLimiter {
+	return newRateLimiter(cfg, cfg.RateLimitGlobalMax, 0)
+}
+
+// globalRateLimitKey is the one key the global limiter is asked about.
+const globalRateLimitKey = "global"
+
+// PostRateLimiter limits submissions to a single post, per IP with
+// STATICOMMENT_RATE_LIMIT_POST_IP_MAX and from everyone together with
+// STATICOMMENT_RATE_LIMIT_POST_MAX, so a wave of spam against one post can
+// be throttled without closing the others. Either limit is disabled at 0.
+type PostRateLimiter struct {
+	perIP   RateLimiter
+	perPost RateLimiter
+}
+
+// NewPostRateLimiter builds the per-post limiters with the algorithm and
+// window of the per-IP one.
+func NewPostRateLimiter(cfg *Config) *PostRateLimiter {
+	return &PostRateLimiter{
+		perIP:   newRateLimiter(cfg, cfg.RateLimitPostIPMax, 0),
+		perPost: newRateLimiter(cfg, cfg.RateLimitPostMax, 0),
+	}
+}
+
+// Allow reports whether ip may submit another comment to the post slug,
+// recording it if so. A submission refused per IP doesn't count against
+// the post.
+func (rl *PostRateLimiter) Allow(ip, slug string) bool {
+	// Prefixed so the keys can share a store with the per-IP limiter's
+	return rl.perIP.Allow("post-ip:"+slug+"/"+ip) && rl.perPost.Allow("post:"+slug)
+}
+
+// SlidingWindowLimiter tracks request timestamps per key and allows at most
+// max requests in any trailing window.
+type SlidingWindowLimiter struct {
+	window  time.Duration
+	max     int
+	mu      sync.Mutex
+	entries map[string][]time.Time
+}
+
+// NewSlidingWindowLimiter creates a sliding-window limiter. If max is 0,
+// limiting is disabled.
+func NewSlidingWindowLimiter(windowSeconds, max int) *SlidingWindowLimiter {
+	rl := &SlidingWindowLimiter{
+		window:  time.Duration(windowSeconds) * time.Second,
+		max:     max,
+		entries: make(map[string][]time.Time),
+	}
+	if max > 0 {
+		go rl.cleanup()
+	}
+	return rl
+}
+
+// Allow checks whether the given key is within the rate limit.
+// Returns true if the request is allowed.
+func (rl *SlidingWindowLimiter) Allow(key string) bool {
+	if rl.max <= 0 {
+		return true
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	cutoff := now.Add(-rl.window)
+
+	// Filter out expired entries
+	timestamps := rl.entries[key]
+	valid := timestamps[:0]
+	for _, t := range timestamps {
+		if t.After(cutoff) {
+			valid = append(valid, t)
+		}
+	}
+
+	if len(valid) >= rl.max {
+		rl.entries[key] = valid
+		return false
+	}
+
+	rl.entries[key] = append(valid, now)
+	return true
+}
+
+// cleanup periodically removes expired entries to prevent memory growth.
+func (rl *SlidingWindowLimiter) cleanup() {
+	ticker := time.NewTicker(rl.window)
+	defer ticker.Stop()
+	for range ticker.C {
+		rl.mu.Lock()
+		now := time.Now()
+		cutoff := now.Add(-rl.window)
+		for key, timestamps := range rl.entries {
+			valid := timestamps[:0]
+			for _, t := range timestamps {
+				if t.After(cutoff) {
+					valid = append(valid, t)
+				}
+			}
+			if len(valid) == 0 {
+				delete(rl.entries, key)
+			} else {
+				rl.entries[key] = valid
+			}
+		}
+		rl.mu.Unlock()
+	}
+}
+
+// TokenBucketLimiter refills each key's bucket at max tokens per window and
+// allows bursts of up to burst requests. Unlike the sliding window it keeps
+// constant state per key, so long windows and high limits stay cheap.
+type TokenBucketLimiter struct {
+	rate    float64 // tokens per second
+	burst   float64
+	window  time.Duration
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucketLimiter creates a token-bucket limiter. If max is 0, limiting
+// is disabled. A burst of 0 defaults to max.
+func NewTokenBucketLimiter(windowSeconds, max, burst int) *TokenBucketLimiter {
+	if burst <= 0 {
+		burst = max
+	}
+	rl := &TokenBucketLimiter{
+		burst:   float64(burst),
+		window:  time.Duration(windowSeconds) * time.Second,
+		buckets: make(map[string]*tokenBucket),
+	}
+	if max > 0 && windowSeconds > 0 {
+		rl.rate = float64(max) / float64(windowSeconds)
+		go rl.cleanup()
+	}
+	return rl
+}
+
+// Allow takes a token from the key's bucket, returning false if it is empty.
+func (rl *TokenBucketLimiter) Allow(key string) bool {
+	if rl.rate <= 0 {
+		return true
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	now := time.Now()
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[key] = b
+	} else {
+		b.tokens = min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+		b.last = now
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// cleanup periodically drops buckets that have refilled completely, since
+// they are indistinguishable from a fresh bucket.
+func (rl *TokenBucketLimiter) cleanup() {
+	ticker := time.NewTicker(rl.window)
+	defer ticker.Stop()
+	for range ticker.C {
+		rl.mu.Lock()
+		now := time.Now()
+		for key, b := range rl.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*rl.rate >= rl.burst {
+				delete(rl.buckets, key)
+			}
+		}
+		rl.mu.Unlock()
+	}
+}
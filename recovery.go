@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Recloner is a Repo backed by a local clone that can be thrown away and
+// cloned afresh, for POST /admin/repo/reclone.
+type Recloner interface {
+	Reclone() error
+}
+
+// interruptedState lists what a git operation killed partway leaves in
+// .git. Locks are taken by a single git process at a time, and ours only
+// run under the repo's lock, so any found while we hold it are stale.
+var interruptedState = []struct {
+	name    string
+	problem string
+}{
+	{"index.lock", "index.lock left behind"},
+	{"HEAD.lock", "HEAD.lock left behind"},
+	{"rebase-merge", "interrupted rebase"},
+	{"rebase-apply", "interrupted rebase"},
+	{"MERGE_HEAD", "interrupted merge"},
+	{"CHERRY_PICK_HEAD", "interrupted cherry-pick"},
+	{"REVERT_HEAD", "interrupted revert"},
+}
+
+// cloneProblems returns what's wrong with the clone at dir: leftovers of an
+// interrupted git operation, or HEAD not on one of branches (detached, or
+// left on a review branch). A clone with none is assumed to be usable.
+func cloneProblems(dir string, branches []string) []string {
+	gitDir := filepath.Join(dir, ".git")
+	var problems []string
+	for _, s := range interruptedState {
+		if _, err := os.Stat(filepath.Join(gitDir, s.name)); err == nil && !contains(problems, s.problem) {
+			problems = append(problems, s.problem)
+		}
+	}
+	head, err := os.ReadFile(filepath.Join(gitDir, "HEAD"))
+	ref, attached := strings.CutPrefix(strings.TrimSpace(string(head)), "ref: ")
+	switch {
+	case err != nil:
+		problems = append(problems, fmt.Sprintf("reading HEAD: %v", err))
+	case !attached:
+		problems = append(problems, "detached HEAD")
+	case !strings.HasPrefix(ref, "refs/heads/") || !contains(branches, strings.TrimPrefix(ref, "refs/heads/")):
+		problems = append(problems, fmt.Sprintf("on %s instead of %s", strings.TrimPrefix(ref, "refs/heads/"), branches[0]))
+	}
+	return problems
+}
+
+// recoverClone repairs the repo's clone if cloneProblems finds anything
+// wrong with it. It first clears the interrupted operation and calls reset,
+// which force-checks out the first of branches; if that fails or leaves
+// problems behind, it calls reclone. Either way the working tree content of
+// keep, the repo-relative paths about to be committed, is preserved.
+func recoverClone(cfg *Config, branches, keep []string, reset, reclone func() error) error {
+	dir := cfg.RepoDir
+	problems := cloneProblems(dir, branches)
+	if len(problems) == 0 {
+		return nil
+	}
+	log.Printf("git: clone is in a broken state (%s), resetting to %s", strings.Join(problems, "; "), branches[0])
+	saved, err := readFiles(dir, keep)
+	if err != nil {
+		return fmt.Errorf("recovering clone: %w", err)
+	}
+	err = clearInterrupted(dir)
+	if err == nil {
+		err = reset()
+	}
+	if err == nil {
+		if problems := cloneProblems(dir, branches); len(problems) > 0 {
+			err = errors.New(strings.Join(problems, "; "))
+		}
+	}
+	if err != nil {
+		log.Printf("git: resetting the clone failed (%v), cloning afresh; unpushed commits are lost", err)
+		if err := reclone(); err != nil {
+			return fmt.Errorf("recovering clone: %w", err)
+		}
+	}
+	if err := writeFiles(cfg, dir, saved); err != nil {
+		return fmt.Errorf("recovering clone: %w", err)
+	}
+	return nil
+}
+
+// clearInterrupted removes the state an interrupted operation left in the
+// clone at dir. The branch itself isn't touched until the operation
+// finishes, so after a forced checkout it's as if the operation had been
+// aborted.
+func clearInterrupted(dir string) error {
+	for _, s := range interruptedState {
+		if err := os.RemoveAll(filepath.Join(dir, ".git", s.name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// emptyDir removes everything in dir but dir itself, which may be a mount
+// point.
+func emptyDir(cfg *Config, dir string) error {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return makeDirs(cfg, dir)
+	}
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readFiles reads the repo-relative paths under dir, recording nil for a
+// file that doesn't exist.
+func readFiles(dir string, paths []string) (map[string][]byte, error) {
+	files := make(map[string][]byte, len(paths))
+	for _, p := range paths {
+		data, err := os.ReadFile(filepath.Join(dir, p))
+		if errors.Is(err, os.ErrNotExist) {
+			files[p] = nil
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		files[p] = data
+	}
+	return files, nil
+}
+
+// writeFiles puts back files as read by readFiles, removing those recorded
+// as nil.
+func writeFiles(cfg *Config, dir string, files map[string][]byte) error {
+	for p, data := range files {
+		full := filepath.Join(dir, p)
+		if data == nil {
+			if err := os.Remove(full); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			continue
+		}
+		if err := makeDirs(cfg, filepath.Dir(full)); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(cfg, full, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveReclone handles POST /admin/repo/reclone.
+func serveReclone(repo Recloner) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("admin: recloning the repo")
+		if err := repo.Reclone(); err != nil {
+			log.Printf("admin: reclone failed: %v", err)
+			http.Error(w, "Reclone failed", http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
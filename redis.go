@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// redisTimeout bounds connecting to Redis and each command, made while
+	// a submission waits.
+	redisTimeout = 2 * time.Second
+	// redisMaxIdle is how many connections are kept open between commands.
+	redisMaxIdle = 8
+)
+
+// redisSlidingWindowScript is SlidingWindowLimiter as a sorted set of hit
+// times in milliseconds, trimmed to the window on each call. ARGV: now,
+// window, max, a unique member for this hit.
+const redisSlidingWindowScript = `
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', now - window)
+if redis.call('ZCARD', KEYS[1]) >= tonumber(ARGV[3]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], now, ARGV[4])
+redis.call('PEXPIRE', KEYS[1], window)
+return 1
+`
+
+// redisTokenBucketScript is TokenBucketLimiter as a hash of the tokens left
+// and when they were counted, expiring once the bucket would be full
+// again. ARGV: now in milliseconds, tokens per millisecond, burst, and
+// how long in milliseconds an empty bucket takes to fill.
+const redisTokenBucketScript = `
+local now = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2])
+local burst = tonumber(ARGV[3])
+local tokens = burst
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'last')
+if bucket[1] and bucket[2] then
+	tokens = math.min(burst, tonumber(bucket[1]) + (now - tonumber(bucket[2])) * rate)
+end
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'last', tostring(now))
+redis.call('PEXPIRE', KEYS[1], ARGV[4])
+return allowed
+`
+
+// RedisClient is a minimal Redis client: commands are sent one at a time
+// on pooled connections, authenticated and switched to the database named
+// in the URL when they're opened.
+type RedisClient struct {
+	addr     string
+	tls      bool
+	username string
+	password string
+	db       int
+	idle     chan *redisConn
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// NewRedisClient returns a client for a URL like
+// redis://:password@host:6379/0, or rediss:// for TLS. Nothing is
+// connected until the first command.
+func NewRedisClient(rawURL string) (*RedisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "redis" && u.Scheme != "rediss") || u.Hostname() == "" {
+		return nil, fmt.Errorf("must be a redis:// or rediss:// URL")
+	}
+	c := &RedisClient{addr: u.Host, tls: u.Scheme == "rediss", idle: make(chan *redisConn, redisMaxIdle)}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil || c.db < 0 {
+			return nil, fmt.Errorf("database must be a non-negative integer")
+		}
+	}
+	return c, nil
+}
+
+// Do sends a command and returns its reply: a string, an int64, nil, or a
+// []any of those. Error replies are returned as errors.
+func (c *RedisClient) Do(args ...string) (any, error) {
+	rc, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := rc.do(args...)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		// The connection may be out of step with its replies
+		rc.conn.Close()
+		return nil, err
+	}
+	c.put(rc)
+	return reply, err
+}
+
+func (c *RedisClient) get() (*redisConn, error) {
+	select {
+	case rc := <-c.idle:
+		return rc, nil
+	default:
+	}
+	dialer := &net.Dialer{Timeout: redisTimeout}
+	var conn net.Conn
+	var err error
+	if c.tls {
+		host, _, _ := net.SplitHostPort(c.addr)
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.addr, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", c.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rc := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	if c.password != "" {
+		args := []string{"AUTH", c.password}
+		if c.username != "" {
+			args = []string{"AUTH", c.username, c.password}
+		}
+		if _, err := rc.do(args...); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis auth: %w", err)
+		}
+	}
+	if c.db != 0 {
+		if _, err := rc.do("SELECT", strconv.Itoa(c.db)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis select: %w", err)
+		}
+	}
+	return rc, nil
+}
+
+func (c *RedisClient) put(rc *redisConn) {
+	select {
+	case c.idle <- rc:
+	default:
+		rc.conn.Close()
+	}
+}
+
+// redisError is an error reply from the server, after which the
+// connection is still usable.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func (rc *redisConn) do(args ...string) (any, error) {
+	rc.conn.SetDeadline(time.Now().Add(redisTimeout))
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&sb, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := io.WriteString(rc.conn, sb.String()); err != nil {
+		return nil, err
+	}
+	return rc.read()
+}
+
+// read parses one RESP2 reply.
+func (rc *redisConn) read() (any, error) {
+	line, err := rc.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad reply %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rc.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: bad reply %q", line)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]any, n)
+		var replyErr error
+		for i := range items {
+			items[i], err = rc.read()
+			var itemErr redisError
+			if errors.As(err, &itemErr) {
+				replyErr = err
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return items, replyErr
+	}
+	return nil, fmt.Errorf("redis: bad reply %q", line)
+}
+
+// RedisStore keeps rate limits and form token nonces in Redis, so replicas
+// behind a load balancer share them rather than each counting its own.
+// It replaces the in-memory and SQLite limiters and nonce stores when
+// STATICOMMENT_REDIS_URL is set. Redis errors fail open, like SQLite's.
+type RedisStore struct {
+	client *RedisClient
+	prefix string
+}
+
+func NewRedisStore(cfg *Config) (*RedisStore, error) {
+	client, err := NewRedisClient(cfg.RedisURL)
+	if err != nil {
+		return nil, fmt.Errorf("STATICOMMENT_REDIS_URL %w", err)
+	}
+	return &RedisStore{client: client, prefix: cfg.RedisPrefix}, nil
+}
+
+// Ping checks the server can be reached.
+func (s *RedisStore) Ping() error {
+	_, err := s.client.Do("PING")
+	return err
+}
+
+// Consume implements NonceStore with a key per nonce expiring with it.
+func (s *RedisStore) Consume(nonce string, expires time.Time) (bool, error) {
+	ttl := max(time.Until(expires).Milliseconds(), 1)
+	reply, err := s.client.Do("SET", s.prefix+"nonce:"+nonce, "1", "PX", strconv.FormatInt(ttl, 10), "NX")
+	if err != nil {
+		return false, err
+	}
+	return reply != nil, nil
+}
+
+// Release implements NonceStore.
+func (s *RedisStore) Release(nonce string) error {
+	_, err := s.client.Do("DEL", s.prefix+"nonce:"+nonce)
+	return err
+}
+
+// RateLimiter returns a limiter with the algorithm and limits from cfg whose
+// state is kept in Redis. Keys expire by themselves, so there's nothing to
+// clean up.
+func (s *RedisStore) RateLimiter(cfg *Config) RateLimiter {
+	return s.rateLimiter(cfg, cfg.RateLimitMax, cfg.RateLimitBurst)
+}
+
+// PostRateLimiter returns the per-post limiters with their state kept in
+// Redis.
+func (s *RedisStore) PostRateLimiter(cfg *Config) *PostRateLimiter {
+	return &PostRateLimiter{
+		perIP:   s.rateLimiter(cfg, cfg.RateLimitPostIPMax, 0),
+		perPost: s.rateLimiter(cfg, cfg.RateLimitPostMax, 0),
+	}
+}
+
+// GlobalRateLimiter returns the limiter on submissions from everyone
+// together with its state kept in Redis.
+func (s *RedisStore) GlobalRateLimiter(cfg *Config) RateLimiter {
+	return s.rateLimiter(cfg, cfg.RateLimitGlobalMax, 0)
+}
+
+func (s *RedisStore) rateLimiter(cfg *Config, max, burst int) RateLimiter {
+	if cfg.RateLimitAlgorithm == "token-bucket" {
+		if burst <= 0 {
+			burst = max
+		}
+		rl := &redisTokenBucket{client: s.client, prefix: s.prefix + "bucket:", burst: burst}
+		if max > 0 && cfg.RateLimitWindow > 0 {
+			rl.rate = float64(max) / float64(cfg.RateLimitWindow*1000)
+		}
+		return rl
+	}
+	return &redisSlidingWindow{client: s.client, prefix: s.prefix + "hits:", window: time.Duration(cfg.RateLimitWindow) * time.Second, max: max}
+}
+
+// redisSlidingWindow is SlidingWindowLimiter with its hits in Redis.
+type redisSlidingWindow struct {
+	client *RedisClient
+	prefix string
+	window time.Duration
+	max    int
+}
+
+func (rl *redisSlidingWindow) Allow(key string) bool {
+	if rl.max <= 0 {
+		return true
+	}
+	// Hits in the same millisecond need members of their own
+	member := make([]byte, 8)
+	rand.Read(member)
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	reply, err := rl.client.Do("EVAL", redisSlidingWindowScript, "1", rl.prefix+key,
+		now, strconv.FormatInt(rl.window.Milliseconds(), 10), strconv.Itoa(rl.max), now+"-"+hex.EncodeToString(member))
+	if err != nil {
+		log.Printf("warning: redis rate limiter: %v", err)
+		return true
+	}
+	return reply == int64(1)
+}
+
+// redisTokenBucket is TokenBucketLimiter with its buckets in Redis.
+type redisTokenBucket struct {
+	client *RedisClient
+	prefix string
+	rate   float64 // tokens per millisecond
+	burst  int
+}
+
+func (rl *redisTokenBucket) Allow(key string) bool {
+	if rl.rate <= 0 {
+		return true
+	}
+	fill := int64(math.Ceil(float64(rl.burst) / rl.rate))
+	reply, err := rl.client.Do("EVAL", redisTokenBucketScript, "1", rl.prefix+key,
+		strconv.FormatInt(time.Now().UnixMilli(), 10), strconv.FormatFloat(rl.rate, 'g', -1, 64), strconv.Itoa(rl.burst), strconv.FormatInt(fill, 10))
+	if err != nil {
+		log.Printf("warning: redis rate limiter: %v", err)
+		return true
+	}
+	return reply == int64(1)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+	"gopkg.in/yaml.v3"
+)
+
+// ContentLimits are the link limit and blocked patterns a comment body is
+// checked against.
+type ContentLimits struct {
+	MaxLinks        int
+	BlockedPatterns []*regexp.Regexp
+}
+
+// ContentOverride is one entry of STATICOMMENT_CONTENT_OVERRIDES_FILE. It
+// applies to comments in any of its languages (the primary subtag of the
+// lang field) from any of its countries; a condition left out matches
+// anything. The limits it sets replace the global ones.
+type ContentOverride struct {
+	Name            string   `yaml:"name"`
+	Lang            []string `yaml:"lang,omitempty"`
+	Country         []string `yaml:"country,omitempty"`
+	MaxLinks        *int     `yaml:"max_links,omitempty"`
+	BlockedPatterns []string `yaml:"blocked_patterns,omitempty"`
+
+	patterns []*regexp.Regexp
+}
+
+// ContentPolicy picks the content limits for a submission: those of the
+// first override matching its language and country, falling back to
+// STATICOMMENT_MAX_LINKS and STATICOMMENT_BLOCKED_PATTERNS.
+type ContentPolicy struct {
+	defaults  ContentLimits
+	overrides []*ContentOverride
+	geo       *maxminddb.Reader
+}
+
+// countryRecord is the part of a GeoLite2-Country, GeoLite2-City or
+// compatible record we read.
+type countryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+}
+
+// LoadContentPolicy reads the overrides file, if any, and opens the GeoIP
+// database for overrides by country.
+func LoadContentPolicy(defaults ContentLimits, overridesFile, geoIPDB string) (*ContentPolicy, error) {
+	policy := &ContentPolicy{defaults: defaults}
+	if overridesFile == "" {
+		return policy, nil
+	}
+	data, err := os.ReadFile(overridesFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading content overrides: %w", err)
+	}
+	if err := yaml.Unmarshal(data, &policy.overrides); err != nil {
+		return nil, fmt.Errorf("parsing content overrides: %w", err)
+	}
+	byCountry := false
+	for i, o := range policy.overrides {
+		if o.Name == "" {
+			o.Name = fmt.Sprintf("override-%d", i+1)
+		}
+		if o.MaxLinks != nil && *o.MaxLinks < 0 {
+			return nil, fmt.Errorf("override %q: max_links must be non-negative", o.Name)
+		}
+		if o.patterns, err = compilePatterns(o.BlockedPatterns); err != nil {
+			return nil, fmt.Errorf("override %q: %w", o.Name, err)
+		}
+		for j := range o.Lang {
+			o.Lang[j] = strings.ToLower(o.Lang[j])
+		}
+		for j := range o.Country {
+			o.Country[j] = strings.ToUpper(o.Country[j])
+		}
+		byCountry = byCountry || len(o.Country) > 0
+	}
+	if byCountry {
+		if geoIPDB == "" {
+			return nil, fmt.Errorf("overrides by country need STATICOMMENT_GEOIP_DB")
+		}
+		if policy.geo, err = maxminddb.Open(geoIPDB); err != nil {
+			return nil, fmt.Errorf("opening GeoIP database: %w", err)
+		}
+	}
+	return policy, nil
+}
+
+// For returns the limits for a comment in lang from ip.
+func (p *ContentPolicy) For(ip, lang string) ContentLimits {
+	if len(p.overrides) == 0 {
+		return p.defaults
+	}
+	primary, _, _ := strings.Cut(strings.ToLower(lang), "-")
+	country := p.country(ip)
+	for _, o := range p.overrides {
+		if (len(o.Lang) > 0 && !contains(o.Lang, primary)) || (len(o.Country) > 0 && !contains(o.Country, country)) {
+			continue
+		}
+		limits := p.defaults
+		if o.MaxLinks != nil {
+			limits.MaxLinks = *o.MaxLinks
+		}
+		if o.BlockedPatterns != nil {
+			limits.BlockedPatterns = o.patterns
+		}
+		return limits
+	}
+	return p.defaults
+}
+
+// country returns ip's ISO country code, or "" if it isn't known.
+func (p *ContentPolicy) country(ip string) string {
+	addr := net.ParseIP(ip)
+	if p.geo == nil || addr == nil {
+		return ""
+	}
+	var rec countryRecord
+	if err := p.geo.Lookup(addr, &rec); err != nil {
+		return ""
+	}
+	return rec.Country.ISOCode
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
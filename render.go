@@ -0,0 +1,126 @@
+package main
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// linkRel is applied to every link generated from comment content so themes
+// don't pass link equity to spam that slips through.
+const linkRel = "nofollow ugc noopener"
+
+// Image policies for Markdown-style images (![alt](url)) in body_html.
+const (
+	ImagePolicyStrip     = "strip"     // replace the image with its alt text
+	ImagePolicyProxy     = "proxy"     // rewrite src through STATICOMMENT_IMAGE_PROXY
+	ImagePolicyAllowlist = "allowlist" // keep images from allowed domains, strip the rest
+)
+
+// inlinePattern matches a Markdown image (groups 1 and 2) or a bare URL.
+var inlinePattern = regexp.MustCompile(`!\[([^\]]*)\]\((https?://[^\s)]+)\)|https?://[^\s<>"]+`)
+
+var bareURLPattern = regexp.MustCompile(`^https?://[^\s<>"]+$`)
+
+// renderBodyHTML converts a plain-text comment body to safe HTML for the
+// stored body_html field. Text is escaped, blank lines separate paragraphs
+// and single newlines become <br>. Depending on config, bare URLs become
+// anchors, Markdown images are stripped, proxied or allowlisted, and a
+// paragraph holding only a URL on an embed domain becomes a sandboxed iframe.
+//
+// Remote content is never loaded by default: images are stripped and no
+// domains are embeddable, so rendered comments cannot leak reader IPs to
+// tracking pixels.
+func renderBodyHTML(body string, cfg *Config) string {
+	body = strings.ReplaceAll(body, "\r\n", "\n")
+	var sb strings.Builder
+	for _, para := range strings.Split(body, "\n\n") {
+		para = strings.TrimSpace(para)
+		if para == "" {
+			continue
+		}
+		if bareURLPattern.MatchString(para) && hostAllowed(para, cfg.EmbedDomains) {
+			sb.WriteString(renderEmbed(para))
+			continue
+		}
+		sb.WriteString("<p>")
+		for i, line := range strings.Split(para, "\n") {
+			if i > 0 {
+				sb.WriteString("<br>\n")
+			}
+			sb.WriteString(renderInline(line, cfg))
+		}
+		sb.WriteString("</p>\n")
+	}
+	return sb.String()
+}
+
+// renderInline escapes a single line, rendering images per the image policy
+// and turning bare URLs into anchors when autolink is enabled.
+func renderInline(line string, cfg *Config) string {
+	var sb strings.Builder
+	last := 0
+	for _, m := range inlinePattern.FindAllStringSubmatchIndex(line, -1) {
+		start, end := m[0], m[1]
+		if m[4] >= 0 {
+			sb.WriteString(html.EscapeString(line[last:start]))
+			sb.WriteString(renderImage(line[m[2]:m[3]], line[m[4]:m[5]], cfg))
+			last = end
+			continue
+		}
+		if !cfg.Autolink {
+			continue
+		}
+		// Leave trailing punctuation outside the link, e.g. "see http://x.com."
+		for end > start && strings.ContainsRune(".,;:!?)'", rune(line[end-1])) {
+			end--
+		}
+		sb.WriteString(html.EscapeString(line[last:start]))
+		sb.WriteString(renderLink(line[start:end], line[start:end]))
+		last = end
+	}
+	sb.WriteString(html.EscapeString(line[last:]))
+	return sb.String()
+}
+
+func renderLink(href, text string) string {
+	return `<a href="` + html.EscapeString(href) + `" rel="` + linkRel + `">` + html.EscapeString(text) + `</a>`
+}
+
+func renderImage(alt, src string, cfg *Config) string {
+	switch cfg.ImagePolicy {
+	case ImagePolicyProxy:
+		src = cfg.ImageProxy + url.QueryEscape(src)
+	case ImagePolicyAllowlist:
+		if !hostAllowed(src, cfg.ImageDomains) {
+			return html.EscapeString(alt)
+		}
+	default:
+		return html.EscapeString(alt)
+	}
+	return `<img src="` + html.EscapeString(src) + `" alt="` + html.EscapeString(alt) + `" loading="lazy" referrerpolicy="no-referrer">`
+}
+
+func renderEmbed(src string) string {
+	return `<iframe src="` + html.EscapeString(src) + `" sandbox="allow-scripts allow-same-origin" loading="lazy" referrerpolicy="no-referrer"></iframe>` + "\n"
+}
+
+// hostAllowed reports whether rawURL's host is one of domains or a subdomain
+// of one.
+func hostAllowed(rawURL string, domains []string) bool {
+	if len(domains) == 0 {
+		return false
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, d := range domains {
+		if host == d || strings.HasSuffix(host, "."+d) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// maxReputationPoints caps how bad a reputation can get, so an address that
+// kept hammering the form recovers within a few half-lives of stopping.
+const maxReputationPoints = 10
+
+// reputationCleanupInterval is how often fully decayed entries are dropped.
+const reputationCleanupInterval = time.Hour
+
+// Reputation tracks how submitters have behaved recently. Each spam
+// rejection adds a point to the submitter's IP, and to its network
+// (autonomous system) if STATICOMMENT_ASN_DB is set; each accepted comment
+// takes one away. Points decay by half every STATICOMMENT_REPUTATION_HALF_LIFE
+// hours. The points, multiplied by their weights, are added to the rule
+// score, so repeat offenders reach the quarantine and reject thresholds
+// sooner. State is kept in memory and resets on restart.
+type Reputation struct {
+	halfLife  time.Duration
+	weight    int
+	asnWeight int
+	asn       *maxminddb.Reader
+
+	mu      sync.Mutex
+	entries map[string]*reputationEntry
+}
+
+type reputationEntry struct {
+	points  float64
+	updated time.Time
+}
+
+// asnRecord is the part of a GeoLite2-ASN or compatible record we read.
+type asnRecord struct {
+	ASN uint `maxminddb:"autonomous_system_number"`
+}
+
+// NewReputation opens the ASN database, if configured, and starts tracking.
+func NewReputation(cfg *Config) (*Reputation, error) {
+	rep := &Reputation{
+		halfLife:  time.Duration(cfg.ReputationHalfLife) * time.Hour,
+		weight:    cfg.ReputationWeight,
+		asnWeight: cfg.ReputationASNWeight,
+		entries:   make(map[string]*reputationEntry),
+	}
+	if cfg.ASNDB != "" {
+		db, err := maxminddb.Open(cfg.ASNDB)
+		if err != nil {
+			return nil, fmt.Errorf("opening ASN database: %w", err)
+		}
+		rep.asn = db
+	}
+	go rep.cleanup()
+	return rep, nil
+}
+
+// Score returns what ip's recent history adds to a submission's rule score.
+func (rep *Reputation) Score(ip string) int {
+	keys := rep.keys(ip)
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	now := time.Now()
+	score := rep.pointsLocked(keys.ip, now) * float64(rep.weight)
+	if keys.asn != "" {
+		score += rep.pointsLocked(keys.asn, now) * float64(rep.asnWeight)
+	}
+	return int(math.Round(score))
+}
+
+// HandleEvent records spam rejections against, and accepted comments for,
+// the submitter's IP and network.
+func (rep *Reputation) HandleEvent(e Event) {
+	var delta float64
+	switch {
+	case e.Type == EventRejected && e.Category == CategorySpam:
+		delta = 1
+	case e.Type == EventAccepted:
+		delta = -1
+	default:
+		return
+	}
+	if e.IP == "" {
+		return
+	}
+	keys := rep.keys(e.IP)
+	rep.mu.Lock()
+	defer rep.mu.Unlock()
+	rep.addLocked(keys.ip, delta, e.Time)
+	if keys.asn != "" {
+		rep.addLocked(keys.asn, delta, e.Time)
+	}
+}
+
+type reputationKeys struct {
+	ip  string
+	asn string
+}
+
+// keys returns the entries ip counts towards. The network is only known
+// with an ASN database.
+func (rep *Reputation) keys(ip string) reputationKeys {
+	keys := reputationKeys{ip: "ip:" + ip}
+	if rep.asn == nil {
+		return keys
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return keys
+	}
+	var rec asnRecord
+	if err := rep.asn.Lookup(addr, &rec); err == nil && rec.ASN != 0 {
+		keys.asn = "asn:" + strconv.FormatUint(uint64(rec.ASN), 10)
+	}
+	return keys
+}
+
+// pointsLocked returns key's points decayed to now.
+func (rep *Reputation) pointsLocked(key string, now time.Time) float64 {
+	entry, ok := rep.entries[key]
+	if !ok {
+		return 0
+	}
+	return entry.points * math.Exp2(-now.Sub(entry.updated).Hours()/rep.halfLife.Hours())
+}
+
+// addLocked adds delta to key's decayed points, keeping them between 0 and
+// maxReputationPoints: good behaviour pays off past rejections but doesn't
+// build up credit a spammer could spend later.
+func (rep *Reputation) addLocked(key string, delta float64, now time.Time) {
+	points := math.Min(math.Max(rep.pointsLocked(key, now)+delta, 0), maxReputationPoints)
+	if points == 0 {
+		delete(rep.entries, key)
+		return
+	}
+	rep.entries[key] = &reputationEntry{points: points, updated: now}
+}
+
+// cleanup periodically drops entries that have decayed to nothing.
+func (rep *Reputation) cleanup() {
+	ticker := time.NewTicker(reputationCleanupInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		rep.mu.Lock()
+		now := time.Now()
+		for key := range rep.entries {
+			if rep.pointsLocked(key, now) < 0.05 {
+				delete(rep.entries, key)
+			}
+		}
+		rep.mu.Unlock()
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"html"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// formError is a submission turned away, as reported to the visitor: a
+// human-readable message, a machine-readable code (the rejection reason)
+// and, where the problem is with particular fields, one entry per field.
+type formError struct {
+	Status  int
+	Code    string
+	Message string
+	Fields  []fieldError
+}
+
+// fieldError is a problem with one form field. For the fields a visitor
+// fills in, Href links to the input, whose id is STATICOMMENT_FIELD_ID_PREFIX
+// followed by the field name; hidden fields have no link.
+type fieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Href    string `json:"href,omitempty"`
+}
+
+// visibleFields are the form inputs a visitor fills in.
+var visibleFields = map[string]bool{"name": true, "email": true, "body": true}
+
+// newFormError returns a 400 formError for the given fields.
+func newFormError(code, msg string, fields ...fieldError) formError {
+	return formError{Status: http.StatusBadRequest, Code: code, Message: msg, Fields: fields}
+}
+
+// serverError is a failure on our side while handling a legitimate
+// submission; code is the failing stage.
+func serverError(code, msg string) formError {
+	return formError{Status: http.StatusInternalServerError, Code: code, Message: msg}
+}
+
+func field(name, code, msg string) fieldError {
+	return fieldError{Field: name, Code: code, Message: msg}
+}
+
+// requiredFields reports each missing required field separately, so the
+// visitor is told about all of them at once.
+func requiredFields(name, body, slug, redirectURL string) formError {
+	var fields []fieldError
+	if name == "" {
+		fields = append(fields, field("name", "required", "Enter your name"))
+	}
+	if body == "" {
+		fields = append(fields, field("body", "required", "Enter a comment"))
+	}
+	if slug == "" {
+		fields = append(fields, field("slug", "required", "The form is missing the post slug"))
+	}
+	if redirectURL == "" {
+		fields = append(fields, field("url", "required", "The form is missing the return URL"))
+	}
+	return newFormError("missing_fields", "Missing required fields (name, body, slug, url)", fields...)
+}
+
+// wantsJSON reports whether the client asked for a JSON response rather
+// than a redirect, e.g. a form submitted with fetch.
+func wantsJSON(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "application/json")
+}
+
+// errorResponse reports a rejected submission: as JSON if the client asked
+// for it, otherwise by redirecting back to the post with the error in the
+// query string:
+//
+//	?comment_error=<message>&comment_error_code=<code>&comment_error_<field>=<message>
+func (h *CommentHandler) errorResponse(w http.ResponseWriter, r *http.Request, redirectURL string, fe formError) {
+	if retryableCodes[fe.Code] {
+		allowRetry(r)
+	}
+	if wantsJSON(r) {
+		h.writeErrorJSON(w, r, fe)
+		return
+	}
+	if redirectURL != "" {
+		u, err := url.Parse(redirectURL)
+		if err == nil {
+			q := u.Query()
+			q.Set("comment_error", fe.Message)
+			q.Set("comment_error_code", fe.Code)
+			for _, f := range fe.Fields {
+				q.Set("comment_error_"+f.Field, f.Message)
+			}
+			u.RawQuery = q.Encode()
+			http.Redirect(w, r, u.String(), http.StatusSeeOther)
+			return
+		}
+	}
+	http.Error(w, fe.Message, fe.Status)
+}
+
+// plainError reports a submission that is refused outright rather than
+// redirected (forbidden origins, bans, rate limits): as JSON if the client
+// asked for it, otherwise as plain text.
+func (h *CommentHandler) plainError(w http.ResponseWriter, r *http.Request, fe formError) {
+	if wantsJSON(r) {
+		h.writeErrorJSON(w, r, fe)
+		return
+	}
+	http.Error(w, fe.Message, fe.Status)
+}
+
+func (h *CommentHandler) writeErrorJSON(w http.ResponseWriter, r *http.Request, fe formError) {
+	fields := make([]fieldError, len(fe.Fields))
+	for i, f := range fe.Fields {
+		if visibleFields[f.Field] {
+			f.Href = "#" + h.cfg.FieldIDPrefix + f.Field
+		}
+		fields[i] = f
+	}
+	fe.Fields = fields
+	allowCORS(w, r, h.origins)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(fe.Status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":       "error",
+		"code":         fe.Code,
+		"message":      fe.Message,
+		"errors":       fe.Fields,
+		"summary_html": errorSummaryHTML(fe),
+	})
+}
+
+// errorSummaryHTML renders an error summary that screen readers announce
+// on insertion, with each field's message linking to its input.
+func errorSummaryHTML(fe formError) string {
+	var sb strings.Builder
+	sb.WriteString(`<div class="staticomment-error-summary" role="alert" tabindex="-1" aria-labelledby="staticomment-error-title">`)
+	sb.WriteString(`<h2 id="staticomment-error-title">There is a problem with your comment</h2><ul>`)
+	if len(fe.Fields) == 0 {
+		sb.WriteString("<li>" + html.EscapeString(fe.Message) + "</li>")
+	}
+	for _, f := range fe.Fields {
+		if f.Href == "" {
+			sb.WriteString("<li>" + html.EscapeString(f.Message) + "</li>")
+			continue
+		}
+		sb.WriteString(`<li><a href="` + html.EscapeString(f.Href) + `">` + html.EscapeString(f.Message) + "</a></li>")
+	}
+	sb.WriteString("</ul></div>")
+	return sb.String()
+}
+
+// successResponse sends the visitor back to the post, or for JSON clients
+// reports the outcome ("submitted", "pending" or "pending_moderation") along
+// with the URL the redirect would have gone to. With asynchronous publishing
+// JSON clients get 202, since nothing has been pushed yet.
+func (h *CommentHandler) successResponse(w http.ResponseWriter, r *http.Request, redirectURL, fragment string) {
+	u, err := url.Parse(redirectURL)
+	if err != nil {
+		http.Error(w, "Bad redirect URL", http.StatusBadRequest)
+		return
+	}
+	u.Fragment = fragment
+	if wantsJSON(r) {
+		allowCORS(w, r, h.origins)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		status := strings.ReplaceAll(strings.TrimPrefix(fragment, "comment-"), "-", "_")
+		if h.cfg.AsyncPublish {
+			w.WriteHeader(http.StatusAccepted)
+		}
+		json.NewEncoder(w).Encode(map[string]string{"status": status, "redirect": u.String()})
+		return
+	}
+	http.Redirect(w, r, u.String(), http.StatusSeeOther)
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Review request APIs selected by STATICOMMENT_PR_PROVIDER.
+const (
+	ProviderGitHub = "github" // GitHub pulls API, also served by Gitea and Forgejo
+	ProviderGitLab = "gitlab" // GitLab merge requests API
+)
+
+// ReviewRequester opens a review request (pull request) asking for branch to
+// be merged into base, returning its URL.
+type ReviewRequester interface {
+	Open(branch, base, title, body string) (string, error)
+}
+
+// newReviewRequester returns the configured provider's ReviewRequester.
+func newReviewRequester(cfg *Config) ReviewRequester {
+	if cfg.PRProvider == ProviderGitLab {
+		return newGitLabMergeRequests(cfg.PRAPI, cfg.PRRepo, cfg.PRToken, cfg.PRLabels)
+	}
+	return newGitHubPulls(cfg.PRAPI, cfg.PRRepo, func() (string, error) { return cfg.apiToken(cfg.PRToken) })
+}
+
+// githubPulls opens pull requests through the GitHub REST API. Gitea and
+// Forgejo serve the same endpoint under /api/v1, so they work too.
+type githubPulls struct {
+	api    string
+	repo   string
+	token  func() (string, error)
+	client *http.Client
+}
+
+func newGitHubPulls(api, repo string, token func() (string, error)) *githubPulls {
+	return &githubPulls{
+		api:    strings.TrimSuffix(api, "/"),
+		repo:   repo,
+		token:  token,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (g *githubPulls) Open(branch, base, title, body string) (string, error) {
+	payload, err := json.Marshal(map[string]string{"title": title, "head": branch, "base": base, "body": body})
+	if err != nil {
+		return "", err
+	}
+	token, err := g.token()
+	if err != nil {
+		return "", fmt.Errorf("opening pull request: %w", err)
+	}
+	req, err := http.NewRequest(http.MethodPost, g.api+"/repos/"+g.repo+"/pulls", bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "token "+token)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("opening pull request: %w", err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+
+	switch {
+	case resp.StatusCode == http.StatusUnprocessableEntity && bytes.Contains(data, []byte("already exists")),
+		resp.StatusCode == http.StatusConflict:
+		// A retried job whose pull request was opened the first time
+		return "", nil
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return "", fmt.Errorf("opening pull request: %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	var pr struct {
+		HTMLURL string `json:"html_url"`
+	}
+	if err := json.Unmarshal(data, &pr); err != nil {
+		return "", fmt.Errorf("parsing pull request response: %w", err)
+	}
+	return pr.HTMLURL, nil
+}
+
+// gitlabMergeRequests opens merge requests through the GitLab REST API. The
+// source branch is deleted when the merge request is merged, so review
+// branches don't pile up.
+type gitlabMergeRequests struct {
+	api     string
+	project string
+	token   string
+	labels  []string
+	client  *http.Client
+}
+
+func newGitLabMergeRequests(api, project, token string, labels []string) *gitlabMergeRequests {
+	return &gitlabMergeRequests{
+		api:     strings.TrimSuffix(api, "/"),
+		project: project,
+		token:   token,
+		labels:  labels,
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (g *gitlabMergeRequests) Open(branch, base, title, body string) (string, error) {
+	payload, err := json.Marshal(map[string]any{
+		"source_branch":        branch,
+		"target_branch":        base,
+		"title":                title,
+		"description":          body,
+		"labels":               strings.Join(g.labels, ","),
+		"remove_source_branch": true,
+	})
+	if err != nil {
+		return "", err
+	}
+	// The project is addressed by its URL-encoded path, e.g. group%2Fsite
+	endpoint := g.api + "/projects/" + url.PathEscape(g.project) + "/merge_requests"
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("PRIVATE-TOKEN", g.token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("opening merge request: %w", err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+
+	switch {
+	case resp.StatusCode == http.StatusConflict:
+		// A retried job whose merge request was opened the first time
+		return "", nil
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return "", fmt.Errorf("opening merge request: %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+	var mr struct {
+		WebURL string `json:"web_url"`
+	}
+	if err := json.Unmarshal(data, &mr); err != nil {
+		return "", fmt.Errorf("parsing merge request response: %w", err)
+	}
+	return mr.WebURL, nil
+}
+
+// repoPath extracts "owner/name" from an SSH or HTTPS git remote URL.
+func repoPath(remote string) string {
+	var path string
+	if strings.Contains(remote, "@") && strings.Contains(remote, ":") && !strings.Contains(remote, "://") {
+		path = strings.SplitN(remote, ":", 2)[1]
+	} else if u, err := url.Parse(remote); err == nil {
+		path = u.Path
+	}
+	return strings.TrimSuffix(strings.Trim(path, "/"), ".git")
+}
+
+// reviewBranch is the branch a moderated comment is pushed to.
+func reviewBranch(prefix string, c Comment, relPath string) string {
+	return prefix + c.Slug + "-" + commentID(relPath)
+}
+
+// reviewPreviewLen is how much of a comment's body its pull request shows.
+const reviewPreviewLen = 2000
+
+// reviewDescription is the pull request body for a moderated comment: a
+// table of who commented where, the body, and how its spam score was made
+// up, so reviewers needn't read the YAML diff. Everything the commenter
+// wrote is shown as code, so mentions, links and images in it do nothing.
+func reviewDescription(job *PublishJob, postTitle string) string {
+	c := job.Comment
+	var sb strings.Builder
+	sb.WriteString("New comment for review.\n\n| | |\n|---|---|\n")
+	if postTitle != "" {
+		fmt.Fprintf(&sb, "| Post | %s (`%s`) |\n", markdownCell(postTitle), c.Slug)
+	} else {
+		fmt.Fprintf(&sb, "| Post | `%s` |\n", c.Slug)
+	}
+	fmt.Fprintf(&sb, "| Author | %s |\n", codeSpan(c.Name))
+	fmt.Fprintf(&sb, "| Date | %s |\n", c.Date)
+	if c.ReplyTo != "" {
+		fmt.Fprintf(&sb, "| Replying to | `%s` |\n", c.ReplyTo)
+	}
+	if c.Lang != "" {
+		fmt.Fprintf(&sb, "| Language | %s |\n", codeSpan(c.Lang))
+	}
+	fmt.Fprintf(&sb, "| File | `%s` |\n\n", job.Path)
+
+	body := c.Body
+	if n := utf8.RuneCountInString(body); n > reviewPreviewLen {
+		body = string([]rune(body)[:reviewPreviewLen])
+		fmt.Fprintf(&sb, "**Comment** (first %d of %d characters):\n\n", reviewPreviewLen, n)
+	} else {
+		sb.WriteString("**Comment:**\n\n")
+	}
+	// A fence longer than any run of backticks in the body can't be closed
+	// by it
+	fence := "```"
+	for strings.Contains(body, fence) {
+		fence += "`"
+	}
+	fmt.Fprintf(&sb, "%stext\n%s\n%s\n\n", fence, body, fence)
+
+	total := 0
+	for _, s := range job.Scores {
+		total += s.Score
+	}
+	if len(job.Scores) == 0 {
+		sb.WriteString("**Spam score:** 0, no score rules matched.\n\n")
+	} else {
+		fmt.Fprintf(&sb, "**Spam score:** %d\n\n| Source | Score |\n|---|---:|\n", total)
+		for _, s := range job.Scores {
+			fmt.Fprintf(&sb, "| %s | %+d |\n", codeSpan(s.Name), s.Score)
+		}
+		sb.WriteString("\n")
+	}
+	sb.WriteString("Merge to publish, or close to reject.\n")
+	return sb.String()
+}
+
+// codeSpan formats s as inline code that's safe in a table cell.
+func codeSpan(s string) string {
+	s = strings.NewReplacer("`", "'", "|", "\\|", "\n", " ", "\r", " ").Replace(s)
+	return "`" + s + "`"
+}
+
+// markdownCell escapes s, text from the repo rather than the commenter, for
+// a table cell.
+func markdownCell(s string) string {
+	return strings.NewReplacer("|", "\\|", "\n", " ", "\r", " ").Replace(s)
+}
+
+// postTitle returns the title in the front matter of slug's post under
+// STATICOMMENT_POSTS_PATH, or "" if it can't be found.
+func (p *Publisher) postTitle(slug string) string {
+	if p.cfg.PostsPath == "" {
+		return ""
+	}
+	path, err := findPost(p.posts.FullPath(p.cfg.PostsPath), slug)
+	if err != nil || path == "" {
+		return ""
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return frontMatterTitle(data)
+}
+
+// frontMatterTitle returns the title from a post's YAML front matter, as
+// used by Jekyll and Hugo, or "" if it has none.
+func frontMatterTitle(data []byte) string {
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	rest, ok := bytes.CutPrefix(data, []byte("---\n"))
+	if !ok {
+		return ""
+	}
+	front, _, ok := bytes.Cut(rest, []byte("\n---"))
+	if !ok {
+		return ""
+	}
+	var meta struct {
+		Title string `yaml:"title"`
+	}
+	if err := yaml.Unmarshal(front, &meta); err != nil {
+		return ""
+	}
+	return strings.TrimSpace(meta.Title)
+}
+
+// parseReviewBranch splits a branch made by reviewBranch back into the slug
+// and comment id. Comment ids are "<timestamp>-<random>", so the id is the
+// last two dash-separated parts and the slug is the rest.
+func parseReviewBranch(prefix, branch string) (slug, id string, ok bool) {
+	rest, found := strings.CutPrefix(branch, prefix)
+	if !found {
+		return "", "", false
+	}
+	parts := strings.Split(rest, "-")
+	if len(parts) < 3 {
+		return "", "", false
+	}
+	slug = strings.Join(parts[:len(parts)-2], "-")
+	id = strings.Join(parts[len(parts)-2:], "-")
+	if !isValidSlug(slug) || !isValidSlug(id) {
+		return "", "", false
+	}
+	return slug, id, true
+}
+
+// mergeRequestEvent is the part of GitLab's merge request hook payload we
+// read.
+type mergeRequestEvent struct {
+	ObjectKind       string `json:"object_kind"`
+	ObjectAttributes struct {
+		Action       string `json:"action"`
+		URL          string `json:"url"`
+		SourceBranch string `json:"source_branch"`
+		TargetBranch string `json:"target_branch"`
+	} `json:"object_attributes"`
+}
+
+// pullRequestEvent is the part of GitHub's pull_request payload we read.
+type pullRequestEvent struct {
+	Action      string `json:"action"`
+	PullRequest struct {
+		HTMLURL string `json:"html_url"`
+		Merged  bool   `json:"merged"`
+		Head    struct {
+			Ref string `json:"ref"`
+		} `json:"head"`
+		Base struct {
+			Ref string `json:"ref"`
+		} `json:"base"`
+	} `json:"pull_request"`
+}
+
+// ReviewWatcher completes moderation when a comment's pull request is
+// closed, delivered as pull_request events to POST /webhooks/github. A
+// merged comment is added to the index and published like a directly
+// committed one, so reply notifications and the notification webhook fire;
+// a comment closed without merging is only logged.
+type ReviewWatcher struct {
+	cfg       *Config
+	publisher *Publisher
+}
+
+func NewReviewWatcher(cfg *Config, publisher *Publisher) *ReviewWatcher {
+	return &ReviewWatcher{cfg: cfg, publisher: publisher}
+}
+
+// HandlePullRequest handles pull_request webhook deliveries. Anything but
+// the closing of one of our pull requests is ignored.
+func (rw *ReviewWatcher) HandlePullRequest(w http.ResponseWriter, payload []byte) {
+	var ev pullRequestEvent
+	if err := json.Unmarshal(payload, &ev); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	pr := ev.PullRequest
+	slug, id, ok := parseReviewBranch(rw.cfg.ModerationPrefix, pr.Head.Ref)
+	if ev.Action != "closed" || pr.Base.Ref != rw.cfg.Branch || !ok {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if !pr.Merged {
+		log.Printf("moderated comment rejected: %s closed without merging %s", pr.HTMLURL, pr.Head.Ref)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err := rw.publisher.PublishMerged(slug, id); err != nil {
+		log.Printf("error publishing merged comment %s/%s: %v", slug, id, err)
+		http.Error(w, "Failed to publish comment", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleMergeRequest handles GitLab merge request hook deliveries, as
+// HandlePullRequest does pull requests: anything but the merging or closing
+// of one of our merge requests is ignored.
+func (rw *ReviewWatcher) HandleMergeRequest(w http.ResponseWriter, payload []byte) {
+	var ev mergeRequestEvent
+	if err := json.Unmarshal(payload, &ev); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	mr := ev.ObjectAttributes
+	slug, id, ok := parseReviewBranch(rw.cfg.ModerationPrefix, mr.SourceBranch)
+	if ev.ObjectKind != "merge_request" || (mr.Action != "merge" && mr.Action != "close") || mr.TargetBranch != rw.cfg.Branch || !ok {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if mr.Action == "close" {
+		log.Printf("moderated comment rejected: %s closed without merging %s", mr.URL, mr.SourceBranch)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err := rw.publisher.PublishMerged(slug, id); err != nil {
+		log.Printf("error publishing merged comment %s/%s: %v", slug, id, err)
+		http.Error(w, "Failed to publish comment", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
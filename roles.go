@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Role is what an admin identity may do. Each role can do everything the
+// ones before it can.
+type Role int
+
+const (
+	// RoleViewer can read reports, dead letters, the outbox, the spam
+	// classifier's stats and scores, and the maintenance state.
+	RoleViewer Role = iota + 1
+	// RoleModerator can also approve, reject and delete comments, reply as
+	// the site owner, and train the spam classifier.
+	RoleModerator
+	// RoleAdmin can also switch maintenance mode, retry and discard outbox
+	// entries, and reclone the repo.
+	RoleAdmin
+)
+
+var roleNames = map[Role]string{RoleViewer: "viewer", RoleModerator: "moderator", RoleAdmin: "admin"}
+
+func (r Role) String() string {
+	return roleNames[r]
+}
+
+func (r Role) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func parseRole(s string) (Role, error) {
+	for r, name := range roleNames {
+		if s == name {
+			return r, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown role %q (want viewer, moderator or admin)", s)
+}
+
+// AdminUser is one entry of STATICOMMENT_ADMIN_USERS_FILE: an identity with
+// its role, recognized by a bearer token, stored as is or as its SHA-256
+// hex digest, or by the verified email or subject of an OIDC ID token.
+type AdminUser struct {
+	Name        string `yaml:"name"`
+	Role        string `yaml:"role"`
+	Token       string `yaml:"token,omitempty"`
+	TokenSHA256 string `yaml:"token_sha256,omitempty"`
+	Email       string `yaml:"email,omitempty"`
+	Subject     string `yaml:"subject,omitempty"`
+
+	role      Role
+	tokenHash []byte
+}
+
+// LoadAdminUsers reads the admin users file.
+func LoadAdminUsers(path string) ([]*AdminUser, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading admin users: %w", err)
+	}
+	var users []*AdminUser
+	if err := yaml.Unmarshal(data, &users); err != nil {
+		return nil, fmt.Errorf("parsing admin users: %w", err)
+	}
+	seen := make(map[string]bool)
+	for i, u := range users {
+		if u.Name == "" {
+			return nil, fmt.Errorf("user %d: name is required", i+1)
+		}
+		if seen[u.Name] {
+			return nil, fmt.Errorf("user %q: listed twice", u.Name)
+		}
+		seen[u.Name] = true
+		if u.role, err = parseRole(u.Role); err != nil {
+			return nil, fmt.Errorf("user %q: %w", u.Name, err)
+		}
+		switch {
+		case u.Token != "" && u.TokenSHA256 != "":
+			return nil, fmt.Errorf("user %q: set token or token_sha256, not both", u.Name)
+		case u.Token != "":
+			sum := sha256.Sum256([]byte(u.Token))
+			u.tokenHash = sum[:]
+		case u.TokenSHA256 != "":
+			if u.tokenHash, err = hex.DecodeString(u.TokenSHA256); err != nil || len(u.tokenHash) != sha256.Size {
+				return nil, fmt.Errorf("user %q: token_sha256 must be a SHA-256 hex digest", u.Name)
+			}
+		case u.Email == "" && u.Subject == "":
+			return nil, fmt.Errorf("user %q: needs a token, token_sha256, email or subject", u.Name)
+		}
+		u.Email = strings.ToLower(u.Email)
+	}
+	return users, nil
+}
+
+// AdminIdentity is who an admin API request was made by.
+type AdminIdentity struct {
+	Name string `json:"name"`
+	Role Role   `json:"role"`
+}
+
+type adminIdentityKey struct{}
+
+// adminIdentity returns the identity AdminAuth found for r.
+func adminIdentity(r *http.Request) AdminIdentity {
+	id, _ := r.Context().Value(adminIdentityKey{}).(AdminIdentity)
+	return id
+}
+
+// AdminAuth identifies admin API requests by their bearer token:
+// STATICOMMENT_ADMIN_TOKEN and time-based tokens have the admin role, and
+// the users in STATICOMMENT_ADMIN_USERS_FILE the role they're given there,
+// whether by token or by OIDC ID token. With OIDC login configured, users
+// can also sign in with a browser and are identified by a session cookie.
+type AdminAuth struct {
+	cfg        *Config
+	users      []*AdminUser
+	oidc       *OIDCVerifier
+	sessionKey []byte
+}
+
+// NewAdminAuth returns the admin API's authentication, or nil if no way to
+// authenticate is configured.
+func NewAdminAuth(cfg *Config) *AdminAuth {
+	if cfg.AdminToken == "" && cfg.AdminTOTPSecret == "" && len(cfg.AdminUsers) == 0 {
+		return nil
+	}
+	a := &AdminAuth{cfg: cfg, users: cfg.AdminUsers}
+	if cfg.AdminOIDCIssuer != "" {
+		a.oidc = NewOIDCVerifier(cfg.AdminOIDCIssuer, cfg.AdminOIDCAudience)
+	}
+	if cfg.AdminOIDCRedirectURL != "" {
+		// Without a configured secret sessions end when the server restarts
+		a.sessionKey = []byte(cfg.AdminSessionSecret)
+		if len(a.sessionKey) == 0 {
+			a.sessionKey = make([]byte, 32)
+			if _, err := rand.Read(a.sessionKey); err != nil {
+				log.Fatalf("admin: generating session key: %v", err)
+			}
+		}
+	}
+	return a
+}
+
+// identify returns the identity token belongs to.
+func (a *AdminAuth) identify(token string) (AdminIdentity, bool) {
+	if token == "" {
+		return AdminIdentity{}, false
+	}
+	if a.cfg.AdminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.cfg.AdminToken)) == 1 {
+		return AdminIdentity{Name: "admin token", Role: RoleAdmin}, true
+	}
+	if a.cfg.AdminTOTPSecret != "" && validAdminTimeToken(a.cfg.AdminTOTPSecret, time.Duration(a.cfg.AdminTOTPPeriod)*time.Second, token, time.Now()) {
+		return AdminIdentity{Name: "time-based token", Role: RoleAdmin}, true
+	}
+	hash := sha256.Sum256([]byte(token))
+	for _, u := range a.users {
+		if u.tokenHash != nil && subtle.ConstantTimeCompare(hash[:], u.tokenHash) == 1 {
+			return AdminIdentity{Name: u.Name, Role: u.role}, true
+		}
+	}
+	if a.oidc == nil || strings.Count(token, ".") != 2 {
+		return AdminIdentity{}, false
+	}
+	claims, err := a.oidc.Verify(token)
+	if err != nil {
+		log.Printf("admin: rejected ID token: %v", err)
+		return AdminIdentity{}, false
+	}
+	return a.userForClaims(claims)
+}
+
+// userForClaims returns the admin user an ID token's claims identify.
+func (a *AdminAuth) userForClaims(claims *OIDCClaims) (AdminIdentity, bool) {
+	for _, u := range a.users {
+		if (u.Subject != "" && u.Subject == claims.Subject) ||
+			(u.Email != "" && claims.EmailIsVerified() && u.Email == strings.ToLower(claims.Email)) {
+			return AdminIdentity{Name: u.Name, Role: u.role}, true
+		}
+	}
+	log.Printf("admin: ID token for %s (%s) matches no admin user", claims.Subject, claims.Email)
+	return AdminIdentity{}, false
+}
+
+// Wrap passes identified requests on to next, with their identity in the
+// context, and turns the rest away with 401, or sends browsers to log in
+// when OIDC login is configured. Requests that change something are logged
+// with who made them.
+func (a *AdminAuth) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		id, ok := a.identify(token)
+		if !ok && token == "" {
+			// The session cookie is SameSite=Strict, but older browsers
+			// ignore that, so cross-site requests are refused outright
+			if id, ok = a.sessionIdentity(r); ok && r.Header.Get("Sec-Fetch-Site") == "cross-site" {
+				http.Error(w, "Forbidden: cross-site request", http.StatusForbidden)
+				return
+			}
+		}
+		if !ok {
+			if a.sessionKey != nil && r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+				http.Redirect(w, r, "/admin/login?return="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+				return
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer realm="staticomment admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			log.Printf("admin: %s %s by %s (%s)", r.Method, r.URL.Path, id.Name, id.Role)
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminIdentityKey{}, id)))
+	})
+}
+
+// requireRole passes requests from identities with at least role on to
+// next and answers the rest with 403.
+func requireRole(role Role, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if adminIdentity(r).Role < role {
+			http.Error(w, "Forbidden: needs the "+role.String()+" role", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Rule actions. Allow, deny and quarantine stop evaluation at the first
+// matching rule; score rules accumulate and evaluation continues.
+const (
+	ActionAllow      = "allow"
+	ActionDeny       = "deny"
+	ActionQuarantine = "quarantine"
+	ActionScore      = "score"
+)
+
+// Rule is one entry of the rules file. Every condition that is set must
+// match (AND); within a condition, any listed value may match (OR).
+type Rule struct {
+	Name   string    `yaml:"name"`
+	Match  RuleMatch `yaml:"match"`
+	Action string    `yaml:"action"`
+	Score  int       `yaml:"score,omitempty"`
+
+	ipNets []*net.IPNet
+	email  []*regexp.Regexp
+	name   []*regexp.Regexp
+	body   []*regexp.Regexp
+}
+
+// RuleMatch lists the conditions a rule can test. IPs accept single
+// addresses or CIDR ranges; email, name and body are case-insensitive
+// regular expressions; origins are compared exactly.
+type RuleMatch struct {
+	IP     []string `yaml:"ip,omitempty"`
+	Email  []string `yaml:"email,omitempty"`
+	Name   []string `yaml:"name,omitempty"`
+	Body   []string `yaml:"body,omitempty"`
+	Origin []string `yaml:"origin,omitempty"`
+}
+
+// Submission is the subset of a request the rules engine looks at.
+type Submission struct {
+	IP     string
+	Email  string
+	Name   string
+	Body   string
+	Origin string
+}
+
+// Verdict is the outcome of evaluating the ruleset against a submission.
+// Action is empty when no terminal rule matched.
+type Verdict struct {
+	Action string
+	Rule   string
+	Score  int
+	Scores []ScoreItem
+}
+
+// ScoreItem is one contribution to a verdict's score: a score rule that
+// matched, or the submitter's reputation.
+type ScoreItem struct {
+	Name  string `json:"name" yaml:"name"`
+	Score int    `json:"score" yaml:"score"`
+}
+
+// Ruleset is an ordered list of rules loaded from STATICOMMENT_RULES_FILE.
+type Ruleset struct {
+	Rules []*Rule
+}
+
+// LoadRules reads and compiles a YAML rules file.
+func LoadRules(path string) (*Ruleset, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading rules file: %w", err)
+	}
+	var rules []*Rule
+	if err := yaml.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("parsing rules file: %w", err)
+	}
+	for i, r := range rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule-%d", i+1)
+		}
+		if err := r.compile(); err != nil {
+			return nil, fmt.Errorf("rule %q: %w", r.Name, err)
+		}
+	}
+	return &Ruleset{Rules: rules}, nil
+}
+
+func (r *Rule) compile() error {
+	switch r.Action {
+	case ActionAllow, ActionDeny, ActionQuarantine:
+	case ActionScore:
+		if r.Score == 0 {
+			return fmt.Errorf("score action requires a non-zero score")
+		}
+	default:
+		return fmt.Errorf("unknown action %q (must be allow, deny, quarantine or score)", r.Action)
+	}
+
+	for _, s := range r.Match.IP {
+		ipNet, err := parseIPOrCIDR(s)
+		if err != nil {
+			return err
+		}
+		r.ipNets = append(r.ipNets, ipNet)
+	}
+
+	var err error
+	if r.email, err = compilePatterns(r.Match.Email); err != nil {
+		return err
+	}
+	if r.name, err = compilePatterns(r.Match.Name); err != nil {
+		return err
+	}
+	if r.body, err = compilePatterns(r.Match.Body); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parseIPOrCIDR accepts "192.0.2.1" or "192.0.2.0/24" and returns a network.
+func parseIPOrCIDR(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		_, ipNet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", s)
+		}
+		return ipNet, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid IP %q", s)
+	}
+	bits := 128
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+func compilePatterns(patterns []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, p := range patterns {
+		re, err := regexp.Compile("(?i)" + p)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %q: %w", p, err)
+		}
+		res = append(res, re)
+	}
+	return res, nil
+}
+
+func (r *Rule) matches(s Submission) bool {
+	if len(r.ipNets) > 0 {
+		ip := net.ParseIP(s.IP)
+		if ip == nil || !anyNetContains(r.ipNets, ip) {
+			return false
+		}
+	}
+	if len(r.email) > 0 && !anyPatternMatches(r.email, s.Email) {
+		return false
+	}
+	if len(r.name) > 0 && !anyPatternMatches(r.name, s.Name) {
+		return false
+	}
+	if len(r.body) > 0 && !anyPatternMatches(r.body, s.Body) {
+		return false
+	}
+	if len(r.Match.Origin) > 0 {
+		found := false
+		for _, o := range r.Match.Origin {
+			if o == s.Origin {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func anyNetContains(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func anyPatternMatches(patterns []*regexp.Regexp, s string) bool {
+	for _, re := range patterns {
+		if re.MatchString(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Evaluate walks the rules in order. The first matching allow, deny or
+// quarantine rule decides the verdict; score rules matched before it add to
+// the verdict's score. A nil ruleset yields an empty verdict.
+func (rs *Ruleset) Evaluate(s Submission) Verdict {
+	var v Verdict
+	if rs == nil {
+		return v
+	}
+	for _, r := range rs.Rules {
+		if !r.matches(s) {
+			continue
+		}
+		if r.Action == ActionScore {
+			v.Score += r.Score
+			v.Scores = append(v.Scores, ScoreItem{Name: r.Name, Score: r.Score})
+			continue
+		}
+		v.Action = r.Action
+		v.Rule = r.Name
+		return v
+	}
+	return v
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+)
+
+// slugPattern matches what isValidSlug accepts, for the schema.
+const slugPattern = `^[A-Za-z0-9_-]+$`
+
+// commentSchema returns the JSON Schema of a stored comment file. It
+// mirrors the Comment struct and the handler's validation, and depends on
+// the configuration only in whether body_html and quoted_excerpt are
+// written.
+func commentSchema(cfg *Config) map[string]any {
+	str := func(description string, keywords map[string]any) map[string]any {
+		prop := map[string]any{"type": "string", "description": description}
+		for k, v := range keywords {
+			prop[k] = v
+		}
+		return prop
+	}
+	props := map[string]any{
+		"name":     str("Commenter's name", map[string]any{"minLength": 1}),
+		"email":    str("Commenter's email address, if given. Private: themes must not render it", map[string]any{"format": "email"}),
+		"body":     str("Comment text as submitted, in plain text", map[string]any{"minLength": 1, "maxLength": defaultMaxBodyLen}),
+		"date":     str("Submission time (UTC)", map[string]any{"format": "date-time"}),
+		"slug":     str("Post the comment belongs to", map[string]any{"pattern": slugPattern}),
+		"reply_to": str("ID (filename without .yml) of the comment this one replies to", map[string]any{"pattern": slugPattern}),
+		"lang":     str("Language tag of the body, e.g. en or pt-BR", map[string]any{"pattern": langPattern.String()}),
+		"dir":      str("Text direction of the body; absent means left to right", map[string]any{"enum": []string{"rtl"}}),
+		"author":   map[string]any{"type": "boolean", "description": "Set on the site owner's own comments; absent otherwise", "const": true},
+	}
+	if cfg.ReplyExcerpt > 0 {
+		props["quoted_excerpt"] = str("Start of the body of the comment replied to, for quoting", map[string]any{"maxLength": cfg.ReplyExcerpt + 1})
+	}
+	if cfg.BodyHTML {
+		props["body_html"] = str("Escaped HTML rendering of the body, safe to output as is", nil)
+	}
+	return map[string]any{
+		"$schema":     "https://json-schema.org/draft/2020-12/schema",
+		"title":       "staticomment comment",
+		"description": "A comment file as committed under the comments path, <slug>/<id>.yml. The files are YAML; this schema applies to their parsed contents.",
+		"type":        "object",
+		"required":    []string{"name", "body", "date", "slug"},
+		"properties":  props,
+	}
+}
+
+// serveSchema handles GET /schema.json.
+func serveSchema(cfg *Config) http.HandlerFunc {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	enc.Encode(commentSchema(cfg))
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/schema+json")
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Write(buf.Bytes())
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	git "github.com/go-git/go-git/v5"
+	"golang.org/x/crypto/ssh"
+)
+
+// Commit signing formats selected by STATICOMMENT_SIGNING_FORMAT, named as
+// in git's gpg.format.
+const (
+	SigningSSH     = "ssh"
+	SigningOpenPGP = "openpgp"
+)
+
+// NewCommitSigner loads STATICOMMENT_SIGNING_KEY for signing commits made
+// with go-git.
+func NewCommitSigner(cfg *Config) (git.Signer, error) {
+	data, err := os.ReadFile(cfg.SigningKey)
+	if err != nil {
+		return nil, fmt.Errorf("reading signing key: %w", err)
+	}
+	if cfg.SigningFormat == SigningOpenPGP {
+		return newOpenPGPSigner(data, cfg.SigningPassphrase)
+	}
+	return newSSHSigner(data, cfg.SigningPassphrase)
+}
+
+// openpgpSigner makes ASCII-armored detached signatures, as gpg does for git.
+type openpgpSigner struct {
+	entity *openpgp.Entity
+}
+
+func newOpenPGPSigner(data []byte, passphrase string) (*openpgpSigner, error) {
+	keys, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("parsing OpenPGP key: %w", err)
+	}
+	entity := keys[0]
+	if entity.PrivateKey == nil {
+		return nil, fmt.Errorf("OpenPGP key has no private key")
+	}
+	if entity.PrivateKey.Encrypted {
+		if err := entity.DecryptPrivateKeys([]byte(passphrase)); err != nil {
+			return nil, fmt.Errorf("decrypting OpenPGP key: %w", err)
+		}
+	}
+	return &openpgpSigner{entity: entity}, nil
+}
+
+func (s *openpgpSigner) Sign(message io.Reader) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := openpgp.ArmoredDetachSign(&buf, s.entity, message, nil); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// sshSigner makes SSH signatures in the SSHSIG format that git (through
+// ssh-keygen -Y sign) uses with gpg.format=ssh.
+type sshSigner struct {
+	signer ssh.Signer
+}
+
+func newSSHSigner(data []byte, passphrase string) (*sshSigner, error) {
+	var signer ssh.Signer
+	var err error
+	if passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(data, []byte(passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing SSH key: %w", err)
+	}
+	return &sshSigner{signer: signer}, nil
+}
+
+// sshsigNamespace is the namespace git signs commits in.
+const sshsigNamespace = "git"
+
+func (s *sshSigner) Sign(message io.Reader) ([]byte, error) {
+	h := sha512.New()
+	if _, err := io.Copy(h, message); err != nil {
+		return nil, err
+	}
+	// The signed data and the signature blob are laid out as in OpenSSH's
+	// PROTOCOL.sshsig
+	signed := append([]byte("SSHSIG"), ssh.Marshal(struct {
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Hash          []byte
+	}{sshsigNamespace, "", "sha512", h.Sum(nil)})...)
+
+	var sig *ssh.Signature
+	var err error
+	if as, ok := s.signer.(ssh.AlgorithmSigner); ok && s.signer.PublicKey().Type() == ssh.KeyAlgoRSA {
+		// SHA-1 RSA signatures aren't accepted by ssh-keygen or GitHub
+		sig, err = as.SignWithAlgorithm(rand.Reader, signed, ssh.KeyAlgoRSASHA512)
+	} else {
+		sig, err = s.signer.Sign(rand.Reader, signed)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	blob := append([]byte("SSHSIG"), ssh.Marshal(struct {
+		Version       uint32
+		PublicKey     []byte
+		Namespace     string
+		Reserved      string
+		HashAlgorithm string
+		Signature     []byte
+	}{1, s.signer.PublicKey().Marshal(), sshsigNamespace, "", "sha512", ssh.Marshal(sig)})...)
+
+	encoded := base64.StdEncoding.EncodeToString(blob)
+	var armored strings.Builder
+	armored.WriteString("-----BEGIN SSH SIGNATURE-----\n")
+	for len(encoded) > 70 {
+		armored.WriteString(encoded[:70] + "\n")
+		encoded = encoded[70:]
+	}
+	armored.WriteString(encoded + "\n-----END SSH SIGNATURE-----\n")
+	return []byte(armored.String()), nil
+}
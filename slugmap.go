@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// SlugMapping takes a post's slug from the path of its URL, for forms that
+// don't carry one: with a pattern, from its "slug" group (or failing that,
+// its first); otherwise by stripping a prefix and one of the suffixes, so
+// that /blog/my-post/, /blog/my-post/index.html and /blog/my-post.html are
+// all my-post.
+type SlugMapping struct {
+	Pattern  *regexp.Regexp
+	Prefix   string
+	Suffixes []string
+}
+
+// LoadSlugMapping reads STATICOMMENT_SLUG_PATTERN, or without one,
+// STATICOMMENT_SLUG_PREFIX and STATICOMMENT_SLUG_SUFFIXES.
+func LoadSlugMapping() (*SlugMapping, error) {
+	m := &SlugMapping{Prefix: os.Getenv("STATICOMMENT_SLUG_PREFIX")}
+	if pattern := os.Getenv("STATICOMMENT_SLUG_PATTERN"); pattern != "" {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("STATICOMMENT_SLUG_PATTERN: invalid regex: %w", err)
+		}
+		if re.NumSubexp() == 0 {
+			return nil, fmt.Errorf("STATICOMMENT_SLUG_PATTERN must have a group capturing the slug")
+		}
+		m.Pattern = re
+	}
+	for _, s := range strings.Split(envOrDefault("STATICOMMENT_SLUG_SUFFIXES", "/index.html,.html,/"), ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			m.Suffixes = append(m.Suffixes, s)
+		}
+	}
+	return m, nil
+}
+
+// Slug returns the slug for the page at pageURL, or "" if its path doesn't
+// fit the mapping.
+func (m *SlugMapping) Slug(pageURL string) string {
+	u, err := url.Parse(pageURL)
+	if err != nil {
+		return ""
+	}
+	path := u.Path
+	if m.Pattern != nil {
+		match := m.Pattern.FindStringSubmatch(path)
+		if match == nil {
+			return ""
+		}
+		if i := m.Pattern.SubexpIndex("slug"); i > 0 {
+			return match[i]
+		}
+		return match[1]
+	}
+	if !strings.HasPrefix(path, m.Prefix) {
+		return ""
+	}
+	path = strings.TrimPrefix(path, m.Prefix)
+	for _, s := range m.Suffixes {
+		if strings.HasSuffix(path, s) {
+			path = strings.TrimSuffix(path, s)
+			break
+		}
+	}
+	return strings.Trim(path, "/")
+}
@@ -7,87 +7,9 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
-// RateLimiter tracks request timestamps per IP for rate limiting.
-type RateLimiter struct {
-	window  time.Duration
-	max     int
-	mu      sync.Mutex
-	entries map[string][]time.Time
-}
-
-// NewRateLimiter creates a rate limiter. If max is 0, limiting is disabled.
-func NewRateLimiter(windowSeconds, max int) *RateLimiter {
-	rl := &RateLimiter{
-		window:  time.Duration(windowSeconds) * time.Second,
-		max:     max,
-		entries: make(map[string][]time.Time),
-	}
-	if max > 0 {
-		go rl.cleanup()
-	}
-	return rl
-}
-
-// Allow checks whether the given IP is within the rate limit.
-// Returns true if the request is allowed.
-func (rl *RateLimiter) Allow(ip string) bool {
-	if rl.max <= 0 {
-		return true
-	}
-
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
-
-	now := time.Now()
-	cutoff := now.Add(-rl.window)
-
-	// Filter out expired entries
-	timestamps := rl.entries[ip]
-	valid := timestamps[:0]
-	for _, t := range timestamps {
-		if t.After(cutoff) {
-			valid = append(valid, t)
-		}
-	}
-
-	if len(valid) >= rl.max {
-		rl.entries[ip] = valid
-		return false
-	}
-
-	rl.entries[ip] = append(valid, now)
-	return true
-}
-
-// cleanup periodically removes expired entries to prevent memory growth.
-func (rl *RateLimiter) cleanup() {
-	ticker := time.NewTicker(rl.window)
-	defer ticker.Stop()
-	for range ticker.C {
-		rl.mu.Lock()
-		now := time.Now()
-		cutoff := now.Add(-rl.window)
-		for ip, timestamps := range rl.entries {
-			valid := timestamps[:0]
-			for _, t := range timestamps {
-				if t.After(cutoff) {
-					valid = append(valid, t)
-				}
-			}
-			if len(valid) == 0 {
-				delete(rl.entries, ip)
-			} else {
-				rl.entries[ip] = valid
-			}
-		}
-		rl.mu.Unlock()
-	}
-}
-
 // extractIP returns the IP portion of a RemoteAddr, stripping the port.
 func extractIP(remoteAddr string) string {
 	host, _, err := net.SplitHostPort(remoteAddr)
@@ -97,6 +19,14 @@ func extractIP(remoteAddr string) string {
 	return host
 }
 
+// Honeypot actions: how a submission that filled in the honeypot field is
+// answered (STATICOMMENT_HONEYPOT_ACTION).
+const (
+	HoneypotAccept = "accept" // fake success, so the bot doesn't learn it was caught
+	HoneypotTarpit = "tarpit" // fake success, drip-fed to slow bots down (see Tarpit)
+	HoneypotReject = "reject" // explicit 403
+)
+
 // checkHoneypot returns true if the honeypot field is filled (indicating a bot).
 func checkHoneypot(r *http.Request, fieldName string) bool {
 	if fieldName == "" {
@@ -108,30 +38,37 @@ func checkHoneypot(r *http.Request, fieldName string) bool {
 var linkPattern = regexp.MustCompile(`https?://`)
 
 // checkBodyContent checks the comment body for excessive links and blocked patterns.
-// Returns an error message string, or empty string if the body is acceptable.
-func checkBodyContent(body string, maxLinks int, blockedPatterns []*regexp.Regexp) string {
+// Returns a short reason code and an error message, or empty strings if the body
+// is acceptable.
+func checkBodyContent(body string, maxLinks int, blockedPatterns []*regexp.Regexp) (reason, msg string) {
 	if maxLinks > 0 {
 		count := len(linkPattern.FindAllStringIndex(body, -1))
 		if count > maxLinks {
-			return fmt.Sprintf("Too many links (max %d)", maxLinks)
+			return "too_many_links", fmt.Sprintf("Too many links (max %d)", maxLinks)
 		}
 	}
 
 	for _, re := range blockedPatterns {
 		if re.MatchString(body) {
-			return "Comment contains blocked content"
+			return "blocked_pattern", "Comment contains blocked content"
 		}
 	}
 
-	return ""
+	return "", ""
 }
 
 // checkTimestamp returns true if the submission was too fast (likely a bot).
-// It parses the hidden _timestamp field (unix epoch seconds) and compares to now.
-func checkTimestamp(r *http.Request, minSeconds int) bool {
+// The time the form was loaded is the form token's issue time if there is
+// one, which is by the server's clock. Otherwise it's the hidden _timestamp
+// field (unix epoch seconds) set by the visitor's browser, whose clock may
+// be up to maxSkew seconds ahead of the server's.
+func checkTimestamp(r *http.Request, minSeconds, maxSkew int, issued time.Time) bool {
 	if minSeconds <= 0 {
 		return false
 	}
+	if !issued.IsZero() {
+		return time.Since(issued) < time.Duration(minSeconds)*time.Second
+	}
 	tsStr := strings.TrimSpace(r.FormValue("_timestamp"))
 	if tsStr == "" {
 		// No timestamp field — skip check (form may not include it)
@@ -142,5 +79,24 @@ func checkTimestamp(r *http.Request, minSeconds int) bool {
 		return true // Invalid timestamp, treat as suspicious
 	}
 	elapsed := time.Now().Unix() - ts
-	return elapsed < int64(minSeconds)
+	return elapsed+int64(maxSkew) < int64(minSeconds)
+}
+
+// clientClockSkew estimates how far the visitor's clock is ahead of the
+// server's (negative if behind) from the _timestamp field. It's measured
+// against the form token's issue time, fetched when the form loaded like
+// the timestamp; without a token, only a timestamp in the future tells
+// anything.
+func clientClockSkew(r *http.Request, issued time.Time) (time.Duration, bool) {
+	ts, err := strconv.ParseInt(strings.TrimSpace(r.FormValue("_timestamp")), 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	if !issued.IsZero() {
+		return time.Unix(ts, 0).Sub(issued), true
+	}
+	if ahead := time.Until(time.Unix(ts, 0)); ahead > 0 {
+		return ahead, true
+	}
+	return 0, false
 }
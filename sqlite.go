@@ -0,0 +1,271 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS rate_limit_hits (
+	key TEXT NOT NULL,
+	at  INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS rate_limit_hits_key_at ON rate_limit_hits (key, at);
+CREATE TABLE IF NOT EXISTS token_buckets (
+	key    TEXT PRIMARY KEY,
+	tokens REAL NOT NULL,
+	last   INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS nonces (
+	nonce   TEXT PRIMARY KEY,
+	expires INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS nonces_expires ON nonces (expires);
+CREATE TABLE IF NOT EXISTS subscriptions (
+	email   TEXT NOT NULL COLLATE NOCASE,
+	slug    TEXT NOT NULL,
+	comment TEXT NOT NULL,
+	created TEXT NOT NULL,
+	PRIMARY KEY (email, slug, comment)
+);
+`
+
+// SQLiteStore keeps mutable operational state (rate limits, form token
+// nonces, subscriptions) in an embedded SQLite database, so a single-node
+// deployment keeps it across restarts. It replaces the in-memory rate
+// limiters and nonce cache and the repo-backed subscription file when
+// STATICOMMENT_SQLITE_PATH is set.
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+func OpenSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, fmt.Errorf("opening sqlite database: %w", err)
+	}
+	// One connection serializes writers, which is all a single node needs and
+	// makes read-modify-write transactions safe
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("creating sqlite schema: %w", err)
+	}
+	return &SQLiteStore{db: db}, nil
+}
+
+// Subscriptions returns every subscription on slug.
+func (s *SQLiteStore) Subscriptions(slug string) ([]Subscription, error) {
+	rows, err := s.db.Query(`SELECT email, slug, comment, created FROM subscriptions WHERE slug = ? ORDER BY created`, slug)
+	if err != nil {
+		return nil, fmt.Errorf("querying subscriptions: %w", err)
+	}
+	defer rows.Close()
+	var subs []Subscription
+	for rows.Next() {
+		var sub Subscription
+		if err := rows.Scan(&sub.Email, &sub.Slug, &sub.Comment, &sub.Created); err != nil {
+			return nil, fmt.Errorf("reading subscription: %w", err)
+		}
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+// AddSubscription records sub, ignoring duplicates. Nothing needs to be
+// committed to the repo, so the returned path is always empty.
+func (s *SQLiteStore) AddSubscription(sub Subscription) (string, error) {
+	if sub.Created == "" {
+		sub.Created = time.Now().UTC().Format(time.RFC3339)
+	}
+	_, err := s.db.Exec(`INSERT OR IGNORE INTO subscriptions (email, slug, comment, created) VALUES (?, ?, ?, ?)`,
+		strings.ToLower(sub.Email), sub.Slug, sub.Comment, sub.Created)
+	if err != nil {
+		return "", fmt.Errorf("inserting subscription: %w", err)
+	}
+	return "", nil
+}
+
+// Consume implements NonceStore. Expired nonces are purged as new ones
+// arrive.
+func (s *SQLiteStore) Consume(nonce string, expires time.Time) (bool, error) {
+	now := time.Now().Unix()
+	if _, err := s.db.Exec(`DELETE FROM nonces WHERE expires <= ?`, now); err != nil {
+		return false, fmt.Errorf("purging nonces: %w", err)
+	}
+	res, err := s.db.Exec(`INSERT OR IGNORE INTO nonces (nonce, expires) VALUES (?, ?)`, nonce, expires.Unix())
+	if err != nil {
+		return false, fmt.Errorf("inserting nonce: %w", err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("inserting nonce: %w", err)
+	}
+	return n == 1, nil
+}
+
+// Release implements NonceStore.
+func (s *SQLiteStore) Release(nonce string) error {
+	if _, err := s.db.Exec(`DELETE FROM nonces WHERE nonce = ?`, nonce); err != nil {
+		return fmt.Errorf("deleting nonce: %w", err)
+	}
+	return nil
+}
+
+// RateLimiter returns a limiter with the algorithm and limits from cfg whose
+// state is kept in the database. It also starts cleaning up after the
+// limiters from PostRateLimiter and GlobalRateLimiter, which share its
+// tables.
+func (s *SQLiteStore) RateLimiter(cfg *Config) RateLimiter {
+	window := time.Duration(cfg.RateLimitWindow) * time.Second
+	if (cfg.RateLimitMax > 0 || cfg.RateLimitPostIPMax > 0 || cfg.RateLimitPostMax > 0 || cfg.RateLimitGlobalMax > 0) && window > 0 {
+		go s.cleanupRateLimits(window)
+	}
+	return s.rateLimiter(cfg, cfg.RateLimitMax, cfg.RateLimitBurst)
+}
+
+// PostRateLimiter returns the per-post limiters with their state kept in
+// the database.
+func (s *SQLiteStore) PostRateLimiter(cfg *Config) *PostRateLimiter {
+	return &PostRateLimiter{
+		perIP:   s.rateLimiter(cfg, cfg.RateLimitPostIPMax, 0),
+		perPost: s.rateLimiter(cfg, cfg.RateLimitPostMax, 0),
+	}
+}
+
+// GlobalRateLimiter returns the limiter on submissions from everyone
+// together with its state kept in the database.
+func (s *SQLiteStore) GlobalRateLimiter(cfg *Config) RateLimiter {
+	return s.rateLimiter(cfg, cfg.RateLimitGlobalMax, 0)
+}
+
+func (s *SQLiteStore) rateLimiter(cfg *Config, max, burst int) RateLimiter {
+	if cfg.RateLimitAlgorithm == "token-bucket" {
+		if burst <= 0 {
+			burst = max
+		}
+		rl := &sqliteTokenBucket{db: s.db, burst: float64(burst)}
+		if max > 0 && cfg.RateLimitWindow > 0 {
+			rl.rate = float64(max) / float64(cfg.RateLimitWindow)
+		}
+		return rl
+	}
+	return &sqliteSlidingWindow{db: s.db, window: time.Duration(cfg.RateLimitWindow) * time.Second, max: max}
+}
+
+// cleanupRateLimits periodically deletes hits older than the window and
+// buckets idle long enough to have refilled.
+func (s *SQLiteStore) cleanupRateLimits(window time.Duration) {
+	ticker := time.NewTicker(window)
+	defer ticker.Stop()
+	for range ticker.C {
+		cutoff := time.Now().Add(-window).UnixNano()
+		if _, err := s.db.Exec(`DELETE FROM rate_limit_hits WHERE at <= ?`, cutoff); err != nil {
+			log.Printf("warning: cleaning up rate limit hits: %v", err)
+		}
+		if _, err := s.db.Exec(`DELETE FROM token_buckets WHERE last <= ?`, cutoff); err != nil {
+			log.Printf("warning: cleaning up token buckets: %v", err)
+		}
+	}
+}
+
+// sqliteSlidingWindow is SlidingWindowLimiter with its timestamps in SQLite.
+// Database errors fail open so an unhealthy disk doesn't block comments.
+type sqliteSlidingWindow struct {
+	db     *sql.DB
+	window time.Duration
+	max    int
+}
+
+func (rl *sqliteSlidingWindow) Allow(key string) bool {
+	if rl.max <= 0 {
+		return true
+	}
+	allowed, err := rl.allow(key)
+	if err != nil {
+		log.Printf("warning: sqlite rate limiter: %v", err)
+		return true
+	}
+	return allowed
+}
+
+func (rl *sqliteSlidingWindow) allow(key string) (bool, error) {
+	tx, err := rl.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	var count int
+	err = tx.QueryRow(`SELECT COUNT(*) FROM rate_limit_hits WHERE key = ? AND at > ?`,
+		key, now.Add(-rl.window).UnixNano()).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+	if count >= rl.max {
+		return false, nil
+	}
+	if _, err := tx.Exec(`INSERT INTO rate_limit_hits (key, at) VALUES (?, ?)`, key, now.UnixNano()); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// sqliteTokenBucket is TokenBucketLimiter with its buckets in SQLite.
+// Database errors fail open.
+type sqliteTokenBucket struct {
+	db    *sql.DB
+	rate  float64
+	burst float64
+}
+
+func (rl *sqliteTokenBucket) Allow(key string) bool {
+	if rl.rate <= 0 {
+		return true
+	}
+	allowed, err := rl.allow(key)
+	if err != nil {
+		log.Printf("warning: sqlite rate limiter: %v", err)
+		return true
+	}
+	return allowed
+}
+
+func (rl *sqliteTokenBucket) allow(key string) (bool, error) {
+	tx, err := rl.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	tokens := rl.burst
+	var last int64
+	err = tx.QueryRow(`SELECT tokens, last FROM token_buckets WHERE key = ?`, key).Scan(&tokens, &last)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case err != nil:
+		return false, err
+	default:
+		tokens = min(rl.burst, tokens+now.Sub(time.Unix(0, last)).Seconds()*rl.rate)
+	}
+
+	allowed := tokens >= 1
+	if allowed {
+		tokens--
+	}
+	_, err = tx.Exec(`INSERT INTO token_buckets (key, tokens, last) VALUES (?, ?, ?)
+		ON CONFLICT (key) DO UPDATE SET tokens = excluded.tokens, last = excluded.last`,
+		key, tokens, now.UnixNano())
+	if err != nil {
+		return false, err
+	}
+	return allowed, tx.Commit()
+}
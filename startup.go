@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	cloneRetryBaseBackoff = time.Second
+	cloneRetryMaxBackoff  = time.Minute
+)
+
+// Startup is the server's root handler. Until Ready is called it answers
+// GET /health, so the process isn't restarted while it waits for the git
+// host, and turns everything else away with 503. GET /readyz reports
+// whether the server is ready, for health checks that gate traffic.
+type Startup struct {
+	handler atomic.Pointer[http.Handler]
+}
+
+func NewStartup() *Startup {
+	return &Startup{}
+}
+
+// Ready starts passing requests to handler.
+func (s *Startup) Ready(handler http.Handler) {
+	s.handler.Store(&handler)
+}
+
+func (s *Startup) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	handler := s.handler.Load()
+	if r.URL.Path == "/readyz" && (r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		if handler == nil {
+			http.Error(w, "starting", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("ok"))
+		return
+	}
+	if handler != nil {
+		(*handler).ServeHTTP(w, r)
+		return
+	}
+	if r.URL.Path == "/health" && r.Method == http.MethodGet {
+		w.Write([]byte("ok"))
+		return
+	}
+	w.Header().Set("Retry-After", "5")
+	http.Error(w, "Service starting, try again shortly", http.StatusServiceUnavailable)
+}
+
+// cloneWithRetry clones the repo, retrying failures with exponential
+// backoff until timeout has passed since the first attempt (forever if
+// timeout is 0). It returns the last error once it gives up.
+func cloneWithRetry(repo Repo, timeout time.Duration) error {
+	start := time.Now()
+	backoff := cloneRetryBaseBackoff
+	for attempt := 1; ; attempt++ {
+		err := repo.Clone()
+		if err == nil {
+			return nil
+		}
+		if timeout > 0 && time.Since(start)+backoff > timeout {
+			return err
+		}
+		log.Printf("git clone failed (attempt %d), retrying in %s: %v", attempt, backoff, err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, cloneRetryMaxBackoff)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// State file names, relative to STATICOMMENT_STATE_PATH.
+const (
+	subscriptionsFile = "subscriptions.yml"
+	bansFile          = "bans.yml"
+)
+
+// Subscription asks for an email when someone replies to Comment on Slug.
+type Subscription struct {
+	Email   string `yaml:"email"`
+	Slug    string `yaml:"slug"`
+	Comment string `yaml:"comment"`
+	Created string `yaml:"created"`
+}
+
+// SubscriptionStore records who wants to hear about replies. The default is
+// the repo-backed StateStore; SQLiteStore is the single-node alternative.
+type SubscriptionStore interface {
+	Subscriptions(slug string) ([]Subscription, error)
+	// AddSubscription records sub, ignoring duplicates. It returns the
+	// repo-relative path of a file to commit alongside the comment, or "".
+	AddSubscription(sub Subscription) (string, error)
+}
+
+// Ban blocks submissions from an IP (or CIDR range) or an email address.
+type Ban struct {
+	IP      string `yaml:"ip,omitempty"`
+	Email   string `yaml:"email,omitempty"`
+	Reason  string `yaml:"reason,omitempty"`
+	Created string `yaml:"created,omitempty"`
+}
+
+// StateStore keeps server-side state (reply subscriptions, bans) as data
+// files in the repo, so it survives instance replacement without a database.
+// The default path is a dot directory, which Jekyll leaves out of the built
+// site. With STATICOMMENT_STATE_KEY set, subscriptions are AES-256-GCM
+// encrypted and stored with a .enc suffix.
+type StateStore struct {
+	cfg  *Config
+	repo Repo
+	aead cipher.AEAD
+	mu   sync.Mutex
+}
+
+func NewStateStore(cfg *Config, repo Repo) (*StateStore, error) {
+	s := &StateStore{cfg: cfg, repo: repo}
+	if cfg.StateKey != nil {
+		block, err := aes.NewCipher(cfg.StateKey)
+		if err != nil {
+			return nil, fmt.Errorf("state key: %w", err)
+		}
+		if s.aead, err = cipher.NewGCM(block); err != nil {
+			return nil, fmt.Errorf("state key: %w", err)
+		}
+	}
+	return s, nil
+}
+
+// encrypted reports whether the named file is stored encrypted. The ban list
+// is maintained by hand like the rules file, so only subscriber addresses
+// are sealed.
+func (s *StateStore) encrypted(name string) bool {
+	return s.aead != nil && name == subscriptionsFile
+}
+
+// relPath returns the repo-relative path of the named state file.
+func (s *StateStore) relPath(name string) string {
+	if s.encrypted(name) {
+		name += ".enc"
+	}
+	return filepath.Join(s.cfg.StatePath, name)
+}
+
+// load decodes the named state file into v. A missing file leaves v as is.
+func (s *StateStore) load(name string, v any) error {
+	data, err := os.ReadFile(s.repo.FullPath(s.relPath(name)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", name, err)
+	}
+	if s.encrypted(name) {
+		if data, err = s.decrypt(data); err != nil {
+			return fmt.Errorf("decrypting %s: %w", name, err)
+		}
+	}
+	if err := yaml.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("parsing %s: %w", name, err)
+	}
+	return nil
+}
+
+// write encodes v into the named state file and returns its repo-relative
+// path. Committing is left to the caller.
+func (s *StateStore) write(name string, v any) (string, error) {
+	data, err := yaml.Marshal(v)
+	if err != nil {
+		return "", fmt.Errorf("marshaling %s: %w", name, err)
+	}
+	if s.encrypted(name) {
+		if data, err = s.encrypt(data); err != nil {
+			return "", fmt.Errorf("encrypting %s: %w", name, err)
+		}
+	}
+	rel := s.relPath(name)
+	full := s.repo.FullPath(rel)
+	if err := makeDirs(s.cfg, filepath.Dir(full)); err != nil {
+		return "", fmt.Errorf("creating state dir: %w", err)
+	}
+	if err := writeFileAtomic(s.cfg, full, data); err != nil {
+		return "", fmt.Errorf("writing %s: %w", name, err)
+	}
+	return rel, nil
+}
+
+// encrypt returns base64(nonce || ciphertext), keeping the file text so it
+// diffs and merges like any other line-based file.
+func (s *StateStore) encrypt(plain []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := s.aead.Seal(nonce, nonce, plain, nil)
+	return []byte(base64.StdEncoding.EncodeToString(sealed) + "\n"), nil
+}
+
+func (s *StateStore) decrypt(data []byte) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	}
+	n := s.aead.NonceSize()
+	if len(sealed) < n {
+		return nil, errors.New("ciphertext too short")
+	}
+	return s.aead.Open(nil, sealed[:n], sealed[n:], nil)
+}
+
+// Subscriptions returns every subscription on slug.
+func (s *StateStore) Subscriptions(slug string) ([]Subscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var all []Subscription
+	if err := s.load(subscriptionsFile, &all); err != nil {
+		return nil, err
+	}
+	var subs []Subscription
+	for _, sub := range all {
+		if sub.Slug == slug {
+			subs = append(subs, sub)
+		}
+	}
+	return subs, nil
+}
+
+// AddSubscription records sub unless an identical one exists and returns the
+// file's repo-relative path for the caller to commit.
+func (s *StateStore) AddSubscription(sub Subscription) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var all []Subscription
+	if err := s.load(subscriptionsFile, &all); err != nil {
+		return "", err
+	}
+	for _, existing := range all {
+		if strings.EqualFold(existing.Email, sub.Email) && existing.Slug == sub.Slug && existing.Comment == sub.Comment {
+			return s.relPath(subscriptionsFile), nil
+		}
+	}
+	if sub.Created == "" {
+		sub.Created = time.Now().UTC().Format(time.RFC3339)
+	}
+	return s.write(subscriptionsFile, append(all, sub))
+}
+
+// Banned returns the first ban matching ip or email.
+func (s *StateStore) Banned(ip, email string) (Ban, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var bans []Ban
+	if err := s.load(bansFile, &bans); err != nil {
+		return Ban{}, false, err
+	}
+	parsedIP := net.ParseIP(ip)
+	for _, b := range bans {
+		if b.Email != "" && email != "" && strings.EqualFold(b.Email, email) {
+			return b, true, nil
+		}
+		if b.IP != "" && parsedIP != nil {
+			ipNet, err := parseIPOrCIDR(b.IP)
+			if err != nil {
+				continue
+			}
+			if ipNet.Contains(parsedIP) {
+				return b, true, nil
+			}
+		}
+	}
+	return Ban{}, false, nil
+}
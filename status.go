@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statusCacheTTL bounds how often GET /status contacts the git remote, since
+// the page is public and may be polled by many visitors.
+const statusCacheTTL = 30 * time.Second
+
+// Overall statuses reported by GET /status.
+const (
+	StatusOperational = "operational"
+	StatusDegraded    = "degraded"
+	StatusUnavailable = "unavailable"
+)
+
+// StatusReport is the public view of whether comments can be submitted.
+type StatusReport struct {
+	Status          string     `json:"status"`
+	Remote          string     `json:"remote"`
+	QueuePending    int        `json:"queue_pending"`
+	LastPublishedAt *time.Time `json:"last_published_at,omitempty"`
+	LastFailedAt    *time.Time `json:"last_failed_at,omitempty"`
+	CheckedAt       time.Time  `json:"checked_at"`
+}
+
+// StatusHandler serves GET /status. It tracks recent publish outcomes from
+// the event bus and caches remote reachability checks.
+type StatusHandler struct {
+	repo      Repo
+	publisher *Publisher
+
+	mu            sync.Mutex
+	lastPublished time.Time
+	lastFailed    time.Time
+	cached        *StatusReport
+}
+
+func NewStatusHandler(repo Repo, publisher *Publisher) *StatusHandler {
+	return &StatusHandler{repo: repo, publisher: publisher}
+}
+
+// HandleEvent is the event bus subscriber recording publish outcomes.
+func (s *StatusHandler) HandleEvent(e Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch e.Type {
+	case EventPublished, EventQuarantined, EventModeration:
+		s.lastPublished = e.Time
+	case EventFailed:
+		s.lastFailed = e.Time
+	default:
+		return
+	}
+	// Outcomes change the status, so don't serve a stale report
+	s.cached = nil
+}
+
+func (s *StatusHandler) report() StatusReport {
+	s.mu.Lock()
+	if s.cached != nil && time.Since(s.cached.CheckedAt) < statusCacheTTL {
+		r := *s.cached
+		s.mu.Unlock()
+		return r
+	}
+	s.mu.Unlock()
+
+	r := StatusReport{Status: StatusOperational, Remote: "ok", CheckedAt: time.Now().UTC()}
+	if err := s.repo.CheckRemote(); err != nil {
+		r.Remote = "unreachable"
+		r.Status = StatusUnavailable
+	}
+	r.QueuePending = s.publisher.Pending()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.lastPublished.IsZero() {
+		t := s.lastPublished.UTC()
+		r.LastPublishedAt = &t
+	}
+	if !s.lastFailed.IsZero() {
+		t := s.lastFailed.UTC()
+		r.LastFailedAt = &t
+	}
+	// A backlog or a most-recent failure means submissions may be delayed
+	if r.Status == StatusOperational && (r.QueuePending > 0 || s.lastFailed.After(s.lastPublished)) {
+		r.Status = StatusDegraded
+	}
+	s.cached = &r
+	return r
+}
+
+func (s *StatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	report := s.report()
+	code := http.StatusOK
+	if report.Status == StatusUnavailable {
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+
+	if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		json.NewEncoder(w).Encode(report)
+		return
+	}
+
+	message := map[string]string{
+		StatusOperational: "Comments are working normally.",
+		StatusDegraded:    "Comments are being accepted but may take longer than usual to appear.",
+		StatusUnavailable: "Comments are temporarily unavailable. Please try again later.",
+	}[report.Status]
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	fmt.Fprintf(w, `<!DOCTYPE html>
+<html lang="en">
+<head><meta charset="utf-8"><title>Comment status</title></head>
+<body>
+<h1>Comments: %s</h1>
+<p>%s</p>
+<p><small>Checked %s</small></p>
+</body>
+</html>
+`, html.EscapeString(report.Status), html.EscapeString(message), report.CheckedAt.Format(time.RFC3339))
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"crypto/subtle"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SyncHandler serves POST /sync, pulling the clone, and the posts clone if
+// there's a separate one, so posts added and comments removed on the remote
+// are seen before the next commit. It's meant
+// to be called by a push webhook and accepts STATICOMMENT_SYNC_TOKEN in any
+// of the forms the common git hosts send a webhook secret in: a GitHub
+// X-Hub-Signature-256 signature, a GitLab X-Gitlab-Token header, or a plain
+// "Authorization: Bearer" header.
+type SyncHandler struct {
+	repos []Repo
+	token []byte
+}
+
+func NewSyncHandler(repos []Repo, token string) *SyncHandler {
+	return &SyncHandler{repos: repos, token: []byte(token)}
+}
+
+func (h *SyncHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1024*1024))
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	if !h.authorized(r, payload) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	for _, repo := range h.repos {
+		if err := repo.Pull(); err != nil {
+			log.Printf("sync: git pull failed: %v", err)
+			http.Error(w, "Sync failed", http.StatusBadGateway)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *SyncHandler) authorized(r *http.Request, payload []byte) bool {
+	if sig := r.Header.Get("X-Hub-Signature-256"); sig != "" {
+		return validHubSignature(h.token, sig, payload)
+	}
+	got := r.Header.Get("X-Gitlab-Token")
+	if got == "" {
+		var ok bool
+		if got, ok = strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); !ok {
+			return false
+		}
+	}
+	return subtle.ConstantTimeCompare([]byte(got), h.token) == 1
+}
+
+// pullPeriodically pulls the repos every interval, for
+// STATICOMMENT_PULL_INTERVAL, so new posts are seen without waiting for a
+// submission or a sync webhook to refresh the clone.
+func pullPeriodically(repos []Repo, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		for _, repo := range repos {
+			if err := repo.Pull(); err != nil {
+				log.Printf("warning: periodic git pull failed: %v", err)
+			}
+		}
+	}
+}
+
+// postsConfig returns the configuration for the separate clone posts are
+// read from with STATICOMMENT_POSTS_REPO or STATICOMMENT_POSTS_BRANCH: the
+// repo's, pointed at the posts repo and branch and cloned beside the repo.
+// Nothing is ever committed there. The token is only kept for a posts repo
+// on the same host, so it isn't sent anywhere it wasn't meant for.
+func postsConfig(cfg *Config) *Config {
+	posts := *cfg
+	posts.GitRepo = cfg.PostsRepo
+	posts.Branch = cfg.PostsBranch
+	posts.RepoDir = cfg.RepoDir + "-posts"
+	posts.GitMirrors = nil
+	posts.PreviewMode = false
+	posts.SigningKey = ""
+	if extractHost(cfg.PostsRepo) != extractHost(cfg.GitRepo) {
+		posts.GitToken = ""
+		posts.GitHubApp = nil
+	}
+	return &posts
+}
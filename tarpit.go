@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"time"
+)
+
+// tarpitInterval is how often a tarpitted response sends another byte.
+const tarpitInterval = time.Second
+
+// maxTarpitDuration keeps tarpitted responses inside the server's write
+// timeout.
+const maxTarpitDuration = 50
+
+// tarpitReasons are the spam rejections STATICOMMENT_TARPIT_REASONS can
+// name. The honeypot is tarpitted through STATICOMMENT_HONEYPOT_ACTION.
+var tarpitReasons = map[string]bool{
+	"banned": true, "rule_deny": true, "rate_limit": true, "invalid_token": true, "token_replay": true,
+	"too_fast": true, "too_many_links": true, "blocked_pattern": true, "score": true, "akismet": true,
+	"recaptcha": true, "hcaptcha": true, "pow": true, "stopforumspam": true, "dnsbl": true, "bayes": true,
+	"language": true,
+}
+
+// Tarpit slows down the response to a submission that failed a bot check:
+// the status and headers go out at once, then the body trickles out a byte
+// a second for STATICOMMENT_TARPIT_DURATION. A browser following a redirect
+// doesn't wait for the body, but most bot HTTP clients read it in full, so
+// the bot pays for the whole duration. At most STATICOMMENT_TARPIT_MAX
+// responses are held at once, so bots can't tie up the server; beyond that
+// responses go out normally.
+type Tarpit struct {
+	duration time.Duration
+	reasons  map[string]bool
+	slots    chan struct{}
+}
+
+func NewTarpit(cfg *Config) *Tarpit {
+	t := &Tarpit{
+		duration: time.Duration(cfg.TarpitDuration) * time.Second,
+		reasons:  make(map[string]bool),
+		slots:    make(chan struct{}, cfg.TarpitMax),
+	}
+	for _, reason := range cfg.TarpitReasons {
+		t.reasons[reason] = true
+	}
+	if cfg.HoneypotAction == HoneypotTarpit {
+		t.reasons["honeypot"] = true
+	}
+	return t
+}
+
+// acquire reserves a slot if rejections for reason are tarpitted, reporting
+// false if they aren't or all slots are in use.
+func (t *Tarpit) acquire(reason string) bool {
+	if !t.reasons[reason] {
+		return false
+	}
+	select {
+	case t.slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (t *Tarpit) release() {
+	<-t.slots
+}
+
+// serve sends the response written by respond, drip-fed. Leading
+// whitespace doesn't change the meaning of an HTML, JSON or plain text
+// body, so the padding goes first and the real body last.
+func (t *Tarpit) serve(w http.ResponseWriter, r *http.Request, respond func(http.ResponseWriter)) {
+	rec := &recordedResponse{header: make(http.Header), status: http.StatusOK}
+	respond(rec)
+	for k, v := range rec.header {
+		w.Header()[k] = v
+	}
+	w.Header().Del("Content-Length")
+	w.WriteHeader(rec.status)
+
+	rc := http.NewResponseController(w)
+	rc.Flush()
+	ticker := time.NewTicker(tarpitInterval)
+	defer ticker.Stop()
+	done := time.NewTimer(t.duration)
+	defer done.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-done.C:
+			w.Write(rec.body.Bytes())
+			return
+		case <-ticker.C:
+			if _, err := w.Write([]byte(" ")); err != nil {
+				return
+			}
+			rc.Flush()
+		}
+	}
+}
+
+// recordedResponse captures a response so it can be replayed slowly.
+type recordedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rr *recordedResponse) Header() http.Header         { return rr.header }
+func (rr *recordedResponse) Write(b []byte) (int, error) { return rr.body.Write(b) }
+func (rr *recordedResponse) WriteHeader(status int)      { rr.status = status }
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// defaultTemplates render the comments partial unless the site repo
+// overrides them. "comments" receives a partialData and "comment" a
+// partialComment.
+const defaultTemplates = `{{define "comments"}}<section class="staticomment" data-slug="{{.Slug}}">
+{{- if .Comments}}
+<ol class="staticomment-list">
+{{- range .Comments}}{{template "comment" .}}{{end}}
+</ol>
+{{- else}}
+<p class="staticomment-empty">No comments yet.</p>
+{{- end}}
+</section>
+{{end}}
+
+{{define "comment"}}
+<li class="staticomment-comment{{if .Author}} staticomment-by-author{{end}}" id="comment-{{.ID}}">
+<p class="staticomment-meta"><span class="staticomment-author">{{.Name}}</span> <time datetime="{{.Date}}">{{.Time.Format "January 2, 2006"}}</time></p>
+<div class="staticomment-body"{{with .Lang}} lang="{{.}}"{{end}}{{with .Dir}} dir="{{.}}"{{end}}>{{.BodyHTML}}</div>
+{{- if .Replies}}
+<ol class="staticomment-replies">
+{{- range .Replies}}{{template "comment" .}}{{end}}
+</ol>
+{{- end}}
+</li>
+{{- end}}`
+
+// Templates holds the templates for the comments partial: the defaults,
+// overridden by any *.html files in STATICOMMENT_TEMPLATES_PATH in the site
+// repo. The directory is checked on each use and re-parsed when its files
+// change, so a pull picks up theme changes without a restart.
+type Templates struct {
+	repo Repo
+	dir  string
+	// base holds the defaults and is never executed, so it can be cloned
+	base *template.Template
+
+	mu      sync.Mutex
+	current *template.Template
+	stamp   string
+}
+
+func NewTemplates(cfg *Config, repo Repo) (*Templates, error) {
+	base, err := template.New("defaults").Parse(defaultTemplates)
+	if err != nil {
+		return nil, fmt.Errorf("parsing default templates: %w", err)
+	}
+	current, err := base.Clone()
+	if err != nil {
+		return nil, err
+	}
+	return &Templates{repo: repo, dir: cfg.TemplatesPath, base: base, current: current}, nil
+}
+
+// Get returns the current templates, reloading them if the files in the
+// repo have changed. A site template that fails to parse is logged and the
+// previous templates stay in use.
+func (t *Templates) Get() *template.Template {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.dir == "" {
+		return t.current
+	}
+
+	files, stamp := t.scan()
+	if stamp == t.stamp {
+		return t.current
+	}
+	t.stamp = stamp
+
+	tmpl, err := t.base.Clone()
+	if err == nil && len(files) > 0 {
+		_, err = tmpl.ParseFiles(files...)
+	}
+	if err != nil {
+		log.Printf("warning: loading templates from %s: %v", t.dir, err)
+		return t.current
+	}
+	log.Printf("templates: loaded %d file(s) from %s", len(files), t.dir)
+	t.current = tmpl
+	return t.current
+}
+
+// scan lists the template files along with a stamp of their names, sizes
+// and modification times that changes whenever any of them does.
+func (t *Templates) scan() ([]string, string) {
+	files, _ := filepath.Glob(filepath.Join(t.repo.FullPath(t.dir), "*.html"))
+	sort.Strings(files)
+	var stamp strings.Builder
+	for _, f := range files {
+		if info, err := os.Stat(f); err == nil {
+			fmt.Fprintf(&stamp, "%s:%d:%d;", filepath.Base(f), info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	return files, stamp.String()
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// tenantQuotaKey sets a tenant's monthly quota, in its settings or, as
+	// the default for every tenant, the host's environment. The host
+	// enforces it, so the instance never sees it.
+	tenantQuotaKey = "STATICOMMENT_TENANT_QUOTA"
+	// tenantQuotaHeader is how the host tells an instance the tenant's
+	// quota is used up, and tenantAcceptedHeader how the instance tells
+	// the host it accepted a submission.
+	tenantQuotaHeader    = "X-Staticomment-Quota-Exceeded"
+	tenantAcceptedHeader = "X-Staticomment-Accepted"
+
+	// quotaWebhookAttempts bounds the deliveries of one quota event.
+	quotaWebhookAttempts = 5
+)
+
+func parseTenantQuota(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer", tenantQuotaKey)
+	}
+	return n, nil
+}
+
+// tenantSetting returns the value of key in settings.
+func tenantSetting(settings []string, key string) (string, bool) {
+	for _, kv := range settings {
+		if value, ok := strings.CutPrefix(kv, key+"="); ok {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// TenantUsage is a tenant's use of its quota in the current month.
+type TenantUsage struct {
+	Month       string `json:"month"` // UTC, as 2006-01
+	Submissions int    `json:"submissions"`
+	Quota       int    `json:"quota"` // 0 for none
+}
+
+// QuotaEvent is sent to STATICOMMENT_TENANT_QUOTA_WEBHOOK when a tenant's
+// submissions reach one of the thresholds.
+type QuotaEvent struct {
+	Type        string `json:"type"`
+	Tenant      string `json:"tenant"`
+	Month       string `json:"month"`
+	Submissions int    `json:"submissions"`
+	Quota       int    `json:"quota"`
+	Threshold   int    `json:"threshold"` // percent of the quota
+}
+
+// tenantUsageFile is what TenantQuota keeps on disk: the month's count and
+// the thresholds already reported for it, and the quota they were
+// percentages of.
+type tenantUsageFile struct {
+	Month       string `json:"month"`
+	Submissions int    `json:"submissions"`
+	Quota       int    `json:"quota"`
+	Reported    []int  `json:"reported,omitempty"`
+}
+
+// TenantQuota counts the submissions a tenant's instance accepts each
+// calendar month, UTC, against its quota. The count survives restarts;
+// each threshold is reported once a month, and again if the quota changes.
+// Submissions still with the instance hold a place in the quota, so
+// concurrent ones can't take the tenant past it.
+type TenantQuota struct {
+	path       string
+	limit      int // 0 counts without limiting
+	thresholds []int
+	report     func(QuotaEvent)
+
+	mu       sync.Mutex
+	usage    tenantUsageFile
+	reserved int // submissions passed on and not yet answered
+}
+
+func NewTenantQuota(path string, limit int, thresholds []int, report func(QuotaEvent)) *TenantQuota {
+	q := &TenantQuota{path: path, limit: limit, thresholds: thresholds, report: report}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, &q.usage)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("warning: tenants: reading %s: %v, counting from zero", path, err)
+	}
+	if q.usage.Quota != limit {
+		q.usage.Quota, q.usage.Reported = limit, nil
+	}
+	return q
+}
+
+// rollover starts a new count once the month is over. q.mu must be held.
+func (q *TenantQuota) rollover(now time.Time) {
+	if month := now.UTC().Format("2006-01"); q.usage.Month != month {
+		q.usage = tenantUsageFile{Month: month, Quota: q.limit}
+	}
+}
+
+// Reserve holds a place in this month's quota for a submission, reporting
+// false if the quota is used up, counting the places already held. Each
+// place held is given back with Release once the instance has answered.
+func (q *TenantQuota) Reserve() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollover(time.Now())
+	if q.limit > 0 && q.usage.Submissions+q.reserved >= q.limit {
+		return false
+	}
+	q.reserved++
+	return true
+}
+
+// Release gives back a place held by Reserve. A submission the instance
+// accepted has been counted by then.
+func (q *TenantQuota) Release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.reserved--
+}
+
+// Count records an accepted submission and reports the thresholds it
+// reaches.
+func (q *TenantQuota) Count() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollover(time.Now())
+	q.usage.Submissions++
+	if q.limit > 0 {
+		for _, threshold := range q.thresholds {
+			if q.usage.Submissions*100 >= threshold*q.limit && !slices.Contains(q.usage.Reported, threshold) {
+				q.usage.Reported = append(q.usage.Reported, threshold)
+				q.report(QuotaEvent{Type: "quota_threshold", Month: q.usage.Month, Submissions: q.usage.Submissions, Quota: q.limit, Threshold: threshold})
+			}
+		}
+	}
+	if err := q.save(); err != nil {
+		log.Printf("warning: tenants: saving %s: %v", q.path, err)
+	}
+}
+
+// save writes the usage to disk. q.mu must be held.
+func (q *TenantQuota) save() error {
+	data, err := json.Marshal(q.usage)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(q.path), 0o700); err != nil {
+		return err
+	}
+	tmp := q.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path)
+}
+
+// Usage returns this month's usage.
+func (q *TenantQuota) Usage() TenantUsage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.rollover(time.Now())
+	return TenantUsage{Month: q.usage.Month, Submissions: q.usage.Submissions, Quota: q.limit}
+}
+
+// QuotaWebhook POSTs quota events as JSON, for billing or alerting. With
+// a secret, each is signed like GitHub's webhooks, in
+// X-Staticomment-Signature-256 as sha256=<hex HMAC of the body>.
+type QuotaWebhook struct {
+	url    string
+	secret []byte
+	client *http.Client
+}
+
+func NewQuotaWebhook(url, secret string) *QuotaWebhook {
+	return &QuotaWebhook{url: url, secret: []byte(secret), client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Send delivers e, retrying failures with backoff.
+func (q *QuotaWebhook) Send(e QuotaEvent) {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		log.Printf("error encoding quota event: %v", err)
+		return
+	}
+	for attempt := 1; ; attempt++ {
+		err := q.post(payload)
+		if err == nil {
+			return
+		}
+		if attempt == quotaWebhookAttempts {
+			log.Printf("error: tenants: quota webhook for %s failed, giving up: %v", e.Tenant, err)
+			return
+		}
+		backoff := notificationBackoff(attempt)
+		log.Printf("warning: tenants: quota webhook for %s failed (attempt %d), retrying in %s: %v", e.Tenant, attempt, backoff.Round(time.Second), err)
+		time.Sleep(backoff)
+	}
+}
+
+func (q *QuotaWebhook) post(payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, q.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(q.secret) > 0 {
+		mac := hmac.New(sha256.New, q.secret)
+		mac.Write(payload)
+		req.Header.Set("X-Staticomment-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := q.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("posting quota webhook: %s", resp.Status)
+	}
+	return nil
+}
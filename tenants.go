@@ -0,0 +1,846 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// tenantFileExt is the extension of the files in
+	// STATICOMMENT_TENANTS_DIR, one per tenant, named after it.
+	tenantFileExt = ".env"
+	// tenantRemoteAddrHeader carries the visitor's address to a tenant's
+	// instance, which only sees the host's; tenantSecretHeader proves the
+	// host sent it.
+	tenantRemoteAddrHeader = "X-Staticomment-Remote-Addr"
+	tenantSecretHeader     = "X-Staticomment-Tenant-Secret"
+
+	tenantRestartBaseBackoff = time.Second
+	tenantRestartMaxBackoff  = time.Minute
+	// tenantStopTimeout is how long an instance has to finish what it's
+	// doing after it's asked to stop, before it's killed.
+	tenantStopTimeout = 30 * time.Second
+	// tenantScrapeTimeout bounds reading an instance's metrics.
+	tenantScrapeTimeout = 5 * time.Second
+)
+
+var tenantNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{0,62}$`)
+
+var tenantKeyPattern = regexp.MustCompile(`^STATICOMMENT_[A-Z0-9_]+$`)
+
+// tenantHostKeys are set by the host for every instance, so tenants'
+// settings can't.
+var tenantHostKeys = []string{
+	"STATICOMMENT_PORT",
+	"STATICOMMENT_DATA_DIR",
+	"STATICOMMENT_METRICS",
+	"STATICOMMENT_TENANT",
+	"STATICOMMENT_TENANT_SECRET",
+	"STATICOMMENT_TENANTS_DIR",
+}
+
+// TenantHostConfig is a tenant host's own configuration, from the host's
+// STATICOMMENT_* variables rather than a site's.
+type TenantHostConfig struct {
+	Dir            string
+	Port           string
+	DataDir        string
+	Metrics        bool
+	AdminToken     string
+	TrustedProxies IPList
+
+	Quota              int   // accepted submissions a month, for tenants not given their own; 0 for none
+	QuotaThresholds    []int // percentages of the quota that fire the webhook
+	QuotaWebhook       string
+	QuotaWebhookSecret string
+}
+
+func LoadTenantHostConfig(dir string) (*TenantHostConfig, error) {
+	cfg := &TenantHostConfig{
+		Dir:                dir,
+		Port:               envOrDefault("STATICOMMENT_PORT", "8080"),
+		Metrics:            os.Getenv("STATICOMMENT_METRICS") == "1",
+		AdminToken:         os.Getenv("STATICOMMENT_ADMIN_TOKEN"),
+		QuotaWebhook:       os.Getenv("STATICOMMENT_TENANT_QUOTA_WEBHOOK"),
+		QuotaWebhookSecret: os.Getenv("STATICOMMENT_TENANT_QUOTA_WEBHOOK_SECRET"),
+	}
+	dataDir, err := filepath.Abs(envOrDefault("STATICOMMENT_DATA_DIR", defaultDataDir(false)))
+	if err != nil {
+		return nil, fmt.Errorf("STATICOMMENT_DATA_DIR: %w", err)
+	}
+	cfg.DataDir = dataDir
+	if cfg.TrustedProxies, err = LoadIPList("STATICOMMENT_TRUSTED_PROXIES"); err != nil {
+		return nil, err
+	}
+	if cfg.Quota, err = parseTenantQuota(envOrDefault(tenantQuotaKey, "0")); err != nil {
+		return nil, err
+	}
+	for _, s := range strings.Split(envOrDefault("STATICOMMENT_TENANT_QUOTA_THRESHOLDS", "80,100"), ",") {
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("STATICOMMENT_TENANT_QUOTA_THRESHOLDS must be comma-separated positive integers")
+		}
+		cfg.QuotaThresholds = append(cfg.QuotaThresholds, n)
+	}
+	slices.Sort(cfg.QuotaThresholds)
+	cfg.QuotaThresholds = slices.Compact(cfg.QuotaThresholds)
+	return cfg, nil
+}
+
+// runTenantHost serves as a tenant host until the server fails.
+func runTenantHost(dir string) {
+	cfg, err := LoadTenantHostConfig(dir)
+	if err != nil {
+		log.Fatalf("config error: %v", err)
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		log.Fatalf("tenants: finding this executable: %v", err)
+	}
+	host := NewTenantHost(cfg, exe)
+
+	log.Printf("staticomment tenant host starting on :%s", cfg.Port)
+	log.Printf("  tenants dir: %s", cfg.Dir)
+	log.Printf("  data dir: %s", filepath.Join(cfg.DataDir, "tenants"))
+	if cfg.Quota > 0 {
+		log.Printf("  default quota: %d submissions a month", cfg.Quota)
+	}
+	if cfg.QuotaWebhook != "" {
+		log.Printf("  quota webhook: %s at %v%%", cfg.QuotaWebhook, cfg.QuotaThresholds)
+	}
+	if err := host.Sync(); err != nil {
+		log.Fatalf("tenants error: %v", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	mux.Handle("/t/{tenant}/", host)
+	if cfg.Metrics {
+		log.Printf("  metrics: enabled at /metrics")
+		mux.HandleFunc("GET /metrics", host.ServeMetrics)
+	}
+	if cfg.AdminToken != "" {
+		log.Printf("  admin API: enabled at /admin/tenants")
+		auth := NewAdminAuth(&Config{AdminToken: cfg.AdminToken})
+		admin := http.NewServeMux()
+		admin.HandleFunc("GET /admin/tenants", host.ServeList)
+		admin.HandleFunc("PUT /admin/tenants/{tenant}", host.ServePut)
+		admin.HandleFunc("DELETE /admin/tenants/{tenant}", host.ServeDelete)
+		admin.HandleFunc("POST /admin/tenants/reload", host.ServeReload)
+		mux.Handle("/admin/", auth.Wrap(admin))
+	}
+
+	var handler http.Handler = mux
+	if len(cfg.TrustedProxies) > 0 {
+		log.Printf("  trusted proxies: %d entries", len(cfg.TrustedProxies))
+		handler = forwardedRemoteAddr(cfg.TrustedProxies, mux)
+	}
+	srv := &http.Server{
+		Addr:              ":" + cfg.Port,
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      60 * time.Second,
+		IdleTimeout:       120 * time.Second,
+	}
+	log.Printf("listening on %s", srv.Addr)
+	log.Fatalf("server error: %v", srv.ListenAndServe())
+}
+
+// TenantHost runs a staticomment instance for each tenant, as a child
+// process with only the tenant's own settings, so each has its own repo
+// and credentials, config, rate limits and data directory, and serves
+// each at /t/<tenant>/. Tenants are the files in the tenants directory,
+// added and changed there or through the host's admin API.
+type TenantHost struct {
+	cfg   *TenantHostConfig
+	exe   string
+	quota *QuotaWebhook // nil without STATICOMMENT_TENANT_QUOTA_WEBHOOK
+
+	mu      sync.Mutex
+	tenants map[string]*Tenant
+	// changing serializes starting and stopping tenants
+	changing sync.Mutex
+}
+
+func NewTenantHost(cfg *TenantHostConfig, exe string) *TenantHost {
+	h := &TenantHost{cfg: cfg, exe: exe, tenants: make(map[string]*Tenant)}
+	if cfg.QuotaWebhook != "" {
+		h.quota = NewQuotaWebhook(cfg.QuotaWebhook, cfg.QuotaWebhookSecret)
+	}
+	return h
+}
+
+// Sync brings the running tenants in line with the tenants directory:
+// new tenants are started, those whose settings changed restarted, and
+// those whose file is gone stopped. Every file is read first, so nothing
+// changes if any can't be.
+func (h *TenantHost) Sync() error {
+	entries, err := os.ReadDir(h.cfg.Dir)
+	if err != nil {
+		return err
+	}
+	found := make(map[string][]string)
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), tenantFileExt)
+		if !ok || e.IsDir() {
+			continue
+		}
+		if !tenantNamePattern.MatchString(name) {
+			log.Printf("warning: tenants: skipping %s: names are lowercase letters, digits and dashes", e.Name())
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(h.cfg.Dir, e.Name()))
+		if err != nil {
+			return err
+		}
+		settings, err := parseTenantSettings(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", e.Name(), err)
+		}
+		found[name] = settings
+	}
+	for name, settings := range found {
+		h.apply(name, settings)
+	}
+	h.mu.Lock()
+	var gone []string
+	for name := range h.tenants {
+		if _, ok := found[name]; !ok {
+			gone = append(gone, name)
+		}
+	}
+	h.mu.Unlock()
+	for _, name := range gone {
+		h.remove(name)
+	}
+	return nil
+}
+
+// apply starts the tenant with settings, restarting it if it's running
+// with others.
+func (h *TenantHost) apply(name string, settings []string) {
+	h.changing.Lock()
+	defer h.changing.Unlock()
+	h.mu.Lock()
+	old := h.tenants[name]
+	h.mu.Unlock()
+	if old != nil {
+		if slices.Equal(old.settings, settings) {
+			return
+		}
+		log.Printf("tenants: %s's settings changed, restarting", name)
+		old.Stop()
+	}
+	t := newTenant(h, name, settings)
+	h.mu.Lock()
+	h.tenants[name] = t
+	h.mu.Unlock()
+	go t.run()
+}
+
+// remove stops the tenant; its data directory is kept.
+func (h *TenantHost) remove(name string) bool {
+	h.changing.Lock()
+	defer h.changing.Unlock()
+	h.mu.Lock()
+	t := h.tenants[name]
+	delete(h.tenants, name)
+	h.mu.Unlock()
+	if t == nil {
+		return false
+	}
+	log.Printf("tenants: stopping %s", name)
+	t.Stop()
+	return true
+}
+
+// sorted returns the tenants in name order.
+func (h *TenantHost) sorted() []*Tenant {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	tenants := make([]*Tenant, 0, len(h.tenants))
+	for _, t := range h.tenants {
+		tenants = append(tenants, t)
+	}
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].name < tenants[j].name })
+	return tenants
+}
+
+// ServeHTTP passes requests for /t/<tenant>/... on to the tenant's
+// instance, without the prefix. Its /metrics is served by the host's,
+// labelled, instead.
+func (h *TenantHost) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("tenant")
+	h.mu.Lock()
+	t := h.tenants[name]
+	h.mu.Unlock()
+	if t == nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	prefix := "/t/" + name
+	if strings.TrimPrefix(r.URL.Path, prefix) == "/metrics" {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	http.StripPrefix(prefix, t).ServeHTTP(w, r)
+}
+
+// ServeMetrics serves each running tenant's metrics, labelled with
+// tenant="<name>", and the host's own: whether each tenant is up, how
+// often it's been restarted, and its usage of its quota.
+func (h *TenantHost) ServeMetrics(w http.ResponseWriter, r *http.Request) {
+	tenants := h.sorted()
+	bodies := make([]string, len(tenants))
+	var wg sync.WaitGroup
+	for i, t := range tenants {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			body, err := t.scrape(r.Context())
+			if err != nil {
+				log.Printf("warning: tenants: reading %s's metrics: %v", t.name, err)
+			}
+			bodies[i] = body
+		}()
+	}
+	wg.Wait()
+
+	var sb strings.Builder
+	sb.WriteString("# HELP staticomment_tenant_up Whether the tenant's instance answered the last scrape.\n# TYPE staticomment_tenant_up gauge\n")
+	for i, t := range tenants {
+		up := 0
+		if bodies[i] != "" {
+			up = 1
+		}
+		fmt.Fprintf(&sb, "staticomment_tenant_up{%s} %d\n", formatLabels([]string{"tenant"}, []string{t.name}), up)
+	}
+	sb.WriteString("# HELP staticomment_tenant_restarts_total Times the tenant's instance exited and was started again.\n# TYPE staticomment_tenant_restarts_total counter\n")
+	for _, t := range tenants {
+		fmt.Fprintf(&sb, "staticomment_tenant_restarts_total{%s} %d\n", formatLabels([]string{"tenant"}, []string{t.name}), t.status().Restarts)
+	}
+	sb.WriteString("# HELP staticomment_tenant_submissions Submissions the tenant's instance accepted this month (UTC).\n# TYPE staticomment_tenant_submissions gauge\n")
+	for _, t := range tenants {
+		fmt.Fprintf(&sb, "staticomment_tenant_submissions{%s} %d\n", formatLabels([]string{"tenant"}, []string{t.name}), t.quota.Usage().Submissions)
+	}
+	sb.WriteString("# HELP staticomment_tenant_quota The tenant's monthly submission quota, 0 if it has none.\n# TYPE staticomment_tenant_quota gauge\n")
+	for _, t := range tenants {
+		fmt.Fprintf(&sb, "staticomment_tenant_quota{%s} %d\n", formatLabels([]string{"tenant"}, []string{t.name}), t.quota.Usage().Quota)
+	}
+	names := make([]string, len(tenants))
+	for i, t := range tenants {
+		names[i] = t.name
+	}
+	mergeTenantMetrics(&sb, names, bodies)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write([]byte(sb.String()))
+}
+
+// tenantMetricFamily is one metric's lines gathered from every tenant: the
+// exposition format wants all of a metric's samples together.
+type tenantMetricFamily struct {
+	header  []string
+	samples []string
+}
+
+// mergeTenantMetrics writes the metrics in bodies, each scraped from the
+// tenant of the same index in names, with a tenant label added to every
+// sample.
+func mergeTenantMetrics(sb *strings.Builder, names, bodies []string) {
+	families := make(map[string]*tenantMetricFamily)
+	var order []string
+	for i, body := range bodies {
+		label := formatLabels([]string{"tenant"}, []string{names[i]})
+		var family *tenantMetricFamily
+		headers := make(map[string]bool)
+		for _, line := range strings.Split(body, "\n") {
+			if fields := strings.Fields(line); len(fields) >= 3 && fields[0] == "#" && (fields[1] == "HELP" || fields[1] == "TYPE") {
+				family = families[fields[2]]
+				if family == nil {
+					family = &tenantMetricFamily{}
+					families[fields[2]] = family
+					order = append(order, fields[2])
+				}
+				// Each tenant repeats the header; the first one's is kept
+				if len(family.header) < 2 && !headers[fields[2]+" "+fields[1]] {
+					family.header = append(family.header, line)
+				}
+				headers[fields[2]+" "+fields[1]] = true
+				continue
+			}
+			if line == "" || strings.HasPrefix(line, "#") || family == nil {
+				continue
+			}
+			end := strings.IndexAny(line, "{ ")
+			switch {
+			case end < 0:
+				continue
+			case line[end] == '{':
+				line = line[:end+1] + label + "," + line[end+1:]
+			default:
+				line = line[:end] + "{" + label + "}" + line[end:]
+			}
+			family.samples = append(family.samples, line)
+		}
+	}
+	for _, name := range order {
+		for _, line := range families[name].header {
+			sb.WriteString(line + "\n")
+		}
+		for _, line := range families[name].samples {
+			sb.WriteString(line + "\n")
+		}
+	}
+}
+
+// tenantRequest is the body of PUT /admin/tenants/{tenant}: the tenant's
+// STATICOMMENT_* settings, as they'd be set in the environment.
+type tenantRequest struct {
+	Settings map[string]string `json:"settings"`
+}
+
+// ServeList serves GET /admin/tenants.
+func (h *TenantHost) ServeList(w http.ResponseWriter, r *http.Request) {
+	tenants := h.sorted()
+	list := make([]TenantStatus, len(tenants))
+	for i, t := range tenants {
+		list[i] = t.status()
+	}
+	writeJSON(w, map[string]any{"tenants": list})
+}
+
+// ServePut serves PUT /admin/tenants/{tenant}, registering a tenant or
+// replacing its settings: they're written to its file in the tenants
+// directory, then the tenant is started or restarted.
+func (h *TenantHost) ServePut(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("tenant")
+	if !tenantNamePattern.MatchString(name) {
+		http.Error(w, "Invalid tenant name: use lowercase letters, digits and dashes", http.StatusBadRequest)
+		return
+	}
+	var req tenantRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 256*1024)).Decode(&req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	var sb strings.Builder
+	for key, value := range req.Settings {
+		if err := checkTenantSetting(key, value); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sb.WriteString(key + "=" + value + "\n")
+	}
+	settings, _ := parseTenantSettings([]byte(sb.String()))
+	data := strings.Join(settings, "\n") + "\n"
+
+	path := filepath.Join(h.cfg.Dir, name+tenantFileExt)
+	_, err := os.Stat(path)
+	created := errors.Is(err, os.ErrNotExist)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(data), 0o600); err != nil {
+		log.Printf("error writing tenant %s: %v", name, err)
+		http.Error(w, "Failed to save tenant", http.StatusInternalServerError)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		log.Printf("error writing tenant %s: %v", name, err)
+		http.Error(w, "Failed to save tenant", http.StatusInternalServerError)
+		return
+	}
+	h.apply(name, settings)
+	log.Printf("admin: %s saved tenant %s", adminIdentity(r).Name, name)
+
+	h.mu.Lock()
+	t := h.tenants[name]
+	h.mu.Unlock()
+	if created {
+		w.WriteHeader(http.StatusCreated)
+	}
+	writeJSON(w, t.status())
+}
+
+// ServeDelete serves DELETE /admin/tenants/{tenant}: the tenant is stopped
+// and its file removed, but its data directory is kept.
+func (h *TenantHost) ServeDelete(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("tenant")
+	if !tenantNamePattern.MatchString(name) {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	err := os.Remove(filepath.Join(h.cfg.Dir, name+tenantFileExt))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("error removing tenant %s: %v", name, err)
+		http.Error(w, "Failed to remove tenant", http.StatusInternalServerError)
+		return
+	}
+	if !h.remove(name) && err != nil {
+		http.Error(w, "Not found", http.StatusNotFound)
+		return
+	}
+	log.Printf("admin: %s removed tenant %s", adminIdentity(r).Name, name)
+	writeJSON(w, map[string]any{"removed": name})
+}
+
+// ServeReload serves POST /admin/tenants/reload, picking up changes made
+// to the tenants directory by hand.
+func (h *TenantHost) ServeReload(w http.ResponseWriter, r *http.Request) {
+	if err := h.Sync(); err != nil {
+		log.Printf("error reloading tenants: %v", err)
+		http.Error(w, "Failed to reload tenants: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	h.ServeList(w, r)
+}
+
+// checkTenantSetting returns an error for a setting a tenant can't have.
+func checkTenantSetting(key, value string) error {
+	if !tenantKeyPattern.MatchString(key) {
+		return fmt.Errorf("%s: only STATICOMMENT_* settings can be given", key)
+	}
+	if slices.Contains(tenantHostKeys, key) {
+		return fmt.Errorf("%s is set by the tenant host", key)
+	}
+	if key == tenantQuotaKey {
+		if _, err := parseTenantQuota(value); err != nil {
+			return err
+		}
+	}
+	if strings.ContainsAny(value, "\r\n\x00") {
+		return fmt.Errorf("%s: values must be one line (STATICOMMENT_SSH_KEY_BASE64 takes a deploy key)", key)
+	}
+	return nil
+}
+
+// parseTenantSettings parses a tenant's file: KEY=VALUE lines, as in an
+// env file, with blank lines and lines starting with # ignored. Values are
+// taken as they are, quotes and all. The settings come back sorted, so
+// they can be compared.
+func parseTenantSettings(data []byte) ([]string, error) {
+	seen := make(map[string]bool)
+	var settings []string
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected KEY=VALUE", i+1)
+		}
+		key = strings.TrimSpace(key)
+		if err := checkTenantSetting(key, value); err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("line %d: %s is set twice", i+1, key)
+		}
+		seen[key] = true
+		settings = append(settings, key+"="+value)
+	}
+	sort.Strings(settings)
+	return settings, nil
+}
+
+// Tenant is one tenant's instance, restarted with backoff whenever it
+// exits until it's stopped.
+type Tenant struct {
+	name     string
+	settings []string
+	host     *TenantHost
+	dataDir  string
+	quota    *TenantQuota
+	secret   string
+	proxy    *httputil.ReverseProxy
+	stop     chan struct{}
+	done     chan struct{}
+
+	mu        sync.Mutex
+	addr      string // empty while the instance isn't running
+	cmd       *exec.Cmd
+	stdin     io.Closer
+	started   time.Time
+	restarts  int
+	lastError string
+}
+
+// TenantStatus is a tenant as listed by the admin API.
+type TenantStatus struct {
+	Name      string      `json:"name"`
+	Running   bool        `json:"running"`
+	Started   string      `json:"started,omitempty"`
+	Restarts  int         `json:"restarts"`
+	LastError string      `json:"last_error,omitempty"`
+	Usage     TenantUsage `json:"usage"`
+}
+
+func newTenant(h *TenantHost, name string, settings []string) *Tenant {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Fatalf("tenants: generating secret: %v", err)
+	}
+	t := &Tenant{
+		name:     name,
+		settings: settings,
+		host:     h,
+		dataDir:  filepath.Join(h.cfg.DataDir, "tenants", name),
+		secret:   hex.EncodeToString(secret),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	limit := h.cfg.Quota
+	if value, ok := tenantSetting(settings, tenantQuotaKey); ok {
+		// Already checked by checkTenantSetting
+		limit, _ = parseTenantQuota(value)
+	}
+	t.quota = NewTenantQuota(filepath.Join(h.cfg.DataDir, "usage", name+".json"), limit, h.cfg.QuotaThresholds, func(e QuotaEvent) {
+		e.Tenant = name
+		log.Printf("tenants: %s has used %d of its %d submissions for %s (%d%%)", name, e.Submissions, e.Quota, e.Month, e.Threshold)
+		if h.quota != nil {
+			go h.quota.Send(e)
+		}
+	})
+	t.proxy = &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			t.mu.Lock()
+			addr := t.addr
+			t.mu.Unlock()
+			pr.SetURL(&url.URL{Scheme: "http", Host: addr})
+			pr.Out.Host = pr.In.Host
+			pr.Out.Header.Set(tenantRemoteAddrHeader, pr.In.RemoteAddr)
+			pr.Out.Header.Set(tenantSecretHeader, t.secret)
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			accepted := resp.Header.Get(tenantAcceptedHeader) != ""
+			resp.Header.Del(tenantAcceptedHeader)
+			if accepted && resp.Header.Get("Idempotent-Replayed") == "" {
+				t.quota.Count()
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("warning: tenants: %s: %v", name, err)
+			w.Header().Set("Retry-After", "5")
+			http.Error(w, "Service unavailable, try again shortly", http.StatusServiceUnavailable)
+		},
+	}
+	return t
+}
+
+// ServeHTTP passes a request on to the tenant's instance. A submission
+// holds a place in the tenant's quota until the instance answers, and
+// submissions past the quota are turned away by the instance, so they're
+// answered like any other refused submission.
+func (t *Tenant) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.Header.Del(tenantQuotaHeader)
+	if r.Method == http.MethodPost && r.URL.Path == "/comment" {
+		if t.quota.Reserve() {
+			defer t.quota.Release()
+		} else {
+			r.Header.Set(tenantQuotaHeader, "1")
+		}
+	}
+	t.proxy.ServeHTTP(w, r)
+}
+
+func (t *Tenant) status() TenantStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := TenantStatus{Name: t.name, Running: t.addr != "", Restarts: t.restarts, LastError: t.lastError, Usage: t.quota.Usage()}
+	if !t.started.IsZero() {
+		s.Started = t.started.UTC().Format(time.RFC3339)
+	}
+	return s
+}
+
+// run starts the instance and starts it again whenever it exits, waiting
+// longer each time it fails quickly, until Stop is called.
+func (t *Tenant) run() {
+	defer close(t.done)
+	backoff := tenantRestartBaseBackoff
+	for {
+		start := time.Now()
+		err := t.start()
+		if err == nil {
+			log.Printf("tenants: started %s", t.name)
+			err = t.cmd.Wait()
+		}
+		t.mu.Lock()
+		t.addr = ""
+		t.lastError = fmt.Sprint(err)
+		t.mu.Unlock()
+		select {
+		case <-t.stop:
+			return
+		default:
+		}
+		if time.Since(start) > tenantRestartMaxBackoff {
+			backoff = tenantRestartBaseBackoff
+		}
+		log.Printf("warning: tenants: %s exited (%v), restarting in %s", t.name, err, backoff)
+		select {
+		case <-t.stop:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, tenantRestartMaxBackoff)
+		t.mu.Lock()
+		t.restarts++
+		t.mu.Unlock()
+	}
+}
+
+// start starts the instance on a free loopback port, with the tenant's
+// settings and none of the host's.
+func (t *Tenant) start() error {
+	if err := os.MkdirAll(t.dataDir, 0o700); err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	addr := l.Addr().String()
+	l.Close()
+	_, port, _ := net.SplitHostPort(addr)
+
+	var env []string
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "STATICOMMENT_") {
+			env = append(env, kv)
+		}
+	}
+	for _, kv := range t.settings {
+		// The quota is the host's to enforce
+		if !strings.HasPrefix(kv, tenantQuotaKey+"=") {
+			env = append(env, kv)
+		}
+	}
+	env = append(env,
+		"STATICOMMENT_PORT="+port,
+		"STATICOMMENT_DATA_DIR="+t.dataDir,
+		"STATICOMMENT_TENANT="+t.name,
+		"STATICOMMENT_TENANT_SECRET="+t.secret,
+	)
+	if t.host.cfg.Metrics {
+		env = append(env, "STATICOMMENT_METRICS=1")
+	}
+	cmd := exec.Command(t.host.exe)
+	cmd.Env = env
+	cmd.Dir = t.dataDir
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	// The instance exits when its stdin closes, whether Stop closes it or
+	// the host goes away
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.cmd, t.stdin, t.addr, t.started = cmd, stdin, addr, time.Now()
+	t.mu.Unlock()
+	return nil
+}
+
+// Stop asks the instance to exit, kills it if it hasn't within
+// tenantStopTimeout, and waits until it's gone.
+func (t *Tenant) Stop() {
+	close(t.stop)
+	t.mu.Lock()
+	cmd, stdin := t.cmd, t.stdin
+	running := t.addr != ""
+	t.mu.Unlock()
+	if running {
+		stdin.Close()
+	}
+	select {
+	case <-t.done:
+	case <-time.After(tenantStopTimeout):
+		log.Printf("warning: tenants: %s didn't stop, killing it", t.name)
+		if cmd != nil {
+			cmd.Process.Kill()
+		}
+		<-t.done
+	}
+}
+
+// scrape reads the instance's metrics, or returns "" if it isn't running.
+func (t *Tenant) scrape(ctx context.Context) (string, error) {
+	t.mu.Lock()
+	addr := t.addr
+	t.mu.Unlock()
+	if addr == "" || !t.host.cfg.Metrics {
+		return "", nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, tenantScrapeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+"/metrics", nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	return string(body), err
+}
+
+// tenantRemoteAddr runs on a tenant's instance: requests the host passed
+// on, carrying its secret, get the visitor's address in place of the
+// host's, so rate limits and the rest see who actually sent them. Only
+// the host can say the tenant's quota is used up.
+func tenantRemoteAddr(secret string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fromHost := subtle.ConstantTimeCompare([]byte(r.Header.Get(tenantSecretHeader)), []byte(secret)) == 1
+		if addr := r.Header.Get(tenantRemoteAddrHeader); addr != "" && fromHost {
+			r.RemoteAddr = addr
+		}
+		if !fromHost {
+			r.Header.Del(tenantQuotaHeader)
+		}
+		r.Header.Del(tenantRemoteAddrHeader)
+		r.Header.Del(tenantSecretHeader)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// watchTenantHost runs on a tenant's instance and exits once its stdin,
+// held open by the host, closes: the host wants it stopped or has gone
+// away, and either way nothing will pass requests on to it.
+func watchTenantHost() {
+	io.Copy(io.Discard, os.Stdin)
+	log.Printf("tenant host closed stdin, exiting")
+	os.Exit(0)
+}
@@ -26,20 +26,55 @@ title: Test Post
 ---
 Hello world
 EOF
+git add -A
+git commit -m "Initial seed"
 
-# Create comments directory
+# Create comments directory, in a commit of its own so a shallow clone
+# leaves history out
 mkdir -p _data/comments
 touch _data/comments/.gitkeep
 
 git add -A
-git commit -m "Initial seed"
+git commit -m "Add comments directory"
 git push origin main
 
 cd /
 rm -rf "$TMPDIR"
 
+# The tenant host's site, the batching instance's, the one shared by the
+# outbox instances, the conflict instance's, the proof-of-work instance's
+# and the limits instance's get copies of their own
+git clone --bare /home/git/repo.git /home/git/tenant.git
+git clone --bare /home/git/repo.git /home/git/batch.git
+git clone --bare /home/git/repo.git /home/git/outbox.git
+git clone --bare /home/git/repo.git /home/git/conflict.git
+git clone --bare /home/git/repo.git /home/git/pow.git
+git clone --bare /home/git/repo.git /home/git/limits.git
+
+# While a "hold" branch exists, pushes to main are refused, so tests can
+# make the server's pushes fail. Deleting hold in the same push lets that
+# push through.
+for repo in conflict.git outbox.git; do
+    cat > /home/git/$repo/hooks/pre-receive << 'EOF'
+#!/bin/sh
+held=$(git rev-parse -q --verify refs/heads/hold)
+main=
+while read old new ref; do
+    case "$ref" in
+    refs/heads/hold) [ "$new" = 0000000000000000000000000000000000000000 ] && held= ;;
+    refs/heads/main) main=1 ;;
+    esac
+done
+if [ -n "$held" ] && [ -n "$main" ]; then
+    echo "main is on hold" >&2
+    exit 1
+fi
+EOF
+    chmod +x /home/git/$repo/hooks/pre-receive
+done
+
 # Fix ownership
-chown -R git:git /home/git/repo.git
+chown -R git:git /home/git/repo.git /home/git/tenant.git /home/git/batch.git /home/git/outbox.git /home/git/conflict.git /home/git/pow.git /home/git/limits.git
 
 # Start sshd in foreground
 exec /usr/sbin/sshd -D -e
@@ -3,8 +3,16 @@
 # Runs against a fully containerized environment with git-server and staticomment
 
 STATICOMMENT_URL="${STATICOMMENT_URL:-http://staticomment:8080}"
+TENANTS_URL="${TENANTS_URL:-http://tenants:8080}"
+BATCH_URL="${BATCH_URL:-http://batch:8080}"
+OUTBOX_A_URL="${OUTBOX_A_URL:-http://outbox-a:8080}"
+OUTBOX_B_URL="${OUTBOX_B_URL:-http://outbox-b:8080}"
+CONFLICT_URL="${CONFLICT_URL:-http://conflict:8080}"
+POW_URL="${POW_URL:-http://pow:8080}"
+LIMITS_URL="${LIMITS_URL:-http://limits:8080}"
 GIT_SERVER="${GIT_SERVER:-git-server}"
 ALLOWED_ORIGIN="${ALLOWED_ORIGIN:-http://testsite.local}"
+ADMIN_TOTP_SECRET="${ADMIN_TOTP_SECRET:-test-totp-secret-0123456789abcdef}"
 REDIRECT_URL="${ALLOWED_ORIGIN}/blog/test-post"
 
 PASS=0
@@ -55,6 +63,27 @@ else
     fail "GET /health body is 'ok'" "got '$BODY'"
 fi
 
+BODY=$(curl -s "$STATICOMMENT_URL/readyz")
+if [ "$BODY" = "ok" ]; then
+    pass "GET /readyz reports ready"
+else
+    fail "GET /readyz reports ready" "got '$BODY'"
+fi
+
+BODY=$(curl -s "$STATICOMMENT_URL/robots.txt")
+if echo "$BODY" | grep -q '^Disallow: /$'; then
+    pass "GET /robots.txt disallows the API"
+else
+    fail "GET /robots.txt disallows the API" "got '$BODY'"
+fi
+
+BODY=$(curl -s "$STATICOMMENT_URL/schema.json")
+if echo "$BODY" | grep -q '"required": \[' && echo "$BODY" | grep -q '"reply_to"'; then
+    pass "GET /schema.json describes the comment file"
+else
+    fail "GET /schema.json describes the comment file" "got '$BODY'"
+fi
+
 # ── 2. Method enforcement ────────────────────────────────────
 echo ""
 echo "--- Method enforcement ---"
@@ -140,6 +169,19 @@ STATUS=$(curl -s -o /dev/null -w "%{http_code}" \
     "$STATICOMMENT_URL/comment")
 assert_status "Missing url returns 400" "400" "$STATUS"
 
+# Error details — machine-readable code and per-field messages
+REDIR=$(curl -s -o /dev/null -w "%{redirect_url}" \
+    -X POST -H "Origin: $ALLOWED_ORIGIN" \
+    -d "body=Hello&slug=test-post&url=$REDIRECT_URL" \
+    "$STATICOMMENT_URL/comment")
+assert_contains "Error redirect carries code" "$REDIR" "comment_error_code=missing_fields"
+assert_contains "Error redirect carries field message" "$REDIR" "comment_error_name="
+
+JSON=$(curl -s -X POST -H "Origin: $ALLOWED_ORIGIN" -H "Accept: application/json" \
+    -d "body=Hello&slug=test-post&url=$REDIRECT_URL" \
+    "$STATICOMMENT_URL/comment")
+assert_contains "JSON error links the field" "$JSON" '"href":"#comment-name"'
+
 # ── 8. Invalid slug ──────────────────────────────────────────
 echo ""
 echo "--- Slug validation ---"
@@ -214,6 +256,22 @@ REDIR=$(curl -s -o /dev/null -w "%{redirect_url}" \
     "$STATICOMMENT_URL/comment")
 assert_contains "Blocked pattern rejected" "$REDIR" "blocked+content"
 
+# ── Rules ────────────────────────────────────────────────────
+echo ""
+echo "--- Rules ---"
+
+STATUS=$(curl -s -o /dev/null -w "%{http_code}" \
+    -X POST -H "Origin: $ALLOWED_ORIGIN" \
+    -d "name=Denied&body=Hello&slug=test-post&url=$REDIRECT_URL&email=bot@spam.example" \
+    "$STATICOMMENT_URL/comment")
+assert_status "Deny rule returns 403" "403" "$STATUS"
+
+REDIR=$(curl -s -o /dev/null -w "%{redirect_url}" \
+    -X POST -H "Origin: $ALLOWED_ORIGIN" \
+    -d "name=Held+Back&body=Hold+me&slug=test-post&url=$REDIRECT_URL" \
+    "$STATICOMMENT_URL/comment")
+assert_contains "Quarantine rule holds the comment" "$REDIR" "#comment-pending"
+
 # ── Spam: Timestamp validation ──────────────────────────────
 echo ""
 echo "--- Spam: Timestamp validation ---"
@@ -267,6 +325,44 @@ STATUS=$(curl -s -o /dev/null -w "%{http_code}" \
     "$STATICOMMENT_URL/comment")
 assert_status "Comment with email returns 303" "303" "$STATUS"
 
+# ── Idempotency keys ─────────────────────────────────────────
+echo ""
+echo "--- Idempotency keys ---"
+
+IDEMPOTENCY_KEY="integration-$(date +%s)-$$"
+
+# Sent too soon: a retry of the same comment later may get through, so
+# that answer isn't kept
+REDIR=$(curl -s -o /dev/null -w "%{redirect_url}" \
+    -X POST -H "Origin: $ALLOWED_ORIGIN" -H "Idempotency-Key: $IDEMPOTENCY_KEY" \
+    -d "name=Idempotent&body=Sent+once&slug=test-post&url=$REDIRECT_URL&_timestamp=$(date +%s)" \
+    "$STATICOMMENT_URL/comment")
+assert_contains "Keyed submission sent too soon refused" "$REDIR" "comment_error_code=too_fast"
+
+HEADERS=$(curl -s -D - -o /dev/null \
+    -X POST -H "Origin: $ALLOWED_ORIGIN" -H "Idempotency-Key: $IDEMPOTENCY_KEY" \
+    -d "name=Idempotent&body=Sent+once&slug=test-post&url=$REDIRECT_URL&_timestamp=$OLD_TS" \
+    "$STATICOMMENT_URL/comment")
+assert_contains "Retry after a refusal that can change is handled afresh" "$HEADERS" "#comment-submitted"
+if printf '%s' "$HEADERS" | grep -qi "^Idempotent-Replayed:"; then
+    fail "Retry after a refusal that can change isn't replayed" "got Idempotent-Replayed"
+else
+    pass "Retry after a refusal that can change isn't replayed"
+fi
+
+HEADERS=$(curl -s -D - -o /dev/null \
+    -X POST -H "Origin: $ALLOWED_ORIGIN" -H "Idempotency-Key: $IDEMPOTENCY_KEY" \
+    -d "name=Idempotent&body=Sent+once&slug=test-post&url=$REDIRECT_URL&_timestamp=$OLD_TS" \
+    "$STATICOMMENT_URL/comment")
+assert_contains "Retry after acceptance gets the first answer" "$HEADERS" "#comment-submitted"
+assert_contains "Retry after acceptance is marked replayed" "$HEADERS" "Idempotent-Replayed: true"
+
+STATUS=$(curl -s -o /dev/null -w "%{http_code}" \
+    -X POST -H "Origin: $ALLOWED_ORIGIN" -H "Idempotency-Key: $IDEMPOTENCY_KEY" \
+    -d "name=Idempotent&body=Something+else&slug=test-post&url=$REDIRECT_URL&_timestamp=$OLD_TS" \
+    "$STATICOMMENT_URL/comment")
+assert_status "Key reused for another comment returns 422" "422" "$STATUS"
+
 # ── 16. Post existence (invalid slug) ─────────────────────────
 echo ""
 echo "--- Post existence validation ---"
@@ -277,6 +373,68 @@ REDIR=$(curl -s -o /dev/null -w "%{redirect_url}" \
     "$STATICOMMENT_URL/comment")
 assert_contains "Nonexistent post rejected" "$REDIR" "Post+not+found"
 
+# ── Metrics ──────────────────────────────────────────────────
+echo ""
+echo "--- Metrics ---"
+
+METRICS=$(curl -s "$STATICOMMENT_URL/metrics")
+assert_contains "Metrics expose published counter" "$METRICS" "staticomment_comments_published_total"
+assert_contains "Metrics count honeypot rejections" "$METRICS" 'staticomment_spam_rejections_total{reason="honeypot"} 1'
+assert_contains "Metrics count honeypot hits by action" "$METRICS" 'staticomment_honeypot_hits_total{action="accept"} 1'
+assert_contains "Metrics count rate limit rejections" "$METRICS" 'staticomment_spam_rejections_total{reason="rate_limit"}'
+assert_contains "Metrics count missing post" "$METRICS" 'staticomment_invalid_submissions_total{reason="post_not_found"} 1'
+assert_contains "Metrics count rule denials" "$METRICS" 'staticomment_spam_rejections_total{reason="rule_deny"} 1'
+
+# ── Status page ──────────────────────────────────────────────
+echo ""
+echo "--- Status page ---"
+
+STATUS_JSON=$(curl -s "$STATICOMMENT_URL/status?format=json")
+assert_contains "Status page reports operational" "$STATUS_JSON" '"status":"operational"'
+
+# ── Comments partial ─────────────────────────────────────────
+echo ""
+echo "--- Comments partial ---"
+
+PARTIAL=$(curl -s "$STATICOMMENT_URL/comments/test-post")
+assert_contains "Partial lists published comments" "$PARTIAL" 'RefererTest'
+
+STATUS=$(curl -s -o /dev/null -w "%{http_code}" "$STATICOMMENT_URL/widget.js")
+assert_status "GET /widget.js returns 200" "200" "$STATUS"
+
+# ── Admin API ────────────────────────────────────────────────
+echo ""
+echo "--- Admin API ---"
+
+# The token staticomment admin-token prints for a 300-second period: the
+# first 32 hex digits of an HMAC of the period's number
+admin_time_token() {
+    printf 'staticomment-admin:%s' "$1" | openssl dgst -sha256 -hmac "$ADMIN_TOTP_SECRET" | sed 's/^.*= //' | cut -c1-32
+}
+PERIOD=$(($(date +%s) / 300))
+
+STATUS=$(curl -s -o /dev/null -w "%{http_code}" "$STATICOMMENT_URL/admin/whoami")
+assert_status "Admin API requires a token" "401" "$STATUS"
+
+BODY=$(curl -s -H "Authorization: Bearer $(admin_time_token "$PERIOD")" "$STATICOMMENT_URL/admin/whoami")
+assert_contains "Time-based token for this period accepted" "$BODY" '"name": "time-based token"'
+
+BODY=$(curl -s -H "Authorization: Bearer $(admin_time_token $((PERIOD - 1)))" "$STATICOMMENT_URL/admin/whoami")
+assert_contains "Time-based token for the last period accepted" "$BODY" '"role": "admin"'
+
+STATUS=$(curl -s -o /dev/null -w "%{http_code}" -H "Authorization: Bearer $(admin_time_token $((PERIOD - 2)))" \
+    "$STATICOMMENT_URL/admin/whoami")
+assert_status "Expired time-based token refused" "401" "$STATUS"
+
+VIEWER_AUTH="Authorization: Bearer test-viewer-token"
+BODY=$(curl -s -H "$VIEWER_AUTH" "$STATICOMMENT_URL/admin/whoami")
+assert_contains "Viewer identified by their token" "$BODY" '"role": "viewer"'
+
+STATUS=$(curl -s -o /dev/null -w "%{http_code}" -X POST -H "$VIEWER_AUTH" \
+    -d '{"slug":"test-post","dry_run":true}' \
+    "$STATICOMMENT_URL/admin/comments/delete")
+assert_status "Viewer refused a moderator endpoint" "403" "$STATUS"
+
 # ── 12, 15, 17, 18. Git verification ─────────────────────────
 echo ""
 echo "--- Git verification ---"
@@ -332,6 +490,20 @@ else
     fail "Comment with email field found" "no comment has email"
 fi
 
+# Quarantined comments go to their own path, with the rule that held them
+HELD_COMMENT=$(grep -l "name: Held Back" "$CLONE_DIR"/repo/_data/quarantine/test-post/*.yml 2>/dev/null | head -1)
+if [ -n "$HELD_COMMENT" ]; then
+    pass "Quarantined comment committed to the quarantine path"
+    assert_contains "Quarantined comment names its rule" "$(cat "$HELD_COMMENT")" "hold-for-review"
+else
+    fail "Quarantined comment committed to the quarantine path" "no quarantined comment found"
+fi
+if grep -l "name: Denied" "$COMMENT_DIR"/*.yml >/dev/null 2>&1; then
+    fail "Denied comment not committed" "found in $COMMENT_DIR"
+else
+    pass "Denied comment not committed"
+fi
+
 # 15. Post existence (valid) — already proven by successful comment above
 pass "Post existence validation (valid slug accepted)"
 
@@ -345,6 +517,413 @@ assert_contains "Commit author is staticomment" "$COMMIT_AUTHOR" "staticomment"
 
 rm -rf "$CLONE_DIR"
 
+# ── Tenant host ──────────────────────────────────────────────
+echo ""
+echo "--- Tenant host ---"
+
+ADMIN_AUTH="Authorization: Bearer test-admin-token"
+TENANT_URL="$TENANTS_URL/t/alpha"
+
+# Settings the host sets itself can't be given to a tenant
+for KEY in STATICOMMENT_DATA_DIR STATICOMMENT_PORT; do
+    STATUS=$(curl -s -o /dev/null -w "%{http_code}" -X PUT -H "$ADMIN_AUTH" \
+        -d "{\"settings\":{\"$KEY\":\"/tmp\"}}" \
+        "$TENANTS_URL/admin/tenants/alpha")
+    assert_status "PUT tenant setting $KEY returns 400" "400" "$STATUS"
+done
+
+STATUS=$(curl -s -o /dev/null -w "%{http_code}" -X PUT -H "$ADMIN_AUTH" \
+    -d '{"settings":{
+        "STATICOMMENT_GIT_REPO":"git@'"$GIT_SERVER"':/home/git/tenant.git",
+        "STATICOMMENT_BRANCH":"main",
+        "STATICOMMENT_SSH_KEY_PATH":"/ssh-keys/id_ed25519",
+        "STATICOMMENT_SSH_INSECURE":"1",
+        "STATICOMMENT_ALLOWED_ORIGINS":"'"$ALLOWED_ORIGIN"'",
+        "STATICOMMENT_POSTS_PATH":"_posts",
+        "STATICOMMENT_RATE_LIMIT_MAX":"30",
+        "STATICOMMENT_TENANT_QUOTA":"3",
+        "STATICOMMENT_IP_DENYLIST":"203.0.113.7"}}' \
+    "$TENANTS_URL/admin/tenants/alpha")
+assert_status "PUT new tenant returns 201" "201" "$STATUS"
+
+# The instance clones its repo before it answers
+for i in $(seq 1 30); do
+    [ "$(curl -s "$TENANT_URL/health")" = "ok" ] && break
+    sleep 1
+done
+BODY=$(curl -s "$TENANT_URL/health")
+if [ "$BODY" = "ok" ]; then
+    pass "Tenant instance answers through the host"
+else
+    fail "Tenant instance answers through the host" "got '$BODY'"
+fi
+
+STATUS=$(curl -s -o /dev/null -w "%{http_code}" "$TENANT_URL/metrics")
+assert_status "Tenant's own /metrics is hidden" "404" "$STATUS"
+
+# Only the host may say who the visitor is: a denylisted address claimed
+# by the client is replaced with its real one
+REDIR=$(curl -s -o /dev/null -w "%{redirect_url}" \
+    -X POST -H "Origin: $ALLOWED_ORIGIN" \
+    -H "X-Staticomment-Remote-Addr: 203.0.113.7:1234" \
+    -d "name=Tenant+Test&body=Spoofed+address&slug=test-post&url=$REDIRECT_URL" \
+    "$TENANT_URL/comment")
+assert_contains "Client-supplied X-Staticomment-Remote-Addr is ignored" "$REDIR" "#comment-submitted"
+
+# Nor may a client say the tenant's quota is used up
+REDIR=$(curl -s -o /dev/null -w "%{redirect_url}" \
+    -X POST -H "Origin: $ALLOWED_ORIGIN" \
+    -H "X-Staticomment-Quota-Exceeded: 1" \
+    -d "name=Tenant+Test&body=Claimed+quota&slug=test-post&url=$REDIRECT_URL" \
+    "$TENANT_URL/comment")
+assert_contains "Client-supplied X-Staticomment-Quota-Exceeded is stripped" "$REDIR" "#comment-submitted"
+
+STATUS=$(curl -s -o /dev/null -w "%{http_code}" "$TENANTS_URL/admin/tenants")
+assert_status "Tenant admin API requires the token" "401" "$STATUS"
+
+TENANTS=$(curl -s -H "$ADMIN_AUTH" "$TENANTS_URL/admin/tenants")
+assert_contains "Tenant list shows alpha running" "$TENANTS" '"running": true'
+
+# Two of alpha's three submissions this month are used. Of four sent at
+# once, only one fits, however they interleave.
+QUOTA_DIR=$(mktemp -d)
+for i in 1 2 3 4; do
+    curl -s -o /dev/null -w "%{redirect_url}" \
+        -X POST -H "Origin: $ALLOWED_ORIGIN" \
+        -d "name=Quota+Test&body=Quota+$i&slug=test-post&url=$REDIRECT_URL" \
+        "$TENANT_URL/comment" > "$QUOTA_DIR/$i" &
+done
+wait
+ACCEPTED=$(grep -l "#comment-submitted" "$QUOTA_DIR"/* | wc -l | tr -d ' ')
+REFUSED=$(grep -l "comment_error_code=quota" "$QUOTA_DIR"/* | wc -l | tr -d ' ')
+rm -rf "$QUOTA_DIR"
+if [ "$ACCEPTED" = "1" ] && [ "$REFUSED" = "3" ]; then
+    pass "Concurrent submissions stop at the tenant's quota"
+else
+    fail "Concurrent submissions stop at the tenant's quota" "$ACCEPTED accepted, $REFUSED refused"
+fi
+
+TENANTS=$(curl -s -H "$ADMIN_AUTH" "$TENANTS_URL/admin/tenants")
+assert_contains "Tenant usage counts submissions up to the quota" "$TENANTS" '"submissions": 3'
+
+# ── Commit batching ──────────────────────────────────────────
+echo ""
+echo "--- Commit batching ---"
+
+# The batch instance batches from 3 comments in 10 seconds, for 5. Of
+# six sent at once, the first two are committed as they arrive and the
+# rest together.
+BATCH_DIR=$(mktemp -d)
+for i in 1 2 3 4 5 6; do
+    curl -s -o /dev/null -w "%{redirect_url}" \
+        -X POST -H "Origin: $ALLOWED_ORIGIN" \
+        -d "name=Batch+Test&body=Burst+$i&slug=test-post&url=$REDIRECT_URL" \
+        "$BATCH_URL/comment" > "$BATCH_DIR/$i" &
+done
+wait
+ACCEPTED=$(grep -l "#comment-submitted" "$BATCH_DIR"/* | wc -l | tr -d ' ')
+rm -rf "$BATCH_DIR"
+assert_status "Burst of comments all published" "6" "$ACCEPTED"
+
+CLONE_DIR=$(mktemp -d)
+git clone -q "git@${GIT_SERVER}:/home/git/batch.git" "$CLONE_DIR/repo" 2>/dev/null
+BATCHES=$(git -C "$CLONE_DIR/repo" log --format=%s | grep -c '^Add [0-9]* comments$')
+assert_status "Burst above the threshold makes a single batch commit" "1" "$BATCHES"
+assert_contains "Batch commit holds the comments past the threshold" "$(git -C "$CLONE_DIR/repo" log --format=%s)" "Add 4 comments"
+rm -rf "$CLONE_DIR"
+
+# Batching stops once fewer than half the threshold arrived in the last
+# 10 seconds; a comment then goes out without waiting for the interval
+sleep 11
+RESULT=$(curl -s -o /dev/null -w "%{redirect_url}\n%{time_total}" \
+    -X POST -H "Origin: $ALLOWED_ORIGIN" \
+    -d "name=Batch+Test&body=Slow&slug=test-post&url=$REDIRECT_URL" \
+    "$BATCH_URL/comment")
+assert_contains "Slow comment published" "$(echo "$RESULT" | sed -n '1p')" "#comment-submitted"
+if echo "$RESULT" | sed -n '2p' | awk '{ exit !($1 < 5) }'; then
+    pass "Slow comment isn't held for a batch"
+else
+    fail "Slow comment isn't held for a batch" "took $(echo "$RESULT" | sed -n '2p')s"
+fi
+
+CLONE_DIR=$(mktemp -d)
+git clone -q "git@${GIT_SERVER}:/home/git/batch.git" "$CLONE_DIR/repo" 2>/dev/null
+assert_contains "Slow comment committed on its own" "$(git -C "$CLONE_DIR/repo" log --format=%s -1)" "Add comment on test-post"
+rm -rf "$CLONE_DIR"
+
+# ── Shared outbox ────────────────────────────────────────────
+echo ""
+echo "--- Shared outbox ---"
+
+# Two instances share one outbox and repo: a publishes while the visitor
+# waits, b in the background, picking up whatever is pending, a's entries
+# included. Every comment must be published exactly once.
+OUTBOX_RESULTS=$(mktemp -d)
+for i in 1 2 3 4; do
+    curl -s -o /dev/null -w "%{redirect_url}" \
+        -X POST -H "Origin: $ALLOWED_ORIGIN" \
+        -d "name=Outbox+Test&body=Shared+a$i&slug=test-post&url=$REDIRECT_URL" \
+        "$OUTBOX_A_URL/comment" > "$OUTBOX_RESULTS/a$i" &
+    curl -s -o /dev/null -w "%{redirect_url}" \
+        -X POST -H "Origin: $ALLOWED_ORIGIN" \
+        -d "name=Outbox+Test&body=Shared+b$i&slug=test-post&url=$REDIRECT_URL" \
+        "$OUTBOX_B_URL/comment" > "$OUTBOX_RESULTS/b$i" &
+done
+wait
+ACCEPTED=$(grep -l "#comment-submitted\|#comment-pending" "$OUTBOX_RESULTS"/* | wc -l | tr -d ' ')
+rm -rf "$OUTBOX_RESULTS"
+assert_status "Submissions to both instances accepted" "8" "$ACCEPTED"
+
+# b publishes after answering, so give it a moment to drain the outbox
+for i in $(seq 1 30); do
+    LEFT=$(find /outbox/pending /outbox/claimed -name '*.json')
+    [ -z "$LEFT" ] && break
+    sleep 1
+done
+if [ -z "$LEFT" ]; then
+    pass "Shared outbox drained"
+else
+    fail "Shared outbox drained" "left: $(echo $LEFT)"
+fi
+
+CLONE_DIR=$(mktemp -d)
+git clone -q "git@${GIT_SERVER}:/home/git/outbox.git" "$CLONE_DIR/repo" 2>/dev/null
+PUBLISHED=0
+for body in a1 a2 a3 a4 b1 b2 b3 b4; do
+    COPIES=$(grep -l "body: Shared $body\$" "$CLONE_DIR"/repo/_data/comments/test-post/*.yml 2>/dev/null | wc -l | tr -d ' ')
+    [ "$COPIES" = "1" ] && PUBLISHED=$((PUBLISHED + 1))
+done
+rm -rf "$CLONE_DIR"
+assert_status "Each comment published exactly once" "8" "$PUBLISHED"
+
+# ── Outbox admin ─────────────────────────────────────────────
+echo ""
+echo "--- Outbox admin ---"
+
+# outbox_id prints the id of the entry in outbox listing $1 whose
+# commenter is named $2
+outbox_id() {
+    printf '%s' "$1" | awk -F'"' -v name="$2" '$2 == "id" { id = $4 } $2 == "name" && $4 == name { print id }'
+}
+
+CLONE_DIR=$(mktemp -d)
+git clone -q "git@${GIT_SERVER}:/home/git/outbox.git" "$CLONE_DIR/repo" 2>/dev/null
+
+# With main on hold, a's comments stay in the outbox; b only retries hourly
+git -C "$CLONE_DIR/repo" push -q origin main:hold 2>/dev/null
+for who in Dropped Retried; do
+    REDIR=$(curl -s -o /dev/null -w "%{redirect_url}" \
+        -X POST -H "Origin: $ALLOWED_ORIGIN" \
+        -d "name=$who&body=Outbox+admin+$who&slug=test-post&url=$REDIRECT_URL" \
+        "$OUTBOX_A_URL/comment")
+    assert_contains "Comment held back by the remote is pending ($who)" "$REDIR" "#comment-pending"
+done
+
+STATUS=$(curl -s -o /dev/null -w "%{http_code}" "$OUTBOX_A_URL/admin/outbox")
+assert_status "Outbox listing without token returns 401" "401" "$STATUS"
+
+OUTBOX_LIST=$(curl -s -H "$ADMIN_AUTH" "$OUTBOX_A_URL/admin/outbox")
+DROPPED_ID=$(outbox_id "$OUTBOX_LIST" Dropped)
+RETRIED_ID=$(outbox_id "$OUTBOX_LIST" Retried)
+if [ -n "$DROPPED_ID" ] && [ -n "$RETRIED_ID" ]; then
+    pass "Outbox lists the held comments"
+else
+    fail "Outbox lists the held comments" "got: $OUTBOX_LIST"
+fi
+assert_contains "Outbox shows why they're held" "$OUTBOX_LIST" '"last_error"'
+
+STATUS=$(curl -s -o /dev/null -w "%{http_code}" -X DELETE -H "$ADMIN_AUTH" \
+    "$OUTBOX_A_URL/admin/outbox/$DROPPED_ID")
+assert_status "Outbox entry discarded (204)" "204" "$STATUS"
+STATUS=$(curl -s -o /dev/null -w "%{http_code}" -X DELETE -H "$ADMIN_AUTH" \
+    "$OUTBOX_A_URL/admin/outbox/$DROPPED_ID")
+assert_status "Discarded entry is gone (404)" "404" "$STATUS"
+
+STATUS=$(curl -s -o /dev/null -w "%{http_code}" -X POST -H "$ADMIN_AUTH" \
+    "$OUTBOX_A_URL/admin/outbox/$RETRIED_ID/retry")
+assert_status "Retry while the remote refuses returns 502" "502" "$STATUS"
+
+git -C "$CLONE_DIR/repo" push -q origin :hold 2>/dev/null
+STATUS=$(curl -s -o /dev/null -w "%{http_code}" -X POST -H "$ADMIN_AUTH" \
+    "$OUTBOX_A_URL/admin/outbox/$RETRIED_ID/retry")
+assert_status "Retry once the remote takes it returns 204" "204" "$STATUS"
+
+OUTBOX_LIST=$(curl -s -H "$ADMIN_AUTH" "$OUTBOX_A_URL/admin/outbox")
+assert_status "Outbox empty after retry and discard" "[]" "$(printf '%s' "$OUTBOX_LIST" | tr -d ' \n')"
+
+git -C "$CLONE_DIR/repo" pull -q 2>/dev/null
+if grep -q "body: Outbox admin Retried" "$CLONE_DIR"/repo/_data/comments/test-post/*.yml 2>/dev/null; then
+    pass "Retried comment published"
+else
+    fail "Retried comment published" "not in the repo"
+fi
+rm -rf "$CLONE_DIR"
+
+# ── Pull conflicts ───────────────────────────────────────────
+echo ""
+echo "--- Pull conflicts ---"
+
+# The conflict instance has a shallow clone, so it must find its own
+# commits without the history behind them
+
+CLONE_DIR=$(mktemp -d)
+git clone -q "git@${GIT_SERVER}:/home/git/conflict.git" "$CLONE_DIR/repo" 2>/dev/null
+git -C "$CLONE_DIR/repo" config user.email "test@test.local"
+git -C "$CLONE_DIR/repo" config user.name "Test Runner"
+
+# With main on hold, the comment and its index entry stay unpushed
+git -C "$CLONE_DIR/repo" push -q origin main:hold 2>/dev/null
+REDIR=$(curl -s -o /dev/null -w "%{redirect_url}" \
+    -X POST -H "Origin: $ALLOWED_ORIGIN" \
+    -d "name=Conflict+Test&body=Conflict+one&slug=test-post&url=$REDIRECT_URL" \
+    "$CONFLICT_URL/comment")
+assert_contains "Comment held back by the remote is pending" "$REDIR" "#comment-pending"
+
+# Upstream writes the same index file and lifts the hold, so replaying the
+# server's commit conflicts, which the fail strategy refuses
+mkdir -p "$CLONE_DIR/repo/_data/comment_index"
+echo "edited: upstream" > "$CLONE_DIR/repo/_data/comment_index/test-post.yml"
+git -C "$CLONE_DIR/repo" add -A
+git -C "$CLONE_DIR/repo" commit -qm "Edit the index upstream"
+git -C "$CLONE_DIR/repo" push -q origin main :hold 2>/dev/null
+sleep 3
+git -C "$CLONE_DIR/repo" pull -q 2>/dev/null
+if grep -q "body: Conflict one" "$CLONE_DIR"/repo/_data/comments/test-post/*.yml 2>/dev/null; then
+    fail "Conflicting commit isn't pushed" "it was"
+else
+    pass "Conflicting commit isn't pushed"
+fi
+
+# It's been retried in the background meanwhile, but only failed once as
+# far as the metrics are concerned, and it shows as waiting
+METRICS=$(curl -s "$CONFLICT_URL/metrics")
+assert_contains "Retried comment counts one publish failure" "$METRICS" 'staticomment_publish_failures_total{stage="push"} 1'
+STATUS_JSON=$(curl -s "$CONFLICT_URL/status?format=json")
+assert_contains "Status page counts the comment waiting for a retry" "$STATUS_JSON" '"queue_pending":1'
+
+# Once the conflict is resolved upstream, the server picks up from where
+# it was: the next comment goes out, the held one with it
+git -C "$CLONE_DIR/repo" rm -q "_data/comment_index/test-post.yml"
+git -C "$CLONE_DIR/repo" commit -qm "Resolve the index conflict"
+git -C "$CLONE_DIR/repo" push -q origin main 2>/dev/null
+REDIR=$(curl -s -o /dev/null -w "%{redirect_url}" \
+    -X POST -H "Origin: $ALLOWED_ORIGIN" \
+    -d "name=Conflict+Test&body=Conflict+two&slug=test-post&url=$REDIRECT_URL" \
+    "$CONFLICT_URL/comment")
+assert_contains "Comment after a resolved conflict published" "$REDIR" "#comment-submitted"
+git -C "$CLONE_DIR/repo" pull -q 2>/dev/null
+if grep -q "body: Conflict one" "$CLONE_DIR"/repo/_data/comments/test-post/*.yml 2>/dev/null; then
+    pass "Held comment published after the conflict"
+else
+    fail "Held comment published after the conflict" "not in the repo"
+fi
+# Its retry finds it pushed already, once its backoff is up
+for i in $(seq 1 20); do
+    STATUS_JSON=$(curl -s "$CONFLICT_URL/status?format=json")
+    printf '%s' "$STATUS_JSON" | grep -qF '"queue_pending":0' && break
+    sleep 1
+done
+assert_contains "Status page shows nothing waiting" "$STATUS_JSON" '"queue_pending":0'
+rm -rf "$CLONE_DIR"
+
+# ── Proof of work ────────────────────────────────────────────
+echo ""
+echo "--- Proof of work ---"
+
+# Solve a challenge from GET /challenge the way the ALTCHA widget does, by
+# hashing the salt with each number up to maxnumber. pow_payload gives the
+# altcha field for an answer.
+CHALLENGE=$(curl -s -H "Origin: $ALLOWED_ORIGIN" "$POW_URL/challenge")
+json_field() {
+    printf '%s' "$CHALLENGE" | sed -n "s/.*\"$1\":\"\{0,1\}\([^\",]*\).*/\1/p"
+}
+SALT=$(json_field salt)
+HASH=$(json_field challenge)
+SIGNATURE=$(json_field signature)
+NUMBER=
+for n in $(seq 0 "$(json_field maxnumber)"); do
+    if [ "$(printf '%s%d' "$SALT" "$n" | sha256sum | cut -d' ' -f1)" = "$HASH" ]; then
+        NUMBER=$n
+        break
+    fi
+done
+pow_payload() {
+    printf '{"algorithm":"SHA-256","challenge":"%s","number":%d,"salt":"%s","signature":"%s"}' \
+        "$HASH" "$1" "$SALT" "$SIGNATURE" | base64 | tr -d '\n'
+}
+if [ -n "$NUMBER" ]; then
+    pass "Challenge solved"
+else
+    fail "Challenge solved" "no number up to maxnumber matches"
+fi
+
+REDIR=$(curl -s -o /dev/null -w "%{redirect_url}" \
+    -X POST -H "Origin: $ALLOWED_ORIGIN" \
+    -d "name=Pow+Test&body=No+solution&slug=test-post&url=$REDIRECT_URL" \
+    "$POW_URL/comment")
+assert_contains "Submission without a solution refused" "$REDIR" "comment_error_code=pow"
+
+REDIR=$(curl -s -o /dev/null -w "%{redirect_url}" \
+    -X POST -H "Origin: $ALLOWED_ORIGIN" \
+    -d "name=Pow+Test&body=Wrong+number&slug=test-post&url=$REDIRECT_URL" \
+    --data-urlencode "altcha=$(pow_payload $((NUMBER + 1)))" \
+    "$POW_URL/comment")
+assert_contains "Wrong solution refused" "$REDIR" "comment_error_code=pow"
+
+REDIR=$(curl -s -o /dev/null -w "%{redirect_url}" \
+    -X POST -H "Origin: $ALLOWED_ORIGIN" \
+    -d "name=Pow+Test&body=Solved&slug=test-post&url=$REDIRECT_URL" \
+    --data-urlencode "altcha=$(pow_payload "$NUMBER")" \
+    "$POW_URL/comment")
+assert_contains "Solved challenge accepted" "$REDIR" "#comment-submitted"
+
+REDIR=$(curl -s -o /dev/null -w "%{redirect_url}" \
+    -X POST -H "Origin: $ALLOWED_ORIGIN" \
+    -d "name=Pow+Test&body=Solved+again&slug=test-post&url=$REDIRECT_URL" \
+    --data-urlencode "altcha=$(pow_payload "$NUMBER")" \
+    "$POW_URL/comment")
+assert_contains "Reused solution refused" "$REDIR" "comment_error_code=pow"
+
+# ── Global limits ────────────────────────────────────────────
+echo ""
+echo "--- Global limits ---"
+
+# The limits instance processes one submission at a time and takes two
+# comments a minute between all visitors. A bot held in the tarpit doesn't
+# take the one slot.
+TARPITTED=$(mktemp)
+curl -s -o /dev/null -w "%{redirect_url}" \
+    -X POST -H "Origin: $ALLOWED_ORIGIN" \
+    -d "name=Limits+Test&body=Too+fast&slug=test-post&url=$REDIRECT_URL&_timestamp=$(date +%s)" \
+    "$LIMITS_URL/comment" > "$TARPITTED" &
+TARPIT_PID=$!
+sleep 1
+
+OLD_TS=$(($(date +%s) - 10))
+STATUS=$(curl -s -o /dev/null -w "%{http_code}" \
+    -X POST -H "Origin: $ALLOWED_ORIGIN" \
+    -d "name=Limits+Test&body=Past+the+bot&slug=test-post&url=$REDIRECT_URL&_timestamp=$OLD_TS" \
+    "$LIMITS_URL/comment")
+assert_status "Comment accepted while a bot is tarpitted (303)" "303" "$STATUS"
+
+wait "$TARPIT_PID"
+assert_contains "Tarpitted submission still refused" "$(cat "$TARPITTED")" "comment_error_code=too_fast"
+rm -f "$TARPITTED"
+
+STATUS=$(curl -s -o /dev/null -w "%{http_code}" \
+    -X POST -H "Origin: $ALLOWED_ORIGIN" \
+    -d "name=Limits+Test&body=Second+comment&slug=test-post&url=$REDIRECT_URL&_timestamp=$OLD_TS" \
+    "$LIMITS_URL/comment")
+assert_status "Second comment within the global limit accepted (303)" "303" "$STATUS"
+
+RESPONSE=$(curl -s -i \
+    -X POST -H "Origin: $ALLOWED_ORIGIN" -H "Accept: application/json" \
+    -d "name=Limits+Test&body=Third+comment&slug=test-post&url=$REDIRECT_URL&_timestamp=$OLD_TS" \
+    "$LIMITS_URL/comment")
+assert_contains "Comment past the global limit returns 429" "$RESPONSE" "HTTP/1.1 429"
+assert_contains "Comment past the global limit says why" "$RESPONSE" '"code":"global_rate_limit"'
+assert_contains "Comment past the global limit sets Retry-After" "$RESPONSE" "Retry-After: 30"
+
 # ── Summary ───────────────────────────────────────────────────
 echo ""
 echo "==========================="
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// maxThreadWalk bounds how many ancestors are followed, guarding against
+// reply_to cycles introduced by hand-edited files.
+const maxThreadWalk = 100
+
+// errReplyTooDeep is returned when a reply exceeds the configured depth and
+// flattening is disabled.
+var errReplyTooDeep = errors.New("reply nesting too deep")
+
+// replyChain returns id followed by its ancestors, nearest first, by reading
+// reply_to from each published comment file. The walk stops at a top-level
+// comment or at a parent that does not exist in the comments path.
+func (h *CommentHandler) replyChain(slug, id string) ([]string, error) {
+	var chain []string
+	for id != "" && len(chain) < maxThreadWalk {
+		chain = append(chain, id)
+		parent, err := h.publishedComment(slug, id)
+		if err != nil {
+			return nil, err
+		}
+		if parent == nil || !isValidSlug(parent.ReplyTo) {
+			break
+		}
+		id = parent.ReplyTo
+	}
+	return chain, nil
+}
+
+// publishedComment reads the published comment id on slug, returning nil if
+// there's no such comment.
+func (h *CommentHandler) publishedComment(slug, id string) (*Comment, error) {
+	data, err := os.ReadFile(h.repo.FullPath(filepath.Join(h.cfg.CommentsPath, slug, id+".yml")))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading comment %s: %w", id, err)
+	}
+	var c Comment
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("parsing comment %s: %w", id, err)
+	}
+	return &c, nil
+}
+
+// quotedExcerpt returns the start of the body of the published comment id
+// on slug, for a reply to quote, or "" if there's no such comment or
+// STATICOMMENT_REPLY_EXCERPT is unset. A parent that can't be read only
+// costs the reply its quote.
+func (h *CommentHandler) quotedExcerpt(slug, id string) string {
+	if h.cfg.ReplyExcerpt == 0 || id == "" {
+		return ""
+	}
+	parent, err := h.publishedComment(slug, id)
+	if err != nil {
+		log.Printf("warning: quoting reply parent on %s: %v", slug, err)
+		return ""
+	}
+	if parent == nil {
+		return ""
+	}
+	return excerpt(parent.Body, h.cfg.ReplyExcerpt)
+}
+
+// excerpt returns the first n characters of s, with runs of whitespace
+// collapsed into a space. If s is longer, it's cut at the last space, unless
+// that would lose more than half, and ends with an ellipsis.
+func excerpt(s string, n int) string {
+	s = strings.Join(strings.Fields(s), " ")
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	cut := string(runes[:n])
+	if i := strings.LastIndex(cut, " "); i > len(cut)/2 {
+		cut = cut[:i]
+	}
+	return strings.TrimRight(cut, " ") + "…"
+}
+
+// resolveReplyTo enforces STATICOMMENT_MAX_REPLY_DEPTH for a reply to
+// replyTo. Top-level comments have depth 0, so a reply to one has depth 1.
+// If the reply would be too deep it is either re-parented to the deepest
+// allowed ancestor (with STATICOMMENT_FLATTEN_REPLIES) or rejected.
+func (h *CommentHandler) resolveReplyTo(slug, replyTo string) (string, error) {
+	max := h.cfg.MaxReplyDepth
+	if replyTo == "" || max <= 0 {
+		return replyTo, nil
+	}
+	chain, err := h.replyChain(slug, replyTo)
+	if err != nil {
+		return "", err
+	}
+	// The new comment sits one level below its parent, i.e. at len(chain)
+	if len(chain) <= max {
+		return replyTo, nil
+	}
+	if !h.cfg.FlattenReplies {
+		return "", errReplyTooDeep
+	}
+	return chain[len(chain)-max], nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errInvalidToken = errors.New("invalid or expired form token")
+	errTokenReplay  = errors.New("form token already used")
+)
+
+// NonceStore remembers consumed form token nonces until they expire.
+type NonceStore interface {
+	// Consume marks nonce as used until expires. It returns false if the
+	// nonce was already used.
+	Consume(nonce string, expires time.Time) (bool, error)
+	// Release forgets nonce so it can be consumed again, for a request
+	// that failed and will be retried.
+	Release(nonce string) error
+}
+
+// FormTokens issues and verifies signed, single-use form tokens. A token is
+// "<issued>.<nonce>.<signature>": the signature proves the server issued it,
+// issued bounds its lifetime, and the nonce store rejects reuse within that
+// lifetime, so a captured token can't be replayed by a bot farm.
+type FormTokens struct {
+	secret []byte
+	ttl    time.Duration
+	nonces NonceStore
+}
+
+func NewFormTokens(secret string, ttl time.Duration, nonces NonceStore) *FormTokens {
+	return &FormTokens{secret: []byte(secret), ttl: ttl, nonces: nonces}
+}
+
+func (t *FormTokens) sign(payload string) string {
+	mac := hmac.New(sha256.New, t.secret)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Issue returns a new token.
+func (t *FormTokens) Issue() (string, error) {
+	nonce, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+	payload := strconv.FormatInt(time.Now().Unix(), 10) + "." + nonce
+	return payload + "." + t.sign(payload), nil
+}
+
+// Verify checks token's signature and age, then consumes its nonce. It
+// returns when the token was issued, by the server's clock.
+func (t *FormTokens) Verify(token string) (time.Time, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return time.Time{}, errInvalidToken
+	}
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(t.sign(payload))) {
+		return time.Time{}, errInvalidToken
+	}
+	unix, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, errInvalidToken
+	}
+	issued := time.Unix(unix, 0)
+	expires := issued.Add(t.ttl)
+	if time.Now().After(expires) {
+		return time.Time{}, errInvalidToken
+	}
+	fresh, err := t.nonces.Consume(parts[1], expires)
+	if err != nil {
+		return issued, err
+	}
+	if !fresh {
+		return time.Time{}, errTokenReplay
+	}
+	return issued, nil
+}
+
+// TokenHandler serves GET /token, which the comment form calls from the
+// site's pages, so it answers CORS requests from the allowed origins.
+type TokenHandler struct {
+	cfg     *Config
+	origins *Origins
+	tokens  *FormTokens
+}
+
+func NewTokenHandler(cfg *Config, origins *Origins, tokens *FormTokens) *TokenHandler {
+	return &TokenHandler{cfg: cfg, origins: origins, tokens: tokens}
+}
+
+func (h *TokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	allowCORS(w, r, h.origins)
+	w.Header().Set("Cache-Control", "no-store")
+
+	token, err := h.tokens.Issue()
+	if err != nil {
+		http.Error(w, "Failed to issue token", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"token": token})
+}
+
+// MemoryNonceStore is an in-memory NonceStore holding at most size nonces.
+// Nonces are only ever added once, so least recently used is also oldest:
+// when full, the oldest nonce is evicted even if it hasn't expired yet.
+type MemoryNonceStore struct {
+	size    int
+	mu      sync.Mutex
+	order   *list.List // of *nonceEntry, oldest at the front
+	entries map[string]*list.Element
+}
+
+type nonceEntry struct {
+	nonce   string
+	expires time.Time
+}
+
+func NewMemoryNonceStore(size int) *MemoryNonceStore {
+	return &MemoryNonceStore{size: size, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (s *MemoryNonceStore) Consume(nonce string, expires time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if el, ok := s.entries[nonce]; ok {
+		if now.Before(el.Value.(*nonceEntry).expires) {
+			return false, nil
+		}
+		s.order.Remove(el)
+		delete(s.entries, nonce)
+	}
+
+	// Drop expired nonces from the old end, then make room
+	for el := s.order.Front(); el != nil; el = s.order.Front() {
+		e := el.Value.(*nonceEntry)
+		if now.Before(e.expires) && s.order.Len() < s.size {
+			break
+		}
+		s.order.Remove(el)
+		delete(s.entries, e.nonce)
+	}
+
+	s.entries[nonce] = s.order.PushBack(&nonceEntry{nonce: nonce, expires: expires})
+	return true, nil
+}
+
+func (s *MemoryNonceStore) Release(nonce string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.entries[nonce]; ok {
+		s.order.Remove(el)
+		delete(s.entries, nonce)
+	}
+	return nil
+}
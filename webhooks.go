@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// GitHubWebhook serves POST /webhooks/github. Deliveries must be signed
+// with STATICOMMENT_WEBHOOK_SECRET; each is passed to the handler for its
+// event type, and events nothing handles are acknowledged and ignored.
+type GitHubWebhook struct {
+	secret   []byte
+	handlers map[string]func(http.ResponseWriter, []byte)
+}
+
+func NewGitHubWebhook(secret string) *GitHubWebhook {
+	return &GitHubWebhook{secret: []byte(secret), handlers: make(map[string]func(http.ResponseWriter, []byte))}
+}
+
+// Handle registers fn for deliveries of the given X-GitHub-Event type.
+func (h *GitHubWebhook) Handle(event string, fn func(w http.ResponseWriter, payload []byte)) {
+	h.handlers[event] = fn
+}
+
+func (h *GitHubWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1024*1024))
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	if !validHubSignature(h.secret, r.Header.Get("X-Hub-Signature-256"), payload) {
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+	fn, ok := h.handlers[r.Header.Get("X-GitHub-Event")]
+	if !ok {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	fn(w, payload)
+}
+
+// validHubSignature checks a GitHub-style "sha256=<hex>" HMAC of the payload.
+func validHubSignature(secret []byte, header string, payload []byte) bool {
+	got, ok := strings.CutPrefix(header, "sha256=")
+	if !ok {
+		return false
+	}
+	sig, err := hex.DecodeString(got)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(payload)
+	return hmac.Equal(sig, mac.Sum(nil))
+}
+
+// GitLabWebhook serves POST /webhooks/gitlab. GitLab doesn't sign
+// deliveries; it sends the webhook's secret token, which must match
+// STATICOMMENT_WEBHOOK_SECRET. Deliveries are dispatched by X-Gitlab-Event
+// like GitHubWebhook's.
+type GitLabWebhook struct {
+	secret   []byte
+	handlers map[string]func(http.ResponseWriter, []byte)
+}
+
+func NewGitLabWebhook(secret string) *GitLabWebhook {
+	return &GitLabWebhook{secret: []byte(secret), handlers: make(map[string]func(http.ResponseWriter, []byte))}
+}
+
+// Handle registers fn for deliveries of the given X-Gitlab-Event type, e.g.
+// "Merge Request Hook".
+func (h *GitLabWebhook) Handle(event string, fn func(w http.ResponseWriter, payload []byte)) {
+	h.handlers[event] = fn
+}
+
+func (h *GitLabWebhook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Gitlab-Token")), h.secret) != 1 {
+		http.Error(w, "Invalid token", http.StatusUnauthorized)
+		return
+	}
+	payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1024*1024))
+	if err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	fn, ok := h.handlers[r.Header.Get("X-Gitlab-Event")]
+	if !ok {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	fn(w, payload)
+}
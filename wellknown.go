@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// defaultRobotsTxt keeps crawlers off the API, except for what a page
+// embedding the widget loads, so search engines rendering the page can
+// index its comments.
+const defaultRobotsTxt = `User-agent: *
+Allow: /widget.js
+Allow: /comments/
+Disallow: /
+`
+
+// securityTxtLifetime is how far ahead the Expires field of a generated
+// security.txt is set. RFC 9116 recommends less than a year.
+const securityTxtLifetime = 180 * 24 * time.Hour
+
+// serveRobotsTxt handles GET /robots.txt, serving STATICOMMENT_ROBOTS_TXT_FILE
+// or the default.
+func serveRobotsTxt(cfg *Config) http.HandlerFunc {
+	body := cfg.RobotsTxt
+	if body == nil {
+		body = []byte(defaultRobotsTxt)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		w.Write(body)
+	}
+}
+
+// serveSecurityTxt handles GET /.well-known/security.txt, serving
+// STATICOMMENT_SECURITY_TXT_FILE as is or one generated from
+// STATICOMMENT_SECURITY_CONTACT and STATICOMMENT_SECURITY_POLICY. A
+// generated file's Expires is always securityTxtLifetime away, so it never
+// goes stale.
+func serveSecurityTxt(cfg *Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "public, max-age=86400")
+		if cfg.SecurityTxt != nil {
+			w.Write(cfg.SecurityTxt)
+			return
+		}
+		var sb strings.Builder
+		for _, c := range cfg.SecurityContacts {
+			sb.WriteString("Contact: " + c + "\n")
+		}
+		if cfg.SecurityPolicy != "" {
+			sb.WriteString("Policy: " + cfg.SecurityPolicy + "\n")
+		}
+		expires := time.Now().UTC().Add(securityTxtLifetime).Truncate(24 * time.Hour)
+		sb.WriteString("Expires: " + expires.Format(time.RFC3339) + "\n")
+		w.Write([]byte(sb.String()))
+	}
+}